@@ -145,6 +145,29 @@ func initProvider(ctx context.Context) (func(context.Context) error, error) {
 
 	return tracerProvider.Shutdown, nil
 }
+
+// initServerTLSConfig builds the TLS configuration of the sidecar HTTP server.
+// If a client CA is configured, clients must present a certificate signed by it (mutual TLS).
+func initServerTLSConfig(slurmConfig slurm.SlurmConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if slurmConfig.TLSClientCAFile != "" {
+		caCert, err := os.ReadFile(slurmConfig.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA certificate: %w", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to append client CA certificate")
+		}
+		tlsConfig.ClientCAs = certPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
 func main() {
 	logger := logrus.StandardLogger()
 
@@ -193,15 +216,52 @@ func main() {
 	}
 
 	mutex := http.NewServeMux()
-	mutex.HandleFunc("/status", SidecarAPIs.StatusHandler)
-	mutex.HandleFunc("/create", SidecarAPIs.SubmitHandler)
-	mutex.HandleFunc("/delete", SidecarAPIs.StopHandler)
+	mutex.HandleFunc("/status", slurm.CountRequests("status", SidecarAPIs.StatusHandler))
+	mutex.HandleFunc("/create", slurm.CountRequests("submit", SidecarAPIs.SubmitHandler))
+	mutex.HandleFunc("/delete", slurm.CountRequests("delete", SidecarAPIs.StopHandler))
 	mutex.HandleFunc("/getLogs", SidecarAPIs.GetLogsHandler)
 	mutex.HandleFunc("/system-info", SidecarAPIs.SystemInfoHandler)
+	mutex.HandleFunc("/drain", SidecarAPIs.DrainHandler)
 
-	SidecarAPIs.CreateDirectories()
+	slurm.SetDraining(slurmConfig.Drain)
+
+	err = SidecarAPIs.CreateDirectories()
+	if err != nil {
+		log.G(ctx).Fatal("Unable to create DataRootFolder: ", err)
+	}
+	err = slurmConfig.Validate()
+	if err != nil {
+		log.G(ctx).Fatal("Invalid configuration: ", err)
+	}
 	SidecarAPIs.LoadJIDs()
 
+	if slurmConfig.MetricsPort != "" {
+		// Served on a port of its own, since the sidecar API may only listen on a unix socket.
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", SidecarAPIs.MetricsHandler())
+		go func() {
+			log.G(ctx).Info("Serving metrics on port ", slurmConfig.MetricsPort)
+			err := http.ListenAndServe(":"+slurmConfig.MetricsPort, metricsMux)
+			if err != nil {
+				log.G(ctx).Fatal(err)
+			}
+		}()
+	}
+
+	server := http.Server{
+		Handler: mutex,
+	}
+
+	tlsEnabled := slurmConfig.TLSCertFile != "" && slurmConfig.TLSKeyFile != ""
+	if tlsEnabled {
+		tlsConfig, err := initServerTLSConfig(slurmConfig)
+		if err != nil {
+			log.G(ctx).Fatal(err)
+		}
+		server.TLSConfig = tlsConfig
+		log.G(ctx).Info("TLS enabled for the sidecar server, mutual TLS: ", slurmConfig.TLSClientCAFile != "")
+	}
+
 	if strings.HasPrefix(slurmConfig.Socket, "unix://") {
 		// Create a Unix domain socket and listen for incoming connections.
 		socket, err := net.Listen("unix", strings.ReplaceAll(slurmConfig.Socket, "unix://", ""))
@@ -217,17 +277,23 @@ func main() {
 			os.Remove(strings.ReplaceAll(slurmConfig.Socket, "unix://", ""))
 			os.Exit(1)
 		}()
-		server := http.Server{
-			Handler: mutex,
-		}
-
 		log.G(ctx).Info(socket)
 
-		if err := server.Serve(socket); err != nil {
+		if tlsEnabled {
+			err = server.ServeTLS(socket, slurmConfig.TLSCertFile, slurmConfig.TLSKeyFile)
+		} else {
+			err = server.Serve(socket)
+		}
+		if err != nil {
 			log.G(ctx).Fatal(err)
 		}
 	} else {
-		err = http.ListenAndServe(":"+slurmConfig.Sidecarport, mutex)
+		server.Addr = ":" + slurmConfig.Sidecarport
+		if tlsEnabled {
+			err = server.ListenAndServeTLS(slurmConfig.TLSCertFile, slurmConfig.TLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
 		if err != nil {
 			log.G(ctx).Fatal(err)
 		}
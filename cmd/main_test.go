@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	slurm "github.com/intertwin-eu/interlink-slurm-plugin/pkg/slurm"
+)
+
+// testCertificate returns a certificate for a client, signed by parent, or a self-signed CA if parent is nil.
+func testCertificate(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testTLSServer starts an HTTPS server with the TLS configuration of the sidecar.
+func testTLSServer(t *testing.T, slurmConfig slurm.SlurmConfig) *httptest.Server {
+	t.Helper()
+	tlsConfig, err := initServerTLSConfig(slurmConfig)
+	if err != nil {
+		t.Fatalf("initServerTLSConfig() error = %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testClient returns a client of the server presenting the certificates.
+func testClient(server *httptest.Server, certificates ...tls.Certificate) *http.Client {
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certificates
+	client.Transport = transport
+	return client
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := testCertificate(t, "interlink-ca", nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA := testCertificate(t, "other-ca", nil)
+	server := testTLSServer(t, slurm.SlurmConfig{TLSClientCAFile: caFile})
+
+	tests := []struct {
+		name         string
+		certificates []tls.Certificate
+		wantErr      bool
+	}{
+		{name: "client without certificate", wantErr: true},
+		{name: "client with a certificate of another CA", certificates: []tls.Certificate{testCertificate(t, "intruder", &otherCA)}, wantErr: true},
+		{name: "client with a certificate of the CA", certificates: []tls.Certificate{testCertificate(t, "interlink", &ca)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := testClient(server, test.certificates...).Get(server.URL + "/status")
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("GET error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerTLSWithoutClientCA(t *testing.T) {
+	server := testTLSServer(t, slurm.SlurmConfig{})
+	resp, err := testClient(server).Get(server.URL + "/status")
+	if err != nil {
+		t.Fatalf("GET error = %v, want a client without certificate accepted", err)
+	}
+	resp.Body.Close()
+}
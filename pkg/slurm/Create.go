@@ -1,6 +1,7 @@
 package slurm
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -11,9 +12,11 @@ import (
 	"strings"
 	"time"
 
+	"al.essio.dev/pkg/shellescape"
 	"github.com/containerd/containerd/log"
 
 	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -33,6 +36,14 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.G(h.Ctx).Info("Slurm Sidecar: received Submit call")
 	statusCode := http.StatusOK
+
+	if draining.Load() {
+		log.G(h.Ctx).Warning("Slurm Sidecar is draining, rejecting the submission")
+		span.AddEvent("Submission rejected, the sidecar is draining")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Slurm Sidecar is draining: new pods are not accepted for now"))
+		return
+	}
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		statusCode = http.StatusInternalServerError
@@ -52,23 +63,128 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The digest is computed before the mutation, so that it matches the pod spec known to Kubernetes.
+	podSpecDigest := digest(data.Pod.Spec)
+
+	data.Pod, err = h.mutatePod(spanCtx, data.Pod)
+	if err != nil {
+		span.AddEvent("Failed to transform the pod")
+		h.handleError(spanCtx, w, http.StatusInternalServerError, err)
+		return
+	}
+
 	containers := data.Pod.Spec.InitContainers
 	containers = append(containers, data.Pod.Spec.Containers...)
 	metadata := data.Pod.ObjectMeta
 	filesPath := h.Config.DataRootFolder + data.Pod.Namespace + "-" + string(data.Pod.UID)
 
+	for _, container := range containers {
+		err = checkImageAllowed(h.Config, container.Image)
+		if err != nil {
+			span.AddEvent("Image " + container.Image + " rejected by the image policy")
+			h.handleError(spanCtx, w, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	err = validateAnnotations(spanCtx, h.Config, data.Pod)
+	if err != nil {
+		span.AddEvent("Pod rejected for its annotations")
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = checkHostNamespaces(h.Config, data.Pod)
+	if err != nil {
+		span.AddEvent("Pod rejected by the host namespaces policy")
+		h.handleError(spanCtx, w, http.StatusForbidden, err)
+		return
+	}
+
+	err = checkSysctls(spanCtx, h.Config, data.Pod)
+	if err != nil {
+		span.AddEvent("Pod rejected by the sysctls policy")
+		h.handleError(spanCtx, w, http.StatusForbidden, err)
+		return
+	}
+
+	submitUser, err := parseSubmitUser(h.Config, data.Pod)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusForbidden, err)
+		return
+	}
+
+	err = checkRunAsUser(data.Pod, submitUser)
+	if err != nil {
+		span.AddEvent("Pod rejected for its runAsUser or runAsGroup")
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	cluster, err := parseClusterName(h.Config, data.Pod)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	jobWideOptions, err := resolveJobWideSingularityOptions(h.Config, data.Pod)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	hetLayout, err := parseHetLayout(data.Pod)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		return
+	}
+	// In a heterogeneous job, the job is sized as the first component, the others get their own #SBATCH hetjob flags.
+	resourcePod := hetComponentPod(data.Pod, hetLayout, 0)
+
+	// With MPS, the daemon pipe directory must be reachable from every container.
+	useMPS := isMPSEnabled(spanCtx, h.Config, data.Pod)
+
 	var singularity_command_pod []SingularityCommand
+	var auditImages []AuditImage
 	var resourceLimits ResourceLimits
 
-	isDefaultCPU := true
-	isDefaultRam := true
-
-	maxCPULimit := 0
-	maxMemoryLimit := 0
+	podCPULimitFloat, podMemoryLimit := podResources(h.Config, resourcePod)
+	isDefaultCPU := podCPULimitFloat == 0
+	isDefaultRam := podMemoryLimit == 0
+	if isDefaultCPU {
+		log.G(h.Ctx).Warning(errors.New("CPU resource not set for pod " + data.Pod.Name + ". Only 1 CPU will be used"))
+	} else {
+		resourceLimits.CPU = int64(math.Ceil(podCPULimitFloat))
+		log.G(h.Ctx).Info("Setting CPU limit to " + strconv.FormatInt(resourceLimits.CPU, 10))
+	}
+	if isDefaultRam {
+		log.G(h.Ctx).Warning(errors.New("Memory resource not set for pod " + data.Pod.Name + ". Only " + strconv.FormatInt(memoryFloorMB(h.Config), 10) + "MB will be used"))
+	} else {
+		resourceLimits.Memory = podMemoryLimit
+		log.G(h.Ctx).Info("Setting Memory limit to " + strconv.FormatInt(resourceLimits.Memory, 10))
+	}
 
-	cpuLimit := int64(0)
-	memoryLimit := int64(0)
+	// With MPS, containers share the GPUs, otherwise each container gets its own.
+	if gpus := podGPUs(h.Config, resourcePod, useMPS); len(gpus) > 0 {
+		resourceLimits.GPUs = gpus
+	}
+	resourceLimits.GPUType, resourceLimits.GPUTypeCount, err = podTypedGPUs(h.Config, resourcePod, useMPS)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		return
+	}
+	gpuOffsets := map[string]int64{}
+	if !useMPS {
+		// The GPUs of each component of a heterogeneous job are numbered from 0.
+		for component := 0; component < max(len(hetLayout), 1); component++ {
+			for name, offset := range containerGPUOffsets(h.Config, hetComponentPod(data.Pod, hetLayout, component)) {
+				gpuOffsets[name] = offset
+			}
+		}
+	}
 
+	// The mounts of the containers add the lines creating their files on the node to the prefix of the job script.
+	var scriptPrefix strings.Builder
 	for i, container := range containers {
 		log.G(h.Ctx).Info("- Beginning script generation for container " + container.Name)
 
@@ -81,6 +197,13 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 		if singOpts, ok := metadata.Annotations["slurm-job.vk.io/singularity-options"]; ok {
 			singularityOptions = singOpts
 		}
+		if containerOpts := containerSingularityOptions(data.Pod, container.Name); containerOpts != "" {
+			singularityOptions = strings.TrimSpace(singularityOptions + " " + containerOpts)
+		}
+		if len(jobWideOptions[container.Name]) > 0 {
+			log.G(h.Ctx).Info("Adding job-wide singularity options ", jobWideOptions[container.Name], " requested by other containers to container ", container.Name)
+			singularityOptions = strings.TrimSpace(singularityOptions + " " + strings.Join(jobWideOptions[container.Name], " "))
+		}
 
 		// See https://github.com/interTwin-eu/interlink-slurm-plugin/issues/32#issuecomment-2416031030
 		// singularity run will honor the entrypoint/command (if exist) in container image, while exec will override entrypoint.
@@ -95,43 +218,36 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 		// no-eval is important so that singularity does not evaluate env var, because the shellquote has already done the safety check.
 		commstr1 := []string{h.Config.SingularityPath, singularityCommand}
 		commstr1 = append(commstr1, h.Config.SingularityDefaultOptions...)
-		commstr1 = append(commstr1, singularityMounts, singularityOptions)
-
-		image := ""
-
-		cpuLimitFloat := container.Resources.Limits.Cpu().AsApproximateFloat64()
-		memoryLimitFromContainer, _ := container.Resources.Limits.Memory().AsInt64()
-
-		cpuLimitFromContainer := int64(math.Ceil(cpuLimitFloat))
-
-		if cpuLimitFromContainer == 0 && isDefaultCPU {
-			log.G(h.Ctx).Warning(errors.New("Max CPU resource not set for " + container.Name + ". Only 1 CPU will be used"))
-			resourceLimits.CPU = 1
-		} else {
-			if cpuLimitFromContainer > resourceLimits.CPU && maxCPULimit < int(cpuLimitFromContainer) {
-				log.G(h.Ctx).Info("Setting CPU limit to " + strconv.FormatInt(cpuLimitFromContainer, 10))
-				cpuLimit = cpuLimitFromContainer
-				maxCPULimit = int(cpuLimitFromContainer)
-				isDefaultCPU = false
-			}
+		commstr1 = append(commstr1, withoutEmptyArgs([]string{singularityMounts, singularityOptions})...)
+		commstr1 = append(commstr1, missingGPUSingularityFlags(h.Config, container, commstr1)...)
+		commstr1 = append(commstr1, runAsSingularityFlags(data.Pod, container, commstr1)...)
+		if prerequisite := runAsPrerequisite(data.Pod, container); prerequisite != "" {
+			span.SetAttributes(attribute.String("job.container"+strconv.Itoa(i)+".runas.prerequisite", prerequisite))
 		}
-
-		if memoryLimitFromContainer == 0 && isDefaultRam {
-			log.G(h.Ctx).Warning(errors.New("Max Memory resource not set for " + container.Name + ". Only 1MB will be used"))
-			resourceLimits.Memory = 1024 * 1024
-		} else {
-			if memoryLimitFromContainer > resourceLimits.Memory && maxMemoryLimit < int(memoryLimitFromContainer) {
-				log.G(h.Ctx).Info("Setting Memory limit to " + strconv.FormatInt(memoryLimitFromContainer, 10))
-				memoryLimit = memoryLimitFromContainer
-				maxMemoryLimit = int(memoryLimitFromContainer)
-				isDefaultRam = false
-			}
+		if useMPS {
+			commstr1 = append(commstr1, "--bind", "${workingPath}/mps")
+		} else if offset, ok := gpuOffsets[container.Name]; ok && hetComponent(hetLayout, container.Name) == 0 {
+			commstr1 = append(commstr1, containerGPUEnv(h.Config, container, offset)...)
+		}
+		if h.Config.SetHostname {
+			commstr1 = append(commstr1, "--hostname", podHostname(data.Pod))
+		}
+		if h.Config.BindTmpToScratch {
+			// podTmpDir is created by the job script, see generateTmpScratchPrologue.
+			commstr1 = append(commstr1, "--bind", "\"${podTmpDir}\":/tmp")
+		}
+		if usesPodResolvConf(h.Config, data.Pod) {
+			// Written by the job script, see generateResolvConfPrologue.
+			commstr1 = append(commstr1, "--bind", "\"${workingPath}/resolv.conf\":/etc/resolv.conf")
+		}
+		// Without workingDir, the container starts in the directory of the job, as singularity does by default.
+		if container.WorkingDir != "" {
+			commstr1 = append(commstr1, "--pwd="+shellescape.Quote(container.WorkingDir))
 		}
 
-		resourceLimits.CPU = cpuLimit
-		resourceLimits.Memory = memoryLimit
+		image := ""
 
-		mounts, err := prepareMounts(spanCtx, h.Config, &data, &container, filesPath)
+		mounts, err := prepareMounts(spanCtx, h.Config, &data, &container, filesPath, &scriptPrefix)
 		log.G(h.Ctx).Debug(mounts)
 		if err != nil {
 			statusCode = http.StatusInternalServerError
@@ -140,33 +256,60 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Only the first container of the pod reads the stdin, as for a job.
+		stdinFile := ""
+		if i == len(data.Pod.Spec.InitContainers) {
+			stdinFile, err = prepareStdin(spanCtx, &data, &container, filesPath)
+			if err != nil {
+				h.handleError(spanCtx, w, http.StatusBadRequest, err)
+				os.RemoveAll(filesPath)
+				return
+			}
+		}
+
 		// prepareEnvs creates a file in the working directory, that must exist. This is created at prepareMounts.
 		envs := prepareEnvs(spanCtx, h.Config, data, container)
 
 		image = container.Image
-		imagePrefix := h.Config.ImagePrefix
 
-		imagePrefixAnnotationFound := false
-		if imagePrefixAnnotation, ok := metadata.Annotations["slurm-job.vk.io/image-root"]; ok {
-			// This takes precedence over ImagePrefix
-			imagePrefix = imagePrefixAnnotation
-			imagePrefixAnnotationFound = true
+		resolvedImage := ""
+		if h.Config.ImageResolveCommand != "" {
+			resolvedImage, err = resolveImageCommand(spanCtx, h.Config, image)
+			if err != nil {
+				h.handleError(spanCtx, w, http.StatusBadRequest, err)
+				os.RemoveAll(filesPath)
+				return
+			}
 		}
-		log.G(h.Ctx).Info("imagePrefix from annotation? ", imagePrefixAnnotationFound, " value: ", imagePrefix)
-
-		// If imagePrefix begins with "/", then it must be an absolute path instead of for example docker://some/image.
-		// The file should be one of https://docs.sylabs.io/guides/3.1/user-guide/cli/singularity_run.html#synopsis format.
-		if strings.HasPrefix(image, "/") {
-			log.G(h.Ctx).Warningf("image set to %s is an absolute path. Prefix won't be added.", image)
-		} else if !strings.HasPrefix(image, imagePrefix) {
-			image = imagePrefix + container.Image
+
+		if resolvedImage != "" {
+			image = resolvedImage
 		} else {
-			log.G(h.Ctx).Warningf("imagePrefix set to %s but already present in the image name %s. Prefix won't be added.", imagePrefix, image)
+			image = prefixedImage(spanCtx, h.Config, data.Pod, image)
+		}
+
+		if h.Config.EnforcePullPolicyNever && container.ImagePullPolicy == v1.PullNever {
+			err = checkLocalImage(container.Name, image)
+			if err != nil {
+				h.handleError(spanCtx, w, http.StatusBadRequest, err)
+				os.RemoveAll(filesPath)
+				return
+			}
+		}
+
+		auditImages = append(auditImages, AuditImage{Container: container.Name, Image: image, Digest: imageDigest(image)})
+
+		registryAuthFile, err := prepareRegistryCredentials(spanCtx, data, container.Name, image, filesPath)
+		if err != nil {
+			h.handleError(spanCtx, w, http.StatusBadRequest, err)
+			os.RemoveAll(filesPath)
+			return
 		}
 
 		log.G(h.Ctx).Debug("-- Appending all commands together...")
 		singularity_command := append(commstr1, envs...)
-		singularity_command = append(singularity_command, mounts)
+		singularity_command = append(singularity_command, withoutEmptyArgs([]string{mounts})...)
+		// With no command nor args, the command ends at the image, so that the runtime uses the image entrypoint.
 		singularity_command = append(singularity_command, image)
 
 		isInit := false
@@ -175,6 +318,17 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 			isInit = true
 		}
 
+		if isInit && h.Config.InitContainerResourceMode == InitContainerResourceStep {
+			singularity_command = append(initContainerStepCommand(h.Config, container), singularity_command...)
+		}
+		if component := hetComponent(hetLayout, container.Name); component > 0 && !isInit {
+			stepCommand := hetStepCommand(h.Config, component)
+			if offset, ok := gpuOffsets[container.Name]; ok {
+				stepCommand = append(stepCommand, hetStepGPUEnv(h.Config, container, offset)...)
+			}
+			singularity_command = append(stepCommand, singularity_command...)
+		}
+
 		span.SetAttributes(
 			attribute.String("job.container"+strconv.Itoa(i)+".name", container.Name),
 			attribute.Bool("job.container"+strconv.Itoa(i)+".isinit", isInit),
@@ -182,17 +336,19 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 			attribute.String("job.container"+strconv.Itoa(i)+".image", image),
 			attribute.StringSlice("job.container"+strconv.Itoa(i)+".command", container.Command),
 			attribute.StringSlice("job.container"+strconv.Itoa(i)+".args", container.Args),
+			attribute.String("job.container"+strconv.Itoa(i)+".workingdir", container.WorkingDir),
 		)
 
 		// Process probes if enabled
-		var readinessProbes, livenessProbes []ProbeCommand
+		var readinessProbes, livenessProbes, startupProbes []ProbeCommand
 		if h.Config.EnableProbes && !isInit {
-			readinessProbes, livenessProbes = translateKubernetesProbes(spanCtx, container)
-			if len(readinessProbes) > 0 || len(livenessProbes) > 0 {
+			readinessProbes, livenessProbes, startupProbes = translateKubernetesProbes(spanCtx, container)
+			if len(readinessProbes) > 0 || len(livenessProbes) > 0 || len(startupProbes) > 0 {
 				log.G(h.Ctx).Info("-- Container " + container.Name + " has probes configured")
 				span.SetAttributes(
 					attribute.Int("job.container"+strconv.Itoa(i)+".readiness_probes", len(readinessProbes)),
 					attribute.Int("job.container"+strconv.Itoa(i)+".liveness_probes", len(livenessProbes)),
+					attribute.Int("job.container"+strconv.Itoa(i)+".startup_probes", len(startupProbes)),
 				)
 			}
 		}
@@ -205,21 +361,135 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 			isInitContainer:    isInit,
 			readinessProbes:    readinessProbes,
 			livenessProbes:     livenessProbes,
+			startupProbes:      startupProbes,
+			stdinFile:          stdinFile,
+			registryAuthFile:   registryAuthFile,
 		})
 	}
 
+	// Resources consumed by the container runtime, declared by the pod RuntimeClass overhead.
+	if overheadCPU, ok := data.Pod.Spec.Overhead[v1.ResourceCPU]; ok && !isDefaultCPU {
+		podCPULimitFloat += overheadCPU.AsApproximateFloat64()
+		resourceLimits.CPU = int64(math.Ceil(podCPULimitFloat))
+		log.G(h.Ctx).Info("Adding pod CPU overhead of " + overheadCPU.String() + ", CPU limit set to " + strconv.FormatInt(resourceLimits.CPU, 10))
+	}
+	if overheadMemory, ok := data.Pod.Spec.Overhead[v1.ResourceMemory]; ok && !isDefaultRam {
+		resourceLimits.Memory += overheadMemory.Value()
+		log.G(h.Ctx).Info("Adding pod Memory overhead of " + overheadMemory.String() + ", Memory limit set to " + strconv.FormatInt(resourceLimits.Memory, 10))
+	}
+
+	// Safety margin for the runtime overhead, applied only to limits coming from the pod.
+	// The CPUs are scaled before being rounded up, eg: 500m scaled by 1.5 is 1 CPU, not 2.
+	if !isDefaultCPU && h.Config.CPUScaleFactor > 0 && h.Config.CPUScaleFactor != 1.0 {
+		resourceLimits.CPU = int64(math.Ceil(podCPULimitFloat * h.Config.CPUScaleFactor))
+		log.G(h.Ctx).Info("CPU limit scaled by " + strconv.FormatFloat(h.Config.CPUScaleFactor, 'f', -1, 64) + " to " + strconv.FormatInt(resourceLimits.CPU, 10))
+	}
+	if !isDefaultRam && h.Config.MemoryScaleFactor > 0 && h.Config.MemoryScaleFactor != 1.0 {
+		resourceLimits.Memory = int64(math.Ceil(float64(resourceLimits.Memory) * h.Config.MemoryScaleFactor))
+		log.G(h.Ctx).Info("Memory limit scaled by " + strconv.FormatFloat(h.Config.MemoryScaleFactor, 'f', -1, 64) + " to " + strconv.FormatInt(resourceLimits.Memory, 10))
+	}
+
+	err = applyResourceFloor(h.Ctx, h.Config, &resourceLimits, isDefaultCPU, isDefaultRam)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		os.RemoveAll(filesPath)
+		return
+	}
+
+	if h.Config.AllowOversubscribe && !isDefaultCPU && podCPULimitFloat < 1 {
+		resourceLimits.CPUFraction = podCPULimitFloat
+	}
+
 	span.SetAttributes(
 		attribute.Int64("job.limits.cpu", resourceLimits.CPU),
 		attribute.Int64("job.limits.memory", resourceLimits.Memory),
 	)
 
-	path, err := produceSLURMScript(spanCtx, h.Config, data.Pod, filesPath, metadata, singularity_command_pod, resourceLimits, isDefaultCPU, isDefaultRam)
+	hetLimits, err := hetComponentLimits(spanCtx, h.Config, data.Pod, hetLayout, useMPS)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusBadRequest, err)
+		os.RemoveAll(filesPath)
+		return
+	}
+	// The other components of a heterogeneous job count in the caps and in the metadata as well.
+	jobLimits := resourceLimits
+	for _, limits := range hetLimits {
+		jobLimits.CPU += limits.CPU
+		jobLimits.Memory += limits.Memory
+	}
+
+	err = checkNamespaceResourceCaps(h.Config, data.Pod, jobLimits, h.JIDs)
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusForbidden, err)
+		os.RemoveAll(filesPath)
+		return
+	}
+	defer releaseNamespaceReservation(string(data.Pod.UID))
+
+	var placementFlags []string
+	if h.Config.TranslatePodAffinity {
+		placementFlags = affinitySbatchFlags(spanCtx, h.Config, data.Pod, h.JIDs)
+	}
+	if h.Config.TranslateTopologySpread {
+		placementFlags = append(placementFlags, topologySpreadSbatchFlags(spanCtx, h.Config, data.Pod, metadata.Annotations["slurm-job.vk.io/flags"])...)
+	}
+	if h.Config.TranslateNodeName {
+		// Added last, so that the --nodelist of the pod node overrides the one of the affinity.
+		placementFlags = append(placementFlags, nodeNameSbatchFlags(spanCtx, h.Config, data.Pod)...)
+	}
+
+	path, err := produceSLURMScript(spanCtx, h.Config, data.Pod, filesPath, metadata, singularity_command_pod, resourceLimits, isDefaultCPU, isDefaultRam, placementFlags, hetComponentFlags(hetLimits), &scriptPrefix)
 	if err != nil {
-		log.G(h.Ctx).Error(err)
+		span.AddEvent("Failed to produce the SLURM script")
+		h.handleError(spanCtx, w, http.StatusInternalServerError, err)
 		os.RemoveAll(filesPath)
 		return
 	}
-	out, err := SLURMBatchSubmit(h.Ctx, h.Config, path)
+
+	podMetadata := newPodMetadata(data.Pod)
+	podMetadata.CPU = jobLimits.CPU
+	podMetadata.Memory = jobLimits.Memory
+	err = writePodMetadata(filesPath, podMetadata)
+	if err != nil {
+		// Metadata is informational only, the job can be submitted anyway.
+		log.G(h.Ctx).Warning("Unable to write pod metadata: ", err)
+	}
+
+	if submitUser != "" {
+		err = chownWorkingDir(filesPath, submitUser)
+		if err != nil {
+			// The job can still run if the directory is readable by its user otherwise, eg: with ACLs, but not the secrets nor the registry credentials.
+			log.G(h.Ctx).Warning("Unable to give the working directory ", filesPath, " to user ", submitUser, ": ", err)
+		}
+	}
+
+	if h.Config.LintScript {
+		err = lintSLURMScript(h.Ctx, h.Config, filesPath)
+		if err != nil {
+			span.AddEvent("Generated SLURM script is malformed")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Generated script is malformed: " + err.Error()))
+			os.RemoveAll(filesPath)
+			return
+		}
+	}
+
+	// The env vars filling the mounted files must survive SubmitAsUserCommand.
+	mountEnvs := mountEnvVarNames(scriptPrefix.String())
+	if h.Config.TestOnlyPreflight {
+		err = SLURMBatchTestOnly(h.Ctx, h.Config, path, submitUser, mountEnvs)
+		if err != nil {
+			span.AddEvent("SLURM Job rejected by sbatch --test-only")
+			// The SLURM message is returned, so that users know which policy rejected the job.
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Job rejected by SLURM: " + err.Error()))
+			os.RemoveAll(filesPath)
+			return
+		}
+	}
+
+	// The request context stops the retries of the submission if InterLink gives up on the request.
+	out, err := SLURMBatchSubmit(r.Context(), h.Config, path, submitUser, mountEnvs, slurmJobName(h.Config, data.Pod), cluster)
 	if err != nil {
 		span.AddEvent("Failed to submit the SLURM Job")
 		statusCode = http.StatusInternalServerError
@@ -228,12 +498,12 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.G(h.Ctx).Info(out)
-	jid, err := handleJidAndPodUid(h.Ctx, data.Pod, h.JIDs, out, filesPath)
+	jid, err := handleJidAndPodUid(h.Ctx, data.Pod, h.JIDs, out, filesPath, cluster, submitUser)
 	if err != nil {
 		statusCode = http.StatusInternalServerError
 		h.handleError(spanCtx, w, http.StatusGatewayTimeout, err)
 		os.RemoveAll(filesPath)
-		err = deleteContainer(spanCtx, h.Config, string(data.Pod.UID), h.JIDs, filesPath)
+		err = deleteContainer(spanCtx, h.Config, string(data.Pod.UID), slurmJobName(h.Config, data.Pod), cluster, submitUser, h.JIDs, filesPath, true)
 		if err != nil {
 			log.G(h.Ctx).Error(err)
 		}
@@ -241,8 +511,51 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	span.AddEvent("SLURM Job successfully submitted with ID " + jid)
+
+	if h.Config.AuditLogPath != "" {
+		directives, err := readSbatchDirectives(path)
+		if err != nil {
+			log.G(h.Ctx).Warning("Unable to read the directives of job ", jid, " for the audit log: ", err)
+		}
+		err = appendAuditRecord(h.Config.AuditLogPath, AuditRecord{
+			Timestamp:     time.Now().UTC(),
+			PodUID:        string(data.Pod.UID),
+			PodName:       data.Pod.Name,
+			PodNamespace:  data.Pod.Namespace,
+			PodSpecDigest: podSpecDigest,
+			Directives:    directives,
+			Images:        auditImages,
+			Resources:     AuditResources{CPU: resourceLimits.CPU, Memory: resourceLimits.Memory, GPUs: resourceLimits.GPUs},
+			JID:           jid,
+			Cluster:       cluster,
+			SubmitUser:    submitUser,
+			Identity:      requestIdentity(r),
+		})
+		if err != nil {
+			// The job is already submitted, so it is not cancelled because of the audit log.
+			log.G(h.Ctx).Error("Unable to append the audit record of job ", jid, ": ", err)
+		}
+	}
 	returnedJID = CreateStruct{PodUID: string(data.Pod.UID), PodJID: jid}
 
+	if h.Config.SynchronousSubmit {
+		// The job is submitted whatever happens here, so failures to follow it are only logged and the status path reports it as usual.
+		log.G(h.Ctx).Info("Waiting for job " + jid + " to start")
+		// The cluster of the job is the one sbatch picked with a list of clusters.
+		jobCluster := cluster
+		if storedJID, ok := lookupJID(h.JIDs, string(data.Pod.UID)); ok {
+			jobCluster = storedJID.Cluster
+		}
+		returnedJID.JobState, returnedJID.NodeList, err = waitJobStarted(r.Context(), h.Config, jid, jobCluster, time.Duration(h.Config.SynchronousSubmitTimeout)*time.Second)
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			log.G(h.Ctx).Warning("Create request of pod ", data.Pod.Name, " cancelled while waiting for job ", jid, " to start")
+			return
+		} else if err != nil {
+			log.G(h.Ctx).Warning("Unable to wait for job ", jid, " to start: ", err)
+		}
+		span.AddEvent("SLURM Job " + jid + " reached state " + returnedJID.JobState)
+	}
+
 	returnedJIDBytes, err = json.Marshal(returnedJID)
 	if err != nil {
 		statusCode = http.StatusInternalServerError
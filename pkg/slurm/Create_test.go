@@ -0,0 +1,848 @@
+package slurm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// testSubmitConfig returns a configuration submitting the jobs with a stub sbatch, with the working directories in a temporary directory.
+func testSubmitConfig(t *testing.T) SlurmConfig {
+	t.Helper()
+	config := testSLURMConfig()
+	config.DataRootFolder = t.TempDir() + "/"
+	config.Sbatchpath = writeTestExecutable(t, t.TempDir(), "sbatch", `echo "Submitted batch job 123"`)
+	return config
+}
+
+// testPod returns a pod named test in the default namespace with the provided containers.
+func testPod(containers ...v1.Container) v1.Pod {
+	for i := range containers {
+		if containers[i].Image == "" {
+			containers[i].Image = "busybox"
+		}
+	}
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "test-uid", Annotations: map[string]string{}},
+		Spec:       v1.PodSpec{Containers: containers},
+	}
+}
+
+// testSubmit posts the pod to SubmitHandler and returns the response and the working directory of the pod.
+func testSubmit(t *testing.T, config SlurmConfig, data commonIL.RetrievedPodData) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	return testSubmitWithHandler(t, SidecarHandler{Config: config}, data)
+}
+
+// testSubmitWithHandler is testSubmit with a handler set up by the test, eg: with a Mutator or the JIDs to check.
+func testSubmitWithHandler(t *testing.T, h SidecarHandler, data commonIL.RetrievedPodData) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	body, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.JIDs == nil {
+		h.JIDs = &map[string]*JidStruct{}
+	}
+	h.Ctx = context.Background()
+	w := httptest.NewRecorder()
+	h.SubmitHandler(w, httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader(body)))
+	return w, h.Config.DataRootFolder + data.Pod.Namespace + "-" + string(data.Pod.UID)
+}
+
+// readJobScript returns the content of job.slurm followed by job.sh in the working directory.
+func readJobScript(t *testing.T, path string) string {
+	t.Helper()
+	script := ""
+	for _, name := range []string{"job.slurm", "job.sh"} {
+		content, err := os.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		script += string(content)
+	}
+	return script
+}
+
+func TestSubmitOversubscribe(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		config := testSubmitConfig(t)
+		config.AllowOversubscribe = allow
+		w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(testContainer("app", "250m", "1Gi"))})
+		if w.Code != http.StatusOK {
+			t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		script := readJobScript(t, path)
+		if got := strings.Contains(script, "#SBATCH --oversubscribe"); got != allow {
+			t.Errorf("AllowOversubscribe %v: --oversubscribe emitted = %v, script:\n%s", allow, got, script)
+		}
+		if got := strings.Contains(script, "export INTERLINK_CPU_FRACTION=0.250"); got != allow {
+			t.Errorf("AllowOversubscribe %v: CPU fraction hint emitted = %v, script:\n%s", allow, got, script)
+		}
+		if !strings.Contains(script, "#SBATCH --cpus-per-task=1") {
+			t.Errorf("AllowOversubscribe %v: 250m is not rounded up to 1 CPU, script:\n%s", allow, script)
+		}
+	}
+}
+
+func TestSubmitAllowedImagePatterns(t *testing.T) {
+	tests := []struct {
+		image    string
+		wantCode int
+	}{
+		{image: "registry.example.org/hpc/solver:1.0", wantCode: http.StatusOK},
+		{image: "docker.io/library/busybox", wantCode: http.StatusForbidden},
+		{image: "registry.example.org/hpc/solver:1.0.evil.org/x", wantCode: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.AllowedImagePatterns = []string{`registry\.example\.org/hpc/[a-z]+:[0-9.]+`}
+			container := testContainer("app", "1", "1Gi")
+			container.Image = test.image
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(container)})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d", w.Code, test.wantCode)
+			}
+			if _, err := os.Stat(filepath.Join(path, "job.slurm")); (err == nil) != (test.wantCode == http.StatusOK) {
+				t.Errorf("job.slurm exists = %v, want %v", err == nil, test.wantCode == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestCompileImagePatterns(t *testing.T) {
+	regexes, err := compileImagePatterns([]string{`busybox`, `registry\.example\.org/.+`})
+	if err != nil {
+		t.Fatalf("compileImagePatterns() error = %v", err)
+	}
+	config := testSLURMConfig()
+	config.AllowedImagePatterns = []string{`busybox`, `registry\.example\.org/.+`}
+	config.allowedImageRegexes = regexes
+	for image, wantAllowed := range map[string]bool{"busybox": true, "busybox:latest": false, "registry.example.org/app": true} {
+		if err := checkImageAllowed(config, image); (err == nil) != wantAllowed {
+			t.Errorf("checkImageAllowed(%q) error = %v, want allowed %v", image, err, wantAllowed)
+		}
+	}
+
+	if _, err := compileImagePatterns([]string{`busybox`, `[a-z`}); err == nil || !strings.Contains(err.Error(), "[a-z") {
+		t.Errorf("compileImagePatterns() error = %v, want the invalid pattern in the error", err)
+	}
+}
+
+func TestSubmitScaleFactors(t *testing.T) {
+	tests := []struct {
+		name              string
+		cpu               string
+		cpuScaleFactor    float64
+		memoryScaleFactor float64
+		wantCPUs          string
+		wantMem           string
+	}{
+		{name: "no scaling", cpu: "2", wantCPUs: "2", wantMem: "1000"},
+		{name: "memory scaled by 1.1", cpu: "2", memoryScaleFactor: 1.1, wantCPUs: "2", wantMem: "1100"},
+		{name: "CPU scaled before rounding up", cpu: "500m", cpuScaleFactor: 1.5, wantCPUs: "1", wantMem: "1000"},
+		{name: "CPU scaled by 1.5", cpu: "3", cpuScaleFactor: 1.5, wantCPUs: "5", wantMem: "1000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.CPUScaleFactor = test.cpuScaleFactor
+			config.MemoryScaleFactor = test.memoryScaleFactor
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(testContainer("app", test.cpu, "1000Mi"))})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			if !strings.Contains(script, "#SBATCH --cpus-per-task="+test.wantCPUs+"\n") {
+				t.Errorf("want --cpus-per-task=%s, script:\n%s", test.wantCPUs, script)
+			}
+			if !strings.Contains(script, "#SBATCH --mem="+test.wantMem+"\n") {
+				t.Errorf("want --mem=%s, script:\n%s", test.wantMem, script)
+			}
+		})
+	}
+}
+
+func TestSubmitOverhead(t *testing.T) {
+	tests := []struct {
+		name     string
+		overhead v1.ResourceList
+		wantCPUs string
+		wantMem  string
+	}{
+		{name: "no overhead", wantCPUs: "1", wantMem: "1000"},
+		{
+			name:     "500m and 256Mi overhead",
+			overhead: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m"), v1.ResourceMemory: resource.MustParse("256Mi")},
+			wantCPUs: "2",
+			wantMem:  "1256",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(testContainer("app", "1", "1000Mi"))
+			pod.Spec.Overhead = test.overhead
+			w, path := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			if !strings.Contains(script, "#SBATCH --cpus-per-task="+test.wantCPUs+"\n") {
+				t.Errorf("want --cpus-per-task=%s, script:\n%s", test.wantCPUs, script)
+			}
+			if !strings.Contains(script, "#SBATCH --mem="+test.wantMem+"\n") {
+				t.Errorf("want --mem=%s, script:\n%s", test.wantMem, script)
+			}
+		})
+	}
+}
+
+func TestSubmitStdinConfigMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdinRef string
+		wantCode int
+	}{
+		{name: "ConfigMap key", stdinRef: "inputs/config.yaml", wantCode: http.StatusOK},
+		{name: "missing key", stdinRef: "inputs/other.yaml", wantCode: http.StatusBadRequest},
+		{name: "missing ConfigMap", stdinRef: "other/config.yaml", wantCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(testContainer("app", "1", "1Gi"), testContainer("sidecar", "1", "1Gi"))
+			pod.Annotations["slurm-job.vk.io/stdin-configmap"] = test.stdinRef
+			data := commonIL.RetrievedPodData{
+				Pod: pod,
+				Containers: []commonIL.RetrievedContainer{{
+					Name:       "app",
+					ConfigMaps: []v1.ConfigMap{{ObjectMeta: metav1.ObjectMeta{Name: "inputs"}, Data: map[string]string{"config.yaml": "steps: 10\n"}}},
+				}},
+			}
+			w, path := testSubmit(t, testSubmitConfig(t), data)
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			stdinPath := filepath.Join(path, "stdin-app")
+			content, err := os.ReadFile(stdinPath)
+			if err != nil || string(content) != "steps: 10\n" {
+				t.Errorf("stdin file = %q, %v, want the ConfigMap key content", content, err)
+			}
+			// Only the first container reads the stdin.
+			redirected := map[string]bool{}
+			for _, line := range strings.Split(readJobScript(t, path), "\n") {
+				if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "runCtn" {
+					redirected[fields[1]] = strings.HasSuffix(line, " < "+stdinPath)
+				}
+			}
+			if !redirected["app"] || redirected["sidecar"] {
+				t.Errorf("stdin redirected from %s = %v, want for app only", stdinPath, redirected)
+			}
+		})
+	}
+}
+
+func TestSubmitTestOnlyPreflight(t *testing.T) {
+	tests := []struct {
+		name     string
+		testOnly string
+		wantCode int
+	}{
+		{name: "accepted", testOnly: `echo "sbatch: Job 123 to start at 2026-01-01T00:00:00" >&2`, wantCode: http.StatusOK},
+		{name: "rejected", testOnly: `echo "sbatch: error: Batch job submission failed: Invalid qos specification" >&2; exit 1`, wantCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			submitted := filepath.Join(stubs, "submitted")
+			config := testSubmitConfig(t)
+			config.TestOnlyPreflight = true
+			config.Sbatchpath = writeTestExecutable(t, stubs, "sbatch", `case "$*" in *--test-only*) `+test.testOnly+`; exit ;; esac
+echo "$@" > `+submitted+`
+echo "Submitted batch job 123"`)
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(testContainer("app", "1", "1Gi"))})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			_, err := os.Stat(submitted)
+			if submittedJob := err == nil; submittedJob != (test.wantCode == http.StatusOK) {
+				t.Errorf("job submitted = %v, want %v", submittedJob, test.wantCode == http.StatusOK)
+			}
+			if test.wantCode == http.StatusOK {
+				return
+			}
+			if !strings.Contains(w.Body.String(), "Invalid qos specification") {
+				t.Errorf("SubmitHandler() body = %q, want the SLURM message", w.Body)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("working directory of the rejected pod exists, error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSubmitJobNameGenerations(t *testing.T) {
+	config := testSubmitConfig(t)
+	config.JobNamePrefix = "il-"
+	jobNames := []string{}
+	for _, uid := range []string{"0b6e1c2a-5d1f-4c8e-9a0b-1c2d3e4f5a6b", "7f3d9e41-2b6c-4d7a-8e9f-0a1b2c3d4e5f"} {
+		pod := testPod(testContainer("app", "1", "1Gi"))
+		pod.UID = types.UID(uid)
+		w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+		if w.Code != http.StatusOK {
+			t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		for _, line := range strings.Split(readJobScript(t, path), "\n") {
+			if jobName, found := strings.CutPrefix(line, "#SBATCH --job-name="); found {
+				jobNames = append(jobNames, jobName)
+			}
+		}
+	}
+	if want := []string{"il-test-0b6e1c2a", "il-test-7f3d9e41"}; strings.Join(jobNames, " ") != strings.Join(want, " ") {
+		t.Errorf("job names = %v, want %v", jobNames, want)
+	}
+
+	// The job of an untracked generation is cancelled by its own name only.
+	stubs := t.TempDir()
+	calls := filepath.Join(stubs, "calls")
+	config.Scancelpath = writeTestExecutable(t, stubs, "scancel", `echo "$@" >> `+calls)
+	pod := testPod(testContainer("app", "1", "1Gi"))
+	pod.UID = "0b6e1c2a-5d1f-4c8e-9a0b-1c2d3e4f5a6b"
+	JIDs := map[string]*JidStruct{}
+	err := deleteContainer(context.Background(), config, string(pod.UID), slurmJobName(config, pod), "", "", &JIDs, t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("deleteContainer() error = %v", err)
+	}
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(content)); got != "--name=il-test-0b6e1c2a" {
+		t.Errorf("scancel called with %q, want --name=il-test-0b6e1c2a", got)
+	}
+}
+
+func TestSubmitCoreSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantCode    int
+		wantFlags   []string
+	}{
+		{name: "unset", wantCode: http.StatusOK},
+		{name: "core-spec", annotations: map[string]string{"slurm-job.vk.io/core-spec": "2"}, wantCode: http.StatusOK, wantFlags: []string{"--core-spec=2"}},
+		{name: "thread-spec", annotations: map[string]string{"slurm-job.vk.io/thread-spec": "0"}, wantCode: http.StatusOK, wantFlags: []string{"--thread-spec=0"}},
+		{name: "negative core-spec", annotations: map[string]string{"slurm-job.vk.io/core-spec": "-1"}, wantCode: http.StatusBadRequest},
+		{name: "not an integer", annotations: map[string]string{"slurm-job.vk.io/thread-spec": "two"}, wantCode: http.StatusBadRequest},
+		{
+			name:        "both",
+			annotations: map[string]string{"slurm-job.vk.io/core-spec": "2", "slurm-job.vk.io/thread-spec": "1"},
+			wantCode:    http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			for key, value := range test.annotations {
+				pod.Annotations[key] = value
+			}
+			w, path := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			flags := []string{}
+			for _, line := range strings.Split(readJobScript(t, path), "\n") {
+				if flag, found := strings.CutPrefix(line, "#SBATCH "); found && (strings.HasPrefix(flag, "--core-spec") || strings.HasPrefix(flag, "--thread-spec")) {
+					flags = append(flags, flag)
+				}
+			}
+			if strings.Join(flags, " ") != strings.Join(test.wantFlags, " ") {
+				t.Errorf("#SBATCH lines = %v, want %v", flags, test.wantFlags)
+			}
+		})
+	}
+}
+
+func TestSubmitSpread(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantCode    int
+		wantSpread  bool
+	}{
+		{name: "multi-node spread", annotations: map[string]string{"slurm-job.vk.io/spread": "true", "slurm-job.vk.io/flags": "--nodes=2"}, wantCode: http.StatusOK, wantSpread: true},
+		{name: "multi-node packed", annotations: map[string]string{"slurm-job.vk.io/spread": "false", "slurm-job.vk.io/flags": "--nodes=2"}, wantCode: http.StatusOK},
+		{name: "multi-node without annotation", annotations: map[string]string{"slurm-job.vk.io/flags": "-N 2"}, wantCode: http.StatusOK},
+		{name: "single node", annotations: map[string]string{"slurm-job.vk.io/spread": "true"}, wantCode: http.StatusOK},
+		{name: "not a boolean", annotations: map[string]string{"slurm-job.vk.io/spread": "wide", "slurm-job.vk.io/flags": "--nodes=2"}, wantCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			for key, value := range test.annotations {
+				pod.Annotations[key] = value
+			}
+			w, path := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			script := readJobScript(t, path)
+			if got := strings.Contains(script, "#SBATCH --spread-job\n"); got != test.wantSpread {
+				t.Errorf("#SBATCH --spread-job = %v, want %v, script:\n%s", got, test.wantSpread, script)
+			}
+		})
+	}
+}
+
+func TestSubmitHostname(t *testing.T) {
+	tests := []struct {
+		name         string
+		setHostname  bool
+		hostname     string
+		wantHostname string
+	}{
+		{name: "spec.hostname", setHostname: true, hostname: "solver-0", wantHostname: "solver-0"},
+		{name: "pod name", setHostname: true, wantHostname: "test"},
+		{name: "SetHostname disabled", hostname: "solver-0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.SetHostname = test.setHostname
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Spec.Hostname = test.hostname
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			if test.wantHostname == "" {
+				if strings.Contains(script, "--hostname") {
+					t.Errorf("--hostname set without SetHostname, script:\n%s", script)
+				}
+				return
+			}
+			if !strings.Contains(script, " --hostname "+test.wantHostname+" ") {
+				t.Errorf("want --hostname %s, script:\n%s", test.wantHostname, script)
+			}
+		})
+	}
+}
+
+func TestSubmitHostNamespaces(t *testing.T) {
+	tests := []struct {
+		name string
+		spec func(spec *v1.PodSpec)
+	}{
+		{name: "hostNetwork", spec: func(spec *v1.PodSpec) { spec.HostNetwork = true }},
+		{name: "hostPID", spec: func(spec *v1.PodSpec) { spec.HostPID = true }},
+		{name: "hostIPC", spec: func(spec *v1.PodSpec) { spec.HostIPC = true }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			test.spec(&pod.Spec)
+			config := testSubmitConfig(t)
+			if err := checkHostNamespaces(config, pod); err == nil || !strings.Contains(err.Error(), test.name) {
+				t.Errorf("checkHostNamespaces() error = %v, want the %s policy error", err, test.name)
+			}
+			if w, _ := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod}); w.Code != http.StatusForbidden {
+				t.Errorf("SubmitHandler() status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+
+			// Singularity shares the host namespaces, the containers run as they are.
+			config.AllowHostNamespaces = true
+			if w, _ := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod}); w.Code != http.StatusOK {
+				t.Errorf("AllowHostNamespaces: SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+		})
+	}
+}
+
+func TestSubmitInitContainerResourceMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		wantInit string
+	}{
+		{mode: InitContainerResourceShared, wantInit: "runInitCtn setup singularity "},
+		{mode: InitContainerResourceStep, wantInit: "runInitCtn setup /usr/bin/srun --ntasks=1 --nodes=1 --exact --cpus-per-task=1 --mem=256 singularity "},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.Srunpath = "/usr/bin/srun"
+			config.InitContainerResourceMode = test.mode
+			pod := testPod(testContainer("app", "2", "1Gi"))
+			pod.Spec.InitContainers = []v1.Container{testContainer("setup", "500m", "256Mi")}
+			pod.Spec.InitContainers[0].Image = "busybox"
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			if !strings.Contains(script, "\n"+test.wantInit) {
+				t.Errorf("want the init container run with %q, script:\n%s", test.wantInit, script)
+			}
+			// The job is sized for the app containers in both modes.
+			if !strings.Contains(script, "#SBATCH --cpus-per-task=2\n") || !strings.Contains(script, "#SBATCH --mem=1024\n") {
+				t.Errorf("want the job sized with 2 CPUs and 1024MB, script:\n%s", script)
+			}
+		})
+	}
+}
+
+func TestSubmitContainerWithoutCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    []string
+		args       []string
+		wantSuffix string
+	}{
+		{name: "no command nor args", wantSuffix: " docker://busybox"},
+		{name: "empty command and args", command: []string{}, args: []string{}, wantSuffix: " docker://busybox"},
+		{name: "args only", args: []string{"--verbose"}, wantSuffix: " docker://busybox --verbose"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container := testContainer("app", "1", "1Gi")
+			container.Command = test.command
+			container.Args = test.args
+			w, path := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: testPod(container)})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			runLine := ""
+			for _, line := range strings.Split(readJobScript(t, path), "\n") {
+				if strings.HasPrefix(line, "runCtn app ") {
+					runLine = line
+				}
+			}
+			if !strings.HasSuffix(runLine, test.wantSuffix) || strings.Contains(runLine, "''") {
+				t.Errorf("container run with %q, want it to end with %q", runLine, test.wantSuffix)
+			}
+		})
+	}
+}
+
+func TestSubmitAsUser(t *testing.T) {
+	tests := []struct {
+		name            string
+		namespace       string
+		annotation      string
+		allowAnnotation bool
+		wantCode        int
+		wantUser        string
+	}{
+		{name: "mapped namespace", namespace: "physics", wantCode: http.StatusOK, wantUser: "alice"},
+		{name: "unmapped namespace", namespace: "default", wantCode: http.StatusOK},
+		{name: "annotation", namespace: "physics", annotation: "bob", allowAnnotation: true, wantCode: http.StatusOK, wantUser: "bob"},
+		{name: "annotation not allowed", namespace: "physics", annotation: "bob", wantCode: http.StatusForbidden},
+		{name: "invalid user", namespace: "default", annotation: "bob; rm -rf /", allowAnnotation: true, wantCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			impersonations := filepath.Join(stubs, "impersonations")
+			config := testSubmitConfig(t)
+			config.SubmitAsUserCommand = writeTestExecutable(t, stubs, "impersonate", `echo "$*" >> `+impersonations+`; shift; exec "$@"`) + " {user}"
+			config.NamespaceUserMap = map[string]string{"physics": "alice"}
+			config.AllowSubmitUserAnnotation = test.allowAnnotation
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Namespace = test.namespace
+			if test.annotation != "" {
+				pod.Annotations["slurm-job.vk.io/submit-user"] = test.annotation
+			}
+			JIDs := map[string]*JidStruct{}
+			w, path := testSubmitWithHandler(t, SidecarHandler{Config: config, JIDs: &JIDs}, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			content, _ := os.ReadFile(impersonations)
+			if test.wantUser == "" {
+				if len(content) != 0 {
+					t.Errorf("impersonated submissions = %q, want none", content)
+				}
+				return
+			}
+			if want := test.wantUser + " " + config.Sbatchpath + " " + filepath.Join(path, "job.slurm"); !strings.HasPrefix(string(content), want) {
+				t.Errorf("impersonated submissions = %q, want %q", content, want)
+			}
+			if jid := JIDs[string(pod.UID)]; jid == nil || jid.JID != "123" || jid.SubmitUser != test.wantUser {
+				t.Errorf("JIDs[%s] = %+v, want job 123 submitted as %s", pod.UID, jid, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestSubmitAsUserConfigMap(t *testing.T) {
+	t.Setenv("SHARED_FS", "false")
+	stubs := t.TempDir()
+	sbatchEnv := filepath.Join(stubs, "sbatch.env")
+	config := testSubmitConfig(t)
+	config.ExportPodData = true
+	// Resets the environment as sudo does, except for the variables of --preserve-env.
+	config.SubmitAsUserCommand = writeTestExecutable(t, stubs, "impersonate", `keep=",${2#--preserve-env=},"; shift 2
+for name in $(env | sed -n 's/^\([A-Za-z_][A-Za-z0-9_]*\)=.*/\1/p'); do
+	case "$keep" in *",$name,"*) ;; *) [ "$name" = PATH ] || unset "$name" ;; esac
+done
+exec "$@"`) + " {user} --preserve-env={env}"
+	config.Sbatchpath = writeTestExecutable(t, stubs, "sbatch", `env > `+sbatchEnv+`
+echo "Submitted batch job 123"`)
+	config.NamespaceUserMap = map[string]string{"default": "alice"}
+	app := testContainer("app", "1", "1Gi")
+	app.VolumeMounts = []v1.VolumeMount{{Name: "inputs", MountPath: "/etc/inputs"}}
+	pod := testPod(app)
+	pod.Spec.Volumes = []v1.Volume{{Name: "inputs", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "inputs"}}}}}
+	data := commonIL.RetrievedPodData{
+		Pod: pod,
+		Containers: []commonIL.RetrievedContainer{{
+			Name:       "app",
+			ConfigMaps: []v1.ConfigMap{{ObjectMeta: metav1.ObjectMeta{Name: "inputs"}, Data: map[string]string{"config.yaml": "steps: 10"}}},
+		}},
+	}
+	w, path := testSubmit(t, config, data)
+	if w.Code != http.StatusOK {
+		t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	envName := "app_configMaps_" + stringToHex(filepath.Join(path, "configMaps", "inputs", "config.yaml"))
+	content, err := os.ReadFile(sbatchEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains("\n"+string(content), "\n"+envName+"=steps: 10\n") {
+		t.Errorf("environment of sbatch run as alice lacks %s, got:\n%s", envName, content)
+	}
+	if strings.Contains(string(content), "SHARED_FS=") {
+		t.Errorf("environment of sbatch run as alice not reset, got:\n%s", content)
+	}
+}
+
+func TestSubmitSysctls(t *testing.T) {
+	tests := []struct {
+		name     string
+		sysctls  []v1.Sysctl
+		wantCode int
+	}{
+		{name: "no sysctls", wantCode: http.StatusOK},
+		{name: "allowed sysctl", sysctls: []v1.Sysctl{{Name: "kernel.shm_rmid_forced", Value: "1"}}, wantCode: http.StatusOK},
+		{name: "allowed by prefix", sysctls: []v1.Sysctl{{Name: "net.ipv4.ip_local_port_range", Value: "32768 60999"}}, wantCode: http.StatusOK},
+		{name: "disallowed sysctl", sysctls: []v1.Sysctl{{Name: "kernel.msgmax", Value: "65536"}}, wantCode: http.StatusForbidden},
+		{
+			name:     "allowed and disallowed sysctls",
+			sysctls:  []v1.Sysctl{{Name: "kernel.shm_rmid_forced", Value: "1"}, {Name: "vm.swappiness", Value: "0"}},
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.AllowSysctls = []string{"kernel.shm_rmid_forced", "net.ipv4.*"}
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Spec.SecurityContext = &v1.PodSecurityContext{Sysctls: test.sysctls}
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if _, err := os.Stat(filepath.Join(path, "job.slurm")); (err == nil) != (test.wantCode == http.StatusOK) {
+				t.Errorf("job.slurm exists = %v, want %v", err == nil, test.wantCode == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestSubmitBindTmpToScratch(t *testing.T) {
+	for _, bindTmp := range []bool{true, false} {
+		t.Run("BindTmpToScratch="+strconv.FormatBool(bindTmp), func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.BindTmpToScratch = bindTmp
+			// The container records the directory bound to its /tmp, if it exists while it runs.
+			config.SingularityPath = writeTestExecutable(t, t.TempDir(), "singularity", `for arg in "$@" ; do
+  case "${arg}" in
+    *:/tmp) test -d "${arg%:/tmp}" && echo "${arg%:/tmp}" > tmp-bind ;;
+  esac
+done`)
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			if got := strings.Contains(script, "runCtn app "+config.SingularityPath+" run --bind \"${podTmpDir}\":/tmp "); got != bindTmp {
+				t.Fatalf("/tmp bound to the node scratch = %v, want %v, script:\n%s", got, bindTmp, script)
+			}
+
+			scratch := t.TempDir()
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID=42", "SLURM_JOB_ID=42", "SLURM_TMPDIR="+scratch)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+			}
+			bound, err := os.ReadFile(filepath.Join(path, "tmp-bind"))
+			if !bindTmp {
+				if err == nil {
+					t.Errorf("container /tmp bound to %s, want no bind", bound)
+				}
+				return
+			}
+			if want := filepath.Join(scratch, "interlink-42"); strings.TrimSpace(string(bound)) != want {
+				t.Errorf("container /tmp bound to %q, %v, want %s", bound, err, want)
+			}
+			if _, err := os.Stat(filepath.Join(scratch, "interlink-42")); err == nil {
+				t.Errorf("node scratch of the job was not removed when the job ended")
+			}
+		})
+	}
+}
+
+func TestSubmitSharedEmptyDir(t *testing.T) {
+	config := testSubmitConfig(t)
+	// The init container writes to /out, and the app container checks it finds the file in /in.
+	config.SingularityPath = writeTestExecutable(t, t.TempDir(), "singularity", `for arg in "$@" ; do
+  case "${arg}" in
+    *:/out:rw) echo "prepared" > "${arg%:/out:rw}/handoff" ;;
+    *:/in:ro) cat "${arg%:/in:ro}/handoff" > handoff-seen ;;
+  esac
+done`)
+	setup := testContainer("setup", "1", "1Gi")
+	setup.VolumeMounts = []v1.VolumeMount{{Name: "data", MountPath: "/out"}}
+	app := testContainer("app", "1", "1Gi")
+	app.VolumeMounts = []v1.VolumeMount{{Name: "data", MountPath: "/in", ReadOnly: true}}
+	pod := testPod(app)
+	pod.Spec.InitContainers = []v1.Container{setup}
+	pod.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod, Containers: []commonIL.RetrievedContainer{{Name: "setup"}, {Name: "app"}}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	script := readJobScript(t, path)
+	volumeDir := filepath.Join(path, "emptyDirs", "data")
+	for _, bind := range []string{"--bind " + volumeDir + ":/out:rw", "--bind " + volumeDir + ":/in:ro"} {
+		if !strings.Contains(script, bind) {
+			t.Errorf("want %s, script:\n%s", bind, script)
+		}
+	}
+
+	cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(), "SLURM_JOBID=42", "SLURM_JOB_ID=42")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+	}
+	if seen, err := os.ReadFile(filepath.Join(path, "handoff-seen")); err != nil || string(seen) != "prepared\n" {
+		t.Errorf("app container found %q, %v in the emptyDir, want the file of the init container", seen, err)
+	}
+}
+
+func TestSubmitMemoryEmptyDir(t *testing.T) {
+	if info, err := os.Stat("/dev/shm"); err != nil || !info.IsDir() {
+		t.Skip("/dev/shm is not available")
+	}
+	tests := []struct {
+		name       string
+		shmTaken   bool
+		cancelled  bool
+		wantOnDisk bool
+	}{
+		{name: "tmpfs"},
+		{name: "fallback to disk", shmTaken: true, wantOnDisk: true},
+		{name: "cancelled job", cancelled: true},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jobID := strconv.Itoa(os.Getpid()) + strconv.Itoa(i)
+			shmDir := "/dev/shm/interlink-" + jobID
+			t.Cleanup(func() { os.RemoveAll(shmDir) })
+			if test.shmTaken {
+				// The job cannot create its directory on the tmpfs.
+				if err := os.WriteFile(shmDir, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := testSubmitConfig(t)
+			// The container records the directory bound to /cache, if it exists while it runs.
+			config.SingularityPath = writeTestExecutable(t, t.TempDir(), "singularity", `for arg in "$@" ; do
+  case "${arg}" in
+    *:/cache:rw) test -d "${arg%:/cache:rw}" && echo "${arg%:/cache:rw}" > cache-bind ;;
+  esac
+done
+test -z "${SLOW_CONTAINER}" || sleep 10`)
+			app := testContainer("app", "1", "1Gi")
+			app.VolumeMounts = []v1.VolumeMount{{Name: "cache", MountPath: "/cache"}}
+			pod := testPod(app)
+			pod.Spec.Volumes = []v1.Volume{{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{Medium: v1.StorageMediumMemory}}}}
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod, Containers: []commonIL.RetrievedContainer{{Name: "app"}}})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			if !strings.Contains(script, "--bind \"${memEmptyDirs}\"/cache:/cache:rw") || !strings.Contains(script, "addExitCleanup removeTmpScratch") {
+				t.Fatalf("memory emptyDir not bound from memEmptyDirs with a cleanup, script:\n%s", script)
+			}
+
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID="+jobID, "SLURM_JOB_ID="+jobID)
+			if test.cancelled {
+				cmd.Env = append(cmd.Env, "SLOW_CONTAINER=1")
+			}
+			output := &bytes.Buffer{}
+			cmd.Stdout, cmd.Stderr = output, output
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if test.cancelled {
+				waitTestFile(t, filepath.Join(path, "cache-bind"))
+				// SLURM sends TERM to all the processes of the job when it is cancelled.
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			}
+			if err := cmd.Wait(); err != nil && !test.cancelled {
+				t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+			}
+
+			bound, err := os.ReadFile(filepath.Join(path, "cache-bind"))
+			want := shmDir + "/cache"
+			if test.wantOnDisk {
+				want = filepath.Join(path, "emptyDirs", "cache")
+			}
+			if strings.TrimSpace(string(bound)) != want {
+				t.Errorf("container /cache bound to %q, %v, want %s, output:\n%s", bound, err, want, output)
+			}
+			if test.wantOnDisk {
+				if _, err := os.Stat(want); err != nil {
+					t.Errorf("memory emptyDir on disk removed before the working directory: %v", err)
+				}
+				return
+			}
+			if _, err := os.Stat(shmDir); !os.IsNotExist(err) {
+				t.Errorf("memory emptyDir of the job was not removed when the job ended: %v", err)
+			}
+		})
+	}
+}
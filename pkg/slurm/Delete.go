@@ -50,14 +50,22 @@ func (h *SidecarHandler) StopHandler(w http.ResponseWriter, r *http.Request) {
 
 	filesPath := h.Config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
 
-	err = deleteContainer(spanCtx, h.Config, string(pod.UID), h.JIDs, filesPath)
+	removeFiles := shouldRemoveWorkingDir(spanCtx, pod, filesPath)
+
+	// Only used for a job whose ID is not known, the known ones are cancelled as the user they were submitted as.
+	submitUser, err := parseSubmitUser(h.Config, *pod)
+	if err != nil {
+		log.G(spanCtx).Warning(err)
+	}
+
+	err = deleteContainer(spanCtx, h.Config, string(pod.UID), slurmJobName(h.Config, *pod), podClusterName(h.Config, *pod), submitUser, h.JIDs, filesPath, removeFiles)
 
 	if err != nil {
 		statusCode = http.StatusInternalServerError
 		h.handleError(spanCtx, w, statusCode, err)
 		return
 	}
-	if os.Getenv("SHARED_FS") != "true" {
+	if os.Getenv("SHARED_FS") != "true" && removeFiles {
 		err = os.RemoveAll(filesPath)
 		if err != nil {
 			statusCode = http.StatusInternalServerError
@@ -0,0 +1,91 @@
+package slurm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// testStop posts the pod to StopHandler, with its job tracked as JID 123, and returns the response.
+func testStop(t *testing.T, config SlurmConfig, pod v1.Pod) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	JIDs := map[string]*JidStruct{string(pod.UID): {PodUID: string(pod.UID), PodNamespace: pod.Namespace, JID: "123"}}
+	h := SidecarHandler{Config: config, JIDs: &JIDs, Ctx: context.Background()}
+	w := httptest.NewRecorder()
+	h.StopHandler(w, httptest.NewRequest(http.MethodPost, "/delete", bytes.NewReader(body)))
+	if _, tracked := JIDs[string(pod.UID)]; tracked {
+		t.Errorf("job of pod %s still tracked after StopHandler()", pod.UID)
+	}
+	return w
+}
+
+// testStopConfig returns a configuration cancelling the jobs with a stub scancel, with the working directories in a temporary directory.
+func testStopConfig(t *testing.T) SlurmConfig {
+	t.Helper()
+	config := testSLURMConfig()
+	config.DataRootFolder = t.TempDir() + "/"
+	config.Scancelpath = writeTestExecutable(t, t.TempDir(), "scancel", "exit 0")
+	return config
+}
+
+func TestStopCleanupPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		exitCode string
+		wantKept bool
+	}{
+		{policy: "", exitCode: "0"},
+		{policy: "always", exitCode: "1"},
+		{policy: "never", exitCode: "0", wantKept: true},
+		{policy: "on-success", exitCode: "0"},
+		{policy: "on-success", exitCode: "1", wantKept: true},
+	}
+	for _, test := range tests {
+		t.Run(test.policy+" exit "+test.exitCode, func(t *testing.T) {
+			config := testStopConfig(t)
+			pod := testPod(v1.Container{Name: "app"})
+			if test.policy != "" {
+				pod.Annotations["slurm-job.vk.io/cleanup-policy"] = test.policy
+			}
+			path := config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, path, "JobID.jid", "123")
+			writeTestFile(t, path, "run-app.out", "done\n")
+			writeTestFile(t, path, "run-app.status", test.exitCode+"\n")
+
+			w := testStop(t, config, pod)
+			if w.Code != http.StatusOK {
+				t.Fatalf("StopHandler() status = %d, want %d", w.Code, http.StatusOK)
+			}
+			_, err := os.Stat(path)
+			if kept := err == nil; kept != test.wantKept {
+				t.Fatalf("working directory kept = %v, want %v", kept, test.wantKept)
+			}
+			if !test.wantKept {
+				return
+			}
+			for _, name := range []string{"run-app.out", "run-app.status", "JobID.jid.deleted"} {
+				if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+					t.Errorf("%s of the kept working directory: %v", name, err)
+				}
+			}
+			// Otherwise LoadJIDs would track the deleted pod again.
+			if _, err := os.Stat(filepath.Join(path, "JobID.jid")); err == nil {
+				t.Errorf("JobID.jid still in the kept working directory")
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package slurm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	trace "go.opentelemetry.io/otel/trace"
+)
+
+// draining is true when new submissions are rejected, while the existing jobs keep being reported and can be cancelled.
+var draining atomic.Bool
+
+// DrainStatus is the body of the drain endpoint, both to read and to set the drain mode.
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+}
+
+// SetDraining enables or disables the drain mode. It is called at startup with the Drain config value.
+func SetDraining(enabled bool) {
+	draining.Store(enabled)
+}
+
+// DrainHandler returns the drain mode on GET, and sets it on POST with a {"draining": true|false} body.
+// While draining, SubmitHandler rejects new pods with 503, e.g. during a cluster maintenance.
+func (h *SidecarHandler) DrainHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now().UnixMicro()
+	tracer := otel.Tracer("interlink-API")
+	spanCtx, span := tracer.Start(h.Ctx, "Drain", trace.WithAttributes(
+		attribute.Int64("start.timestamp", start),
+	))
+	defer span.End()
+	defer commonIL.SetDurationSpan(start, span)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			h.handleError(spanCtx, w, http.StatusInternalServerError, err)
+			return
+		}
+		var status DrainStatus
+		err = json.Unmarshal(bodyBytes, &status)
+		if err != nil {
+			h.handleError(spanCtx, w, http.StatusBadRequest, err)
+			return
+		}
+		SetDraining(status.Draining)
+		span.SetAttributes(attribute.Bool("drain.enabled", status.Draining))
+		log.G(h.Ctx).Info("Slurm Sidecar: drain mode set to ", status.Draining)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseBytes, err := json.Marshal(DrainStatus{Draining: draining.Load()})
+	if err != nil {
+		h.handleError(spanCtx, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
@@ -0,0 +1,51 @@
+package slurm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+)
+
+// testDrain calls DrainHandler, with a body to set the drain mode on POST, and returns the reported drain mode.
+func testDrain(t *testing.T, method string, body string) bool {
+	t.Helper()
+	h := SidecarHandler{Config: testSLURMConfig(), Ctx: context.Background()}
+	w := httptest.NewRecorder()
+	h.DrainHandler(w, httptest.NewRequest(method, "/drain", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("DrainHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var status DrainStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	return status.Draining
+}
+
+func TestDrain(t *testing.T) {
+	t.Cleanup(func() { SetDraining(false) })
+	if !testDrain(t, http.MethodPost, `{"draining": true}`) || !testDrain(t, http.MethodGet, "") {
+		t.Fatalf("DrainHandler() does not report the drain mode set")
+	}
+
+	pod := testPod(testContainer("app", "1", "1Gi"))
+	w, _ := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: pod})
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "draining") {
+		t.Errorf("SubmitHandler() while draining = %d %q, want %d with draining", w.Code, w.Body, http.StatusServiceUnavailable)
+	}
+	if w := testStop(t, testStopConfig(t), pod); w.Code != http.StatusOK {
+		t.Errorf("StopHandler() while draining status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	if testDrain(t, http.MethodPost, `{"draining": false}`) {
+		t.Fatalf("DrainHandler() does not report the drain mode unset")
+	}
+	if w, _ := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: pod}); w.Code != http.StatusOK {
+		t.Errorf("SubmitHandler() after the drain status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
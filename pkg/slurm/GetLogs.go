@@ -10,6 +10,7 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -23,7 +24,20 @@ import (
 	trace "go.opentelemetry.io/otel/trace"
 )
 
+// waitOrDone sleeps for the duration, and returns false without waiting until the end if the request is cancelled, eg: on Ctrl+C of kubectl logs -f.
+func waitOrDone(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 // Logs in follow mode (get logs until the death of the container) with "kubectl -f".
+// Following stops when the container ends or when the client disconnects, then the output file is closed.
 func (h *SidecarHandler) GetLogsFollowMode(
 	spanCtx context.Context,
 	podUid string,
@@ -36,7 +50,7 @@ func (h *SidecarHandler) GetLogsFollowMode(
 	sessionContext string,
 ) error {
 	// Follow until this file exist, that indicates the end of container, thus the end of following.
-	containerStatusPath := path + "/run-" + req.ContainerName + ".status"
+	containerStatusPath := strings.TrimSuffix(containerOutputPath, filepath.Ext(containerOutputPath)) + ".status"
 	// Get the offset of what we read.
 	containerOutputLastOffset := len(containerOutput)
 	sessionContextMessage := GetSessionContextMessage(sessionContext)
@@ -60,7 +74,10 @@ func (h *SidecarHandler) GetLogsFollowMode(
 				} else {
 					log.G(h.Ctx).Error(sessionContextMessage, "wrote file not found but could not flush because server does not support Flusher.")
 				}
-				time.Sleep(4 * time.Second)
+				if !waitOrDone(r.Context(), 4*time.Second) {
+					log.G(h.Ctx).Info(sessionContextMessage, "Client disconnected, stopping to follow the container logs")
+					return nil
+				}
 				continue
 			} else {
 				// Case unknown error.
@@ -88,10 +105,13 @@ func (h *SidecarHandler) GetLogsFollowMode(
 
 	bufferBytes := make([]byte, 4096)
 
-	// Looping until we get end of job.
-	// TODO: handle the Ctrl+C of kubectl logs.
+	// Looping until we get end of job, or until the client disconnects.
 	var isContainerDead bool = false
 	for {
+		if r.Context().Err() != nil {
+			log.G(h.Ctx).Info(sessionContextMessage, "Client disconnected, stopping to follow the container logs")
+			break
+		}
 		n, errRead := containerOutputReader.Read(bufferBytes)
 		if errRead != nil && errRead != io.EOF {
 			// Error during read.
@@ -131,7 +151,7 @@ func (h *SidecarHandler) GetLogsFollowMode(
 					// The status file of the container does not exist, so the container is still alive. Continuing to follow logs.
 					// Sleep because otherwise it can be a stress to file system to always read it when it has nothing.
 					log.G(h.Ctx).Debug(sessionContextMessage, "EOF of container logs, sleeping 4s before retrying...")
-					time.Sleep(4 * time.Second)
+					waitOrDone(r.Context(), 4*time.Second)
 				} else {
 					// The status file exist, so the container is dead. Trying to get the latest log one last time.
 					// Because the moment we found the status file, there might be some more logs to read.
@@ -191,8 +211,36 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 		attribute.Bool("opts.timestamps", req.Opts.Timestamps),
 	)
 
+	// With SplitOutputStreams, ?stream=stdout or ?stream=stderr returns only this stream, otherwise both are returned.
+	outputSuffix := ".out"
+	jobOutputFiles := []string{"job.out", "job.err"}
+	switch stream := r.URL.Query().Get("stream"); stream {
+	case "":
+	case "stdout":
+		outputSuffix = ".stdout"
+		jobOutputFiles = []string{"job.out"}
+	case "stderr":
+		outputSuffix = ".stderr"
+		jobOutputFiles = []string{"job.err"}
+	default:
+		h.handleError(spanCtx, w, http.StatusBadRequest, errors.New("unknown log stream "+stream+", expected stdout or stderr"))
+		return
+	}
+
 	path := h.Config.DataRootFolder + req.Namespace + "-" + req.PodUID
-	containerOutputPath := path + "/run-" + req.ContainerName + ".out"
+	containerOutputPath := path + "/run-" + req.ContainerName + outputSuffix
+	// Ephemeral containers have no run- output, see launchEphemeralContainers.
+	ephemeralOutputPath := path + "/ephemeral-" + req.ContainerName + ".out"
+	// Init containers have no run- output either, their output is init-<name>.
+	initOutputPath := path + "/init-" + req.ContainerName + outputSuffix
+	if _, err := os.Stat(containerOutputPath); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(ephemeralOutputPath); err == nil {
+			containerOutputPath = ephemeralOutputPath
+		} else if _, err := os.Stat(initOutputPath); err == nil {
+			log.G(h.Ctx).Debug(sessionContextMessage, "no app container output, using the output of init container ", req.ContainerName)
+			containerOutputPath = initOutputPath
+		}
+	}
 	var output []byte
 	if req.Opts.Timestamps {
 		// h.logErrorVerbose(sessionContextMessage+"unsupported option req.Opts.Timestamps, ignoring it", spanCtx, w, err)
@@ -202,46 +250,40 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 	}
 	containerOutput, err := h.ReadLogs(containerOutputPath, span, spanCtx, w, sessionContextMessage)
 	if err != nil {
-		log.G(h.Ctx).Warning(sessionContextMessage, "cannot find any container with this name, falling back to init containers")
-		containerOutputPath := path + "/init-" + req.ContainerName + ".out"
-		containerOutput, err = h.ReadLogs(containerOutputPath, span, spanCtx, w, sessionContextMessage)
+		// Error already handled in ReadLogs
+		log.G(h.Ctx).Warning(sessionContextMessage, "cannot find any log for this container")
+		return
+	}
+	for _, jobOutputFile := range jobOutputFiles {
+		// job.err only exists with SplitOutputStreams, ReadLogs returns nothing for missing files.
+		jobOutput, err := h.ReadLogs(path+"/"+jobOutputFile, span, spanCtx, w, sessionContextMessage)
 		if err != nil {
 			// Error already handled in waitAndReadLogs
-			log.G(h.Ctx).Warning(sessionContextMessage, "cannot find any log for this container")
 			return
 		}
+		output = append(output, jobOutput...)
 	}
-	jobOutput, err := h.ReadLogs(path+"/"+"job.out", span, spanCtx, w, sessionContextMessage)
-	if err != nil {
-		// Error already handled in waitAndReadLogs
-		return
-	}
-
-	output = append(output, jobOutput...)
 	output = append(output, containerOutput...)
 
 	var returnedLogs string
 
 	if req.Opts.Tail != 0 {
-		var lastLines []string
-
-		splittedLines := strings.Split(string(output), "\n")
+		// The output ends with a newline, which does not start another line.
+		lastLines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
 
-		if req.Opts.Tail > len(splittedLines) {
-			lastLines = splittedLines
-		} else {
-			lastLines = splittedLines[len(splittedLines)-req.Opts.Tail-1:]
+		if req.Opts.Tail < len(lastLines) {
+			lastLines = lastLines[len(lastLines)-req.Opts.Tail:]
 		}
 
-		for _, line := range lastLines {
-			returnedLogs += line + "\n"
+		if len(output) > 0 {
+			returnedLogs = strings.Join(lastLines, "\n") + "\n"
 		}
 	} else if req.Opts.LimitBytes != 0 {
 		var lastBytes []byte
 		if req.Opts.LimitBytes > len(output) {
 			lastBytes = output
 		} else {
-			lastBytes = output[len(output)-req.Opts.LimitBytes-1:]
+			lastBytes = output[len(output)-req.Opts.LimitBytes:]
 		}
 
 		returnedLogs = string(lastBytes)
@@ -263,7 +305,7 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 				continue
 			}
 			if req.Opts.SinceSeconds != 0 {
-				if currentTime.Sub(timestamp).Seconds() > float64(req.Opts.SinceSeconds) {
+				if currentTime.Sub(timestamp).Seconds() <= float64(req.Opts.SinceSeconds) {
 					returnedLogs += Log + "\n"
 				}
 			} else {
@@ -272,6 +314,15 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 				}
 			}
 		}
+	} else if req.Opts.SinceSeconds != 0 || !req.Opts.SinceTime.IsZero() {
+		// Without timestamps, lines cannot be filtered: the logs are skipped only if nothing was written since then.
+		sinceTime := req.Opts.SinceTime
+		if req.Opts.SinceSeconds != 0 {
+			sinceTime = currentTime.Add(-time.Duration(req.Opts.SinceSeconds) * time.Second)
+		}
+		if info, err := os.Stat(containerOutputPath); err == nil && info.ModTime().Before(sinceTime) {
+			returnedLogs = ""
+		}
 	}
 
 	commonIL.SetDurationSpan(start, span, commonIL.WithHTTPReturnCode(http.StatusOK))
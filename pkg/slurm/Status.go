@@ -1,10 +1,12 @@
 package slurm
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"regexp"
@@ -76,45 +78,94 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if timeNow.Sub(timer) >= time.Second*10 {
+	if timeNow.Sub(timer) >= statusPollDelay {
 		cmd := []string{"--me"}
 		shell := exec.ExecTask{
 			Command: h.Config.Squeuepath,
 			Args:    cmd,
 			Shell:   true,
 		}
-		execReturn, _ := shell.Execute()
+		execReturn, _ := executeSlurmQuery(spanCtx, h.Config, shell)
 		execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
 
+		if isTransientSlurmError(execReturn.Stderr) && cachedStatus != nil {
+			// The controller does not answer: the last known status is kept, instead of failing the pods.
+			log.G(h.Ctx).Warning(sessionContextMessage, "squeue still failing after ", h.Config.SlurmQueryRetries, " retries, serving the last known status: ", execReturn.Stderr)
+			w.WriteHeader(statusCode)
+			bodyBytes, err := json.Marshal(h.withPodConditions(req, lastKnownStatuses(req)))
+			if err != nil {
+				h.handleError(spanCtx, w, http.StatusInternalServerError, err)
+				return
+			}
+			w.Write(bodyBytes)
+			return
+		}
+
 		if execReturn.Stderr != "" {
 			statusCode = http.StatusInternalServerError
 			h.handleError(spanCtx, w, statusCode, errors.New(sessionContextMessage+"unable to retrieve job status: "+execReturn.Stderr))
 			return
 		}
 
+		batchedStates, batchError := h.batchJobStates(spanCtx, req)
+
 		for _, pod := range req {
 			containerStatuses := []v1.ContainerStatus{}
 			uid := string(pod.UID)
 			path := h.Config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
 
-			if checkIfJidExists(spanCtx, (h.JIDs), uid) {
-				// Eg of output: "R 0"
-				// With test, exit_code is better than DerivedEC, because for canceled jobs, it gives 15 while DerivedEC gives 0.
-				// states=all or else some jobs are hidden, then it is impossible to get job exit code.
-				cmd := []string{"--noheader", "-a", "--states=all", "-O", "exit_code,StateCompact", "-j ", (*h.JIDs)[uid].JID}
-				shell := exec.ExecTask{
-					Command: h.Config.Squeuepath,
-					Args:    cmd,
-					// true to be able to add prefix to squeue, but this is ugly
-					Shell: true,
+			if jid, tracked := lookupJID(h.JIDs, uid); tracked {
+				var execReturn exec.ExecResult
+				if batchedStates != nil {
+					// A job missing from the batched output left squeue, as when squeue -j fails for it.
+					state, ok := batchedStates[jid.JID]
+					if ok {
+						execReturn.Stdout = state
+					} else {
+						execReturn.Stderr = "job " + jid.JID + " not found in squeue"
+					}
+				} else if isTransientSlurmError(batchError) {
+					// Already retried by batchJobStates, querying each job would only load the controller more.
+					execReturn.Stderr = batchError
+				} else {
+					// Eg of output: "R 0"
+					// With test, exit_code is better than DerivedEC, because for canceled jobs, it gives 15 while DerivedEC gives 0.
+					// states=all or else some jobs are hidden, then it is impossible to get job exit code.
+					cmd := []string{"--noheader", "-a", "--states=all", "-O", "exit_code,StateCompact", "-j ", jid.JID}
+					cmd = append(cmd, clusterFlags(jid.Cluster)...)
+					shell := exec.ExecTask{
+						Command: h.Config.Squeuepath,
+						Args:    cmd,
+						// true to be able to add prefix to squeue, but this is ugly
+						Shell: true,
+					}
+					execReturn, _ = executeSlurmQuery(spanCtx, h.Config, shell)
+					// With --clusters, squeue prints the cluster name before the job line, which would match the state pattern.
+					execReturn.Stdout = stripClusterHeader(execReturn.Stdout)
 				}
-				execReturn, _ := shell.Execute()
 				timeNow = time.Now()
 
 				// log.G(h.Ctx).Info("Pod: " + jid.PodUID + " | JID: " + jid.JID)
 
+				if isTransientSlurmError(execReturn.Stderr) {
+					if lastStatus, ok := lastKnownStatus(uid); ok {
+						log.G(h.Ctx).Warning(sessionContextMessage, "Serving the last known status of job ", jid.JID, ", squeue failed: ", execReturn.Stderr)
+						resp = append(resp, lastStatus)
+						continue
+					}
+				}
+
+				if execReturn.Stderr != "" && h.Config.Sacctpath != "" {
+					// The job left squeue: its final state comes from the accounting, see statusDuringAccountingLag.
+					lagStatuses, ok := h.statusDuringAccountingLag(spanCtx, path, pod, jid, timeNow, sessionContextMessage)
+					if ok {
+						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: lagStatuses})
+						continue
+					}
+				}
+
 				if execReturn.Stderr != "" {
-					span.AddEvent("squeue returned error " + execReturn.Stderr + " for Job " + (*h.JIDs)[uid].JID + ".\nGetting status from files")
+					span.AddEvent("squeue returned error " + execReturn.Stderr + " for Job " + jid.JID + ".\nGetting status from files")
 					log.G(h.Ctx).Error(sessionContextMessage, "ERR: ", execReturn.Stderr)
 					for _, ct := range pod.Spec.Containers {
 						log.G(h.Ctx).Info(sessionContextMessage, "getting exit status from  "+path+"/run-"+ct.Name+".status")
@@ -174,20 +225,20 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 					// Only keep the number part. Eg: exitCodeMatch = "123"
 					exitCodeMatch := exitCodeMatchSlice[1]
 
-					// log.G(h.Ctx).Info("JID: " + (*h.JIDs)[uid].JID + " | Status: " + stateMatch + " | Pod: " + pod.Name + " | UID: " + string(pod.UID))
-					log.G(h.Ctx).Infof("%sJID: %s | Status: %s | Job exit code (if applicable): %s | Pod: %s | UID: %s", sessionContextMessage, (*h.JIDs)[uid].JID, stateMatch, exitCodeMatch, pod.Name, string(pod.UID))
+					// log.G(h.Ctx).Info("JID: " + jid.JID + " | Status: " + stateMatch + " | Pod: " + pod.Name + " | UID: " + string(pod.UID))
+					log.G(h.Ctx).Infof("%sJID: %s | Status: %s | Job exit code (if applicable): %s | Pod: %s | UID: %s", sessionContextMessage, jid.JID, stateMatch, exitCodeMatch, pod.Name, string(pod.UID))
 
 					switch stateMatch {
 					case "CD":
-						if (*h.JIDs)[uid].EndTime.IsZero() {
-							(*h.JIDs)[uid].EndTime = timeNow
+						if jid.EndTime.IsZero() {
+							updateJID(func() { jid.EndTime = timeNow })
 							f, err := os.Create(path + "/FinishedAt.time")
 							if err != nil {
 								statusCode = http.StatusInternalServerError
 								h.handleError(spanCtx, w, statusCode, err)
 								return
 							}
-							f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+							f.WriteString(jid.EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
 						}
 						for _, ct := range pod.Spec.Containers {
 							exitCode, err := getExitCode(h.Ctx, path, ct.Name, exitCodeMatch, sessionContextMessage)
@@ -195,47 +246,37 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 								log.G(h.Ctx).Error(err)
 								continue
 							}
-							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}, ExitCode: int32(exitCode)}}, Ready: false}
+							containerStatus := h.terminatedContainerStatus(path, ct.Name, jid, exitCode)
 							containerStatuses = append(containerStatuses, containerStatus)
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
 					case "CG":
-						if (*h.JIDs)[uid].StartTime.IsZero() {
-							(*h.JIDs)[uid].StartTime = timeNow
+						if jid.StartTime.IsZero() {
+							updateJID(func() { jid.StartTime = timeNow })
 							f, err := os.Create(path + "/StartedAt.time")
 							if err != nil {
 								statusCode = http.StatusInternalServerError
 								h.handleError(spanCtx, w, statusCode, err)
 								return
 							}
-							f.WriteString((*h.JIDs)[uid].StartTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+							f.WriteString(jid.StartTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
 						}
 						for _, ct := range pod.Spec.Containers {
-							// Check probe status for container readiness
-							readinessCount, _, err := loadProbeMetadata(path, ct.Name)
-							isReady := true
-							if err != nil {
-								log.G(h.Ctx).Debug("Failed to load probe metadata for container ", ct.Name, ": ", err)
-							} else {
-								isReady = checkContainerReadiness(spanCtx, h.Config, path, ct.Name, readinessCount)
-							}
-
-							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}}}, Ready: isReady}
-							containerStatuses = append(containerStatuses, containerStatus)
+							containerStatuses = append(containerStatuses, h.runningJobContainerStatus(spanCtx, path, ct.Name, jid))
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
 					case "F":
 						// patch to fix Leonardo temporary F status after submit
 						_, err := os.Stat(path + "/FinishedAt.time")
-						if (*h.JIDs)[uid].EndTime.IsZero() && errors.Is(err, os.ErrNotExist) {
-							(*h.JIDs)[uid].EndTime = timeNow
+						if jid.EndTime.IsZero() && errors.Is(err, os.ErrNotExist) {
+							updateJID(func() { jid.EndTime = timeNow })
 							f, err := os.Create(path + "/FinishedAt.time")
 							if err != nil {
 								statusCode = http.StatusInternalServerError
 								h.handleError(spanCtx, w, statusCode, err)
 								return
 							}
-							f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+							f.WriteString(jid.EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
 						}
 						for _, ct := range pod.Spec.Containers {
 							exitCode, err := getExitCode(h.Ctx, path, ct.Name, exitCodeMatch, sessionContextMessage)
@@ -243,7 +284,7 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 								log.G(h.Ctx).Error(err)
 								continue
 							}
-							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}, ExitCode: exitCode}}, Ready: false}
+							containerStatus := h.terminatedContainerStatus(path, ct.Name, jid, exitCode)
 							containerStatuses = append(containerStatuses, containerStatus)
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
@@ -254,15 +295,15 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
 					case "PR":
-						if (*h.JIDs)[uid].EndTime.IsZero() {
-							(*h.JIDs)[uid].EndTime = timeNow
+						if jid.EndTime.IsZero() {
+							updateJID(func() { jid.EndTime = timeNow })
 							f, err := os.Create(path + "/FinishedAt.time")
 							if err != nil {
 								statusCode = http.StatusInternalServerError
 								h.handleError(spanCtx, w, statusCode, err)
 								return
 							}
-							f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+							f.WriteString(jid.EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
 						}
 						for _, ct := range pod.Spec.Containers {
 							exitCode, err := getExitCode(h.Ctx, path, ct.Name, exitCodeMatch, sessionContextMessage)
@@ -270,35 +311,29 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 								log.G(h.Ctx).Error(err)
 								continue
 							}
-							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}, ExitCode: exitCode}}, Ready: false}
+							containerStatus := h.terminatedContainerStatus(path, ct.Name, jid, exitCode)
 							containerStatuses = append(containerStatuses, containerStatus)
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
 					case "R":
-						if (*h.JIDs)[uid].StartTime.IsZero() {
-							(*h.JIDs)[uid].StartTime = timeNow
+						if jid.StartTime.IsZero() {
+							updateJID(func() { jid.StartTime = timeNow })
 							f, err := os.Create(path + "/StartedAt.time")
 							if err != nil {
 								statusCode = http.StatusInternalServerError
 								h.handleError(spanCtx, w, statusCode, err)
 								return
 							}
-							f.WriteString((*h.JIDs)[uid].StartTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+							f.WriteString(jid.StartTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
 						}
 						for _, ct := range pod.Spec.Containers {
-							// Check probe status for container readiness
-							readinessCount, _, err := loadProbeMetadata(path, ct.Name)
-							isReady := true
-							if err != nil {
-								log.G(h.Ctx).Debug("Failed to load probe metadata for container ", ct.Name, ": ", err)
-							} else {
-								isReady = checkContainerReadiness(spanCtx, h.Config, path, ct.Name, readinessCount)
-							}
-
-							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}}}, Ready: isReady}
-							containerStatuses = append(containerStatuses, containerStatus)
+							containerStatuses = append(containerStatuses, h.runningJobContainerStatus(spanCtx, path, ct.Name, jid))
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
+						if h.Config.EnableEphemeralContainers {
+							launchEphemeralContainers(spanCtx, h.Config, path, *pod, jid)
+						}
+						checkWorkdirSize(spanCtx, h.Config, path, jid)
 					case "S":
 						for _, ct := range pod.Spec.Containers {
 							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}, Ready: false}
@@ -306,15 +341,15 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
 					case "ST":
-						if (*h.JIDs)[uid].EndTime.IsZero() {
-							(*h.JIDs)[uid].EndTime = timeNow
+						if jid.EndTime.IsZero() {
+							updateJID(func() { jid.EndTime = timeNow })
 							f, err := os.Create(path + "/FinishedAt.time")
 							if err != nil {
 								statusCode = http.StatusInternalServerError
 								h.handleError(spanCtx, w, statusCode, err)
 								return
 							}
-							f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+							f.WriteString(jid.EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
 						}
 						for _, ct := range pod.Spec.Containers {
 							exitCode, err := getExitCode(h.Ctx, path, ct.Name, exitCodeMatch, sessionContextMessage)
@@ -322,20 +357,20 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 								log.G(h.Ctx).Error(err)
 								continue
 							}
-							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}, ExitCode: exitCode}}, Ready: false}
+							containerStatus := h.terminatedContainerStatus(path, ct.Name, jid, exitCode)
 							containerStatuses = append(containerStatuses, containerStatus)
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
 					default:
-						if (*h.JIDs)[uid].EndTime.IsZero() {
-							(*h.JIDs)[uid].EndTime = timeNow
+						if jid.EndTime.IsZero() {
+							updateJID(func() { jid.EndTime = timeNow })
 							f, err := os.Create(path + "/FinishedAt.time")
 							if err != nil {
 								statusCode = http.StatusInternalServerError
 								h.handleError(spanCtx, w, statusCode, err)
 								return
 							}
-							f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+							f.WriteString(jid.EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
 						}
 						for _, ct := range pod.Spec.Containers {
 							exitCode, err := getExitCode(h.Ctx, path, ct.Name, exitCodeMatch, sessionContextMessage)
@@ -343,11 +378,18 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 								log.G(h.Ctx).Error(err)
 								continue
 							}
-							containerStatus := v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}, ExitCode: exitCode}}, Ready: false}
+							containerStatus := h.terminatedContainerStatus(path, ct.Name, jid, exitCode)
 							containerStatuses = append(containerStatuses, containerStatus)
 						}
 						resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
 					}
+
+					if h.Config.CollectNodeFeatures && !jid.StartTime.IsZero() && !jid.NodeFeaturesCollected {
+						h.storeNodeFeatures(spanCtx, path, jid)
+					}
+					if h.Config.CollectAccounting && !jid.EndTime.IsZero() && !jid.AccountingCollected {
+						h.storeJobAccounting(spanCtx, path, jid)
+					}
 				}
 			} else {
 				for _, ct := range pod.Spec.Containers {
@@ -360,6 +402,7 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		cachedStatus = resp
 		timer = time.Now()
+		statusPollDelay = statusPollInterval(h.Config)
 	} else {
 		log.G(h.Ctx).Debug(sessionContextMessage, "Cached status")
 		resp = cachedStatus
@@ -371,7 +414,7 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	if statusCode != http.StatusOK {
 		w.Write([]byte("Some errors occurred deleting containers. Check SLURM Sidecar's logs"))
 	} else {
-		bodyBytes, err := json.Marshal(resp)
+		bodyBytes, err := json.Marshal(h.withPodConditions(req, resp))
 		if err != nil {
 			h.handleError(spanCtx, w, statusCode, err)
 			return
@@ -396,3 +439,255 @@ func (h *SidecarHandler) getSinfoSummary() (string, error) {
 
 	return execReturn.Stdout, nil
 }
+
+// runningJobContainerStatus builds the status of a container of a running job. A container that already exited, from its run-<container>.status
+// file, is terminated while the others keep running, so that a pod with a crashed container reports, eg: 2/3 containers ready.
+// The readiness of a running container comes from its probes, it is ready if it has none.
+func (h *SidecarHandler) runningJobContainerStatus(ctx context.Context, path string, containerName string, jid *JidStruct) v1.ContainerStatus {
+	if content, err := os.ReadFile(path + "/run-" + containerName + ".status"); err == nil {
+		exitCode, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err == nil {
+			containerStatus := h.terminatedContainerStatus(path, containerName, jid, int32(exitCode))
+			if info, err := os.Stat(path + "/run-" + containerName + ".status"); err == nil && jid.EndTime.IsZero() {
+				containerStatus.State.Terminated.FinishedAt = metav1.Time{Time: info.ModTime()}
+			}
+			return containerStatus
+		}
+		log.G(ctx).Warning("Unable to read the exit code of container ", containerName, ": ", err)
+	}
+
+	isReady := true
+	readinessCount, _, startupCount, err := loadProbeMetadata(path, containerName)
+	if err != nil {
+		log.G(ctx).Debug("Failed to load probe metadata for container ", containerName, ": ", err)
+	} else {
+		isReady = checkContainerReadiness(ctx, h.Config, path, containerName, readinessCount, startupCount)
+	}
+	return v1.ContainerStatus{Name: containerName, State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: jid.StartTime}}}, Ready: isReady, RestartCount: loadContainerRestartCount(path, containerName), LastTerminationState: loadContainerLastState(path, containerName)}
+}
+
+// terminatedContainerStatus builds the status of a container whose job reached a terminal state.
+// If the container failed and FailureLogTailLines is set, the last lines of its output are reported in the termination message,
+// so that users can see the actual error without fetching the logs.
+func (h *SidecarHandler) terminatedContainerStatus(path string, containerName string, jid *JidStruct, exitCode int32) v1.ContainerStatus {
+	terminated := &v1.ContainerStateTerminated{
+		StartedAt:  metav1.Time{Time: jid.StartTime},
+		FinishedAt: metav1.Time{Time: jid.EndTime},
+		ExitCode:   exitCode,
+	}
+	if exitCode != 0 {
+		terminated.Reason = "Error"
+		if h.Config.FailureLogTailLines > 0 {
+			terminated.Message = getContainerOutputTail(h.Ctx, path, containerName, h.Config.FailureLogTailLines)
+		}
+	}
+	if reason := loadWorkdirFullReason(path); reason != "" {
+		terminated.Reason = workdirFullReason
+		terminated.Message = reason
+	}
+	return v1.ContainerStatus{Name: containerName, State: v1.ContainerState{Terminated: terminated}, Ready: false, RestartCount: loadContainerRestartCount(path, containerName), LastTerminationState: loadContainerLastState(path, containerName)}
+}
+
+// getContainerOutputTail returns the last lines of the output file of a container (stderr is redirected in the same file).
+// Init containers output is used as fallback. Returns an empty string if no output is found.
+func getContainerOutputTail(ctx context.Context, path string, containerName string, lines int) string {
+	output, err := os.ReadFile(path + "/run-" + containerName + ".out")
+	if err != nil {
+		output, err = os.ReadFile(path + "/init-" + containerName + ".out")
+		if err != nil {
+			log.G(ctx).Debug("No output found for container ", containerName, " to build the failure message: ", err)
+			return ""
+		}
+	}
+
+	splittedLines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(splittedLines) > lines {
+		splittedLines = splittedLines[len(splittedLines)-lines:]
+	}
+	return strings.Join(splittedLines, "\n")
+}
+
+// storeJobAccounting collects the sacct accounting of a terminated job and stores it in the pod metadata.
+// Failures are only logged, since the accounting is not needed to report the status.
+func (h *SidecarHandler) storeJobAccounting(ctx context.Context, path string, jid *JidStruct) {
+	accounting, err := collectJobAccounting(ctx, h.Config, jid.JID, jid.Cluster)
+	if err != nil {
+		log.G(h.Ctx).Warning("Unable to collect accounting of job ", jid.JID, ": ", err)
+		return
+	}
+
+	podMetadata, err := readPodMetadata(path)
+	if err != nil {
+		log.G(h.Ctx).Debug("Unable to read pod metadata, creating a new one: ", err)
+		podMetadata = PodMetadata{PodUID: jid.PodUID, PodNamespace: jid.PodNamespace}
+	}
+	podMetadata.Accounting = accounting
+	err = writePodMetadata(path, podMetadata)
+	if err != nil {
+		log.G(h.Ctx).Warning("Unable to store accounting of job ", jid.JID, ": ", err)
+		return
+	}
+	updateJID(func() { jid.AccountingCollected = true })
+}
+
+// storeNodeFeatures stores the nodes of a started job and their features in the pod metadata, to know on which hardware the pod ran.
+func (h *SidecarHandler) storeNodeFeatures(ctx context.Context, path string, jid *JidStruct) {
+	nodeList, features, err := collectNodeFeatures(ctx, h.Config, jid.JID, jid.Cluster)
+	if err != nil {
+		log.G(h.Ctx).Warning("Unable to collect node features of job ", jid.JID, ": ", err)
+		return
+	}
+
+	podMetadata, err := readPodMetadata(path)
+	if err != nil {
+		log.G(h.Ctx).Debug("Unable to read pod metadata, creating a new one: ", err)
+		podMetadata = PodMetadata{PodUID: jid.PodUID, PodNamespace: jid.PodNamespace}
+	}
+	podMetadata.NodeList = nodeList
+	podMetadata.NodeFeatures = features
+	err = writePodMetadata(path, podMetadata)
+	if err != nil {
+		log.G(h.Ctx).Warning("Unable to store node features of job ", jid.JID, ": ", err)
+		return
+	}
+	updateJID(func() { jid.NodeFeaturesCollected = true })
+}
+
+// statusDuringAccountingLag computes the status of a job that is not in squeue anymore from the accounting, with the reason of the sacct state.
+// A finished job can leave squeue before landing in sacct: for AccountingLagGrace seconds, such a job is reported as Running instead of lost.
+// It returns false if the status must be computed from the container status files, either because they are all written or because the grace expired.
+// The terminal sacct state is kept in jid, since it does not change anymore.
+// Its reason is only reported for the containers without a status file, the other ones report their own exit.
+func (h *SidecarHandler) statusDuringAccountingLag(ctx context.Context, path string, pod *v1.Pod, jid *JidStruct, timeNow time.Time, sessionContextMessage string) ([]v1.ContainerStatus, bool) {
+	var containerStatuses []v1.ContainerStatus
+
+	state, exitCode := jid.FinalState, jid.FinalExitCode
+	if state == "" {
+		var err error
+		state, exitCode, err = getSacctJobState(ctx, h.Config, jid.JID, jid.Cluster)
+		if err != nil {
+			log.G(h.Ctx).Warning(sessionContextMessage, "Unable to get job ", jid.JID, " state from sacct: ", err)
+		}
+	}
+	if state != "" && state != "PENDING" && state != "RUNNING" && state != "REQUEUED" && state != "SUSPENDED" {
+		updateJID(func() {
+			jid.MissingSince = time.Time{}
+			jid.FinalState = state
+			jid.FinalExitCode = exitCode
+		})
+		if jid.EndTime.IsZero() {
+			updateJID(func() { jid.EndTime = timeNow })
+			err := os.WriteFile(path+"/FinishedAt.time", []byte(jid.EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST")), 0644)
+			if err != nil {
+				log.G(h.Ctx).Warning(sessionContextMessage, "Unable to write FinishedAt.time: ", err)
+			}
+		}
+		if h.Config.CollectAccounting && !jid.AccountingCollected {
+			h.storeJobAccounting(ctx, path, jid)
+		}
+		for _, ct := range pod.Spec.Containers {
+			containerExitCode, err := getExitCode(h.Ctx, path, ct.Name, exitCode, sessionContextMessage)
+			if err != nil {
+				log.G(h.Ctx).Error(err)
+				continue
+			}
+			containerStatus := h.terminatedContainerStatus(path, ct.Name, jid, containerExitCode)
+			_, statusErr := os.Stat(path + "/run-" + ct.Name + ".status")
+			if os.IsNotExist(statusErr) && containerStatus.State.Terminated.Reason != workdirFullReason && (containerExitCode != 0 || state == "COMPLETED") {
+				containerStatus.State.Terminated.Reason = sacctStateReason(state)
+			}
+			containerStatuses = append(containerStatuses, containerStatus)
+		}
+		return containerStatuses, true
+	}
+
+	allStatusFilesWritten := true
+	for _, ct := range pod.Spec.Containers {
+		if _, err := os.Stat(path + "/run-" + ct.Name + ".status"); err != nil {
+			allStatusFilesWritten = false
+		}
+	}
+	if allStatusFilesWritten {
+		return nil, false
+	}
+
+	if jid.MissingSince.IsZero() {
+		updateJID(func() { jid.MissingSince = timeNow })
+	}
+	if h.Config.AccountingLagGrace <= 0 {
+		return nil, false
+	}
+	if timeNow.Sub(jid.MissingSince) >= time.Duration(h.Config.AccountingLagGrace)*time.Second {
+		log.G(h.Ctx).Warning(sessionContextMessage, "Job ", jid.JID, " not found in squeue nor in sacct after ", h.Config.AccountingLagGrace, "s")
+		return nil, false
+	}
+
+	log.G(ctx).Info(sessionContextMessage, "Job ", jid.JID, " not found in squeue nor in sacct yet, reporting it as running")
+	for _, ct := range pod.Spec.Containers {
+		containerStatuses = append(containerStatuses, v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: jid.StartTime}}}, Ready: true})
+	}
+	return containerStatuses, true
+}
+
+// statusPollInterval returns StatusPollInterval extended by a random part of up to StatusPollJitter of it,
+// so that sidecars sharing a SLURM controller do not all query squeue at the same time.
+func statusPollInterval(config SlurmConfig) time.Duration {
+	interval := time.Duration(config.StatusPollInterval) * time.Second
+	if config.StatusPollJitter <= 0 || interval <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Float64()*config.StatusPollJitter*float64(interval))
+}
+
+// squeueBatchSize is the maximum number of jobs of each squeue call of batchJobStates, to bound the length of the command line.
+const squeueBatchSize = 500
+
+// batchJobStates queries the state of the jobs of the pods with one squeue call per cluster and per squeueBatchSize jobs, instead of one call per job.
+// It returns the "exit_code StateCompact" output of each JID, as printed by the per job query. Jobs missing from the output are not in squeue anymore.
+// It returns nil and the error if a call fails, eg: when none of the jobs is known to squeue, then the jobs are queried one by one.
+func (h *SidecarHandler) batchJobStates(ctx context.Context, pods []*v1.Pod) (map[string]string, string) {
+	var clusters []string
+	jidsByCluster := map[string][]string{}
+	for _, pod := range pods {
+		jid, ok := lookupJID(h.JIDs, string(pod.UID))
+		if !ok {
+			continue
+		}
+		if _, ok := jidsByCluster[jid.Cluster]; !ok {
+			clusters = append(clusters, jid.Cluster)
+		}
+		jidsByCluster[jid.Cluster] = append(jidsByCluster[jid.Cluster], jid.JID)
+	}
+
+	states := map[string]string{}
+	for _, cluster := range clusters {
+		jids := jidsByCluster[cluster]
+		for start := 0; start < len(jids); start += squeueBatchSize {
+			end := min(start+squeueBatchSize, len(jids))
+			cmd := []string{"--noheader", "-a", "--states=all", "-O", "JobID,exit_code,StateCompact", "--jobs=" + strings.Join(jids[start:end], ",")}
+			cmd = append(cmd, clusterFlags(cluster)...)
+			shell := exec.ExecTask{
+				Command: h.Config.Squeuepath,
+				Args:    cmd,
+				Shell:   true,
+			}
+			execReturn, _ := executeSlurmQuery(ctx, h.Config, shell)
+			if execReturn.Stderr != "" {
+				log.G(ctx).Warning("Unable to query the state of ", end-start, " jobs with one squeue call: ", execReturn.Stderr)
+				return nil, execReturn.Stderr
+			}
+			for _, line := range strings.Split(stripClusterHeader(execReturn.Stdout), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) < 3 {
+					continue
+				}
+				// The components of a heterogeneous job are listed as <jid>+<component>, the first one gives the state of the job.
+				jid, _, _ := strings.Cut(fields[0], "+")
+				if _, ok := states[jid]; !ok {
+					states[jid] = fields[1] + " " + fields[2] + " "
+				}
+			}
+		}
+	}
+	return states, ""
+}
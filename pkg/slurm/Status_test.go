@@ -0,0 +1,291 @@
+package slurm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	exec "github.com/alexellis/go-execute/pkg/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// writeTestFile writes a file of the working directory, eg: a container status or output.
+func writeTestFile(t *testing.T, path string, name string, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(path, name), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTerminatedContainerStatusOutputTail(t *testing.T) {
+	tests := []struct {
+		name        string
+		exitCode    int32
+		tailLines   int
+		wantReason  string
+		wantMessage string
+	}{
+		{name: "failed", exitCode: 1, tailLines: 2, wantReason: "Error", wantMessage: "line 4\nerror: out of cheese"},
+		{name: "failed with more lines than the output", exitCode: 1, tailLines: 10, wantReason: "Error", wantMessage: "line 1\nline 2\nline 3\nline 4\nerror: out of cheese"},
+		{name: "failed without tail", exitCode: 1, tailLines: 0, wantReason: "Error"},
+		{name: "succeeded", exitCode: 0, tailLines: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir()
+			writeTestFile(t, path, "run-app.out", "line 1\nline 2\nline 3\nline 4\nerror: out of cheese\n")
+			config := testSLURMConfig()
+			config.FailureLogTailLines = test.tailLines
+			h := SidecarHandler{Config: config, Ctx: context.Background()}
+
+			status := h.terminatedContainerStatus(path, "app", &JidStruct{JID: "123"}, test.exitCode)
+			terminated := status.State.Terminated
+			if terminated == nil {
+				t.Fatalf("terminatedContainerStatus() state = %+v, want terminated", status.State)
+			}
+			if terminated.ExitCode != test.exitCode || terminated.Reason != test.wantReason || terminated.Message != test.wantMessage {
+				t.Errorf("terminatedContainerStatus() = %d, %q, %q, want %d, %q, %q", terminated.ExitCode, terminated.Reason, terminated.Message, test.exitCode, test.wantReason, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestGetContainerOutputTailInitContainer(t *testing.T) {
+	path := t.TempDir()
+	writeTestFile(t, path, "init-setup.out", "fetching\nfailed to fetch\n")
+	if got := getContainerOutputTail(context.Background(), path, "setup", 1); got != "failed to fetch" {
+		t.Errorf("getContainerOutputTail() = %q, want %q", got, "failed to fetch")
+	}
+	if got := getContainerOutputTail(context.Background(), path, "missing", 1); got != "" {
+		t.Errorf("getContainerOutputTail() = %q without output, want empty", got)
+	}
+}
+
+func TestRunningJobContainerStatus(t *testing.T) {
+	path := t.TempDir()
+	writeTestFile(t, path, "run-worker.status", "1\n")
+	h := SidecarHandler{Config: testSLURMConfig(), Ctx: context.Background()}
+	jid := &JidStruct{JID: "42", StartTime: time.Now().Add(-time.Minute)}
+
+	ready := 0
+	for _, name := range []string{"web", "worker", "sidecar"} {
+		status := h.runningJobContainerStatus(context.Background(), path, name, jid)
+		if status.Ready {
+			ready++
+		}
+		if name == "worker" {
+			terminated := status.State.Terminated
+			if terminated == nil || terminated.ExitCode != 1 || terminated.Reason != "Error" || status.Ready {
+				t.Errorf("runningJobContainerStatus(%s) = %+v, ready %v, want terminated with exit code 1 and not ready", name, status.State, status.Ready)
+			}
+			continue
+		}
+		if status.State.Running == nil || !status.Ready {
+			t.Errorf("runningJobContainerStatus(%s) = %+v, ready %v, want running and ready", name, status.State, status.Ready)
+		}
+	}
+	if ready != 2 {
+		t.Errorf("%d/3 containers ready, want 2/3", ready)
+	}
+}
+
+func TestStatusDuringAccountingLag(t *testing.T) {
+	stubs := t.TempDir()
+	sacctOutput := filepath.Join(stubs, "sacct.out")
+	writeTestFile(t, stubs, "sacct.out", "")
+	config := testSLURMConfig()
+	config.Sacctpath = writeTestExecutable(t, stubs, "sacct", "cat "+sacctOutput)
+	config.AccountingLagGrace = 30
+	h := SidecarHandler{Config: config, Ctx: context.Background()}
+	pod := testPod(v1.Container{Name: "app"})
+	startTime := time.Now().Add(-time.Hour)
+	jid := &JidStruct{JID: "42", StartTime: startTime}
+	path := t.TempDir()
+
+	// The job left squeue but is not in the accounting yet.
+	for _, elapsed := range []time.Duration{0, 10 * time.Second} {
+		statuses, ok := h.statusDuringAccountingLag(context.Background(), path, &pod, jid, startTime.Add(time.Hour+elapsed), "")
+		if !ok || len(statuses) != 1 || statuses[0].State.Running == nil {
+			t.Fatalf("statusDuringAccountingLag() after %v = %+v, %v, want the container running", elapsed, statuses, ok)
+		}
+	}
+
+	writeTestFile(t, stubs, "sacct.out", "COMPLETED|0:0\n")
+	statuses, ok := h.statusDuringAccountingLag(context.Background(), path, &pod, jid, startTime.Add(time.Hour+20*time.Second), "")
+	if !ok || len(statuses) != 1 || statuses[0].State.Terminated == nil {
+		t.Fatalf("statusDuringAccountingLag() = %+v, %v, want the container terminated", statuses, ok)
+	}
+	if terminated := statuses[0].State.Terminated; terminated.ExitCode != 0 || terminated.Reason != "Completed" {
+		t.Errorf("terminated state = %+v, want exit code 0 and reason Completed", terminated)
+	}
+	if jid.FinalState != "COMPLETED" || !jid.MissingSince.IsZero() {
+		t.Errorf("FinalState = %q, MissingSince = %v, want COMPLETED and reset", jid.FinalState, jid.MissingSince)
+	}
+}
+
+func TestStatusDuringAccountingLagGraceExpired(t *testing.T) {
+	config := testSLURMConfig()
+	config.Sacctpath = writeTestExecutable(t, t.TempDir(), "sacct", "true")
+	config.AccountingLagGrace = 30
+	h := SidecarHandler{Config: config, Ctx: context.Background()}
+	pod := testPod(v1.Container{Name: "app"})
+	now := time.Now()
+	jid := &JidStruct{JID: "42", StartTime: now.Add(-time.Hour), MissingSince: now.Add(-time.Minute)}
+
+	if statuses, ok := h.statusDuringAccountingLag(context.Background(), t.TempDir(), &pod, jid, now, ""); ok {
+		t.Errorf("statusDuringAccountingLag() = %+v, want the status computed from the files after the grace", statuses)
+	}
+}
+
+func TestStatusPollInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval int
+		jitter   float64
+		wantMin  time.Duration
+		wantMax  time.Duration
+	}{
+		{name: "no interval", jitter: 0.5},
+		{name: "no jitter", interval: 5, wantMin: 5 * time.Second, wantMax: 5 * time.Second},
+		{name: "jitter", interval: 10, jitter: 0.2, wantMin: 10 * time.Second, wantMax: 12 * time.Second},
+		{name: "full jitter", interval: 1, jitter: 1, wantMin: time.Second, wantMax: 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := SlurmConfig{StatusPollInterval: test.interval, StatusPollJitter: test.jitter}
+			varies := false
+			first := statusPollInterval(config)
+			for i := 0; i < 100; i++ {
+				got := statusPollInterval(config)
+				if got < test.wantMin || got > test.wantMax {
+					t.Fatalf("statusPollInterval() = %v, want between %v and %v", got, test.wantMin, test.wantMax)
+				}
+				varies = varies || got != first
+			}
+			if wantVaries := test.wantMin != test.wantMax; varies != wantVaries {
+				t.Errorf("statusPollInterval() varies = %v, want %v", varies, wantVaries)
+			}
+		})
+	}
+}
+
+func TestWaitOrDone(t *testing.T) {
+	interval := statusPollInterval(SlurmConfig{StatusPollInterval: 1, StatusPollJitter: 0.5})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if waitOrDone(ctx, interval) {
+		t.Errorf("waitOrDone() = true, want false once the context is cancelled")
+	}
+	if elapsed := time.Since(start); elapsed >= interval {
+		t.Errorf("waitOrDone() returned after %v, want before the interval %v", elapsed, interval)
+	}
+	if !waitOrDone(context.Background(), 10*time.Millisecond) {
+		t.Errorf("waitOrDone() = false, want true after the interval")
+	}
+}
+
+// testSqueue returns a stub of squeue printing the state of the jobs of --jobs or -j, writing one line to calls per call.
+// Job 7 left squeue, and job 9 is a heterogeneous job listed with its two components.
+func testSqueue(t testing.TB, calls string) string {
+	return writeTestExecutable(t, t.TempDir(), "squeue", `echo "$@" >> `+calls+`
+jobs=""
+previous=""
+for arg in "$@" ; do
+  case "${arg}" in
+    --jobs=*) jobs="${arg#--jobs=}" ;;
+  esac
+  test "${previous}" = "-j" && jobs="${arg}"
+  previous="${arg}"
+done
+IFS=,
+for job in ${jobs} ; do
+  case "${job}" in
+    7) ;;
+    9) echo "9+0 0 R" ; echo "9+1 0 CG" ;;
+    *) echo "${job} 0 R" ;;
+  esac
+done`)
+}
+
+// testTrackedPods returns count pods tracked with the jobs 1 to count.
+func testTrackedPods(count int) ([]*v1.Pod, map[string]*JidStruct) {
+	pods := []*v1.Pod{}
+	JIDs := map[string]*JidStruct{}
+	for i := 1; i <= count; i++ {
+		pod := testPod(v1.Container{Name: "app"})
+		pod.UID = types.UID("uid-" + strconv.Itoa(i))
+		pods = append(pods, &pod)
+		JIDs[string(pod.UID)] = &JidStruct{JID: strconv.Itoa(i), PodUID: string(pod.UID), PodNamespace: pod.Namespace}
+	}
+	return pods, JIDs
+}
+
+func TestBatchJobStates(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	config := testSLURMConfig()
+	config.Squeuepath = testSqueue(t, calls)
+	pods, JIDs := testTrackedPods(squeueBatchSize + 1)
+	h := SidecarHandler{Config: config, JIDs: &JIDs, Ctx: context.Background()}
+
+	states, stderr := h.batchJobStates(context.Background(), pods)
+	if stderr != "" {
+		t.Fatalf("batchJobStates() error = %s", stderr)
+	}
+	if len(states) != len(pods)-1 {
+		t.Errorf("batchJobStates() has %d states, want %d", len(states), len(pods)-1)
+	}
+	if _, ok := states["7"]; ok {
+		t.Errorf("batchJobStates() has a state for job 7, which left squeue")
+	}
+	for jid, want := range map[string]string{"1": "0 R ", "9": "0 R ", "501": "0 R "} {
+		if states[jid] != want {
+			t.Errorf("state of job %s = %q, want %q", jid, states[jid], want)
+		}
+	}
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(string(content), "\n"); count != 2 {
+		t.Errorf("squeue called %d times, want once per %d jobs", count, squeueBatchSize)
+	}
+
+	config.Squeuepath = writeTestExecutable(t, t.TempDir(), "squeue", `echo "slurm_load_jobs error: Invalid job id specified" >&2`)
+	h.Config = config
+	if states, stderr := h.batchJobStates(context.Background(), pods); states != nil || stderr == "" {
+		t.Errorf("batchJobStates() = %v, %q, want the squeue error", states, stderr)
+	}
+}
+
+func BenchmarkJobStates(b *testing.B) {
+	config := testSLURMConfig()
+	config.Squeuepath = testSqueue(b, os.DevNull)
+	pods, JIDs := testTrackedPods(500)
+	h := SidecarHandler{Config: config, JIDs: &JIDs, Ctx: context.Background()}
+
+	b.Run("per job", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, pod := range pods {
+				jid, _ := lookupJID(h.JIDs, string(pod.UID))
+				shell := exec.ExecTask{
+					Command: config.Squeuepath,
+					Args:    []string{"--noheader", "-a", "--states=all", "-O", "exit_code,StateCompact", "-j ", jid.JID},
+					Shell:   true,
+				}
+				executeSlurmQuery(context.Background(), config, shell)
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.batchJobStates(context.Background(), pods)
+		}
+	})
+}
@@ -19,6 +19,7 @@ type SystemInfoResponse struct {
 	Status         string `json:"status"`
 	Timestamp      string `json:"timestamp"`
 	SlurmConnected bool   `json:"slurm_connected"`
+	Draining       bool   `json:"draining"`
 	SinfoOutput    string `json:"sinfo_output,omitempty"`
 	Error          string `json:"error,omitempty"`
 }
@@ -39,6 +40,7 @@ func (h *SidecarHandler) SystemInfoHandler(w http.ResponseWriter, r *http.Reques
 	response := SystemInfoResponse{
 		Status:    "ok",
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Draining:  draining.Load(),
 	}
 
 	// Test SLURM connectivity using sinfo -s command
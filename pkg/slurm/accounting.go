@@ -0,0 +1,297 @@
+package slurm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	exec "github.com/alexellis/go-execute/pkg/v1"
+	"github.com/containerd/containerd/log"
+
+	"go.opentelemetry.io/otel/attribute"
+	trace "go.opentelemetry.io/otel/trace"
+)
+
+// JobAccounting holds the resources allocated to a terminated job, expressed in resource-seconds for cost attribution, and the resources it actually used.
+type JobAccounting struct {
+	AllocTRES       string `json:"AllocTRES"`
+	ElapsedSeconds  int64  `json:"ElapsedSeconds"`
+	CPUSeconds      int64  `json:"CPUSeconds"`
+	MemoryMBSeconds int64  `json:"MemoryMBSeconds"`
+	GPUSeconds      int64  `json:"GPUSeconds"`
+	// Usage of the job, to right-size the requests. They are 0 if the accounting does not provide them.
+	MaxRSSBytes     int64 `json:"MaxRSSBytes"`
+	AveCPUSeconds   int64 `json:"AveCPUSeconds"`
+	TotalCPUSeconds int64 `json:"TotalCPUSeconds"`
+}
+
+// collectJobAccounting runs sacct for the provided job and parses the allocated TRES, the elapsed time and the usage of the job steps.
+func collectJobAccounting(ctx context.Context, config SlurmConfig, jid string, cluster string) (*JobAccounting, error) {
+	shell := exec.ExecTask{
+		Command: config.Sacctpath,
+		Args:    append([]string{"-j", jid, "--noheader", "--parsable2", "--format=JobID,AllocTRES,Elapsed,MaxRSS,AveCPU,TotalCPU"}, clusterFlags(cluster)...),
+		Shell:   true,
+	}
+
+	execReturn, err := executeSlurmQuery(ctx, config, shell)
+	if err != nil {
+		return nil, err
+	}
+	if execReturn.Stderr != "" {
+		return nil, errors.New("could not run sacct: " + execReturn.Stderr)
+	}
+
+	accounting, err := parseJobAccounting(execReturn.Stdout)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse sacct output for job %s: %w", jid, err)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("Collected accounting for SLURM Job "+jid, trace.WithAttributes(
+		attribute.String("accounting.alloctres", accounting.AllocTRES),
+		attribute.Int64("accounting.elapsed", accounting.ElapsedSeconds),
+		attribute.Int64("accounting.cpuseconds", accounting.CPUSeconds),
+		attribute.Int64("accounting.memorymbseconds", accounting.MemoryMBSeconds),
+		attribute.Int64("accounting.gpuseconds", accounting.GPUSeconds),
+		attribute.Int64("accounting.maxrss", accounting.MaxRSSBytes),
+		attribute.Int64("accounting.avecpu", accounting.AveCPUSeconds),
+		attribute.Int64("accounting.totalcpu", accounting.TotalCPUSeconds),
+	))
+	log.G(ctx).Debug("Accounting of job ", jid, ": ", *accounting)
+
+	return accounting, nil
+}
+
+// getSacctJobState returns the state (eg: COMPLETED, FAILED) and the exit code of the job from the accounting.
+// The state is empty if the job is not in the accounting yet.
+func getSacctJobState(ctx context.Context, config SlurmConfig, jid string, cluster string) (string, string, error) {
+	shell := exec.ExecTask{
+		Command: config.Sacctpath,
+		Args:    append([]string{"-j", jid, "-X", "--noheader", "--parsable2", "--format=State,ExitCode"}, clusterFlags(cluster)...),
+		Shell:   true,
+	}
+
+	execReturn, err := executeSlurmQuery(ctx, config, shell)
+	if err != nil {
+		return "", "", err
+	}
+	if execReturn.Stderr != "" {
+		return "", "", errors.New("could not run sacct: " + execReturn.Stderr)
+	}
+	return parseSacctJobState(execReturn.Stdout)
+}
+
+// parseSacctJobState parses a "State|ExitCode" line of sacct --parsable2, eg: "FAILED|2:0" gives FAILED and 2.
+// For jobs killed by a signal, the exit code is 128 + the signal as in a shell, eg: "CANCELLED by 1000|0:15" gives CANCELLED and 143.
+func parseSacctJobState(output string) (string, string, error) {
+	line := strings.TrimSpace(strings.Split(strings.TrimSpace(output), "\n")[0])
+	if line == "" {
+		return "", "", nil
+	}
+	fields := strings.Split(line, "|")
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected sacct output %q", output)
+	}
+	state := strings.Fields(fields[0])
+	if len(state) == 0 {
+		return "", "", nil
+	}
+	exitCode, signal, _ := strings.Cut(fields[1], ":")
+	if signalNumber, err := strconv.Atoi(signal); err == nil && signalNumber > 0 && signalNumber < 65 && exitCode == "0" {
+		exitCode = strconv.Itoa(128 + signalNumber)
+	} else if state[0] == "OUT_OF_MEMORY" && exitCode == "0" {
+		// The OOM killer sends SIGKILL, which sacct does not report.
+		exitCode = "137"
+	}
+	return state[0], exitCode, nil
+}
+
+// sacctStateReason returns the reason of the terminated state of the containers of a job in this sacct state.
+func sacctStateReason(state string) string {
+	switch state {
+	case "COMPLETED":
+		return "Completed"
+	case "OUT_OF_MEMORY":
+		return "OOMKilled"
+	case "TIMEOUT", "DEADLINE":
+		return "DeadlineExceeded"
+	case "CANCELLED":
+		return "Cancelled"
+	case "PREEMPTED":
+		return "Preempted"
+	case "NODE_FAIL":
+		return "NodeFailure"
+	}
+	return "Error"
+}
+
+// parseJobAccounting parses the "JobID|AllocTRES|Elapsed|MaxRSS|AveCPU|TotalCPU" lines of sacct --parsable2, eg:
+//
+//	42|billing=4,cpu=4,gres/gpu=1,mem=4G,node=1|00:10:00|||00:35:12
+//	42.batch|cpu=4,mem=4G,node=1|00:10:00|2316K|00:35:10|00:35:10
+//
+// The allocation and the total CPU time come from the job line, MaxRSS and AveCPU are the highest among the job steps.
+func parseJobAccounting(output string) (*JobAccounting, error) {
+	var accounting *JobAccounting
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("unexpected sacct output %q", line)
+		}
+
+		if !strings.Contains(fields[0], ".") {
+			jobAccounting, err := parseJobAllocation(fields[1], fields[2])
+			if err != nil {
+				return nil, err
+			}
+			// TotalCPU is missing if the accounting is not enabled on the cluster, it is not an error.
+			jobAccounting.TotalCPUSeconds, _ = parseSlurmDuration(fields[5])
+			accounting = jobAccounting
+			continue
+		}
+
+		// Step usage is optional too, unparsable values are ignored.
+		if maxRSS, err := parseMem(fields[3]); err == nil && accounting != nil && maxRSS > accounting.MaxRSSBytes {
+			accounting.MaxRSSBytes = maxRSS
+		}
+		if aveCPU, err := parseSlurmDuration(fields[4]); err == nil && accounting != nil && aveCPU > accounting.AveCPUSeconds {
+			accounting.AveCPUSeconds = aveCPU
+		}
+	}
+
+	if accounting == nil {
+		return nil, fmt.Errorf("no job line in sacct output %q", output)
+	}
+	return accounting, nil
+}
+
+// parseJobAllocation computes the resource-seconds of an allocation from its AllocTRES (eg: "billing=4,cpu=4,gres/gpu=1,mem=4G,node=1") and Elapsed fields.
+func parseJobAllocation(allocTRES string, elapsedField string) (*JobAccounting, error) {
+	elapsed, err := parseSlurmDuration(elapsedField)
+	if err != nil {
+		return nil, err
+	}
+
+	accounting := &JobAccounting{AllocTRES: allocTRES, ElapsedSeconds: elapsed}
+	for _, tres := range strings.Split(allocTRES, ",") {
+		keyValue := strings.SplitN(tres, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch keyValue[0] {
+		case "cpu":
+			cpu, err := strconv.ParseInt(keyValue[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cpu TRES %q: %w", keyValue[1], err)
+			}
+			accounting.CPUSeconds = cpu * elapsed
+		case "mem":
+			mem, err := parseMem(keyValue[1])
+			if err != nil {
+				return nil, err
+			}
+			accounting.MemoryMBSeconds = mem / 1024 / 1024 * elapsed
+		case "gres/gpu":
+			// Typed GPUs are reported both as gres/gpu and gres/gpu:type, only the untyped total is counted.
+			gpu, err := strconv.ParseInt(keyValue[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gpu TRES %q: %w", keyValue[1], err)
+			}
+			accounting.GPUSeconds = gpu * elapsed
+		}
+	}
+
+	return accounting, nil
+}
+
+// parseSlurmDuration parses a SLURM duration ([DD-][HH:]MM:SS, optionally with fractional seconds) into seconds.
+func parseSlurmDuration(duration string) (int64, error) {
+	duration = strings.TrimSpace(duration)
+	if duration == "" {
+		return 0, errors.New("empty duration")
+	}
+	days := int64(0)
+	if dayParts := strings.SplitN(duration, "-", 2); len(dayParts) == 2 {
+		parsedDays, err := strconv.ParseInt(dayParts[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", duration, err)
+		}
+		days = parsedDays
+		duration = dayParts[1]
+	}
+
+	seconds := int64(0)
+	for _, part := range strings.Split(duration, ":") {
+		// Fractional seconds (eg: 01:02.345) are truncated.
+		value, err := strconv.ParseInt(strings.SplitN(part, ".", 2)[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", duration, err)
+		}
+		seconds = seconds*60 + value
+	}
+
+	return days*24*3600 + seconds, nil
+}
+
+// memUnits are the multipliers of the memory suffixes accepted by parseMem. The single-letter uppercase suffixes are the
+// binary units of SLURM (eg: 4G is 4GiB), the two-letter ones are the Kubernetes binary units, and k is the Kubernetes decimal kilo.
+// M, G, T and P are not the decimal units of Kubernetes: the values parsed are the ones printed by sacct, whose units are binary,
+// so 1000M is 1000MiB.
+var memUnits = map[string]int64{
+	"":   1,
+	"k":  1000,
+	"K":  1 << 10,
+	"M":  1 << 20,
+	"G":  1 << 30,
+	"T":  1 << 40,
+	"P":  1 << 50,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+}
+
+// memRegex matches a memory value with an optional fractional part and an optional suffix, eg: "4G", "512Mi", "7.50G".
+var memRegex = regexp.MustCompile(`^(\d+(?:\.\d+)?)([A-Za-z]*)$`)
+
+// parseMem parses a memory value (eg: "4G", "512Mi", "7.50G" as printed by sacct) into bytes, see memUnits. Values without suffix are bytes.
+// Fractional values are rounded to the nearest byte.
+func parseMem(mem string) (int64, error) {
+	if mem == "" {
+		return 0, errors.New("empty memory value")
+	}
+	match := memRegex.FindStringSubmatch(mem)
+	if match == nil {
+		return 0, fmt.Errorf("invalid memory value %q", mem)
+	}
+	unit, ok := memUnits[match[2]]
+	if !ok {
+		return 0, fmt.Errorf("invalid memory value %q: unknown suffix %q", mem, match[2])
+	}
+
+	if strings.Contains(match[1], ".") {
+		value, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid memory value %q: %w", mem, err)
+		}
+		bytes := math.Round(value * float64(unit))
+		if bytes >= math.MaxInt64 {
+			return 0, fmt.Errorf("invalid memory value %q: too large", mem)
+		}
+		return int64(bytes), nil
+	}
+
+	value, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory value %q: %w", mem, err)
+	}
+	if value > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid memory value %q: too large", mem)
+	}
+	return value * unit, nil
+}
@@ -0,0 +1,151 @@
+package slurm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseJobAllocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		allocTRES string
+		elapsed   string
+		want      JobAccounting
+		wantErr   bool
+	}{
+		{
+			name:      "CPU, memory and GPU",
+			allocTRES: "billing=4,cpu=4,gres/gpu=1,mem=4G,node=1",
+			elapsed:   "00:10:00",
+			want:      JobAccounting{AllocTRES: "billing=4,cpu=4,gres/gpu=1,mem=4G,node=1", ElapsedSeconds: 600, CPUSeconds: 2400, MemoryMBSeconds: 4096 * 600, GPUSeconds: 600},
+		},
+		{
+			name:      "typed GPUs counted once",
+			allocTRES: "cpu=2,gres/gpu:a100=2,gres/gpu=2,mem=512M",
+			elapsed:   "1-00:00:00",
+			want:      JobAccounting{AllocTRES: "cpu=2,gres/gpu:a100=2,gres/gpu=2,mem=512M", ElapsedSeconds: 86400, CPUSeconds: 2 * 86400, MemoryMBSeconds: 512 * 86400, GPUSeconds: 2 * 86400},
+		},
+		{
+			name:      "minutes and fractional seconds",
+			allocTRES: "cpu=1,mem=1024M",
+			elapsed:   "02:03.5",
+			want:      JobAccounting{AllocTRES: "cpu=1,mem=1024M", ElapsedSeconds: 123, CPUSeconds: 123, MemoryMBSeconds: 1024 * 123},
+		},
+		{
+			name:      "empty allocation",
+			allocTRES: "",
+			elapsed:   "00:00:10",
+			want:      JobAccounting{ElapsedSeconds: 10},
+		},
+		{name: "invalid elapsed", allocTRES: "cpu=1", elapsed: "ten minutes", wantErr: true},
+		{name: "invalid cpu", allocTRES: "cpu=many", elapsed: "00:00:10", wantErr: true},
+		{name: "invalid memory", allocTRES: "mem=4X", elapsed: "00:00:10", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseJobAllocation(test.allocTRES, test.elapsed)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseJobAllocation() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && *got != test.want {
+				t.Errorf("parseJobAllocation() = %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSlurmDuration(t *testing.T) {
+	tests := []struct {
+		duration string
+		want     int64
+		wantErr  bool
+	}{
+		{duration: "00:00:42", want: 42},
+		{duration: "01:02:03", want: 3723},
+		{duration: "05:06", want: 306},
+		{duration: "2-03:00:00", want: 2*86400 + 3*3600},
+		{duration: "00:01:02.345", want: 62},
+		{duration: "", wantErr: true},
+		{duration: "x-00:00:00", wantErr: true},
+		{duration: "00:aa:00", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.duration, func(t *testing.T) {
+			got, err := parseSlurmDuration(test.duration)
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Errorf("parseSlurmDuration(%q) = %d, %v, want %d, wantErr %v", test.duration, got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseMem(t *testing.T) {
+	tests := []struct {
+		mem     string
+		want    int64
+		wantErr bool
+	}{
+		{mem: "512Mi", want: 512 << 20},
+		{mem: "2Gi", want: 2 << 30},
+		{mem: "1000M", want: 1000 << 20},
+		{mem: "1Ti", want: 1 << 40},
+		{mem: "4G", want: 4 << 30},
+		{mem: "128k", want: 128000},
+		{mem: "7.50G", want: 7.5 * (1 << 30)},
+		{mem: "1024", want: 1024},
+		{mem: "", wantErr: true},
+		{mem: "2Xi", wantErr: true},
+		{mem: "-1G", wantErr: true},
+		{mem: "9000000P", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.mem, func(t *testing.T) {
+			got, err := parseMem(test.mem)
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Errorf("parseMem(%q) = %d, %v, want %d, wantErr %v", test.mem, got, err, test.want, test.wantErr)
+			}
+			if err != nil && test.mem != "" && !strings.Contains(err.Error(), test.mem) {
+				t.Errorf("parseMem(%q) error = %v, want the value in the error", test.mem, err)
+			}
+		})
+	}
+}
+
+func TestParseJobAccounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    JobAccounting
+		wantErr bool
+	}{
+		{
+			name: "job with steps",
+			output: "42|billing=4,cpu=4,gres/gpu=1,mem=4G,node=1|00:10:00|||00:35:12\n" +
+				"42.batch|cpu=4,mem=4G,node=1|00:10:00|2316K|00:35:10|00:35:10\n" +
+				"42.0|cpu=4,mem=4G,node=1|00:09:00|1.50G|00:20:00|00:20:00\n",
+			want: JobAccounting{
+				AllocTRES: "billing=4,cpu=4,gres/gpu=1,mem=4G,node=1", ElapsedSeconds: 600, CPUSeconds: 2400, MemoryMBSeconds: 4096 * 600, GPUSeconds: 600,
+				MaxRSSBytes: 3 << 29, AveCPUSeconds: 2110, TotalCPUSeconds: 2112,
+			},
+		},
+		{
+			name:   "no usage in the accounting",
+			output: "42|cpu=1,mem=1G|00:00:10|||\n42.batch|cpu=1,mem=1G|00:00:10|||\n",
+			want:   JobAccounting{AllocTRES: "cpu=1,mem=1G", ElapsedSeconds: 10, CPUSeconds: 10, MemoryMBSeconds: 1024 * 10},
+		},
+		{name: "only steps", output: "42.batch|cpu=1|00:00:10|1K|00:00:01|00:00:01\n", wantErr: true},
+		{name: "missing fields", output: "42|cpu=1|00:00:10\n", wantErr: true},
+		{name: "no output", output: "", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseJobAccounting(test.output)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseJobAccounting() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && *got != test.want {
+				t.Errorf("parseJobAccounting() = %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
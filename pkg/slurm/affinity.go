@@ -0,0 +1,103 @@
+package slurm
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// affinitySbatchFlags approximates the required podAffinity and podAntiAffinity terms of the pod with --nodelist and --exclude,
+// using the nodes where the matching pods tracked in JIDs currently run. SLURM has no co-location of independent jobs, so this is best effort:
+// only the kubernetes.io/hostname topology is supported, pods not yet running are ignored and namespaceSelector is not evaluated.
+func affinitySbatchFlags(ctx context.Context, config SlurmConfig, pod v1.Pod, JIDs *map[string]*JidStruct) []string {
+	affinity := pod.Spec.Affinity
+	if affinity == nil {
+		return nil
+	}
+
+	var flags []string
+	if affinity.PodAffinity != nil {
+		for _, term := range affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+			nodeLists := matchingPodsNodeLists(ctx, config, pod, term, JIDs)
+			if len(nodeLists) > 0 {
+				// --nodelist requires every listed node to be allocated, so only the nodes of the first matching pod are used.
+				flags = append(flags, "--nodelist="+nodeLists[0])
+				break
+			}
+		}
+	}
+
+	if affinity.PodAntiAffinity != nil {
+		var excluded []string
+		for _, term := range affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+			excluded = append(excluded, matchingPodsNodeLists(ctx, config, pod, term, JIDs)...)
+		}
+		if len(excluded) > 0 {
+			flags = append(flags, "--exclude="+strings.Join(excluded, ","))
+		}
+	}
+
+	if len(flags) > 0 {
+		log.G(ctx).Info("Pod affinity of ", pod.Name, " translated to ", flags)
+	}
+	return flags
+}
+
+// matchingPodsNodeLists returns the nodes of the running jobs of the tracked pods matching the affinity term.
+func matchingPodsNodeLists(ctx context.Context, config SlurmConfig, pod v1.Pod, term v1.PodAffinityTerm, JIDs *map[string]*JidStruct) []string {
+	if term.TopologyKey != v1.LabelHostname {
+		log.G(ctx).Warning("Pod affinity topology key ", term.TopologyKey, " of pod ", pod.Name, " is not supported, only ", v1.LabelHostname, " is")
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(term.LabelSelector)
+	if err != nil {
+		log.G(ctx).Warning("Invalid pod affinity label selector of pod ", pod.Name, ": ", err)
+		return nil
+	}
+
+	namespaces := term.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{pod.Namespace}
+	}
+
+	var nodeLists []string
+	for uid, jid := range trackedJobs(JIDs) {
+		if uid == string(pod.UID) || jid.StartTime.IsZero() || !containsString(namespaces, jid.PodNamespace) {
+			continue
+		}
+		podMetadata, err := readPodMetadata(config.DataRootFolder + jid.PodNamespace + "-" + uid)
+		if err != nil || !selector.Matches(labels.Set(podMetadata.Labels)) {
+			continue
+		}
+		nodeList, err := getJobNodeList(config, jid.JID, jid.Cluster)
+		if err != nil || nodeList == "" {
+			log.G(ctx).Debug("Unable to get the nodes of job ", jid.JID, ": ", err)
+			continue
+		}
+		nodeLists = append(nodeLists, nodeList)
+	}
+	return nodeLists
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsArg reports whether one of the command arguments is arg, also inside space-joined options such as the singularity-options annotation.
+func containsArg(command []string, arg string) bool {
+	for _, c := range command {
+		if containsString(strings.Fields(c), arg) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package slurm
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAffinitySbatchFlags(t *testing.T) {
+	config := testSLURMConfig()
+	config.DataRootFolder = t.TempDir() + "/"
+	config.Squeuepath = writeTestExecutable(t, t.TempDir(), "squeue", `echo "node07"`)
+	// db runs on node07, cache is still pending.
+	JIDs := map[string]*JidStruct{
+		"db-uid":    {PodUID: "db-uid", PodNamespace: "default", JID: "1", StartTime: time.Now()},
+		"cache-uid": {PodUID: "cache-uid", PodNamespace: "default", JID: "2"},
+	}
+	for uid, app := range map[string]string{"db-uid": "db", "cache-uid": "cache"} {
+		path := config.DataRootFolder + "default-" + uid
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writePodMetadata(path, PodMetadata{PodUID: uid, PodNamespace: "default", Labels: map[string]string{"app": app}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	term := func(app string, topologyKey string) []v1.PodAffinityTerm {
+		return []v1.PodAffinityTerm{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}}, TopologyKey: topologyKey}}
+	}
+
+	tests := []struct {
+		name      string
+		affinity  *v1.Affinity
+		wantFlags []string
+	}{
+		{name: "no affinity"},
+		{
+			name:      "affinity to a running pod",
+			affinity:  &v1.Affinity{PodAffinity: &v1.PodAffinity{RequiredDuringSchedulingIgnoredDuringExecution: term("db", v1.LabelHostname)}},
+			wantFlags: []string{"--nodelist=node07"},
+		},
+		{
+			name:      "anti-affinity to a running pod",
+			affinity:  &v1.Affinity{PodAntiAffinity: &v1.PodAntiAffinity{RequiredDuringSchedulingIgnoredDuringExecution: term("db", v1.LabelHostname)}},
+			wantFlags: []string{"--exclude=node07"},
+		},
+		{
+			name:     "affinity to a pending pod",
+			affinity: &v1.Affinity{PodAffinity: &v1.PodAffinity{RequiredDuringSchedulingIgnoredDuringExecution: term("cache", v1.LabelHostname)}},
+		},
+		{
+			name:     "unsupported topology key",
+			affinity: &v1.Affinity{PodAffinity: &v1.PodAffinity{RequiredDuringSchedulingIgnoredDuringExecution: term("db", v1.LabelTopologyZone)}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(v1.Container{Name: "app"})
+			pod.Spec.Affinity = test.affinity
+			flags := affinitySbatchFlags(context.Background(), config, pod, &JIDs)
+			if strings.Join(flags, " ") != strings.Join(test.wantFlags, " ") {
+				t.Errorf("affinitySbatchFlags() = %v, want %v", flags, test.wantFlags)
+			}
+		})
+	}
+}
+
+func TestContainsArg(t *testing.T) {
+	tests := []struct {
+		command []string
+		arg     string
+		want    bool
+	}{
+		{command: []string{"singularity", "run", "--fakeroot"}, arg: "--fakeroot", want: true},
+		{command: []string{"singularity", "run", "--writable-tmpfs --nv"}, arg: "--nv", want: true},
+		{command: []string{"singularity", "run", "--nvccli"}, arg: "--nv", want: false},
+		{command: []string{"singularity", "run", "--bind /data:/data-f"}, arg: "-f", want: false},
+	}
+	for _, test := range tests {
+		if got := containsArg(test.command, test.arg); got != test.want {
+			t.Errorf("containsArg(%q, %q) = %v, want %v", test.command, test.arg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package slurm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// annotationPrefix is the prefix of the annotations configuring the jobs of the pods.
+const annotationPrefix = "slurm-job.vk.io/"
+
+// anyAnnotationValue accepts free form annotations, eg: SLURM flags or shell commands.
+func anyAnnotationValue(string) bool { return true }
+
+// oneOfAnnotationValues accepts the listed values only.
+func oneOfAnnotationValues(values ...string) func(string) bool {
+	return func(value string) bool { return containsString(values, value) }
+}
+
+// knownAnnotations are the slurm-job.vk.io annotations, without the prefix, with the check of their value.
+// They are the only validation of the values, the annotations are used as they are once the pod is accepted.
+var knownAnnotations = map[string]func(string) bool{
+	"flags":                anyAnnotationValue,
+	"mpi-flags":            anyAnnotationValue,
+	"pre-exec":             anyAnnotationValue,
+	"singularity-commands": anyAnnotationValue,
+	"singularity-mounts":   anyAnnotationValue,
+	"singularity-options":  anyAnnotationValue,
+	"image-root":           anyAnnotationValue,
+	"env-dir":              anyAnnotationValue,
+	"env-profile":          anyAnnotationValue,
+	"het-layout":           anyAnnotationValue,
+	"cleanup-policy":       oneOfAnnotationValues("always", "on-success", "never"),
+	"gpu-mps":              oneOfAnnotationValues("true", "false"),
+	"gpu-count-scope":      oneOfAnnotationValues("per-node", "total"),
+	"gpu-bind":             gpuBindRegex.MatchString,
+	"stdin-configmap":      regexp.MustCompile(`^[^/]+/.+$`).MatchString,
+	"core-spec":            isNonNegativeInteger,
+	"thread-spec":          isNonNegativeInteger,
+	"cluster":              clusterNameRegex.MatchString,
+	"partition":            slurmNameRegex.MatchString,
+	"qos":                  slurmNameRegex.MatchString,
+	"account":              slurmNameRegex.MatchString,
+	"time-limit":           timeLimitRegex.MatchString,
+	"umask":                umaskRegex.MatchString,
+	"submit-user":          submitUserRegex.MatchString,
+	"spread": func(value string) bool {
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	},
+}
+
+// lenientAnnotations are the annotations whose malformed value is ignored with a warning where it is used, eg: the cleanup policy falls back to always.
+// They are only rejected with StrictAnnotations.
+var lenientAnnotations = map[string]bool{
+	"cleanup-policy": true,
+	"gpu-mps":        true,
+}
+
+// isNonNegativeInteger accepts the values of slurm-job.vk.io/core-spec and slurm-job.vk.io/thread-spec.
+func isNonNegativeInteger(value string) bool {
+	count, err := strconv.Atoi(value)
+	return err == nil && count >= 0
+}
+
+// checkAnnotations returns an error listing the slurm-job.vk.io annotations of the pod that are malformed, or an EnvProfiles entry that does not exist.
+// If strict, the unknown ones, eg: misspelled, and the malformed lenientAnnotations are listed too.
+// slurm-job.vk.io/singularity-options.<container name> is unknown if the pod has no such container.
+func checkAnnotations(config SlurmConfig, pod v1.Pod, strict bool) error {
+	containers := map[string]bool{}
+	for _, container := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		containers[container.Name] = true
+	}
+
+	unknown := []string{}
+	malformed := []string{}
+	for key, value := range pod.Annotations {
+		name, found := strings.CutPrefix(key, annotationPrefix)
+		if !found {
+			continue
+		}
+		if containerName, found := strings.CutPrefix(name, "singularity-options."); found {
+			if strict && !containers[containerName] {
+				unknown = append(unknown, key+" (no container named "+containerName+")")
+			}
+			continue
+		}
+		check, known := knownAnnotations[name]
+		switch {
+		case !known:
+			if strict {
+				unknown = append(unknown, key)
+			}
+		case !check(value):
+			if strict || !lenientAnnotations[name] {
+				malformed = append(malformed, fmt.Sprintf("%s=%q", key, value))
+			}
+		case name == "env-profile":
+			if _, found := config.EnvProfiles[value]; !found {
+				malformed = append(malformed, fmt.Sprintf("%s=%q (not one of the EnvProfiles)", key, value))
+			}
+		}
+	}
+	_, coreSpec := pod.Annotations[annotationPrefix+"core-spec"]
+	_, threadSpec := pod.Annotations[annotationPrefix+"thread-spec"]
+	if coreSpec && threadSpec {
+		malformed = append(malformed, annotationPrefix+"core-spec with "+annotationPrefix+"thread-spec (they cannot be used together)")
+	}
+	if len(unknown) == 0 && len(malformed) == 0 {
+		return nil
+	}
+
+	sort.Strings(unknown)
+	sort.Strings(malformed)
+	problems := []string{}
+	if len(unknown) > 0 {
+		problems = append(problems, "unknown annotations: "+strings.Join(unknown, ", "))
+	}
+	if len(malformed) > 0 {
+		problems = append(problems, "malformed annotations: "+strings.Join(malformed, ", "))
+	}
+	return fmt.Errorf("pod %s has invalid %s annotations, %s", pod.Name, strings.TrimSuffix(annotationPrefix, "/"), strings.Join(problems, "; "))
+}
+
+// validateAnnotations rejects the pods with malformed slurm-job.vk.io annotations, and with unknown ones if StrictAnnotations is set.
+// Otherwise the unknown ones are only logged, since they are ignored.
+func validateAnnotations(ctx context.Context, config SlurmConfig, pod v1.Pod) error {
+	err := checkAnnotations(config, pod, config.StrictAnnotations)
+	if err != nil || config.StrictAnnotations {
+		return err
+	}
+	if err := checkAnnotations(config, pod, true); err != nil {
+		log.G(ctx).Warning(err)
+	}
+	return nil
+}
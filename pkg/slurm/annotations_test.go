@@ -0,0 +1,67 @@
+package slurm
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+)
+
+func TestCheckAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		strict      bool
+		wantErr     []string
+	}{
+		{name: "known annotations", annotations: map[string]string{"slurm-job.vk.io/partition": "gpu", "slurm-job.vk.io/time-limit": "01:00:00", "other.io/key": "x"}, strict: true},
+		{name: "unknown annotation", annotations: map[string]string{"slurm-job.vk.io/partiton": "gpu"}, strict: true, wantErr: []string{"unknown annotations: slurm-job.vk.io/partiton"}},
+		{name: "unknown annotation without strict", annotations: map[string]string{"slurm-job.vk.io/partiton": "gpu"}},
+		{name: "malformed annotation", annotations: map[string]string{"slurm-job.vk.io/core-spec": "-1"}, wantErr: []string{`malformed annotations: slurm-job.vk.io/core-spec="-1"`}},
+		{name: "lenient annotation", annotations: map[string]string{"slurm-job.vk.io/cleanup-policy": "sometimes"}},
+		{name: "lenient annotation with strict", annotations: map[string]string{"slurm-job.vk.io/cleanup-policy": "sometimes"}, strict: true, wantErr: []string{`slurm-job.vk.io/cleanup-policy="sometimes"`}},
+		{name: "options of a container", annotations: map[string]string{"slurm-job.vk.io/singularity-options.app": "--writable-tmpfs"}, strict: true},
+		{name: "options of a missing container", annotations: map[string]string{"slurm-job.vk.io/singularity-options.db": "--writable-tmpfs"}, strict: true, wantErr: []string{"slurm-job.vk.io/singularity-options.db (no container named db)"}},
+		{name: "missing env profile", annotations: map[string]string{"slurm-job.vk.io/env-profile": "cuda"}, wantErr: []string{"not one of the EnvProfiles"}},
+		{name: "core-spec with thread-spec", annotations: map[string]string{"slurm-job.vk.io/core-spec": "1", "slurm-job.vk.io/thread-spec": "1"}, wantErr: []string{"cannot be used together"}},
+		{
+			name:        "every problem",
+			annotations: map[string]string{"slurm-job.vk.io/qos": "no qos", "slurm-job.vk.io/acount": "x", "slurm-job.vk.io/partiton": "gpu"},
+			strict:      true,
+			wantErr:     []string{"unknown annotations: slurm-job.vk.io/acount, slurm-job.vk.io/partiton; malformed annotations: slurm-job.vk.io/qos=\"no qos\""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Annotations = test.annotations
+			err := checkAnnotations(testSLURMConfig(), pod, test.strict)
+			if (err != nil) != (len(test.wantErr) > 0) {
+				t.Fatalf("checkAnnotations() error = %v, want %q", err, test.wantErr)
+			}
+			for _, wantErr := range test.wantErr {
+				if !strings.Contains(err.Error(), wantErr) {
+					t.Errorf("checkAnnotations() error = %v, want %q", err, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestSubmitStrictAnnotations(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		config := testSubmitConfig(t)
+		config.StrictAnnotations = strict
+		pod := testPod(testContainer("app", "1", "1Gi"))
+		pod.Annotations["slurm-job.vk.io/partiton"] = "gpu"
+		w, _ := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+		wantCode := http.StatusOK
+		if strict {
+			wantCode = http.StatusBadRequest
+		}
+		if w.Code != wantCode {
+			t.Errorf("StrictAnnotations %v: SubmitHandler() status = %d, want %d: %s", strict, w.Code, wantCode, w.Body)
+		}
+	}
+}
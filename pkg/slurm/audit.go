@@ -0,0 +1,117 @@
+package slurm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLogMutex serializes the writes to the audit log, so that concurrent submissions do not interleave their records.
+var auditLogMutex sync.Mutex
+
+// AuditRecord describes a successful submission: what was received, how it was translated and who submitted it.
+// One record is appended as a JSON line to AuditLogPath for every submitted job.
+type AuditRecord struct {
+	Timestamp     time.Time      `json:"timestamp"`
+	PodUID        string         `json:"podUID"`
+	PodName       string         `json:"podName"`
+	PodNamespace  string         `json:"podNamespace"`
+	PodSpecDigest string         `json:"podSpecDigest"`
+	Directives    []string       `json:"directives"`
+	Images        []AuditImage   `json:"images"`
+	Resources     AuditResources `json:"resources"`
+	JID           string         `json:"jid"`
+	Cluster       string         `json:"cluster,omitempty"`
+	SubmitUser    string         `json:"submitUser,omitempty"`
+	Identity      AuditIdentity  `json:"identity"`
+}
+
+// AuditImage is the image run by a container, after the image prefix and ImageResolveCommand.
+// Digest is only set for images pinned by digest, eg: docker://registry/image@sha256:...
+type AuditImage struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// AuditResources is the allocation requested for the job, Memory is in bytes.
+type AuditResources struct {
+	CPU    int64            `json:"cpu"`
+	Memory int64            `json:"memory"`
+	GPUs   map[string]int64 `json:"gpus,omitempty"`
+}
+
+// AuditIdentity identifies the submitter: the interLink session, the remote address and, with mTLS, the subject of the client certificate.
+type AuditIdentity struct {
+	Session           string `json:"session"`
+	RemoteAddr        string `json:"remoteAddr"`
+	ClientCertSubject string `json:"clientCertSubject,omitempty"`
+}
+
+// requestIdentity returns the identity of the submitter of the request.
+func requestIdentity(r *http.Request) AuditIdentity {
+	identity := AuditIdentity{
+		Session:    GetSessionContext(r),
+		RemoteAddr: r.RemoteAddr,
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		identity.ClientCertSubject = r.TLS.PeerCertificates[0].Subject.String()
+	}
+	return identity
+}
+
+// digest returns the sha256 of the JSON encoding of value, eg: of the pod spec as received.
+func digest(value interface{}) string {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(valueBytes)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// imageDigest returns the digest of an image pinned by digest, or an empty string.
+func imageDigest(image string) string {
+	if i := strings.LastIndex(image, "@"); i >= 0 && strings.HasPrefix(image[i+1:], "sha256:") {
+		return image[i+1:]
+	}
+	return ""
+}
+
+// readSbatchDirectives returns the #SBATCH lines of the job script.
+func readSbatchDirectives(scriptPath string) ([]string, error) {
+	content, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	directives := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "#SBATCH") {
+			directives = append(directives, line)
+		}
+	}
+	return directives, nil
+}
+
+// appendAuditRecord appends the record as a JSON line to the audit log. The file is only ever opened in append mode.
+func appendAuditRecord(auditLogPath string, record AuditRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+	f, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(recordBytes, '\n'))
+	return err
+}
@@ -0,0 +1,77 @@
+package slurm
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSubmitAuditRecord(t *testing.T) {
+	config := testSubmitConfig(t)
+	config.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	const imageDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	pods := []commonIL.RetrievedPodData{
+		{Pod: testPod(testContainer("app", "2", "1Gi"))},
+		{Pod: testPod(testContainer("app", "1", "1Gi"))},
+	}
+	pods[1].Pod.UID = types.UID("pinned-uid")
+	pods[1].Pod.Spec.Containers[0].Image = "busybox@" + imageDigest
+	for _, data := range pods {
+		w, _ := testSubmit(t, config, data)
+		if w.Code != http.StatusOK {
+			t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	}
+
+	content, err := os.ReadFile(config.AuditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != len(pods) {
+		t.Fatalf("audit log has %d records, want one per submission:\n%s", len(lines), content)
+	}
+
+	var record AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v, record: %s", err, lines[0])
+	}
+	if record.Timestamp.IsZero() {
+		t.Errorf("timestamp is not set")
+	}
+	if record.PodUID != "test-uid" || record.PodName != "test" || record.PodNamespace != "default" {
+		t.Errorf("pod = %s %s/%s, want test-uid default/test", record.PodUID, record.PodNamespace, record.PodName)
+	}
+	if want := digest(pods[0].Pod.Spec); record.PodSpecDigest != want {
+		t.Errorf("podSpecDigest = %q, want %q", record.PodSpecDigest, want)
+	}
+	if !containsString(record.Directives, "#SBATCH --cpus-per-task=2") || !containsString(record.Directives, "#SBATCH --mem=1024") {
+		t.Errorf("directives = %v, want the #SBATCH lines of the job", record.Directives)
+	}
+	if len(record.Images) != 1 || record.Images[0] != (AuditImage{Container: "app", Image: "docker://busybox"}) {
+		t.Errorf("images = %+v, want docker://busybox for app", record.Images)
+	}
+	if record.Resources.CPU != 2 || record.Resources.Memory != 1024*1024*1024 {
+		t.Errorf("resources = %+v, want 2 CPUs and 1Gi", record.Resources)
+	}
+	if record.JID != "123" {
+		t.Errorf("jid = %q, want 123", record.JID)
+	}
+	if record.Identity.Session != "NoSessionFound#0" || record.Identity.RemoteAddr == "" {
+		t.Errorf("identity = %+v, want the session and the remote address of the request", record.Identity)
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v, record: %s", err, lines[1])
+	}
+	if len(record.Images) != 1 || record.Images[0].Digest != imageDigest {
+		t.Errorf("images = %+v, want the digest %s", record.Images, imageDigest)
+	}
+}
@@ -0,0 +1,50 @@
+package slurm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// clusterNameRegex matches a SLURM cluster name, or a comma separated list of them.
+var clusterNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+(,[A-Za-z0-9_.-]+)*$`)
+
+// podClusterName returns the SLURM cluster targeted by the pod: the slurm-job.vk.io/cluster annotation, or ClusterName.
+// It is empty if neither is set, then the commands target the local cluster.
+func podClusterName(config SlurmConfig, pod v1.Pod) string {
+	if cluster, ok := pod.Annotations["slurm-job.vk.io/cluster"]; ok {
+		return cluster
+	}
+	return config.ClusterName
+}
+
+// parseClusterName returns the cluster of the pod, or an error if it is not a valid cluster name.
+// Cluster names end up in shell commands, so they are checked before the submission.
+func parseClusterName(config SlurmConfig, pod v1.Pod) (string, error) {
+	cluster := podClusterName(config, pod)
+	if cluster != "" && !clusterNameRegex.MatchString(cluster) {
+		return "", fmt.Errorf("invalid SLURM cluster name %q", cluster)
+	}
+	return cluster, nil
+}
+
+// clusterFlags returns the --clusters flag to pass to the SLURM commands, if a cluster is set.
+func clusterFlags(cluster string) []string {
+	if cluster == "" {
+		return nil
+	}
+	return []string{"--clusters=" + cluster}
+}
+
+// stripClusterHeader removes the "CLUSTER: <name>" lines that squeue and sinfo print, even with --noheader, when --clusters is used.
+func stripClusterHeader(output string) string {
+	lines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "CLUSTER:") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
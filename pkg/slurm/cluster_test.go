@@ -0,0 +1,80 @@
+package slurm
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestClusterFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		clusterName string
+		annotation  string
+		wantCluster string
+	}{
+		{name: "local cluster"},
+		{name: "ClusterName", clusterName: "c1", wantCluster: "c1"},
+		{name: "annotation over ClusterName", clusterName: "c1", annotation: "c2", wantCluster: "c2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			calls := filepath.Join(stubs, "calls")
+			config := testSubmitConfig(t)
+			config.ClusterName = test.clusterName
+			config.Squeuepath = writeTestExecutable(t, stubs, "squeue", `echo "squeue $@" >> `+calls+`
+echo "123 0 R"`)
+			config.Scancelpath = writeTestExecutable(t, stubs, "scancel", `echo "scancel $@" >> `+calls)
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			if test.annotation != "" {
+				pod.Annotations["slurm-job.vk.io/cluster"] = test.annotation
+			}
+
+			JIDs := map[string]*JidStruct{}
+			w, path := testSubmitWithHandler(t, SidecarHandler{Config: config, JIDs: &JIDs}, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			if got := strings.Contains(script, "#SBATCH --clusters="+test.wantCluster+"\n"); got != (test.wantCluster != "") {
+				t.Errorf("#SBATCH --clusters=%s emitted = %v, script:\n%s", test.wantCluster, got, script)
+			}
+			jid, tracked := lookupJID(&JIDs, "test-uid")
+			if !tracked || jid.Cluster != test.wantCluster {
+				t.Fatalf("tracked job = %+v, %v, want cluster %q", jid, tracked, test.wantCluster)
+			}
+
+			h := SidecarHandler{Config: config, JIDs: &JIDs, Ctx: context.Background()}
+			states, _ := h.batchJobStates(context.Background(), []*v1.Pod{&pod})
+			if states["123"] == "" {
+				t.Errorf("batchJobStates() = %v, want the state of job 123", states)
+			}
+			err := deleteContainer(context.Background(), config, "test-uid", slurmJobName(config, pod), test.wantCluster, "", &JIDs, path, true)
+			if err != nil {
+				t.Fatalf("deleteContainer() error = %v", err)
+			}
+
+			content, err := os.ReadFile(calls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			calledCommands := []string{}
+			for _, call := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+				calledCommands = append(calledCommands, strings.Fields(call)[0])
+				if got := strings.Contains(call, " --clusters="+test.wantCluster); got != (test.wantCluster != "") {
+					t.Errorf("%q passes --clusters=%s = %v", call, test.wantCluster, got)
+				}
+			}
+			if strings.Join(calledCommands, " ") != "squeue scancel" {
+				t.Errorf("called %v, want squeue then scancel", calledCommands)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package slurm
+
+import (
+	"os"
+	"strings"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+// podStatusResponse is the pod status returned to interLink, extended with the pod conditions computed from the job state
+// and the state of the ephemeral containers, see EnableEphemeralContainers.
+type podStatusResponse struct {
+	commonIL.PodStatus
+	Conditions          []v1.PodCondition    `json:"conditions,omitempty"`
+	EphemeralContainers []v1.ContainerStatus `json:"ephemeralContainers,omitempty"`
+}
+
+// withPodConditions attaches to each status the pod conditions and the ephemeral container states of the matching requested pod.
+func (h *SidecarHandler) withPodConditions(req []*v1.Pod, statuses []commonIL.PodStatus) []podStatusResponse {
+	pods := make(map[string]*v1.Pod, len(req))
+	for _, pod := range req {
+		pods[string(pod.UID)] = pod
+	}
+
+	resp := make([]podStatusResponse, 0, len(statuses))
+	for _, status := range statuses {
+		podResp := podStatusResponse{PodStatus: status}
+		if pod, ok := pods[status.PodUID]; ok {
+			_, scheduled := lookupJID(h.JIDs, status.PodUID)
+			path := h.Config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
+			podResp.Conditions = computePodConditions(path, pod, scheduled, status.Containers)
+			if h.Config.EnableEphemeralContainers {
+				podResp.EphemeralContainers = ephemeralContainerStatuses(path, pod)
+			}
+		}
+		resp = append(resp, podResp)
+	}
+	return resp
+}
+
+// computePodConditions maps the job state to the PodScheduled, Initialized, ContainersReady and Ready conditions.
+// PodScheduled is true once a JID exists, Initialized once every init container exited with 0,
+// ContainersReady and Ready once every container is ready (which already accounts for readiness probes).
+func computePodConditions(path string, pod *v1.Pod, scheduled bool, containerStatuses []v1.ContainerStatus) []v1.PodCondition {
+	initialized := scheduled && initContainersCompleted(path, pod, containerStatuses)
+
+	containersReady := scheduled && len(containerStatuses) >= len(pod.Spec.Containers)
+	for _, containerStatus := range containerStatuses {
+		if !containerStatus.Ready {
+			containersReady = false
+			break
+		}
+	}
+
+	return []v1.PodCondition{
+		podCondition(v1.PodScheduled, scheduled, "JobNotSubmitted"),
+		podCondition(v1.PodInitialized, initialized, "ContainersNotInitialized"),
+		podCondition(v1.ContainersReady, containersReady, "ContainersNotReady"),
+		podCondition(v1.PodReady, containersReady, "ContainersNotReady"),
+	}
+}
+
+// initContainersCompleted returns true if every init container status file reports a 0 exit code.
+// Once an app container started or terminated, the init containers are completed as well.
+func initContainersCompleted(path string, pod *v1.Pod, containerStatuses []v1.ContainerStatus) bool {
+	for _, containerStatus := range containerStatuses {
+		if containerStatus.State.Running != nil || containerStatus.State.Terminated != nil {
+			return true
+		}
+	}
+
+	for _, initContainer := range pod.Spec.InitContainers {
+		content, err := os.ReadFile(path + "/init-" + initContainer.Name + ".status")
+		if err != nil || strings.TrimSpace(string(content)) != "0" {
+			return false
+		}
+	}
+	return true
+}
+
+func podCondition(conditionType v1.PodConditionType, status bool, falseReason string) v1.PodCondition {
+	if status {
+		return v1.PodCondition{Type: conditionType, Status: v1.ConditionTrue}
+	}
+	return v1.PodCondition{Type: conditionType, Status: v1.ConditionFalse, Reason: falseReason}
+}
@@ -0,0 +1,80 @@
+package slurm
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestComputePodConditions(t *testing.T) {
+	running := v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+	waiting := v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"}}
+	tests := []struct {
+		name              string
+		scheduled         bool
+		initStatus        string
+		containerStatuses []v1.ContainerStatus
+		want              map[v1.PodConditionType]v1.ConditionStatus
+	}{
+		{
+			name: "not submitted",
+			want: map[v1.PodConditionType]v1.ConditionStatus{v1.PodScheduled: v1.ConditionFalse, v1.PodInitialized: v1.ConditionFalse, v1.ContainersReady: v1.ConditionFalse, v1.PodReady: v1.ConditionFalse},
+		},
+		{
+			name:              "init container running",
+			scheduled:         true,
+			containerStatuses: []v1.ContainerStatus{{Name: "app", State: waiting}, {Name: "sidecar", State: waiting}},
+			want:              map[v1.PodConditionType]v1.ConditionStatus{v1.PodScheduled: v1.ConditionTrue, v1.PodInitialized: v1.ConditionFalse, v1.ContainersReady: v1.ConditionFalse, v1.PodReady: v1.ConditionFalse},
+		},
+		{
+			name:              "init container failed",
+			scheduled:         true,
+			initStatus:        "1",
+			containerStatuses: []v1.ContainerStatus{{Name: "app", State: waiting}, {Name: "sidecar", State: waiting}},
+			want:              map[v1.PodConditionType]v1.ConditionStatus{v1.PodScheduled: v1.ConditionTrue, v1.PodInitialized: v1.ConditionFalse, v1.ContainersReady: v1.ConditionFalse, v1.PodReady: v1.ConditionFalse},
+		},
+		{
+			name:              "mid-run with a container not ready",
+			scheduled:         true,
+			initStatus:        "0",
+			containerStatuses: []v1.ContainerStatus{{Name: "app", State: running, Ready: true}, {Name: "sidecar", State: running}},
+			want:              map[v1.PodConditionType]v1.ConditionStatus{v1.PodScheduled: v1.ConditionTrue, v1.PodInitialized: v1.ConditionTrue, v1.ContainersReady: v1.ConditionFalse, v1.PodReady: v1.ConditionFalse},
+		},
+		{
+			name:              "mid-run with every container ready",
+			scheduled:         true,
+			initStatus:        "0",
+			containerStatuses: []v1.ContainerStatus{{Name: "app", State: running, Ready: true}, {Name: "sidecar", State: running, Ready: true}},
+			want:              map[v1.PodConditionType]v1.ConditionStatus{v1.PodScheduled: v1.ConditionTrue, v1.PodInitialized: v1.ConditionTrue, v1.ContainersReady: v1.ConditionTrue, v1.PodReady: v1.ConditionTrue},
+		},
+		{
+			name:              "container missing from the statuses",
+			scheduled:         true,
+			containerStatuses: []v1.ContainerStatus{{Name: "app", State: running, Ready: true}},
+			want:              map[v1.PodConditionType]v1.ConditionStatus{v1.PodScheduled: v1.ConditionTrue, v1.PodInitialized: v1.ConditionTrue, v1.ContainersReady: v1.ConditionFalse, v1.PodReady: v1.ConditionFalse},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir()
+			if test.initStatus != "" {
+				writeTestFile(t, path, "init-setup.status", test.initStatus+"\n")
+			}
+			pod := testPod(v1.Container{Name: "app"}, v1.Container{Name: "sidecar"})
+			pod.Spec.InitContainers = []v1.Container{{Name: "setup"}}
+
+			conditions := computePodConditions(path, &pod, test.scheduled, test.containerStatuses)
+			if len(conditions) != len(test.want) {
+				t.Fatalf("computePodConditions() = %+v, want %d conditions", conditions, len(test.want))
+			}
+			for _, condition := range conditions {
+				if condition.Status != test.want[condition.Type] {
+					t.Errorf("condition %s = %s, want %s", condition.Type, condition.Status, test.want[condition.Type])
+				}
+				if condition.Status == v1.ConditionFalse && condition.Reason == "" {
+					t.Errorf("condition %s is false without a reason", condition.Type)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package slurm
+
+import (
+	"strings"
+
+	"al.essio.dev/pkg/shellescape"
+	v1 "k8s.io/api/core/v1"
+)
+
+// appendUnique appends the values that are not in the list yet.
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// usesPodResolvConf tells if the containers of the pod get their own resolv.conf, see generateResolvConfPrologue: if HonorDNSConfig is set
+// and the pod has a dnsConfig or the None dnsPolicy. Otherwise, the containers get the resolv.conf of the node as singularity binds it by default.
+func usesPodResolvConf(config SlurmConfig, pod v1.Pod) bool {
+	return config.HonorDNSConfig && (pod.Spec.DNSConfig != nil || pod.Spec.DNSPolicy == v1.DNSNone)
+}
+
+// generateResolvConfPrologue returns the script lines writing the resolv.conf of the pod to the working directory with writeResolvConf,
+// built on the node as the kubelet does: with dnsPolicy None, only from the dnsConfig of the pod, otherwise from the resolv.conf of the node
+// with the nameservers and searches of the dnsConfig appended and its options overriding the ones with the same name.
+// It is empty if the pod does not get its own resolv.conf.
+func generateResolvConfPrologue(config SlurmConfig, pod v1.Pod) string {
+	if !usesPodResolvConf(config, pod) {
+		return ""
+	}
+	base := "node"
+	if pod.Spec.DNSPolicy == v1.DNSNone {
+		base = "none"
+	}
+	var nameservers, searches, options []string
+	if pod.Spec.DNSConfig != nil {
+		nameservers = pod.Spec.DNSConfig.Nameservers
+		searches = pod.Spec.DNSConfig.Searches
+		for _, option := range pod.Spec.DNSConfig.Options {
+			value := option.Name
+			if option.Value != nil {
+				value += ":" + *option.Value
+			}
+			options = append(options, value)
+		}
+	}
+	return "\nwriteResolvConf \"${workingPath}/resolv.conf\" " + base +
+		" " + shellescape.Quote(strings.Join(nameservers, " ")) +
+		" " + shellescape.Quote(strings.Join(searches, " ")) +
+		" " + shellescape.Quote(strings.Join(options, " ")) + "\n"
+}
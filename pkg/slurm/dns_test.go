@@ -0,0 +1,86 @@
+package slurm
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSubmitDNSConfig(t *testing.T) {
+	ndots := "2"
+	dnsConfig := &v1.PodDNSConfig{
+		Nameservers: []string{"10.0.0.10", "10.0.0.11"},
+		Searches:    []string{"physics.svc.cluster.local"},
+		Options:     []v1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}, {Name: "edns0"}},
+	}
+	tests := []struct {
+		name           string
+		honorDNSConfig bool
+		dnsPolicy      v1.DNSPolicy
+		wantLines      []string
+		wantInLines    []string
+	}{
+		{
+			name:           "dnsPolicy None",
+			honorDNSConfig: true,
+			dnsPolicy:      v1.DNSNone,
+			wantLines:      []string{"nameserver 10.0.0.10", "nameserver 10.0.0.11", "search physics.svc.cluster.local", "options ndots:2 edns0"},
+		},
+		{
+			name:           "dnsConfig appended to the node resolv.conf",
+			honorDNSConfig: true,
+			dnsPolicy:      v1.DNSClusterFirst,
+			// The nameservers of the node come first and may leave no room for the ones of the pod.
+			wantInLines: []string{"physics.svc.cluster.local", "ndots:2"},
+		},
+		{name: "HonorDNSConfig disabled", dnsPolicy: v1.DNSNone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.HonorDNSConfig = test.honorDNSConfig
+			config.SingularityPath = writeTestExecutable(t, t.TempDir(), "singularity", "exit 0")
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Spec.DNSPolicy = test.dnsPolicy
+			pod.Spec.DNSConfig = dnsConfig
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			bind := "--bind \"${workingPath}/resolv.conf\":/etc/resolv.conf"
+			if got := strings.Contains(script, bind); got != test.honorDNSConfig {
+				t.Fatalf("resolv.conf bound = %v, want %v, script:\n%s", got, test.honorDNSConfig, script)
+			}
+			if !test.honorDNSConfig {
+				return
+			}
+
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+			}
+			content, err := os.ReadFile(filepath.Join(path, "resolv.conf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			if test.wantLines != nil && strings.Join(lines, "\n") != strings.Join(test.wantLines, "\n") {
+				t.Errorf("resolv.conf = %q, want %q", lines, test.wantLines)
+			}
+			for _, value := range test.wantInLines {
+				if !strings.Contains(string(content), " "+value) {
+					t.Errorf("resolv.conf = %q, want %q", lines, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package slurm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ephemeralContainerCommand returns the srun command running an ephemeral container as a step of the job of the pod.
+// --overlap lets the step share the resources already used by the containers of the job.
+func ephemeralContainerCommand(Ctx context.Context, config SlurmConfig, pod v1.Pod, jid *JidStruct, container v1.EphemeralContainer) []string {
+	stepCommand := []string{config.Srunpath, "--jobid=" + jid.JID}
+	stepCommand = append(stepCommand, clusterFlags(jid.Cluster)...)
+	stepCommand = append(stepCommand, "--overlap", "--ntasks=1", "--nodes=1")
+
+	// As for the other containers, exec overrides the image entrypoint, run uses it.
+	singularityCommand := "run"
+	if len(container.Command) != 0 {
+		singularityCommand = "exec"
+	}
+	stepCommand = append(stepCommand, config.SingularityPath, singularityCommand)
+	stepCommand = append(stepCommand, config.SingularityDefaultOptions...)
+	if container.WorkingDir != "" {
+		stepCommand = append(stepCommand, "--pwd="+container.WorkingDir)
+	}
+	for _, env := range container.Env {
+		if env.ValueFrom == nil {
+			stepCommand = append(stepCommand, "--env", env.Name+"="+env.Value)
+		}
+	}
+	stepCommand = append(stepCommand, prefixedImage(Ctx, config, pod, container.Image))
+	stepCommand = append(stepCommand, container.Command...)
+	return append(stepCommand, container.Args...)
+}
+
+// ephemeralPolicyReason is the reason of the ephemeral containers rejected by the admission checks of the sidecar.
+const ephemeralPolicyReason = "PolicyRejected"
+
+// checkEphemeralContainer runs on an ephemeral container the admission checks done on the containers of the pod at creation,
+// since kubectl debug adds it to a running pod and it would otherwise bypass the site policy.
+func checkEphemeralContainer(Ctx context.Context, config SlurmConfig, pod v1.Pod, container v1.EphemeralContainer) error {
+	err := checkImageAllowed(config, container.Image)
+	if err != nil {
+		return err
+	}
+	if config.EnforcePullPolicyNever && container.ImagePullPolicy == v1.PullNever {
+		err = checkLocalImage(container.Name, prefixedImage(Ctx, config, pod, container.Image))
+		if err != nil {
+			return err
+		}
+	}
+	err = validateAnnotations(Ctx, config, pod)
+	if err != nil {
+		return err
+	}
+	err = checkHostNamespaces(config, pod)
+	if err != nil {
+		return err
+	}
+	return checkSysctls(Ctx, config, pod)
+}
+
+// launchEphemeralContainers starts the ephemeral containers of the pod that were not started yet, eg: added by kubectl debug.
+// The output of a container goes to ephemeral-<name>.out in the working directory, which also marks it as started,
+// and its exit code to ephemeral-<name>.status once it exits. A container rejected by checkEphemeralContainer is not started,
+// its status is 126 and ephemeral-<name>.reason holds the error.
+func launchEphemeralContainers(Ctx context.Context, config SlurmConfig, path string, pod v1.Pod, jid *JidStruct) {
+	for _, container := range pod.Spec.EphemeralContainers {
+		outputFile, err := os.OpenFile(path+"/ephemeral-"+container.Name+".out", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			if !errors.Is(err, os.ErrExist) {
+				log.G(Ctx).Error("Unable to create the output of ephemeral container ", container.Name, ": ", err)
+			}
+			continue
+		}
+
+		err = checkEphemeralContainer(Ctx, config, pod, container)
+		if err != nil {
+			log.G(Ctx).Warning("Not starting ephemeral container ", container.Name, ": ", err)
+			outputFile.WriteString(err.Error() + "\n")
+			outputFile.Close()
+			os.WriteFile(path+"/ephemeral-"+container.Name+".reason", []byte(err.Error()), 0644)
+			os.WriteFile(path+"/ephemeral-"+container.Name+".status", []byte("126"), 0644)
+			continue
+		}
+
+		// Steps are started as the user the job was submitted as, since srun --jobid is only allowed to the job owner.
+		userPrefix := submitUserPrefix(config, jid.SubmitUser, nil)
+
+		stepCommand := ephemeralContainerCommand(Ctx, config, pod, jid, container)
+		loggedCommand := append([]string{}, stepCommand...)
+		for i := 1; i < len(loggedCommand); i++ {
+			if name, value, found := strings.Cut(loggedCommand[i], "="); found && loggedCommand[i-1] == "--env" {
+				loggedCommand[i] = name + "=" + redactedEnvValue(config, name, value)
+			}
+		}
+		log.G(Ctx).Info("Starting ephemeral container ", container.Name, " of pod ", pod.Name, " in job ", jid.JID, ": ", loggedCommand)
+		cmd := exec.Command(config.BashPath, append([]string{"-c", userPrefix + `"$@"`, "ephemeral"}, stepCommand...)...)
+		cmd.Stdout = outputFile
+		cmd.Stderr = outputFile
+		err = cmd.Start()
+		if err != nil {
+			log.G(Ctx).Error("Unable to start ephemeral container ", container.Name, ": ", err)
+			outputFile.WriteString(err.Error() + "\n")
+			outputFile.Close()
+			os.WriteFile(path+"/ephemeral-"+container.Name+".status", []byte("127"), 0644)
+			continue
+		}
+
+		go func(containerName string) {
+			defer outputFile.Close()
+			cmd.Wait()
+			exitCode := cmd.ProcessState.ExitCode()
+			log.G(Ctx).Info("Ephemeral container ", containerName, " of pod ", pod.Name, " exited with code ", exitCode)
+			err := os.WriteFile(path+"/ephemeral-"+containerName+".status", []byte(strconv.Itoa(exitCode)), 0644)
+			if err != nil {
+				log.G(Ctx).Error("Unable to write the status of ephemeral container ", containerName, ": ", err)
+			}
+		}(container.Name)
+	}
+}
+
+// ephemeralContainerStatuses returns the state of the ephemeral containers of the pod, from their output and status files.
+func ephemeralContainerStatuses(path string, pod *v1.Pod) []v1.ContainerStatus {
+	statuses := []v1.ContainerStatus{}
+	for _, container := range pod.Spec.EphemeralContainers {
+		status := v1.ContainerStatus{Name: container.Name, Image: container.Image, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}}
+		if content, err := os.ReadFile(path + "/ephemeral-" + container.Name + ".status"); err == nil {
+			exitCode, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+			status.State = v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: int32(exitCode), Reason: terminatedReason(int32(exitCode))}}
+			if message, err := os.ReadFile(path + "/ephemeral-" + container.Name + ".reason"); err == nil {
+				status.State.Terminated.Reason = ephemeralPolicyReason
+				status.State.Terminated.Message = string(message)
+			}
+		} else if _, err := os.Stat(path + "/ephemeral-" + container.Name + ".out"); err == nil {
+			status.State = v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,75 @@
+package slurm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// waitTestFile waits for the file to be written, eg: the status of an ephemeral container, and returns its content.
+func waitTestFile(t *testing.T, path string) string {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		if content, err := os.ReadFile(path); err == nil {
+			return string(content)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s was not written", path)
+	return ""
+}
+
+func TestLaunchEphemeralContainers(t *testing.T) {
+	config := testSLURMConfig()
+	config.AllowedImagePatterns = []string{"busybox", "docker://busybox"}
+	// The step prints its arguments, which are the srun flags and the container command.
+	config.Srunpath = writeTestExecutable(t, t.TempDir(), "srun", `echo "$@"`)
+	path := t.TempDir()
+	pod := testPod(v1.Container{Name: "app"})
+	pod.Spec.EphemeralContainers = []v1.EphemeralContainer{
+		{EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:    "debugger",
+			Image:   "busybox",
+			Command: []string{"sh"},
+			Args:    []string{"-c", "ps"},
+			Env:     []v1.EnvVar{{Name: "DEBUG", Value: "1"}},
+		}},
+		{EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: "intruder", Image: "evil/toolbox"}},
+	}
+	jid := &JidStruct{JID: "123", PodUID: string(pod.UID), PodNamespace: pod.Namespace}
+
+	launchEphemeralContainers(context.Background(), config, path, pod, jid)
+	if status := waitTestFile(t, filepath.Join(path, "ephemeral-debugger.status")); status != "0" {
+		t.Errorf("debugger exit code = %s, want 0", status)
+	}
+	output, err := os.ReadFile(filepath.Join(path, "ephemeral-debugger.out"))
+	want := "--jobid=123 --overlap --ntasks=1 --nodes=1 singularity exec --env DEBUG=1 docker://busybox sh -c ps\n"
+	if err != nil || string(output) != want {
+		t.Errorf("srun step = %q, %v, want %q", output, err, want)
+	}
+	if status := waitTestFile(t, filepath.Join(path, "ephemeral-intruder.status")); status != "126" {
+		t.Errorf("intruder exit code = %s, want 126", status)
+	}
+
+	statuses := ephemeralContainerStatuses(path, &pod)
+	if len(statuses) != 2 {
+		t.Fatalf("ephemeralContainerStatuses() = %+v, want the two ephemeral containers", statuses)
+	}
+	if terminated := statuses[0].State.Terminated; terminated == nil || terminated.ExitCode != 0 || terminated.Reason != "Completed" {
+		t.Errorf("debugger state = %+v, want Completed", statuses[0].State)
+	}
+	if terminated := statuses[1].State.Terminated; terminated == nil || terminated.Reason != ephemeralPolicyReason {
+		t.Errorf("intruder state = %+v, want %s", statuses[1].State, ephemeralPolicyReason)
+	}
+
+	// The next status poll does not start the containers again.
+	launchEphemeralContainers(context.Background(), config, path, pod, jid)
+	time.Sleep(200 * time.Millisecond)
+	if again, _ := os.ReadFile(filepath.Join(path, "ephemeral-debugger.out")); string(again) != want {
+		t.Errorf("srun step = %q after the next launch, want it started once", again)
+	}
+}
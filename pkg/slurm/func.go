@@ -2,10 +2,15 @@ package slurm
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/kubernetes"
@@ -73,6 +78,18 @@ func NewSlurmConfig() (SlurmConfig, error) {
 			SlurmConfigInst.Sinfopath = os.Getenv("SINFOPATH")
 		}
 
+		if os.Getenv("SACCTPATH") != "" {
+			SlurmConfigInst.Sacctpath = os.Getenv("SACCTPATH")
+		}
+
+		if os.Getenv("SCONTROLPATH") != "" {
+			SlurmConfigInst.Scontrolpath = os.Getenv("SCONTROLPATH")
+		}
+
+		if os.Getenv("SRUNPATH") != "" {
+			SlurmConfigInst.Srunpath = os.Getenv("SRUNPATH")
+		}
+
 		if os.Getenv("SINGULARITYPATH") != "" {
 			SlurmConfigInst.SingularityPath = os.Getenv("SINGULARITYPATH")
 		}
@@ -109,8 +126,241 @@ func NewSlurmConfig() (SlurmConfig, error) {
 			SlurmConfigInst.Sinfopath = "/usr/bin/sinfo"
 		}
 
+		// Set default SacctPath if not configured
+		if SlurmConfigInst.Sacctpath == "" {
+			SlurmConfigInst.Sacctpath = "/usr/bin/sacct"
+		}
+
+		// Set default ScontrolPath if not configured
+		if SlurmConfigInst.Scontrolpath == "" {
+			SlurmConfigInst.Scontrolpath = "/usr/bin/scontrol"
+		}
+
+		// Set default SrunPath if not configured
+		if SlurmConfigInst.Srunpath == "" {
+			SlurmConfigInst.Srunpath = "/usr/bin/srun"
+		}
+
+		if SlurmConfigInst.SynchronousSubmitTimeout == 0 {
+			SlurmConfigInst.SynchronousSubmitTimeout = 300
+		}
+		if SlurmConfigInst.SynchronousSubmitTimeout < 0 {
+			err := errors.New("invalid SynchronousSubmitTimeout, expected a positive number of seconds")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.KinitPath == "" {
+			SlurmConfigInst.KinitPath = "kinit"
+		}
+		if SlurmConfigInst.KlistPath == "" {
+			SlurmConfigInst.KlistPath = "klist"
+		}
+
+		if (SlurmConfigInst.TLSCertFile == "") != (SlurmConfigInst.TLSKeyFile == "") {
+			err := errors.New("TLSCertFile and TLSKeyFile must be set together to enable TLS")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+		if SlurmConfigInst.TLSClientCAFile != "" && SlurmConfigInst.TLSCertFile == "" {
+			err := errors.New("TLSClientCAFile requires TLSCertFile and TLSKeyFile to be set")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		// The value ends up in an #SBATCH line, so only a conservative set of characters is allowed.
+		if SlurmConfigInst.SbatchExport != "" && !regexp.MustCompile(`^[A-Za-z0-9_=,./:-]+$`).MatchString(SlurmConfigInst.SbatchExport) {
+			err := errors.New("invalid SbatchExport value " + SlurmConfigInst.SbatchExport + ", expected ALL, NONE or a comma separated list of variables")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.RuntimeOptionConflictPolicy == "" {
+			SlurmConfigInst.RuntimeOptionConflictPolicy = RuntimeOptionConflictError
+		}
+		if SlurmConfigInst.RuntimeOptionConflictPolicy != RuntimeOptionConflictError && SlurmConfigInst.RuntimeOptionConflictPolicy != RuntimeOptionConflictUnion {
+			err := errors.New("invalid RuntimeOptionConflictPolicy value " + SlurmConfigInst.RuntimeOptionConflictPolicy + ", expected error or union")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.ResourceScope == "" {
+			SlurmConfigInst.ResourceScope = ResourceScopeLimits
+		}
+		if SlurmConfigInst.ResourceScope != ResourceScopeLimits && SlurmConfigInst.ResourceScope != ResourceScopeRequests && SlurmConfigInst.ResourceScope != ResourceScopeMax {
+			err := errors.New("invalid ResourceScope value " + SlurmConfigInst.ResourceScope + ", expected limits, requests or max")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.ResourceAggregation == "" {
+			SlurmConfigInst.ResourceAggregation = ResourceAggregationPod
+		}
+		if SlurmConfigInst.ResourceAggregation != ResourceAggregationPod && SlurmConfigInst.ResourceAggregation != ResourceAggregationMax {
+			err := errors.New("invalid ResourceAggregation value " + SlurmConfigInst.ResourceAggregation + ", expected pod or max")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.StatusPollInterval == 0 {
+			SlurmConfigInst.StatusPollInterval = 10
+		}
+		if SlurmConfigInst.StatusPollInterval < 0 || SlurmConfigInst.StatusPollJitter < 0 || SlurmConfigInst.StatusPollJitter > 1 {
+			err := errors.New("invalid StatusPollInterval or StatusPollJitter, expected a positive number of seconds and a jitter between 0 and 1")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.SlurmQueryRetryDelay == 0 {
+			SlurmConfigInst.SlurmQueryRetryDelay = 500
+		}
+		if SlurmConfigInst.SlurmQueryRetries < 0 || SlurmConfigInst.SlurmQueryRetryDelay < 0 {
+			err := errors.New("invalid SlurmQueryRetries or SlurmQueryRetryDelay, expected a positive number of retries and of milliseconds")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.SubmitRetryBaseDelay == 0 {
+			SlurmConfigInst.SubmitRetryBaseDelay = 1000
+		}
+		if SlurmConfigInst.SubmitRetries < 0 || SlurmConfigInst.SubmitRetryBaseDelay < 0 {
+			err := errors.New("invalid SubmitRetries or SubmitRetryBaseDelay, expected a positive number of retries and of milliseconds")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		for _, field := range SlurmConfigInst.CommentFields {
+			if !validCommentField(field) {
+				err := errors.New("invalid CommentFields field " + field + ", expected name, namespace, uid, serviceAccount, label:<key> or annotation:<key>")
+				log.G(context.Background()).Error(err.Error() + ". Exiting...")
+				return SlurmConfig{}, err
+			}
+		}
+
+		// An empty list disables the redaction, only a missing one gets the defaults.
+		if SlurmConfigInst.SensitiveEnvPatterns == nil {
+			SlurmConfigInst.SensitiveEnvPatterns = defaultSensitiveEnvPatterns
+		}
+		for _, pattern := range SlurmConfigInst.SensitiveEnvPatterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				err := errors.New("invalid pattern " + pattern + " in SensitiveEnvPatterns")
+				log.G(context.Background()).Error(err.Error() + ". Exiting...")
+				return SlurmConfig{}, err
+			}
+		}
+
+		if SlurmConfigInst.WorkdirFullAction == "" {
+			SlurmConfigInst.WorkdirFullAction = WorkdirFullTruncate
+		}
+		if SlurmConfigInst.WorkdirFullAction != WorkdirFullTruncate && SlurmConfigInst.WorkdirFullAction != WorkdirFullFail {
+			err := errors.New("invalid WorkdirFullAction value " + SlurmConfigInst.WorkdirFullAction + ", expected truncate or fail")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.ResourceFloorMode == "" {
+			SlurmConfigInst.ResourceFloorMode = ResourceFloorClamp
+		}
+		if SlurmConfigInst.ResourceFloorMode != ResourceFloorClamp && SlurmConfigInst.ResourceFloorMode != ResourceFloorError {
+			err := errors.New("invalid ResourceFloorMode value " + SlurmConfigInst.ResourceFloorMode + ", expected clamp or error")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.MountConflictPolicy == "" {
+			SlurmConfigInst.MountConflictPolicy = MountConflictLastWins
+		}
+		if SlurmConfigInst.MountConflictPolicy != MountConflictError && SlurmConfigInst.MountConflictPolicy != MountConflictLastWins {
+			err := errors.New("invalid MountConflictPolicy value " + SlurmConfigInst.MountConflictPolicy + ", expected error or last-wins")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.InitContainerResourceMode == "" {
+			SlurmConfigInst.InitContainerResourceMode = InitContainerResourceShared
+		}
+		if SlurmConfigInst.InitContainerResourceMode != InitContainerResourceShared && SlurmConfigInst.InitContainerResourceMode != InitContainerResourceStep {
+			err := errors.New("invalid InitContainerResourceMode value " + SlurmConfigInst.InitContainerResourceMode + ", expected shared or step")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.DefaultPartition != "" && !slurmNameRegex.MatchString(SlurmConfigInst.DefaultPartition) {
+			err := errors.New("invalid DefaultPartition value " + SlurmConfigInst.DefaultPartition)
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.DefaultQos != "" && !slurmNameRegex.MatchString(SlurmConfigInst.DefaultQos) {
+			err := errors.New("invalid DefaultQos value " + SlurmConfigInst.DefaultQos)
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.DefaultTimeLimit != "" && !timeLimitRegex.MatchString(SlurmConfigInst.DefaultTimeLimit) {
+			err := errors.New("invalid DefaultTimeLimit value " + SlurmConfigInst.DefaultTimeLimit + ", expected a SLURM time such as 2-00:00:00")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.DefaultAccount != "" && !slurmNameRegex.MatchString(SlurmConfigInst.DefaultAccount) {
+			err := errors.New("invalid DefaultAccount value " + SlurmConfigInst.DefaultAccount)
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+		for namespace, account := range SlurmConfigInst.NamespaceAccountMap {
+			if !slurmNameRegex.MatchString(account) {
+				err := errors.New("invalid NamespaceAccountMap value " + account + " for namespace " + namespace)
+				log.G(context.Background()).Error(err.Error() + ". Exiting...")
+				return SlurmConfig{}, err
+			}
+		}
+
+		if SlurmConfigInst.SubmitAsUserCommand != "" && !strings.Contains(SlurmConfigInst.SubmitAsUserCommand, "{user}") {
+			err := errors.New("invalid SubmitAsUserCommand value " + SlurmConfigInst.SubmitAsUserCommand + ", expected a {user} placeholder")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.DefaultContainerUmask != "" && !umaskRegex.MatchString(SlurmConfigInst.DefaultContainerUmask) {
+			err := errors.New("invalid DefaultContainerUmask value " + SlurmConfigInst.DefaultContainerUmask + ", expected an octal value such as 027")
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+
+		if SlurmConfigInst.EnvDir != "" {
+			if info, err := os.Stat(SlurmConfigInst.EnvDir); err != nil || !info.IsDir() {
+				err := errors.New("EnvDir " + SlurmConfigInst.EnvDir + " is not an existing directory")
+				log.G(context.Background()).Error(err.Error() + ". Exiting...")
+				return SlurmConfig{}, err
+			}
+		}
+
+		// Scale factors not set (or invalid) mean no scaling.
+		if SlurmConfigInst.CPUScaleFactor <= 0 {
+			SlurmConfigInst.CPUScaleFactor = 1.0
+		}
+		if SlurmConfigInst.MemoryScaleFactor <= 0 {
+			SlurmConfigInst.MemoryScaleFactor = 1.0
+		}
+
+		allowedImageRegexes, err := compileImagePatterns(SlurmConfigInst.AllowedImagePatterns)
+		if err != nil {
+			log.G(context.Background()).Error(err.Error() + ". Exiting...")
+			return SlurmConfig{}, err
+		}
+		SlurmConfigInst.allowedImageRegexes = allowedImageRegexes
+
 		SlurmConfigInst.set = true
 
+		if SlurmConfigInst.GPUGresNames == nil {
+			SlurmConfigInst.GPUGresNames = map[string]string{"nvidia.com/gpu": "gpu", "amd.com/gpu": "gpu"}
+		}
+
+		if SlurmConfigInst.TopologySpreadFlags == nil {
+			SlurmConfigInst.TopologySpreadFlags = map[string][]string{"kubernetes.io/hostname": {"--distribution=cyclic"}}
+		}
+
 		if len(SlurmConfigInst.SingularityDefaultOptions) == 0 {
 			SlurmConfigInst.SingularityDefaultOptions = []string{"--nv", "--no-eval", "--containall"}
 		}
@@ -118,6 +368,45 @@ func NewSlurmConfig() (SlurmConfig, error) {
 	return SlurmConfigInst, nil
 }
 
+// Validate checks that the SLURM binaries run by the sidecar are executable and that DataRootFolder is a writable directory,
+// so that a misconfigured sidecar fails at startup instead of in the handlers. SingularityPath is not checked, since it runs on the SLURM nodes.
+func (config SlurmConfig) Validate() error {
+	binaries := [][2]string{
+		{"SbatchPath", config.Sbatchpath},
+		{"SqueuePath", config.Squeuepath},
+		{"ScancelPath", config.Scancelpath},
+		{"BashPath", config.BashPath},
+	}
+	if config.EnableEphemeralContainers {
+		binaries = append(binaries, [2]string{"SrunPath", config.Srunpath})
+	}
+	if config.KerberosKeytab != "" {
+		binaries = append(binaries, [2]string{"KinitPath", config.KinitPath}, [2]string{"KlistPath", config.KlistPath})
+	}
+	errs := []error{}
+	for _, binary := range binaries {
+		name, path := binary[0], binary[1]
+		if path == "" {
+			errs = append(errs, errors.New(name+" is not set"))
+		} else if _, err := exec.LookPath(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s is not an executable: %w", name, path, err))
+		}
+	}
+
+	info, err := os.Stat(config.DataRootFolder)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("DataRootFolder %s: %w", config.DataRootFolder, err))
+	} else if !info.IsDir() {
+		errs = append(errs, errors.New("DataRootFolder "+config.DataRootFolder+" is not a directory"))
+	} else if probe, err := os.CreateTemp(config.DataRootFolder, ".write-check-"); err != nil {
+		errs = append(errs, fmt.Errorf("DataRootFolder %s is not writable: %w", config.DataRootFolder, err))
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+	return errors.Join(errs...)
+}
+
 func (h *SidecarHandler) handleError(ctx context.Context, w http.ResponseWriter, statusCode int, err error) {
 	span := trace.SpanFromContext(ctx)
 	span.AddEvent("An error occurred:" + err.Error())
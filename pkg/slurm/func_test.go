@@ -0,0 +1,75 @@
+package slurm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	stubs := t.TempDir()
+	executable := writeTestExecutable(t, stubs, "sbatch", "true")
+	notExecutable := filepath.Join(stubs, "squeue")
+	writeTestFile(t, stubs, "squeue", "")
+	readOnly := filepath.Join(t.TempDir(), "readonly")
+	if err := os.Mkdir(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	validConfig := func() SlurmConfig {
+		config := testSLURMConfig()
+		config.Sbatchpath = executable
+		config.Squeuepath = executable
+		config.Scancelpath = executable
+		config.BashPath = "/bin/bash"
+		config.DataRootFolder = t.TempDir()
+		return config
+	}
+	tests := []struct {
+		name       string
+		config     func(*SlurmConfig)
+		wantErr    []string
+		skipAsRoot bool
+	}{
+		{name: "valid", config: func(*SlurmConfig) {}},
+		{name: "empty SbatchPath", config: func(c *SlurmConfig) { c.Sbatchpath = "" }, wantErr: []string{"SbatchPath is not set"}},
+		{name: "missing binary", config: func(c *SlurmConfig) { c.Scancelpath = filepath.Join(stubs, "missing") }, wantErr: []string{"ScancelPath " + filepath.Join(stubs, "missing")}},
+		{name: "not executable binary", config: func(c *SlurmConfig) { c.Squeuepath = notExecutable }, wantErr: []string{"SqueuePath " + notExecutable + " is not an executable"}},
+		{name: "srun of ephemeral containers", config: func(c *SlurmConfig) {
+			c.EnableEphemeralContainers = true
+			c.Srunpath = ""
+		}, wantErr: []string{"SrunPath is not set"}},
+		{name: "kinit of Kerberos", config: func(c *SlurmConfig) {
+			c.KerberosKeytab = "/etc/sidecar.keytab"
+			c.KinitPath = ""
+			c.KlistPath = executable
+		}, wantErr: []string{"KinitPath is not set"}},
+		{name: "missing DataRootFolder", config: func(c *SlurmConfig) { c.DataRootFolder = filepath.Join(stubs, "missing") }, wantErr: []string{"DataRootFolder " + filepath.Join(stubs, "missing")}},
+		{name: "DataRootFolder is a file", config: func(c *SlurmConfig) { c.DataRootFolder = notExecutable }, wantErr: []string{"is not a directory"}},
+		{name: "every error", config: func(c *SlurmConfig) {
+			c.Sbatchpath = ""
+			c.BashPath = ""
+			c.DataRootFolder = notExecutable
+		}, wantErr: []string{"SbatchPath is not set", "BashPath is not set", "is not a directory"}},
+		// root can write to a read-only directory.
+		{name: "read-only DataRootFolder", config: func(c *SlurmConfig) { c.DataRootFolder = readOnly }, wantErr: []string{"is not writable"}, skipAsRoot: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.skipAsRoot && os.Geteuid() == 0 {
+				t.Skip("running as root")
+			}
+			config := validConfig()
+			test.config(&config)
+			err := config.Validate()
+			if (err != nil) != (len(test.wantErr) > 0) {
+				t.Fatalf("Validate() error = %v, want %q", err, test.wantErr)
+			}
+			for _, wantErr := range test.wantErr {
+				if !strings.Contains(err.Error(), wantErr) {
+					t.Errorf("Validate() error = %v, want %q", err, wantErr)
+				}
+			}
+		})
+	}
+}
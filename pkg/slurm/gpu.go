@@ -0,0 +1,319 @@
+package slurm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// containerGPUCount returns the number of NVIDIA GPUs requested in the limits of the container, typed GPUs of TypedGpuMap included, eg: nvidia.com/a100.
+func containerGPUCount(config SlurmConfig, container v1.Container) int64 {
+	count := int64(0)
+	for resourceName, quantity := range container.Resources.Limits {
+		if resourceName == "nvidia.com/gpu" {
+			count += quantity.Value()
+		} else if _, typed := config.TypedGpuMap[string(resourceName)]; typed && strings.HasPrefix(string(resourceName), "nvidia.com/") {
+			count += quantity.Value()
+		}
+	}
+	return count
+}
+
+// gpuSingularityFlags are the singularity flags exposing the GPUs of a vendor in the container.
+var gpuSingularityFlags = map[string]string{
+	"nvidia.com/gpu": "--nv",
+	"amd.com/gpu":    "--rocm",
+}
+
+// containerGPUs returns the GPUs requested in the limits of the container for each resource of GPUGresNames, by SLURM gres name.
+func containerGPUs(config SlurmConfig, container v1.Container) map[string]int64 {
+	return containerMappedGPUs(config.GPUGresNames, container)
+}
+
+// containerMappedGPUs returns the GPUs requested in the limits of the container for each resource of gpuNames, by the name it is mapped to.
+func containerMappedGPUs(gpuNames map[string]string, container v1.Container) map[string]int64 {
+	gpus := map[string]int64{}
+	for resourceName, gresName := range gpuNames {
+		if quantity, ok := container.Resources.Limits[v1.ResourceName(resourceName)]; ok && quantity.Value() > gpus[gresName] {
+			gpus[gresName] = quantity.Value()
+		}
+	}
+	return gpus
+}
+
+// podGPUs returns the GPUs requested by the pod, by SLURM gres name. App containers run together, so their GPUs are summed,
+// unless they share them (eg: with MPS), then the maximum is taken. Init containers run one at a time, before them:
+// the job gets at least the GPUs of the largest one.
+func podGPUs(config SlurmConfig, pod v1.Pod, shared bool) map[string]int64 {
+	return podMappedGPUs(config.GPUGresNames, pod, shared)
+}
+
+// podMappedGPUs returns the GPUs requested by the pod for each resource of gpuNames, by the name it is mapped to, added up as in podGPUs.
+func podMappedGPUs(gpuNames map[string]string, pod v1.Pod, shared bool) map[string]int64 {
+	gpus := map[string]int64{}
+	for _, container := range pod.Spec.Containers {
+		for gresName, count := range containerMappedGPUs(gpuNames, container) {
+			if !shared {
+				gpus[gresName] += count
+			} else if count > gpus[gresName] {
+				gpus[gresName] = count
+			}
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		for gresName, count := range containerMappedGPUs(gpuNames, container) {
+			if count > gpus[gresName] {
+				gpus[gresName] = count
+			}
+		}
+	}
+	for gresName, count := range gpus {
+		if count == 0 {
+			delete(gpus, gresName)
+		}
+	}
+	return gpus
+}
+
+// containerGPUOffsets returns, for each app container requesting NVIDIA GPUs, the index of its first GPU among the GPUs of the job,
+// so that each container gets its own GPUs. It is empty if less than two app containers request GPUs, then they all see the GPUs of the job.
+func containerGPUOffsets(config SlurmConfig, pod v1.Pod) map[string]int64 {
+	offsets := map[string]int64{}
+	offset := int64(0)
+	for _, container := range pod.Spec.Containers {
+		if count := containerGPUCount(config, container); count > 0 {
+			offsets[container.Name] = offset
+			offset += count
+		}
+	}
+	if len(offsets) < 2 {
+		return map[string]int64{}
+	}
+	return offsets
+}
+
+// containerGPUEnv returns the singularity flags setting CUDA_VISIBLE_DEVICES of the container to its own GPUs, see gpusOfCtn in the job script.
+func containerGPUEnv(config SlurmConfig, container v1.Container, offset int64) []string {
+	return []string{"--env", "CUDA_VISIBLE_DEVICES=\"$(gpusOfCtn " + strconv.FormatInt(offset, 10) + " " + strconv.FormatInt(containerGPUCount(config, container), 10) + ")\""}
+}
+
+// hetStepGPUEnv returns the command setting CUDA_VISIBLE_DEVICES of a container of a heterogeneous job component after the first one to its own GPUs,
+// run by its srun step before singularity. gpusOfCtn must run in the step, where CUDA_VISIBLE_DEVICES lists the GPUs of the component instead of the first one.
+func hetStepGPUEnv(config SlurmConfig, container v1.Container, offset int64) []string {
+	return []string{config.BashPath, "-c", "'export SINGULARITYENV_CUDA_VISIBLE_DEVICES=\"$(gpusOfCtn " + strconv.FormatInt(offset, 10) + " " + strconv.FormatInt(containerGPUCount(config, container), 10) + ")\" ; exec \"$@\"'", "gpusOfCtn"}
+}
+
+// missingGPUSingularityFlags returns the singularity flags needed by the GPUs requested by the container that are not already in the command,
+// eg: --nv for nvidia.com/gpu when SingularityDefaultOptions do not include it. The typed GPUs of TypedGpuMap get the flag of their vendor,
+// eg: --nv for nvidia.com/a100.
+func missingGPUSingularityFlags(config SlurmConfig, container v1.Container, command []string) []string {
+	var flags []string
+	for resourceName, quantity := range container.Resources.Limits {
+		flag, ok := gpuSingularityFlags[string(resourceName)]
+		if _, typed := config.TypedGpuMap[string(resourceName)]; typed {
+			vendor, _, _ := strings.Cut(string(resourceName), "/")
+			flag, ok = gpuSingularityFlags[vendor+"/gpu"]
+		}
+		if !ok || quantity.Value() == 0 || containsArg(command, flag) || containsString(flags, flag) {
+			continue
+		}
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// podTypedGPUs returns the SLURM gpu type and the number of the GPUs requested by the pod for the resources of TypedGpuMap, eg: a100 and 2
+// for nvidia.com/a100: 2, added up as in podGPUs. The type is empty if none is requested. A job cannot easily get GPUs of several types,
+// so more than one type, or typed GPUs along with the ones of GPUGresNames, are an error.
+func podTypedGPUs(config SlurmConfig, pod v1.Pod, shared bool) (string, int64, error) {
+	typedGPUs := podMappedGPUs(config.TypedGpuMap, pod, shared)
+	if len(typedGPUs) == 0 {
+		return "", 0, nil
+	}
+	gpuTypes := make([]string, 0, len(typedGPUs))
+	for gpuType := range typedGPUs {
+		gpuTypes = append(gpuTypes, gpuType)
+	}
+	sort.Strings(gpuTypes)
+	if len(gpuTypes) > 1 {
+		return "", 0, fmt.Errorf("pod %s requests GPUs of several types (%s), a SLURM job can only get GPUs of one type", pod.Name, strings.Join(gpuTypes, ", "))
+	}
+	if len(podGPUs(config, pod, shared)) > 0 {
+		return "", 0, fmt.Errorf("pod %s requests GPUs of type %s along with GPUs of GPUGresNames, a SLURM job can only get GPUs of one type", pod.Name, gpuTypes[0])
+	}
+	return gpuTypes[0], typedGPUs[gpuTypes[0]], nil
+}
+
+// gpuGresFlags returns the --gres flag requesting the GPUs of the pod, eg: --gres=gpu:2 or --gres=gpu:a100:2 with a typed gres name.
+// The GPUs of the containers are added up by podGPUs. Nothing is emitted
+// if slurm-job.vk.io/flags already request GPUs, or for multi-node jobs, whose GPUs are requested according to slurm-job.vk.io/gpu-count-scope.
+// The typed GPUs of TypedGpuMap are requested for the whole job instead, eg: --gpus=a100:2, also for multi-node jobs.
+func gpuGresFlags(ctx context.Context, pod v1.Pod, resourceLimits ResourceLimits, slurmFlags string) []string {
+	if resourceLimits.GPUType == "" && (len(resourceLimits.GPUs) == 0 || nodesFromFlags(slurmFlags) > 1) {
+		return nil
+	}
+	if regexp.MustCompile(`--(gpus|gpus-per-node|gres)[ =]`).MatchString(slurmFlags) {
+		log.G(ctx).Warning("GPUs of pod " + pod.Name + " are already requested in slurm-job.vk.io/flags, not adding them to --gres")
+		return nil
+	}
+	if resourceLimits.GPUType != "" {
+		return []string{"--gpus=" + resourceLimits.GPUType + ":" + strconv.FormatInt(resourceLimits.GPUTypeCount, 10)}
+	}
+
+	gresNames := make([]string, 0, len(resourceLimits.GPUs))
+	for gresName := range resourceLimits.GPUs {
+		gresNames = append(gresNames, gresName)
+	}
+	sort.Strings(gresNames)
+	gres := []string{}
+	for _, gresName := range gresNames {
+		gres = append(gres, gresName+":"+strconv.FormatInt(resourceLimits.GPUs[gresName], 10))
+	}
+	return []string{"--gres=" + strings.Join(gres, ",")}
+}
+
+// podRequestsGPU tells if at least one container of the pod requests an NVIDIA GPU.
+func podRequestsGPU(config SlurmConfig, pod v1.Pod) bool {
+	containers := append([]v1.Container{}, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	for _, container := range containers {
+		if containerGPUCount(config, container) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gpuBindRegex matches the --gpu-bind values supported by SLURM, eg: "closest", "map_gpu:0,1", "verbose,single:1".
+var gpuBindRegex = regexp.MustCompile(`^(verbose,)?(none|closest|map_gpu:[0-9*,]+|mask_gpu:[0-9a-fA-Fx*,]+|per_task:[0-9]+|single:[0-9]+)$`)
+
+// parseGPUBind returns the value of the slurm-job.vk.io/gpu-bind annotation, or an error if it is not a valid --gpu-bind value.
+func parseGPUBind(pod v1.Pod) (string, error) {
+	gpuBind, ok := pod.Annotations["slurm-job.vk.io/gpu-bind"]
+	if !ok {
+		return "", nil
+	}
+	if !gpuBindRegex.MatchString(gpuBind) {
+		return "", fmt.Errorf("invalid slurm-job.vk.io/gpu-bind annotation %q", gpuBind)
+	}
+	return gpuBind, nil
+}
+
+// parseGPUCountScope returns the value of the slurm-job.vk.io/gpu-count-scope annotation: "per-node" (default) or "total".
+func parseGPUCountScope(pod v1.Pod) (string, error) {
+	scope, ok := pod.Annotations["slurm-job.vk.io/gpu-count-scope"]
+	if !ok {
+		return "per-node", nil
+	}
+	if scope != "per-node" && scope != "total" {
+		return "", fmt.Errorf("invalid slurm-job.vk.io/gpu-count-scope annotation %q, expected per-node or total", scope)
+	}
+	return scope, nil
+}
+
+// nodesFromFlags returns the minimum number of nodes requested with --nodes or -N in the sbatch flags, 1 if not set.
+func nodesFromFlags(slurmFlags string) int {
+	match := regexp.MustCompile(`(?:--nodes[ =]|-N ?)(\d+)`).FindStringSubmatch(slurmFlags)
+	if match == nil {
+		return 1
+	}
+	nodes, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 1
+	}
+	return nodes
+}
+
+// gpuCountFlags returns the directives telling SLURM how the GPUs of a multi-node pod are distributed, from the GPUs of GPUGresNames in resourceLimits
+// (added up by podGPUs, or their maximum with MPS): with the per-node scope, they are requested on every node (--gpus-per-node), with the total scope
+// they are spread on all nodes (--gpus). Gres names other than gpu, eg: a gres of another accelerator, cannot be spread and are requested per node with --gres.
+// Nothing is emitted for single node jobs or if the sbatch flags already request GPUs. Typed GPUs are requested by gpuGresFlags.
+func gpuCountFlags(ctx context.Context, pod v1.Pod, resourceLimits ResourceLimits, slurmFlags string) ([]string, error) {
+	scope, err := parseGPUCountScope(pod)
+	if err != nil {
+		return nil, err
+	}
+	if len(resourceLimits.GPUs) == 0 || nodesFromFlags(slurmFlags) <= 1 {
+		return nil, nil
+	}
+	if regexp.MustCompile(`--(gpus|gpus-per-node|gres)[ =]`).MatchString(slurmFlags) {
+		log.G(ctx).Warning("GPUs of pod " + pod.Name + " are already requested in slurm-job.vk.io/flags, ignoring slurm-job.vk.io/gpu-count-scope")
+		return nil, nil
+	}
+
+	gresNames := make([]string, 0, len(resourceLimits.GPUs))
+	for gresName := range resourceLimits.GPUs {
+		gresNames = append(gresNames, gresName)
+	}
+	sort.Strings(gresNames)
+	gpus := []string{}
+	gres := []string{}
+	for _, gresName := range gresNames {
+		count := strconv.FormatInt(resourceLimits.GPUs[gresName], 10)
+		if gresName == "gpu" {
+			gpus = append(gpus, count)
+		} else if gpuType, typed := strings.CutPrefix(gresName, "gpu:"); typed {
+			gpus = append(gpus, gpuType+":"+count)
+		} else {
+			gres = append(gres, gresName+":"+count)
+		}
+	}
+
+	flags := []string{}
+	if len(gpus) > 0 && scope == "total" {
+		flags = append(flags, "--gpus="+strings.Join(gpus, ","))
+	} else if len(gpus) > 0 {
+		flags = append(flags, "--gpus-per-node="+strings.Join(gpus, ","))
+	}
+	if len(gres) > 0 {
+		if scope == "total" {
+			log.G(ctx).Warning("Gres " + strings.Join(gres, ",") + " of pod " + pod.Name + " cannot be spread on the nodes, requesting it on every node")
+		}
+		flags = append(flags, "--gres="+strings.Join(gres, ","))
+	}
+	return flags, nil
+}
+
+// isMPSEnabled tells if containers of the pod must share GPUs through NVIDIA MPS (Multi-Process Service).
+// It requires the slurm-job.vk.io/gpu-mps annotation set to "true", AllowMPS in the config and at least one GPU requested.
+func isMPSEnabled(ctx context.Context, config SlurmConfig, pod v1.Pod) bool {
+	if pod.Annotations["slurm-job.vk.io/gpu-mps"] != "true" {
+		return false
+	}
+	if !config.AllowMPS {
+		log.G(ctx).Warning("slurm-job.vk.io/gpu-mps annotation found on pod " + pod.Name + " but AllowMPS is disabled, ignoring it")
+		return false
+	}
+	if !podRequestsGPU(config, pod) {
+		log.G(ctx).Warning("slurm-job.vk.io/gpu-mps annotation found on pod " + pod.Name + " but no GPU is requested, ignoring it")
+		return false
+	}
+	return true
+}
+
+// generateMPSPrologue returns the script lines starting the MPS control daemon. Pipe and log directories are in the working directory,
+// which is bound in the containers, so that CUDA applications inside them reach the daemon thanks to the CUDA_MPS_* variables.
+// They are also exported as SINGULARITYENV_* variables, since the containers do not get the environment of the job with --cleanenv.
+func generateMPSPrologue() string {
+	return "\n# NVIDIA MPS shared-GPU mode" +
+		"\nexport CUDA_MPS_PIPE_DIRECTORY=${workingPath}/mps/pipe" +
+		"\nexport CUDA_MPS_LOG_DIRECTORY=${workingPath}/mps/log" +
+		"\nexport SINGULARITYENV_CUDA_MPS_PIPE_DIRECTORY=\"${CUDA_MPS_PIPE_DIRECTORY}\"" +
+		"\nexport SINGULARITYENV_CUDA_MPS_LOG_DIRECTORY=\"${CUDA_MPS_LOG_DIRECTORY}\"" +
+		"\nmkdir -p \"${CUDA_MPS_PIPE_DIRECTORY}\" \"${CUDA_MPS_LOG_DIRECTORY}\"" +
+		"\nprintf \"%s\\n\" \"$(date -Is --utc) Starting NVIDIA MPS control daemon...\"" +
+		"\nnvidia-cuda-mps-control -d\n"
+}
+
+// generateMPSEpilogue returns the script lines stopping the MPS control daemon once all containers ended.
+func generateMPSEpilogue() string {
+	return "\nprintf \"%s\\n\" \"$(date -Is --utc) Stopping NVIDIA MPS control daemon...\"" +
+		"\necho quit | nvidia-cuda-mps-control\n"
+}
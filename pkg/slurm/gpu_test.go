@@ -0,0 +1,309 @@
+package slurm
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// testGPUContainer returns a container with the provided CPU and memory limits and count GPUs of the resource, eg: nvidia.com/gpu.
+func testGPUContainer(name string, cpu string, memory string, gpuResource v1.ResourceName, count string) v1.Container {
+	container := testContainer(name, cpu, memory)
+	container.Resources.Limits[gpuResource] = resource.MustParse(count)
+	return container
+}
+
+func TestSubmitMPS(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowMPS bool
+		gpus     string
+		wantMPS  bool
+	}{
+		{name: "MPS GPU pod", allowMPS: true, gpus: "1", wantMPS: true},
+		{name: "AllowMPS disabled", allowMPS: false, gpus: "1"},
+		{name: "no GPU requested", allowMPS: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.AllowMPS = test.allowMPS
+			container := testContainer("app", "1", "1Gi")
+			if test.gpus != "" {
+				container = testGPUContainer("app", "1", "1Gi", "nvidia.com/gpu", test.gpus)
+			}
+			pod := testPod(container)
+			pod.Annotations["slurm-job.vk.io/gpu-mps"] = "true"
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+
+			for _, line := range []string{
+				"export CUDA_MPS_PIPE_DIRECTORY=${workingPath}/mps/pipe",
+				"export CUDA_MPS_LOG_DIRECTORY=${workingPath}/mps/log",
+				"export SINGULARITYENV_CUDA_MPS_PIPE_DIRECTORY=\"${CUDA_MPS_PIPE_DIRECTORY}\"",
+				"export SINGULARITYENV_CUDA_MPS_LOG_DIRECTORY=\"${CUDA_MPS_LOG_DIRECTORY}\"",
+				"nvidia-cuda-mps-control -d",
+				"echo quit | nvidia-cuda-mps-control",
+				"--bind ${workingPath}/mps",
+			} {
+				if got := strings.Contains(script, line); got != test.wantMPS {
+					t.Errorf("%q in the script = %v, want %v", line, got, test.wantMPS)
+				}
+			}
+			if !test.wantMPS {
+				return
+			}
+			// The daemon is started before the containers and stopped once they all ended.
+			start, run, wait, stop := strings.Index(script, "nvidia-cuda-mps-control -d"), strings.Index(script, "\nrunCtn app "), strings.Index(script, "\nwaitCtns\n"), strings.Index(script, "echo quit | nvidia-cuda-mps-control")
+			if !(start < run && run < wait && wait < stop) {
+				t.Errorf("MPS daemon started at %d and stopped at %d, want around the containers run at %d and waited at %d", start, stop, run, wait)
+			}
+		})
+	}
+}
+
+func TestSubmitGPUBind(t *testing.T) {
+	tests := []struct {
+		name     string
+		gpuBind  string
+		gpus     string
+		wantCode int
+		wantFlag bool
+	}{
+		{name: "closest", gpuBind: "closest", gpus: "2", wantCode: http.StatusOK, wantFlag: true},
+		{name: "GPU map", gpuBind: "map_gpu:0,1", gpus: "2", wantCode: http.StatusOK, wantFlag: true},
+		{name: "verbose single", gpuBind: "verbose,single:1", gpus: "2", wantCode: http.StatusOK, wantFlag: true},
+		{name: "no GPU requested", gpuBind: "closest", wantCode: http.StatusOK},
+		{name: "unknown type", gpuBind: "nearest", gpus: "2", wantCode: http.StatusBadRequest},
+		{name: "injected flag", gpuBind: "closest --exclusive", gpus: "2", wantCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container := testContainer("app", "1", "1Gi")
+			if test.gpus != "" {
+				container = testGPUContainer("app", "1", "1Gi", "nvidia.com/gpu", test.gpus)
+			}
+			pod := testPod(container)
+			pod.Annotations["slurm-job.vk.io/gpu-bind"] = test.gpuBind
+			w, path := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			script := readJobScript(t, path)
+			if got := strings.Contains(script, "#SBATCH --gpu-bind="+test.gpuBind+"\n"); got != test.wantFlag {
+				t.Errorf("--gpu-bind=%s emitted = %v, want %v, script:\n%s", test.gpuBind, got, test.wantFlag, script)
+			}
+		})
+	}
+}
+
+func TestSubmitGPUCountScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    string
+		scope    string
+		wantCode int
+		wantGPUs []string
+	}{
+		{name: "default scope", flags: "--nodes=2", wantCode: http.StatusOK, wantGPUs: []string{"--gpus-per-node=4"}},
+		{name: "per-node", flags: "--nodes=2", scope: "per-node", wantCode: http.StatusOK, wantGPUs: []string{"--gpus-per-node=4"}},
+		{name: "total", flags: "--nodes=2", scope: "total", wantCode: http.StatusOK, wantGPUs: []string{"--gpus=4"}},
+		{name: "GPUs already in the flags", flags: "--nodes=2 --gpus=8", scope: "total", wantCode: http.StatusOK, wantGPUs: []string{"--gpus=8"}},
+		{name: "invalid scope", flags: "--nodes=2", scope: "node", wantCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(testGPUContainer("app", "1", "1Gi", "nvidia.com/gpu", "4"))
+			pod.Annotations["slurm-job.vk.io/flags"] = test.flags
+			if test.scope != "" {
+				pod.Annotations["slurm-job.vk.io/gpu-count-scope"] = test.scope
+			}
+			w, path := testSubmit(t, testSubmitConfig(t), commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			gpus := []string{}
+			for _, line := range strings.Split(readJobScript(t, path), "\n") {
+				if flag, found := strings.CutPrefix(line, "#SBATCH "); found && strings.HasPrefix(flag, "--gpus") {
+					gpus = append(gpus, flag)
+				}
+			}
+			if strings.Join(gpus, " ") != strings.Join(test.wantGPUs, " ") {
+				t.Errorf("#SBATCH GPU lines = %v, want %v", gpus, test.wantGPUs)
+			}
+		})
+	}
+}
+
+func TestSubmitExportGPUUUIDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		export    bool
+		gpus      string
+		wantLines bool
+	}{
+		{name: "GPU pod", export: true, gpus: "2", wantLines: true},
+		{name: "ExportGPUUUIDs disabled", gpus: "2"},
+		{name: "no GPU requested", export: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.ExportGPUUUIDs = test.export
+			container := testContainer("app", "1", "1Gi")
+			if test.gpus != "" {
+				container = testGPUContainer("app", "1", "1Gi", "nvidia.com/gpu", test.gpus)
+			}
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(container)})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			for _, line := range []string{
+				`export ALLOCATED_GPU_UUIDS=$(nvidia-smi --query-gpu=uuid --format=csv,noheader ${CUDA_VISIBLE_DEVICES:+-i "${CUDA_VISIBLE_DEVICES}"} | paste -sd, -)`,
+				`export SINGULARITYENV_ALLOCATED_GPU_UUIDS="${ALLOCATED_GPU_UUIDS}"`,
+			} {
+				if got := strings.Contains(script, line+"\n"); got != test.wantLines {
+					t.Errorf("%q in the script = %v, want %v", line, got, test.wantLines)
+				}
+			}
+		})
+	}
+}
+
+func TestSubmitGPUsPerContainer(t *testing.T) {
+	config := testSubmitConfig(t)
+	pod := testPod(
+		testGPUContainer("trainer", "1", "1Gi", "nvidia.com/gpu", "1"),
+		testGPUContainer("evaluator", "1", "1Gi", "nvidia.com/gpu", "1"),
+		testContainer("logger", "1", "1Gi"),
+	)
+	w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+	if w.Code != http.StatusOK {
+		t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	script := readJobScript(t, path)
+	if !strings.Contains(script, "#SBATCH --gres=gpu:2\n") {
+		t.Errorf("want --gres=gpu:2 for the GPUs of both containers, script:\n%s", script)
+	}
+
+	// Each container selects its own GPU among the ones of the job.
+	lines := map[string]string{}
+	for _, line := range strings.Split(script, "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "runCtn" {
+			lines[fields[1]] = line
+		}
+	}
+	for container, want := range map[string]string{"trainer": "gpusOfCtn 0 1", "evaluator": "gpusOfCtn 1 1"} {
+		if !strings.Contains(lines[container], "--env CUDA_VISIBLE_DEVICES=\"$("+want+")\"") {
+			t.Errorf("runCtn line of %s = %q, want CUDA_VISIBLE_DEVICES of %s", container, lines[container], want)
+		}
+	}
+	if strings.Contains(lines["logger"], "CUDA_VISIBLE_DEVICES") {
+		t.Errorf("runCtn line of logger = %q, want no CUDA_VISIBLE_DEVICES", lines["logger"])
+	}
+
+	start := strings.Index(script, "gpusOfCtn() {")
+	end := strings.Index(script[start:], "\n}\n")
+	if start < 0 || end < 0 {
+		t.Fatalf("gpusOfCtn is not defined in the script:\n%s", script)
+	}
+	for args, want := range map[string]string{"0 1": "3", "1 1": "5", "1 2": "3,5"} {
+		cmd := exec.Command("/bin/bash", "-c", script[start:start+end+3]+"gpusOfCtn "+args)
+		cmd.Env = append(os.Environ(), "CUDA_VISIBLE_DEVICES=3,5")
+		output, err := cmd.Output()
+		if err != nil || string(output) != want {
+			t.Errorf("gpusOfCtn %s = %q, %v, want %q", args, output, err, want)
+		}
+	}
+}
+
+func TestSubmitTypedGPUs(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []v1.Container
+		flags      string
+		wantCode   int
+		wantFlag   string
+	}{
+		{
+			name:       "typed GPUs",
+			containers: []v1.Container{testGPUContainer("app", "1", "1Gi", "nvidia.com/a100", "2")},
+			wantCode:   http.StatusOK,
+			wantFlag:   "#SBATCH --gpus=a100:2",
+		},
+		{
+			name: "typed GPUs of several containers",
+			containers: []v1.Container{
+				testGPUContainer("trainer", "1", "1Gi", "nvidia.com/a100", "1"),
+				testGPUContainer("evaluator", "1", "1Gi", "nvidia.com/a100", "2"),
+			},
+			wantCode: http.StatusOK,
+			wantFlag: "#SBATCH --gpus=a100:3",
+		},
+		{
+			name:       "GPUs in the flags",
+			containers: []v1.Container{testGPUContainer("app", "1", "1Gi", "nvidia.com/a100", "2")},
+			flags:      "--gpus=v100:1",
+			wantCode:   http.StatusOK,
+		},
+		{
+			name: "several types",
+			containers: []v1.Container{
+				testGPUContainer("trainer", "1", "1Gi", "nvidia.com/a100", "1"),
+				testGPUContainer("evaluator", "1", "1Gi", "nvidia.com/v100", "1"),
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "typed and untyped GPUs",
+			containers: []v1.Container{
+				testGPUContainer("trainer", "1", "1Gi", "nvidia.com/a100", "1"),
+				testGPUContainer("evaluator", "1", "1Gi", "nvidia.com/gpu", "1"),
+			},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.TypedGpuMap = map[string]string{"nvidia.com/a100": "a100", "nvidia.com/v100": "v100"}
+			pod := testPod(test.containers...)
+			if test.flags != "" {
+				pod.Annotations["slurm-job.vk.io/flags"] = test.flags
+			}
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			script := readJobScript(t, path)
+			if test.wantFlag != "" && !strings.Contains(script, test.wantFlag+"\n") {
+				t.Errorf("want %s, script:\n%s", test.wantFlag, script)
+			}
+			if test.wantFlag == "" && strings.Contains(script, "#SBATCH --gpus=a100") {
+				t.Errorf("--gpus=a100 added along with the GPUs of the flags, script:\n%s", script)
+			}
+			if strings.Contains(script, "--gres=") {
+				t.Errorf("--gres set for typed GPUs, script:\n%s", script)
+			}
+		})
+	}
+}
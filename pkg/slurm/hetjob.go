@@ -0,0 +1,161 @@
+package slurm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// parseHetLayout returns the app containers of each component of the heterogeneous job of the pod, from the slurm-job.vk.io/het-layout annotation,
+// eg: "trainer;loader,monitor" for a first component running trainer and a second one running loader and monitor.
+// App containers not listed and init containers run in the first component. It is nil without the annotation.
+func parseHetLayout(pod v1.Pod) ([][]string, error) {
+	layout, ok := pod.Annotations["slurm-job.vk.io/het-layout"]
+	if !ok {
+		return nil, nil
+	}
+	appContainers := map[string]bool{}
+	for _, container := range pod.Spec.Containers {
+		appContainers[container.Name] = true
+	}
+	components := [][]string{}
+	seen := map[string]bool{}
+	for _, component := range strings.Split(layout, ";") {
+		names := []string{}
+		for _, name := range strings.Split(component, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !appContainers[name] {
+				return nil, fmt.Errorf("slurm-job.vk.io/het-layout annotation of pod %s: %s is not an app container of the pod", pod.Name, name)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("slurm-job.vk.io/het-layout annotation of pod %s: container %s is in more than one component", pod.Name, name)
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("slurm-job.vk.io/het-layout annotation of pod %s has an empty component: %q", pod.Name, layout)
+		}
+		components = append(components, names)
+	}
+	if len(components) < 2 {
+		return nil, fmt.Errorf("slurm-job.vk.io/het-layout annotation of pod %s needs at least two components separated by ';': %q", pod.Name, layout)
+	}
+	return components, nil
+}
+
+// hetComponent returns the index of the component of the heterogeneous job running the container, 0 for the first one or without layout.
+func hetComponent(layout [][]string, containerName string) int {
+	for i, component := range layout {
+		if containsString(component, containerName) {
+			return i
+		}
+	}
+	return 0
+}
+
+// hetComponentPod returns the pod with only the app containers of a component of its heterogeneous job, so that the resources of the component
+// are computed as the ones of a pod. The first component also keeps the init containers. It is the pod itself without layout.
+func hetComponentPod(pod v1.Pod, layout [][]string, component int) v1.Pod {
+	if len(layout) == 0 {
+		return pod
+	}
+	componentPod := *pod.DeepCopy()
+	componentPod.Spec.Containers = []v1.Container{}
+	for _, container := range pod.Spec.Containers {
+		if hetComponent(layout, container.Name) == component {
+			componentPod.Spec.Containers = append(componentPod.Spec.Containers, container)
+		}
+	}
+	if component != 0 {
+		componentPod.Spec.InitContainers = nil
+	}
+	return componentPod
+}
+
+// hetComponentLimits returns the resources of the components of the heterogeneous job after the first one, which gets the resources of the pod.
+// Each component is sized as a pod with its containers: scaled by CPUScaleFactor and MemoryScaleFactor, checked against the floor of ResourceFloorMode,
+// with 1 CPU and MemoryFloorMB of memory when not set, and with the GPUs of GPUGresNames and TypedGpuMap.
+func hetComponentLimits(Ctx context.Context, config SlurmConfig, pod v1.Pod, layout [][]string, shared bool) ([]ResourceLimits, error) {
+	components := []ResourceLimits{}
+	for i := 1; i < len(layout); i++ {
+		componentPod := hetComponentPod(pod, layout, i)
+		cpu, memory := podResources(config, componentPod)
+		limits := ResourceLimits{CPU: 1, Memory: memoryFloorMB(config) * 1024 * 1024, GPUs: podGPUs(config, componentPod, shared)}
+		if cpu > 0 {
+			if config.CPUScaleFactor > 0 {
+				cpu *= config.CPUScaleFactor
+			}
+			limits.CPU = int64(math.Ceil(cpu))
+		}
+		if memory > 0 {
+			limits.Memory = memory
+			if config.MemoryScaleFactor > 0 {
+				limits.Memory = int64(math.Ceil(float64(memory) * config.MemoryScaleFactor))
+			}
+		}
+		err := applyResourceFloor(Ctx, config, &limits, cpu == 0, memory == 0)
+		if err != nil {
+			return nil, fmt.Errorf("component %d of the heterogeneous job of pod %s: %w", i, pod.Name, err)
+		}
+		limits.GPUType, limits.GPUTypeCount, err = podTypedGPUs(config, componentPod, shared)
+		if err != nil {
+			return nil, err
+		}
+		components = append(components, limits)
+	}
+	return components, nil
+}
+
+// hetComponentFlags returns the #SBATCH flags of the components of the heterogeneous job after the first one, from their hetComponentLimits.
+// Each component is a single task.
+func hetComponentFlags(components []ResourceLimits) [][]string {
+	componentFlags := [][]string{}
+	for _, limits := range components {
+		flags := []string{"--nodes=1", "--ntasks=1", "--cpus-per-task=" + strconv.FormatInt(limits.CPU, 10), "--mem=" + strconv.FormatInt(limits.Memory/1024/1024, 10)}
+		gresNames := make([]string, 0, len(limits.GPUs))
+		for gresName := range limits.GPUs {
+			gresNames = append(gresNames, gresName)
+		}
+		sort.Strings(gresNames)
+		gres := []string{}
+		for _, gresName := range gresNames {
+			gres = append(gres, gresName+":"+strconv.FormatInt(limits.GPUs[gresName], 10))
+		}
+		if len(gres) > 0 {
+			flags = append(flags, "--gres="+strings.Join(gres, ","))
+		}
+		if limits.GPUType != "" {
+			flags = append(flags, "--gpus="+limits.GPUType+":"+strconv.FormatInt(limits.GPUTypeCount, 10))
+		}
+		componentFlags = append(componentFlags, flags)
+	}
+	return componentFlags
+}
+
+// hetStepCommand returns the srun command running a container in a component of the heterogeneous job after the first one,
+// since the job script only runs in the allocation of the first component.
+func hetStepCommand(config SlurmConfig, component int) []string {
+	return []string{config.Srunpath, "--het-group=" + strconv.Itoa(component), "--ntasks=1", "--nodes=1"}
+}
+
+// hetInheritedFlags returns the flags of the pod that apply to each component of its heterogeneous job, eg: the partition and the account.
+func hetInheritedFlags(flags []string) []string {
+	inherited := []string{}
+	for _, flag := range flags {
+		for _, prefix := range []string{"--partition=", "--qos=", "--account=", "--time=", "--constraint="} {
+			if strings.HasPrefix(flag, prefix) {
+				inherited = append(inherited, flag)
+			}
+		}
+	}
+	return inherited
+}
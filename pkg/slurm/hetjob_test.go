@@ -0,0 +1,68 @@
+package slurm
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+)
+
+func TestParseHetLayout(t *testing.T) {
+	pod := testPod(testContainer("trainer", "1", "1Gi"), testContainer("loader", "1", "1Gi"), testContainer("monitor", "1", "1Gi"))
+	tests := []struct {
+		name    string
+		layout  string
+		want    [][]string
+		wantErr bool
+	}{
+		{name: "two components", layout: "trainer;loader,monitor", want: [][]string{{"trainer"}, {"loader", "monitor"}}},
+		{name: "spaces", layout: " trainer ; loader ", want: [][]string{{"trainer"}, {"loader"}}},
+		{name: "single component", layout: "trainer,loader", wantErr: true},
+		{name: "unknown container", layout: "trainer;writer", wantErr: true},
+		{name: "container in two components", layout: "trainer;trainer,loader", wantErr: true},
+		{name: "empty component", layout: "trainer;;loader", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod.Annotations["slurm-job.vk.io/het-layout"] = test.layout
+			got, err := parseHetLayout(pod)
+			if (err != nil) != test.wantErr || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseHetLayout(%q) = %v, %v, want %v, wantErr %v", test.layout, got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubmitHetJob(t *testing.T) {
+	config := testSubmitConfig(t)
+	config.Srunpath = "srun"
+	pod := testPod(testGPUContainer("trainer", "4", "8Gi", "nvidia.com/gpu", "2"), testContainer("loader", "2", "1Gi"))
+	pod.Annotations["slurm-job.vk.io/het-layout"] = "trainer;loader"
+	w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+	if w.Code != http.StatusOK {
+		t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	script := readJobScript(t, path)
+
+	directives := []string{}
+	for _, line := range strings.Split(script, "\n") {
+		if flag, found := strings.CutPrefix(line, "#SBATCH "); found && !strings.HasPrefix(flag, "--job-name") && !strings.HasPrefix(flag, "--output") {
+			directives = append(directives, flag)
+		}
+	}
+	// The job is sized as the trainer component, the loader component follows the hetjob separator.
+	want := []string{"--gres=gpu:2", "--cpus-per-task=4", "--mem=8192", "hetjob", "--nodes=1", "--ntasks=1", "--cpus-per-task=2", "--mem=1024"}
+	if !reflect.DeepEqual(directives, want) {
+		t.Errorf("#SBATCH lines = %v, want %v", directives, want)
+	}
+	for _, line := range []string{
+		"\nrunCtn trainer singularity run --nv docker://busybox\n",
+		"\nrunCtn loader srun --het-group=1 --ntasks=1 --nodes=1 singularity run docker://busybox\n",
+	} {
+		if !strings.Contains(script, line) {
+			t.Errorf("want %q, script:\n%s", strings.TrimSpace(line), script)
+		}
+	}
+}
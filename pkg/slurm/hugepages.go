@@ -0,0 +1,67 @@
+package slurm
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// podHugepages returns the number of hugepages requested by the containers of the pod, per page size (eg: "2Mi").
+// Init containers run before them, so they are not counted. Limits that are not a multiple of the page size are rounded up.
+func podHugepages(pod v1.Pod) map[string]int64 {
+	pages := map[string]int64{}
+	for _, container := range pod.Spec.Containers {
+		for name, quantity := range container.Resources.Limits {
+			if !strings.HasPrefix(string(name), v1.ResourceHugePagesPrefix) {
+				continue
+			}
+			pageSizeString := strings.TrimPrefix(string(name), v1.ResourceHugePagesPrefix)
+			pageSize, err := resource.ParseQuantity(pageSizeString)
+			if err != nil || pageSize.Value() <= 0 {
+				continue
+			}
+			pages[pageSizeString] += (quantity.Value() + pageSize.Value() - 1) / pageSize.Value()
+		}
+	}
+	return pages
+}
+
+// hugepagesGresFlags adds the hugepages requested by the pod to the --gres flag, as <HugepagesGresName>:<page size>:<pages> (eg: hugepages:2Mi:512).
+// An existing --gres flag is extended, otherwise a new one is added. Flags are returned unchanged if HugepagesGresName is not set.
+func hugepagesGresFlags(Ctx context.Context, config SlurmConfig, pod v1.Pod, flags []string) []string {
+	if config.HugepagesGresName == "" {
+		return flags
+	}
+	pages := podHugepages(pod)
+	if len(pages) == 0 {
+		return flags
+	}
+
+	pageSizes := make([]string, 0, len(pages))
+	for pageSize := range pages {
+		pageSizes = append(pageSizes, pageSize)
+	}
+	sort.Strings(pageSizes)
+	gres := []string{}
+	for _, pageSize := range pageSizes {
+		gres = append(gres, config.HugepagesGresName+":"+pageSize+":"+strconv.FormatInt(pages[pageSize], 10))
+	}
+	log.G(Ctx).Info("Requesting hugepages of pod " + pod.Name + " as gres " + strings.Join(gres, ","))
+
+	for i, flag := range flags {
+		if strings.HasPrefix(flag, "--gres=") {
+			flags[i] = flag + "," + strings.Join(gres, ",")
+			return flags
+		}
+		if flag == "--gres" && i+1 < len(flags) {
+			flags[i+1] = flags[i+1] + "," + strings.Join(gres, ",")
+			return flags
+		}
+	}
+	return append(flags, "--gres="+strings.Join(gres, ","))
+}
@@ -0,0 +1,53 @@
+package slurm
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestSubmitHugepages(t *testing.T) {
+	tests := []struct {
+		name      string
+		gresName  string
+		hugepages map[string]string
+		wantGres  []string
+	}{
+		{name: "HugepagesGresName not set", hugepages: map[string]string{"hugepages-2Mi": "1Gi"}},
+		{name: "no hugepages", gresName: "hugepages"},
+		{name: "2Mi pages", gresName: "hugepages", hugepages: map[string]string{"hugepages-2Mi": "1Gi"}, wantGres: []string{"--gres=hugepages:2Mi:512"}},
+		{
+			name:      "2Mi and 1Gi pages",
+			gresName:  "hugepages",
+			hugepages: map[string]string{"hugepages-2Mi": "3M", "hugepages-1Gi": "2Gi"},
+			wantGres:  []string{"--gres=hugepages:1Gi:2,hugepages:2Mi:2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.HugepagesGresName = test.gresName
+			container := testContainer("app", "1", "1Gi")
+			for name, quantity := range test.hugepages {
+				container.Resources.Limits[v1.ResourceName(name)] = resource.MustParse(quantity)
+			}
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(container)})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			gres := []string{}
+			for _, line := range strings.Split(readJobScript(t, path), "\n") {
+				if flag, found := strings.CutPrefix(line, "#SBATCH "); found && strings.HasPrefix(flag, "--gres") {
+					gres = append(gres, flag)
+				}
+			}
+			if strings.Join(gres, " ") != strings.Join(test.wantGres, " ") {
+				t.Errorf("#SBATCH --gres lines = %v, want %v", gres, test.wantGres)
+			}
+		})
+	}
+}
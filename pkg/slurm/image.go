@@ -0,0 +1,105 @@
+package slurm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	exec "github.com/alexellis/go-execute/pkg/v1"
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// imageTransports are the singularity image URIs that are used as they are, without adding the image prefix.
+var imageTransports = []string{"docker://", "docker-archive://", "docker-daemon://", "oci://", "oci-archive://", "oras://", "library://", "shub://", "http://", "https://"}
+
+// resolveImageCommand runs ImageResolveCommand with the image of the container as first argument.
+// Its output is the image URI given to singularity, eg: a .sif path on a shared filesystem for images converted by the site,
+// or an empty output to fall back to the image prefix. A non-zero exit code rejects the pod.
+func resolveImageCommand(Ctx context.Context, config SlurmConfig, image string) (string, error) {
+	shell := exec.ExecTask{
+		Command: config.BashPath,
+		Args:    []string{"-c", config.ImageResolveCommand, "image-resolve", image},
+	}
+	execReturn, err := shell.Execute()
+	if err != nil {
+		return "", err
+	}
+	if execReturn.ExitCode != 0 {
+		return "", errors.New("image resolve command exited with code " + strconv.Itoa(execReturn.ExitCode) + " for image " + image + ": " + execReturn.Stderr)
+	}
+	resolved := strings.TrimSpace(execReturn.Stdout)
+	if resolved != "" {
+		log.G(Ctx).Info("Image " + image + " resolved to " + resolved)
+	}
+	return resolved, nil
+}
+
+// hasImageTransport returns true if the image already is a singularity image URI, eg: oras://registry/image:tag.
+func hasImageTransport(image string) bool {
+	for _, transport := range imageTransports {
+		if strings.HasPrefix(image, transport) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixedImage adds to the image the slurm-job.vk.io/image-root annotation of the pod, or ImagePrefix.
+// Absolute paths, images with a transport and images already starting with the prefix are returned unchanged.
+func prefixedImage(Ctx context.Context, config SlurmConfig, pod v1.Pod, image string) string {
+	imagePrefix := config.ImagePrefix
+
+	imagePrefixAnnotationFound := false
+	if imagePrefixAnnotation, ok := pod.Annotations["slurm-job.vk.io/image-root"]; ok {
+		// This takes precedence over ImagePrefix
+		imagePrefix = imagePrefixAnnotation
+		imagePrefixAnnotationFound = true
+	}
+	log.G(Ctx).Info("imagePrefix from annotation? ", imagePrefixAnnotationFound, " value: ", imagePrefix)
+
+	// If imagePrefix begins with "/", then it must be an absolute path instead of for example docker://some/image.
+	// The file should be one of https://docs.sylabs.io/guides/3.1/user-guide/cli/singularity_run.html#synopsis format.
+	if strings.HasPrefix(image, "/") {
+		log.G(Ctx).Warningf("image set to %s is an absolute path. Prefix won't be added.", image)
+	} else if hasImageTransport(image) && !strings.HasPrefix(image, imagePrefix) {
+		log.G(Ctx).Warningf("image set to %s already has a transport. Prefix won't be added.", image)
+	} else if !strings.HasPrefix(image, imagePrefix) {
+		image = imagePrefix + image
+	} else {
+		log.G(Ctx).Warningf("imagePrefix set to %s but already present in the image name %s. Prefix won't be added.", imagePrefix, image)
+	}
+	return image
+}
+
+// localImageTransports are the singularity image URIs of images on the local filesystem.
+var localImageTransports = []string{"docker-archive://", "oci://", "oci-archive://"}
+
+// checkLocalImage returns an error if the image of a container with the Never pull policy is not already on the filesystem, eg: a .sif file or a
+// sandbox directory, since singularity would pull the others. Paths are checked on the sidecar host, that shares them with the SLURM nodes.
+func checkLocalImage(containerName string, image string) error {
+	path := image
+	for _, transport := range localImageTransports {
+		path = strings.TrimPrefix(path, transport)
+	}
+	if strings.HasPrefix(image, "docker-daemon://") {
+		// Read from the docker daemon of the node, which is never pulled by singularity.
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return errors.New("image " + image + " of container " + containerName + " is not present on the filesystem and its pull policy is Never")
+	}
+	// oci:// and docker-archive:// may end with a :tag or a @digest after the path.
+	path, _, _ = strings.Cut(path, "@")
+	if _, err := os.Stat(path); err != nil {
+		if index := strings.LastIndex(path, ":"); index > 0 {
+			if _, errWithoutTag := os.Stat(path[:index]); errWithoutTag == nil {
+				return nil
+			}
+		}
+		return errors.New("image " + image + " of container " + containerName + " is not present and its pull policy is Never: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package slurm
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSubmitImageRouting(t *testing.T) {
+	// Images converted by the site are on the shared filesystem, the others are pulled from their registry.
+	const resolver = `case "$1" in converted/*) echo "/lustre/images/${1#converted/}.sif" ;; rejected/*) exit 1 ;; esac`
+	tests := []struct {
+		name           string
+		image          string
+		resolveCommand string
+		wantImage      string
+		wantCode       int
+	}{
+		{name: "sif path", image: "/lustre/images/app.sif", wantImage: "/lustre/images/app.sif", wantCode: http.StatusOK},
+		{name: "OCI reference", image: "ghcr.io/org/app:1.0", wantImage: "docker://ghcr.io/org/app:1.0", wantCode: http.StatusOK},
+		{name: "image with a transport", image: "oras://ghcr.io/org/app:1.0", wantImage: "oras://ghcr.io/org/app:1.0", wantCode: http.StatusOK},
+		{name: "image resolved to a sif path", image: "converted/app", resolveCommand: resolver, wantImage: "/lustre/images/app.sif", wantCode: http.StatusOK},
+		{name: "image not resolved", image: "ghcr.io/org/app:1.0", resolveCommand: resolver, wantImage: "docker://ghcr.io/org/app:1.0", wantCode: http.StatusOK},
+		{name: "image rejected", image: "rejected/app", resolveCommand: resolver, wantCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.ImageResolveCommand = test.resolveCommand
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Spec.Containers[0].Image = test.image
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			script := readJobScript(t, path)
+			if !strings.Contains(script, "runCtn app singularity run "+test.wantImage+"\n") {
+				t.Errorf("want the image %s run by singularity, script:\n%s", test.wantImage, script)
+			}
+		})
+	}
+}
+
+func TestSubmitPullPolicyNever(t *testing.T) {
+	images := t.TempDir()
+	writeTestFile(t, images, "app.sif", "")
+	writeTestFile(t, images, "app.tar", "")
+	tests := []struct {
+		name       string
+		image      string
+		pullPolicy v1.PullPolicy
+		wantCode   int
+	}{
+		{name: "present sif", image: filepath.Join(images, "app.sif"), pullPolicy: v1.PullNever, wantCode: http.StatusOK},
+		{name: "present archive with a tag", image: "oci-archive://" + filepath.Join(images, "app.tar") + ":1.0", pullPolicy: v1.PullNever, wantCode: http.StatusOK},
+		{name: "docker daemon", image: "docker-daemon://app:1.0", pullPolicy: v1.PullNever, wantCode: http.StatusOK},
+		{name: "missing sif", image: filepath.Join(images, "missing.sif"), pullPolicy: v1.PullNever, wantCode: http.StatusBadRequest},
+		{name: "registry image", image: "ghcr.io/org/app:1.0", pullPolicy: v1.PullNever, wantCode: http.StatusBadRequest},
+		{name: "missing sif pulled if not present", image: filepath.Join(images, "missing.sif"), pullPolicy: v1.PullIfNotPresent, wantCode: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			submitted := filepath.Join(stubs, "submitted")
+			config := testSubmitConfig(t)
+			config.EnforcePullPolicyNever = true
+			config.Sbatchpath = writeTestExecutable(t, stubs, "sbatch", `touch `+submitted+`
+echo "Submitted batch job 123"`)
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Spec.Containers[0].Image = test.image
+			pod.Spec.Containers[0].ImagePullPolicy = test.pullPolicy
+			w, _ := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if _, err := os.Stat(submitted); (err == nil) != (test.wantCode == http.StatusOK) {
+				t.Errorf("job submitted = %v, want %v", err == nil, test.wantCode == http.StatusOK)
+			}
+		})
+	}
+
+	if err := checkLocalImage("app", filepath.Join(images, "missing.sif")); err == nil || !strings.Contains(err.Error(), "pull policy is Never") {
+		t.Errorf("checkLocalImage() error = %v, want the pull policy in the error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package slurm
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// kerberosCheckInterval is how long a ticket checked by ensureKerberosTicket is trusted before klist is run again.
+const kerberosCheckInterval = time.Minute
+
+var (
+	kerberosMutex     sync.Mutex
+	kerberosCheckedAt time.Time
+)
+
+// kinitCommand returns the kinit command acquiring a ticket from KerberosKeytab, for KerberosPrincipal if set, or for the host principal as kinit -k does.
+func kinitCommand(config SlurmConfig) []string {
+	command := []string{config.KinitPath, "-k", "-t", config.KerberosKeytab}
+	if config.KerberosPrincipal != "" {
+		command = append(command, config.KerberosPrincipal)
+	}
+	return command
+}
+
+// ensureKerberosTicket makes sure that the sidecar has a valid Kerberos ticket before it runs a SLURM command, if KerberosKeytab is set.
+// The ticket is checked with klist -s at most every kerberosCheckInterval, and acquired again with kinit once it is missing or expired.
+func ensureKerberosTicket(ctx context.Context, config SlurmConfig) error {
+	if config.KerberosKeytab == "" {
+		return nil
+	}
+	kerberosMutex.Lock()
+	defer kerberosMutex.Unlock()
+	if time.Since(kerberosCheckedAt) < kerberosCheckInterval {
+		return nil
+	}
+	if exec.Command(config.KlistPath, "-s").Run() != nil {
+		log.G(ctx).Info("No valid Kerberos ticket, acquiring one from " + config.KerberosKeytab)
+		command := kinitCommand(config)
+		output, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+		if err != nil {
+			kerberosCheckedAt = time.Time{}
+			return fmt.Errorf("unable to acquire a Kerberos ticket with %s: %w: %s", strings.Join(command, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	kerberosCheckedAt = time.Now()
+	return nil
+}
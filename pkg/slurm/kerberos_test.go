@@ -0,0 +1,95 @@
+package slurm
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+)
+
+func TestSubmitKerberosTicket(t *testing.T) {
+	t.Cleanup(func() { kerberosCheckedAt = time.Time{} })
+	stubs := t.TempDir()
+	calls := filepath.Join(stubs, "calls")
+	ticket := filepath.Join(stubs, "ticket")
+	config := testSubmitConfig(t)
+	config.KerberosKeytab = "/etc/sidecar.keytab"
+	config.KerberosPrincipal = "sidecar@EXAMPLE.ORG"
+	config.KlistPath = writeTestExecutable(t, stubs, "klist", `echo "klist $@" >> `+calls+`
+test -e `+ticket)
+	config.KinitPath = writeTestExecutable(t, stubs, "kinit", `echo "kinit $@" >> `+calls+`
+touch `+ticket)
+	config.Sbatchpath = writeTestExecutable(t, stubs, "sbatch", `echo "sbatch" >> `+calls+`
+echo "Submitted batch job 123"`)
+
+	tests := []struct {
+		name      string
+		setup     func()
+		wantCalls []string
+	}{
+		{
+			name:      "no ticket",
+			setup:     func() { kerberosCheckedAt = time.Time{} },
+			wantCalls: []string{"klist -s", "kinit -k -t /etc/sidecar.keytab sidecar@EXAMPLE.ORG", "sbatch"},
+		},
+		{
+			name:      "ticket recently checked",
+			setup:     func() {},
+			wantCalls: []string{"sbatch"},
+		},
+		{
+			name:      "valid ticket",
+			setup:     func() { kerberosCheckedAt = time.Time{} },
+			wantCalls: []string{"klist -s", "sbatch"},
+		},
+		{
+			name: "expired ticket",
+			setup: func() {
+				kerberosCheckedAt = time.Time{}
+				os.Remove(ticket)
+			},
+			wantCalls: []string{"klist -s", "kinit -k -t /etc/sidecar.keytab sidecar@EXAMPLE.ORG", "sbatch"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(calls)
+			test.setup()
+			w, _ := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(testContainer("app", "1", "1Gi"))})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			content, err := os.ReadFile(calls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSpace(string(content)), "\n"); strings.Join(got, "\n") != strings.Join(test.wantCalls, "\n") {
+				t.Errorf("called %q, want %q", got, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestEnsureKerberosTicketKinitFailure(t *testing.T) {
+	t.Cleanup(func() { kerberosCheckedAt = time.Time{} })
+	kerberosCheckedAt = time.Time{}
+	stubs := t.TempDir()
+	config := testSLURMConfig()
+	config.KerberosKeytab = "/etc/sidecar.keytab"
+	config.KlistPath = writeTestExecutable(t, stubs, "klist", "exit 1")
+	config.KinitPath = writeTestExecutable(t, stubs, "kinit", `echo "kinit: Keytab contains no suitable keys" >&2
+exit 1`)
+
+	err := ensureKerberosTicket(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "Keytab contains no suitable keys") {
+		t.Errorf("ensureKerberosTicket() error = %v, want the kinit error", err)
+	}
+	if !kerberosCheckedAt.IsZero() {
+		t.Errorf("ticket trusted after a failed kinit")
+	}
+}
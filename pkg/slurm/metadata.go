@@ -0,0 +1,146 @@
+package slurm
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const podMetadataFile = "PodMetadata.json"
+
+// PodMetadata holds information about a submitted pod that is useful to operators and to the sidecar itself.
+// It is stored as JSON in the working directory of the pod.
+type PodMetadata struct {
+	PodName        string                        `json:"PodName"`
+	PodNamespace   string                        `json:"PodNamespace"`
+	PodUID         string                        `json:"PodUID"`
+	Labels         map[string]string             `json:"Labels,omitempty"`
+	ContainerPorts map[string][]v1.ContainerPort `json:"ContainerPorts,omitempty"`
+	Accounting     *JobAccounting                `json:"Accounting,omitempty"`
+	NodeList       string                        `json:"NodeList,omitempty"`
+	NodeFeatures   []string                      `json:"NodeFeatures,omitempty"`
+	// CPU and Memory (in bytes) are the limits of the job, used for NamespaceResourceCaps.
+	CPU    int64 `json:"CPU,omitempty"`
+	Memory int64 `json:"Memory,omitempty"`
+}
+
+// newPodMetadata collects the metadata of the provided pod.
+func newPodMetadata(pod v1.Pod) PodMetadata {
+	metadata := PodMetadata{
+		PodName:      pod.Name,
+		PodNamespace: pod.Namespace,
+		PodUID:       string(pod.UID),
+		Labels:       pod.Labels,
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if len(container.Ports) > 0 {
+			if metadata.ContainerPorts == nil {
+				metadata.ContainerPorts = make(map[string][]v1.ContainerPort)
+			}
+			metadata.ContainerPorts[container.Name] = container.Ports
+		}
+	}
+
+	return metadata
+}
+
+// writePodMetadata stores the metadata as JSON in the working directory of the pod.
+func writePodMetadata(path string, metadata PodMetadata) error {
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+"/"+podMetadataFile, metadataBytes, 0644)
+}
+
+// readPodMetadata loads the metadata stored in the working directory of the pod.
+func readPodMetadata(path string) (PodMetadata, error) {
+	var metadata PodMetadata
+	metadataBytes, err := os.ReadFile(path + "/" + podMetadataFile)
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(metadataBytes, &metadata)
+	return metadata, err
+}
+
+// formatPortsComment returns the declared container ports in the form "ports=container:port/protocol,..." to be used as job comment.
+// Returns an empty string if no port is declared.
+func formatPortsComment(pod v1.Pod) string {
+	var ports []string
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			protocol := string(port.Protocol)
+			if protocol == "" {
+				protocol = string(v1.ProtocolTCP)
+			}
+			ports = append(ports, container.Name+":"+strconv.Itoa(int(port.ContainerPort))+"/"+protocol)
+		}
+	}
+	if len(ports) == 0 {
+		return ""
+	}
+	return "ports=" + strings.Join(ports, ",")
+}
+
+// commentFieldValue returns the value of a field of CommentFields for the pod: name, namespace, uid, serviceAccount, label:<key> or annotation:<key>.
+// It is false for labels and annotations the pod does not have.
+func commentFieldValue(pod v1.Pod, field string) (string, string, bool) {
+	switch field {
+	case "name":
+		return field, pod.Name, true
+	case "namespace":
+		return field, pod.Namespace, true
+	case "uid":
+		return field, string(pod.UID), true
+	case "serviceAccount":
+		return field, pod.Spec.ServiceAccountName, true
+	}
+	if key, found := strings.CutPrefix(field, "label:"); found {
+		value, ok := pod.Labels[key]
+		return key, value, ok
+	}
+	if key, found := strings.CutPrefix(field, "annotation:"); found {
+		value, ok := pod.Annotations[key]
+		return key, value, ok
+	}
+	return "", "", false
+}
+
+// validCommentField tells if a field of CommentFields is known.
+func validCommentField(field string) bool {
+	switch field {
+	case "name", "namespace", "uid", "serviceAccount":
+		return true
+	}
+	return (strings.HasPrefix(field, "label:") && field != "label:") || (strings.HasPrefix(field, "annotation:") && field != "annotation:")
+}
+
+// escapeCommentValue escapes the separators of the structured comment with a backslash. Whitespace and double quotes, that sbatch does not
+// keep in #SBATCH lines, are replaced by underscores.
+func escapeCommentValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, ";", `\;`, "=", `\=`).Replace(value)
+	return strings.Map(func(r rune) rune {
+		if r == '"' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// formatStructuredComment returns the CommentFields of the pod in the form "key=value;key2=value2" to be used as job comment, so that they
+// can be parsed from sacct --format=Comment. Returns an empty string if the pod has none of the fields.
+func formatStructuredComment(config SlurmConfig, pod v1.Pod) string {
+	pairs := []string{}
+	for _, field := range config.CommentFields {
+		if key, value, ok := commentFieldValue(pod, field); ok {
+			pairs = append(pairs, escapeCommentValue(key)+"="+escapeCommentValue(value))
+		}
+	}
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,79 @@
+package slurm
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSubmitContainerPorts(t *testing.T) {
+	for _, portsInJobComment := range []bool{false, true} {
+		config := testSubmitConfig(t)
+		config.PortsInJobComment = portsInJobComment
+		app := testContainer("app", "1", "1Gi")
+		app.Ports = []v1.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "metrics", ContainerPort: 9090, Protocol: v1.ProtocolUDP}}
+		w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(app, testContainer("sidecar", "1", "1Gi"))})
+		if w.Code != http.StatusOK {
+			t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+
+		metadata, err := readPodMetadata(path)
+		if err != nil {
+			t.Fatalf("readPodMetadata() error = %v", err)
+		}
+		if want := map[string][]v1.ContainerPort{"app": app.Ports}; !reflect.DeepEqual(metadata.ContainerPorts, want) {
+			t.Errorf("ContainerPorts = %v, want %v", metadata.ContainerPorts, want)
+		}
+
+		script := readJobScript(t, path)
+		if got := strings.Contains(script, "#SBATCH --comment=ports=app:8080/TCP,app:9090/UDP\n"); got != portsInJobComment {
+			t.Errorf("PortsInJobComment %v: ports in the job comment = %v, script:\n%s", portsInJobComment, got, script)
+		}
+	}
+}
+
+func TestFormatStructuredComment(t *testing.T) {
+	pod := testPod(testContainer("app", "1", "1Gi"))
+	pod.Labels = map[string]string{"app": "web", "team": "a;b=c"}
+	pod.Annotations["owner"] = "jane doe"
+	pod.Spec.ServiceAccountName = "runner"
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{name: "no fields"},
+		{name: "pod fields", fields: []string{"name", "namespace", "uid", "serviceAccount"}, want: "name=test;namespace=default;uid=test-uid;serviceAccount=runner"},
+		{name: "label and annotation", fields: []string{"label:app", "annotation:owner"}, want: "app=web;owner=jane_doe"},
+		{name: "escaped separators", fields: []string{"label:team"}, want: `team=a\;b\=c`},
+		{name: "missing label", fields: []string{"label:missing", "name"}, want: "name=test"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.CommentFields = test.fields
+			if got := formatStructuredComment(config, pod); got != test.want {
+				t.Errorf("formatStructuredComment() = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	config := testSubmitConfig(t)
+	config.CommentFields = []string{"namespace", "label:app"}
+	config.PortsInJobComment = true
+	app := testContainer("app", "1", "1Gi")
+	app.Ports = []v1.ContainerPort{{ContainerPort: 8080}}
+	pod = testPod(app)
+	pod.Labels = map[string]string{"app": "web"}
+	w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+	if w.Code != http.StatusOK {
+		t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if script := readJobScript(t, path); !strings.Contains(script, "#SBATCH --comment=namespace=default;app=web;ports=app:8080/TCP\n") {
+		t.Errorf("structured comment missing from the script:\n%s", script)
+	}
+}
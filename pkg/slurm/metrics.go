@@ -0,0 +1,94 @@
+package slurm
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRuntime is the container runtime label of the metrics, the only one this plugin runs.
+const metricsRuntime = "singularity"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "interlink_slurm_requests_total",
+		Help: "Requests received by the sidecar, by handler (submit, delete, status), runtime and outcome (ok, error).",
+	}, []string{"handler", "runtime", "outcome"})
+
+	slurmCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "interlink_slurm_command_duration_seconds",
+		Help:    "Duration of the sbatch, squeue, sacct and scancel calls, by command and outcome (ok, error).",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"command", "outcome"})
+
+	trackedJobsOnce sync.Once
+)
+
+// metricsOutcome returns the outcome label of a request or a command.
+func metricsOutcome(failed bool) string {
+	if failed {
+		return "error"
+	}
+	return "ok"
+}
+
+// observeSlurmCommand records the duration of a call of a SLURM command started at start, named after the binary of its path.
+func observeSlurmCommand(command string, start time.Time, failed bool) {
+	slurmCommandDuration.WithLabelValues(filepath.Base(command), metricsOutcome(failed)).Observe(time.Since(start).Seconds())
+}
+
+// metricsResponseWriter keeps the status code written by a handler.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *metricsResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *metricsResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush lets the wrapped handlers stream their response, as the logs in follow mode do.
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CountRequests wraps a handler of the sidecar to count its requests in interlink_slurm_requests_total, as errors if it answers with a status code of 400 or more.
+func CountRequests(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metricsWriter := &metricsResponseWriter{ResponseWriter: w}
+		handler(metricsWriter, r)
+		requestsTotal.WithLabelValues(handlerName, metricsRuntime, metricsOutcome(metricsWriter.statusCode >= http.StatusBadRequest)).Inc()
+	}
+}
+
+// MetricsHandler returns the handler serving the metrics of the sidecar in the Prometheus format, including the number of jobs it tracks.
+func (h *SidecarHandler) MetricsHandler() http.Handler {
+	trackedJobsOnce.Do(func() {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "interlink_slurm_tracked_jobs",
+			Help: "Jobs currently tracked by the sidecar.",
+		}, func() float64 {
+			jidsMutex.RLock()
+			defer jidsMutex.RUnlock()
+			return float64(len(*h.JIDs))
+		})
+	})
+	return promhttp.Handler()
+}
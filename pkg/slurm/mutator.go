@@ -0,0 +1,77 @@
+package slurm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	exec "github.com/alexellis/go-execute/pkg/v1"
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// PodSpecMutator transforms a pod before it is translated into a SLURM job, eg: to apply site policies
+// such as default annotations, sidecar removal or image substitution.
+type PodSpecMutator interface {
+	MutatePod(ctx context.Context, pod v1.Pod) (v1.Pod, error)
+}
+
+// CommandPodSpecMutator runs an external command receiving the pod as JSON on stdin and writing the transformed pod as JSON on stdout.
+// A non-zero exit code rejects the pod.
+type CommandPodSpecMutator struct {
+	BashPath string
+	Command  string
+}
+
+func (m CommandPodSpecMutator) MutatePod(ctx context.Context, pod v1.Pod) (v1.Pod, error) {
+	podBytes, err := json.Marshal(pod)
+	if err != nil {
+		return v1.Pod{}, err
+	}
+
+	shell := exec.ExecTask{
+		Command: m.BashPath,
+		Args:    []string{"-c", m.Command},
+		Stdin:   bytes.NewReader(podBytes),
+	}
+	execReturn, err := shell.Execute()
+	if err != nil {
+		return v1.Pod{}, err
+	}
+	if execReturn.ExitCode != 0 {
+		return v1.Pod{}, errors.New("pod transform command exited with code " + strconv.Itoa(execReturn.ExitCode) + ": " + execReturn.Stderr)
+	}
+
+	var mutatedPod v1.Pod
+	err = json.Unmarshal([]byte(execReturn.Stdout), &mutatedPod)
+	if err != nil {
+		return v1.Pod{}, fmt.Errorf("could not parse the output of the pod transform command: %w", err)
+	}
+	return mutatedPod, nil
+}
+
+// mutatePod applies the PodSpecMutator of the handler, or the PodTransformCommand of the config if no mutator is registered.
+// Without any of them the pod is returned as is.
+func (h *SidecarHandler) mutatePod(ctx context.Context, pod v1.Pod) (v1.Pod, error) {
+	mutator := h.Mutator
+	if mutator == nil && h.Config.PodTransformCommand != "" {
+		mutator = CommandPodSpecMutator{BashPath: h.Config.BashPath, Command: h.Config.PodTransformCommand}
+	}
+	if mutator == nil {
+		return pod, nil
+	}
+
+	mutatedPod, err := mutator.MutatePod(ctx, pod)
+	if err != nil {
+		return v1.Pod{}, err
+	}
+	// The identity of the pod is used to track the job, it cannot be changed.
+	if mutatedPod.Name != pod.Name || mutatedPod.Namespace != pod.Namespace || mutatedPod.UID != pod.UID {
+		return v1.Pod{}, errors.New("the pod mutator changed the name, namespace or UID of pod " + pod.Namespace + "/" + pod.Name)
+	}
+	log.G(ctx).Debug("Pod ", pod.Namespace, "/", pod.Name, " mutated before translation")
+	return mutatedPod, nil
+}
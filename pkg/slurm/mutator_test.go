@@ -0,0 +1,68 @@
+package slurm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+// testMutator is a PodSpecMutator calling the function.
+type testMutator func(pod v1.Pod) v1.Pod
+
+func (m testMutator) MutatePod(ctx context.Context, pod v1.Pod) (v1.Pod, error) {
+	return m(pod), nil
+}
+
+func TestSubmitMutator(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutator  testMutator
+		wantCode int
+		wantFlag bool
+	}{
+		{name: "no mutator", wantCode: http.StatusOK},
+		{
+			name: "mutator setting a default annotation",
+			mutator: func(pod v1.Pod) v1.Pod {
+				if pod.Annotations == nil {
+					pod.Annotations = map[string]string{}
+				}
+				pod.Annotations["slurm-job.vk.io/flags"] = "--exclusive"
+				return pod
+			},
+			wantCode: http.StatusOK,
+			wantFlag: true,
+		},
+		{
+			name: "mutator changing the UID",
+			mutator: func(pod v1.Pod) v1.Pod {
+				pod.UID = "other-uid"
+				return pod
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := SidecarHandler{Config: testSubmitConfig(t)}
+			if test.mutator != nil {
+				h.Mutator = test.mutator
+			}
+			w, path := testSubmitWithHandler(t, h, commonIL.RetrievedPodData{Pod: testPod(testContainer("app", "1", "1Gi"))})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			script := readJobScript(t, path)
+			if got := strings.Contains(script, "#SBATCH --exclusive\n"); got != test.wantFlag {
+				t.Errorf("--exclusive emitted = %v, want %v, script:\n%s", got, test.wantFlag, script)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package slurm
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	exec "github.com/alexellis/go-execute/pkg/v1"
+	"github.com/containerd/containerd/log"
+
+	"go.opentelemetry.io/otel/attribute"
+	trace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+// getJobNodeList returns the nodes allocated to the job, in SLURM hostlist format (eg: "node[01-02]").
+func getJobNodeList(config SlurmConfig, jid string, cluster string) (string, error) {
+	shell := exec.ExecTask{
+		Command: config.Squeuepath,
+		Args:    append([]string{"--noheader", "-a", "--states=all", "-O", "NodeList", "-j", jid}, clusterFlags(cluster)...),
+		Shell:   true,
+	}
+
+	execReturn, err := shell.Execute()
+	if err != nil {
+		return "", err
+	}
+	if execReturn.Stderr != "" {
+		return "", errors.New("could not get the nodes of job " + jid + ": " + execReturn.Stderr)
+	}
+	return strings.TrimSpace(stripClusterHeader(execReturn.Stdout)), nil
+}
+
+// synchronousSubmitPollInterval is the delay between the squeue calls of waitJobStarted.
+var synchronousSubmitPollInterval = 2 * time.Second
+
+// waitJobStarted polls squeue until the job is not waiting anymore, eg: RUNNING or already ended, until timeout or until ctx is done.
+// It returns the last state of the job and its nodes, empty while it is pending or once SLURM forgot it.
+func waitJobStarted(ctx context.Context, config SlurmConfig, jid string, cluster string, timeout time.Duration) (string, string, error) {
+	deadline := time.After(timeout)
+	for {
+		shell := exec.ExecTask{
+			Command: config.Squeuepath,
+			Args:    append([]string{"--noheader", "-a", "--states=all", "-O", "State,NodeList", "-j", jid}, clusterFlags(cluster)...),
+			Shell:   true,
+		}
+		execReturn, err := executeSlurmQuery(ctx, config, shell)
+		if err != nil {
+			return "", "", err
+		}
+		if execReturn.Stderr != "" {
+			return "", "", errors.New("could not get the state of job " + jid + ": " + execReturn.Stderr)
+		}
+		state, nodeList := "", ""
+		if fields := strings.Fields(stripClusterHeader(execReturn.Stdout)); len(fields) > 0 {
+			state = fields[0]
+			if len(fields) > 1 {
+				nodeList = fields[1]
+			}
+		}
+		if state != "PENDING" && state != "CONFIGURING" && state != "REQUEUED" {
+			return state, nodeList, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return state, "", ctx.Err()
+		case <-deadline:
+			log.G(ctx).Info("Job " + jid + " still " + state + " after the SynchronousSubmitTimeout")
+			return state, "", nil
+		case <-time.After(synchronousSubmitPollInterval):
+		}
+	}
+}
+
+// getNodeFeatures returns the features (sinfo %f) of the provided nodes.
+func getNodeFeatures(config SlurmConfig, nodeList string, cluster string) ([]string, error) {
+	shell := exec.ExecTask{
+		Command: config.Sinfopath,
+		Args:    append([]string{"--noheader", "-n", nodeList, "-o", "%f"}, clusterFlags(cluster)...),
+		Shell:   true,
+	}
+
+	execReturn, err := shell.Execute()
+	if err != nil {
+		return nil, err
+	}
+	if execReturn.Stderr != "" {
+		return nil, errors.New("could not get the features of nodes " + nodeList + ": " + execReturn.Stderr)
+	}
+	return parseNodeFeatures(stripClusterHeader(execReturn.Stdout)), nil
+}
+
+// parseNodeFeatures merges the comma separated features of every sinfo line, eg: "gpu,a100\ngpu,v100" gives [a100 gpu v100].
+func parseNodeFeatures(output string) []string {
+	featureSet := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		for _, feature := range strings.Split(strings.TrimSpace(line), ",") {
+			// sinfo reports "(null)" for nodes without features.
+			if feature != "" && feature != "(null)" {
+				featureSet[feature] = true
+			}
+		}
+	}
+
+	features := make([]string, 0, len(featureSet))
+	for feature := range featureSet {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// collectNodeFeatures returns the nodes where the job runs and their features.
+func collectNodeFeatures(ctx context.Context, config SlurmConfig, jid string, cluster string) (string, []string, error) {
+	nodeList, err := getJobNodeList(config, jid, cluster)
+	if err != nil {
+		return "", nil, err
+	}
+	if nodeList == "" {
+		return "", nil, errors.New("no node allocated to job " + jid)
+	}
+
+	features, err := getNodeFeatures(config, nodeList, cluster)
+	if err != nil {
+		return "", nil, err
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("job.nodelist", nodeList),
+		attribute.StringSlice("job.nodefeatures", features),
+	)
+	log.G(ctx).Debug("Job ", jid, " runs on nodes ", nodeList, " with features ", features)
+
+	return nodeList, features, nil
+}
+
+// nodeExists returns true if sinfo knows the node.
+func nodeExists(config SlurmConfig, node string, cluster string) (bool, error) {
+	shell := exec.ExecTask{
+		Command: config.Sinfopath,
+		Args:    append([]string{"--noheader", "-N", "-n", node, "-o", "%N"}, clusterFlags(cluster)...),
+		Shell:   true,
+	}
+
+	execReturn, err := shell.Execute()
+	if err != nil {
+		return false, err
+	}
+	if execReturn.Stderr != "" {
+		return false, errors.New("could not get node " + node + ": " + execReturn.Stderr)
+	}
+	return strings.TrimSpace(stripClusterHeader(execReturn.Stdout)) != "", nil
+}
+
+// nodeNameSbatchFlags maps the spec.nodeName of a pre-scheduled pod to --nodelist, and to --exclusive if NodeNameExclusive is set.
+// With ValidateNodeName, nodes unknown to SLURM are skipped: pods bound to the virtual node carry its name, which is not a SLURM node.
+func nodeNameSbatchFlags(ctx context.Context, config SlurmConfig, pod v1.Pod) []string {
+	node := pod.Spec.NodeName
+	if node == "" {
+		return nil
+	}
+
+	if config.ValidateNodeName {
+		exists, err := nodeExists(config, node, podClusterName(config, pod))
+		if err != nil {
+			log.G(ctx).Warning("Unable to check node ", node, " of pod ", pod.Name, ", ignoring its nodeName: ", err)
+			return nil
+		}
+		if !exists {
+			log.G(ctx).Info("Node ", node, " of pod ", pod.Name, " is not a SLURM node, ignoring its nodeName")
+			return nil
+		}
+	}
+
+	flags := []string{"--nodelist=" + node}
+	if config.NodeNameExclusive {
+		flags = append(flags, "--exclusive")
+	}
+	log.G(ctx).Info("Node name of ", pod.Name, " translated to ", flags)
+	return flags
+}
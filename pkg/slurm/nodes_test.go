@@ -0,0 +1,173 @@
+package slurm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+)
+
+func TestParseNodeFeatures(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{name: "one node", output: "gpu,a100\n", want: []string{"a100", "gpu"}},
+		{name: "nodes with different features", output: "gpu,a100\ngpu,v100\n", want: []string{"a100", "gpu", "v100"}},
+		{name: "node without features", output: "(null)\n", want: []string{}},
+		{name: "no output", output: "", want: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseNodeFeatures(test.output); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseNodeFeatures(%q) = %v, want %v", test.output, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStoreNodeFeatures(t *testing.T) {
+	stubs := t.TempDir()
+	config := testSLURMConfig()
+	config.Squeuepath = writeTestExecutable(t, stubs, "squeue", `echo "gpu[01-02]"`)
+	config.Sinfopath = writeTestExecutable(t, stubs, "sinfo", `echo "gpu,a100,ib"; echo "gpu,a100"`)
+	path := t.TempDir()
+	h := SidecarHandler{Config: config, Ctx: context.Background()}
+	jid := &JidStruct{JID: "123", PodUID: "test-uid", PodNamespace: "default"}
+
+	h.storeNodeFeatures(context.Background(), path, jid)
+	metadata, err := readPodMetadata(path)
+	if err != nil {
+		t.Fatalf("readPodMetadata() error = %v", err)
+	}
+	if metadata.NodeList != "gpu[01-02]" {
+		t.Errorf("NodeList = %q, want gpu[01-02]", metadata.NodeList)
+	}
+	if want := []string{"a100", "gpu", "ib"}; !reflect.DeepEqual(metadata.NodeFeatures, want) {
+		t.Errorf("NodeFeatures = %v, want %v", metadata.NodeFeatures, want)
+	}
+	if !jid.NodeFeaturesCollected {
+		t.Errorf("NodeFeaturesCollected = false, want the features collected once")
+	}
+}
+
+func TestSubmitNodeName(t *testing.T) {
+	tests := []struct {
+		name          string
+		nodeName      string
+		disabled      bool
+		exclusive     bool
+		validate      bool
+		sinfoOutput   string
+		wantDirective []string
+	}{
+		{name: "no nodeName"},
+		{name: "nodeName", nodeName: "cn01", wantDirective: []string{"#SBATCH --nodelist=cn01"}},
+		{name: "NodeNameExclusive", nodeName: "cn01", exclusive: true, wantDirective: []string{"#SBATCH --nodelist=cn01", "#SBATCH --exclusive"}},
+		{name: "SLURM node", nodeName: "cn01", validate: true, sinfoOutput: "cn01", wantDirective: []string{"#SBATCH --nodelist=cn01"}},
+		{name: "virtual node", nodeName: "interlink-slurm", validate: true},
+		{name: "TranslateNodeName disabled", nodeName: "cn01", disabled: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.TranslateNodeName = !test.disabled
+			config.NodeNameExclusive = test.exclusive
+			config.ValidateNodeName = test.validate
+			config.Sinfopath = writeTestExecutable(t, t.TempDir(), "sinfo", "echo "+test.sinfoOutput)
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Spec.NodeName = test.nodeName
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			script := readJobScript(t, path)
+			for _, directive := range test.wantDirective {
+				if !strings.Contains(script, directive+"\n") {
+					t.Errorf("want %s, script:\n%s", directive, script)
+				}
+			}
+			if len(test.wantDirective) == 0 && strings.Contains(script, "--nodelist") {
+				t.Errorf("--nodelist set for node %q, script:\n%s", test.nodeName, script)
+			}
+		})
+	}
+}
+
+// testStartingSqueue writes a squeue stub printing the job as PENDING for the first calls, then RUNNING on cn01.
+func testStartingSqueue(t *testing.T, stubs string, pendingCalls int) string {
+	t.Helper()
+	calls := filepath.Join(stubs, "squeue-calls")
+	return writeTestExecutable(t, stubs, "squeue", `echo "$@" >> `+calls+`
+if [ "$(wc -l < `+calls+`)" -le `+strconv.Itoa(pendingCalls)+` ]; then
+	echo "PENDING"
+else
+	echo "RUNNING cn01"
+fi`)
+}
+
+func TestSubmitSynchronous(t *testing.T) {
+	pollInterval := synchronousSubmitPollInterval
+	synchronousSubmitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { synchronousSubmitPollInterval = pollInterval })
+
+	for _, synchronous := range []bool{false, true} {
+		stubs := t.TempDir()
+		config := testSubmitConfig(t)
+		config.SynchronousSubmit = synchronous
+		config.SynchronousSubmitTimeout = 10
+		config.Squeuepath = testStartingSqueue(t, stubs, 2)
+		w, _ := testSubmit(t, config, commonIL.RetrievedPodData{Pod: testPod(testContainer("app", "1", "1Gi"))})
+		if w.Code != http.StatusOK {
+			t.Fatalf("SynchronousSubmit %v: SubmitHandler() status = %d, want %d: %s", synchronous, w.Code, http.StatusOK, w.Body)
+		}
+
+		returnedJID := CreateStruct{}
+		if err := json.Unmarshal(w.Body.Bytes(), &returnedJID); err != nil {
+			t.Fatal(err)
+		}
+		want := CreateStruct{PodUID: "test-uid", PodJID: "123"}
+		wantCalls := 0
+		if synchronous {
+			want.JobState, want.NodeList = "RUNNING", "cn01"
+			wantCalls = 3
+		}
+		if returnedJID != want {
+			t.Errorf("SynchronousSubmit %v: SubmitHandler() = %+v, want %+v", synchronous, returnedJID, want)
+		}
+		content, _ := os.ReadFile(filepath.Join(stubs, "squeue-calls"))
+		if calls := strings.Count(string(content), "\n"); calls != wantCalls {
+			t.Errorf("SynchronousSubmit %v: squeue called %d times, want %d", synchronous, calls, wantCalls)
+		}
+	}
+}
+
+func TestWaitJobStartedPending(t *testing.T) {
+	pollInterval := synchronousSubmitPollInterval
+	synchronousSubmitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { synchronousSubmitPollInterval = pollInterval })
+	config := testSLURMConfig()
+	config.Squeuepath = testStartingSqueue(t, t.TempDir(), 1000)
+
+	state, nodeList, err := waitJobStarted(context.Background(), config, "123", "", 50*time.Millisecond)
+	if state != "PENDING" || nodeList != "" || err != nil {
+		t.Errorf("waitJobStarted() after the timeout = %q, %q, %v, want PENDING without nodes", state, nodeList, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	state, _, err = waitJobStarted(ctx, config, "123", "", time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("waitJobStarted() with a cancelled context = %q, %v, want %v", state, err, context.Canceled)
+	}
+}
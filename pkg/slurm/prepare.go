@@ -8,18 +8,23 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"al.essio.dev/pkg/shellescape"
 	exec2 "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/containerd/containerd/log"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
@@ -32,12 +37,15 @@ type SidecarHandler struct {
 	Config SlurmConfig
 	JIDs   *map[string]*JidStruct
 	Ctx    context.Context
+	// Mutator, if set, transforms every pod before it is translated. See PodSpecMutator.
+	Mutator PodSpecMutator
 }
 
 var (
-	prefix       string
 	timer        time.Time
 	cachedStatus []commonIL.PodStatus
+	// statusPollDelay is how long cachedStatus is served before querying squeue again, see statusPollInterval.
+	statusPollDelay time.Duration
 )
 
 type JidStruct struct {
@@ -46,11 +54,68 @@ type JidStruct struct {
 	JID          string    `json:"JID"`
 	StartTime    time.Time `json:"StartTime"`
 	EndTime      time.Time `json:"EndTime"`
+	// Cluster is the SLURM cluster the job was submitted to, empty for the local cluster.
+	Cluster string `json:"Cluster,omitempty"`
+	// SubmitUser is the user the job was submitted as with SubmitAsUserCommand, empty for the user running the sidecar.
+	SubmitUser string `json:"SubmitUser,omitempty"`
+	// AccountingCollected is true once the accounting of the terminated job has been stored in the pod metadata.
+	AccountingCollected bool `json:"-"`
+	// NodeFeaturesCollected is true once the features of the nodes of the job have been stored in the pod metadata.
+	NodeFeaturesCollected bool `json:"-"`
+	// MissingSince is when the job was first found neither in squeue nor in sacct, see AccountingLagGrace.
+	MissingSince time.Time `json:"-"`
+	// FinalState and FinalExitCode are the terminal sacct state and exit code of a job that left squeue, so that sacct is queried only once.
+	FinalState    string `json:"-"`
+	FinalExitCode string `json:"-"`
 }
 
+const (
+	// ResourceFloorClamp raises the limits below the floor to the floor.
+	ResourceFloorClamp = "clamp"
+	// ResourceFloorError rejects pods whose limits are below the floor.
+	ResourceFloorError = "error"
+)
+
+const (
+	// ResourceScopeLimits sizes the job from the resource limits of the containers.
+	ResourceScopeLimits = "limits"
+	// ResourceScopeRequests sizes the job from the resource requests of the containers.
+	ResourceScopeRequests = "requests"
+	// ResourceScopeMax sizes the job from the largest of the requests and limits of each container.
+	ResourceScopeMax = "max"
+)
+
+const (
+	// ResourceAggregationPod sizes the job as Kubernetes sizes a pod: the app containers summed, at least the largest init container.
+	ResourceAggregationPod = "pod"
+	// ResourceAggregationMax sizes the job from the largest container, app or init, eg: for containers that run one after the other.
+	ResourceAggregationMax = "max"
+)
+
+const (
+	// MountConflictError rejects pods with conflicting mount destinations.
+	MountConflictError = "error"
+	// MountConflictLastWins keeps the last of the conflicting mounts and logs a warning.
+	MountConflictLastWins = "last-wins"
+)
+
+const (
+	// InitContainerResourceShared runs init containers directly in the job, with the whole allocation.
+	InitContainerResourceShared = "shared"
+	// InitContainerResourceStep runs each init container in its own srun step, sized with its own limits.
+	InitContainerResourceStep = "step"
+)
+
 type ResourceLimits struct {
 	CPU    int64
 	Memory int64
+	// CPUFraction is the requested CPU when below 1 (e.g. 0.25 for 250m). It is only set if AllowOversubscribe is enabled.
+	CPUFraction float64
+	// GPUs are the GPUs requested by the containers, by SLURM gres name (see GPUGresNames).
+	GPUs map[string]int64
+	// GPUType and GPUTypeCount are the typed GPUs requested by the containers, by SLURM gpu type (see TypedGpuMap).
+	GPUType      string
+	GPUTypeCount int64
 }
 
 type SingularityCommand struct {
@@ -61,6 +126,21 @@ type SingularityCommand struct {
 	containerArgs      []string
 	readinessProbes    []ProbeCommand
 	livenessProbes     []ProbeCommand
+	startupProbes      []ProbeCommand
+	stdinFile          string
+	// registryAuthFile, if set, exports the credentials of the image registry, see prepareRegistryCredentials.
+	registryAuthFile string
+}
+
+// withoutEmptyArgs removes the empty strings (eg: options not set) from args, so that they do not end up as stray empty arguments in the runtime command.
+func withoutEmptyArgs(args []string) []string {
+	nonEmptyArgs := []string{}
+	for _, arg := range args {
+		if strings.TrimSpace(arg) != "" {
+			nonEmptyArgs = append(nonEmptyArgs, arg)
+		}
+	}
+	return nonEmptyArgs
 }
 
 // stringToHex encodes the provided str string into a hex string and removes all trailing redundant zeroes to keep the output more compact
@@ -120,6 +200,7 @@ func (h *SidecarHandler) CreateDirectories() error {
 
 // LoadJIDs loads Job IDs into the main JIDs struct from files in the root folder.
 // It's useful went down and needed to be restarded, but there were jobs running, for example.
+// Jobs that SLURM does not know anymore are not loaded, see jobStillKnown.
 // Return only error in case of failure
 func (h *SidecarHandler) LoadJIDs() error {
 	path := h.Config.DataRootFolder
@@ -181,14 +262,88 @@ func (h *SidecarHandler) LoadJIDs() error {
 					log.G(h.Ctx).Debug(err)
 				}
 			}
-			JIDEntry := JidStruct{PodUID: string(podUID), PodNamespace: string(podNamespace), JID: string(JID), StartTime: StartedAt, EndTime: FinishedAt}
+
+			// Only written for jobs submitted to a specific cluster.
+			cluster, err := os.ReadFile(path + entry.Name() + "/" + "Cluster.name")
+			if err != nil && !os.IsNotExist(err) {
+				log.G(h.Ctx).Debug(err)
+			}
+			// Only written for jobs submitted with SubmitAsUserCommand.
+			submitUser, err := os.ReadFile(path + entry.Name() + "/" + "SubmitUser.name")
+			if err != nil && !os.IsNotExist(err) {
+				log.G(h.Ctx).Debug(err)
+			}
+			JIDEntry := JidStruct{PodUID: string(podUID), PodNamespace: string(podNamespace), JID: string(JID), StartTime: StartedAt, EndTime: FinishedAt, Cluster: string(cluster), SubmitUser: string(submitUser)}
+			if JIDEntry.EndTime.IsZero() && !h.jobStillKnown(JIDEntry) {
+				log.G(h.Ctx).Warning("Job ", JIDEntry.JID, " of pod ", JIDEntry.PodUID, " is neither in squeue nor in the accounting anymore, not recovering it")
+				continue
+			}
+			jidsMutex.Lock()
 			(*h.JIDs)[string(podUID)] = &JIDEntry
+			jidsMutex.Unlock()
 		}
 	}
 
 	return nil
 }
 
+// jobStillKnown tells if a job recovered by LoadJIDs is still in squeue or in the accounting, eg: not lost while the sidecar was down.
+// Without Sacctpath, or when SLURM cannot be queried, the job is kept, since its status files can still tell its state.
+func (h *SidecarHandler) jobStillKnown(jid JidStruct) bool {
+	if h.Config.Sacctpath == "" {
+		return true
+	}
+	shell := exec2.ExecTask{
+		Command: h.Config.Squeuepath,
+		Args:    append([]string{"--noheader", "-a", "--states=all", "-O", "StateCompact", "-j", jid.JID}, clusterFlags(jid.Cluster)...),
+		Shell:   true,
+	}
+	execReturn, err := executeSlurmQuery(h.Ctx, h.Config, shell)
+	if err != nil || (execReturn.Stderr == "" && strings.TrimSpace(stripClusterHeader(execReturn.Stdout)) != "") {
+		return true
+	}
+	if execReturn.Stderr != "" && !strings.Contains(execReturn.Stderr, "Invalid job id") {
+		return true
+	}
+	state, _, err := getSacctJobState(h.Ctx, h.Config, jid.JID, jid.Cluster)
+	return err != nil || state != ""
+}
+
+// truncateAttrValue truncates value to maxLen bytes (without splitting a character) followed by an ellipsis, to keep large values
+// such as certificates out of span attributes and logs. Values are kept intact if maxLen is 0.
+func truncateAttrValue(value string, maxLen int) string {
+	if maxLen <= 0 || len(value) <= maxLen {
+		return value
+	}
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + "..."
+}
+
+// defaultSensitiveEnvPatterns are the SensitiveEnvPatterns used when the config does not set them.
+var defaultSensitiveEnvPatterns = []string{"*TOKEN*", "*SECRET*", "*PASSWORD*"}
+
+// isSensitiveEnv tells if the name of an environment variable matches one of SensitiveEnvPatterns, ignoring the case.
+func isSensitiveEnv(config SlurmConfig, name string) bool {
+	for _, pattern := range config.SensitiveEnvPatterns {
+		if matched, _ := filepath.Match(strings.ToUpper(pattern), strings.ToUpper(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedEnvValue returns the value of an environment variable as reported in the traces and logs: *** for sensitive variables,
+// see isSensitiveEnv, otherwise the value truncated to MaxAttrValueLen.
+func redactedEnvValue(config SlurmConfig, name string, value string) string {
+	if isSensitiveEnv(config, name) {
+		return "***"
+	}
+	return truncateAttrValue(value, config.MaxAttrValueLen)
+}
+
 func createEnvFile(Ctx context.Context, config SlurmConfig, podData commonIL.RetrievedPodData, container v1.Container) ([]string, []string, error) {
 	envs := []string{}
 	// For debugging purpose only
@@ -212,14 +367,19 @@ func createEnvFile(Ctx context.Context, config SlurmConfig, podData commonIL.Ret
 		tmpValue := shellescape.Quote(envVar.Value)
 		tmp := (envVar.Name + "=" + tmpValue)
 
-		envs_data = append(envs_data, tmp)
+		// The full value goes to the envfile, only the traces and logs get a redacted or truncated one.
+		if isSensitiveEnv(config, envVar.Name) {
+			envs_data = append(envs_data, envVar.Name+"=***")
+		} else {
+			envs_data = append(envs_data, truncateAttrValue(tmp, config.MaxAttrValueLen))
+		}
 
 		_, err := envfile.WriteString(tmp + "\n")
 		if err != nil {
 			log.G(Ctx).Error(err)
 			return nil, nil, err
 		} else {
-			log.G(Ctx).Debug("---- Written envfile file " + envfilePath + " key " + envVar.Name + " value " + tmpValue)
+			log.G(Ctx).Debug("---- Written envfile file " + envfilePath + " key " + envVar.Name + " value " + redactedEnvValue(config, envVar.Name, tmpValue))
 		}
 	}
 
@@ -311,6 +471,175 @@ func getPodVolume(pod *v1.Pod, volumeName string) (*v1.Volume, error) {
 	return nil, fmt.Errorf("could not find volume %s in pod %s", volumeName, pod.Name)
 }
 
+// compileImagePatterns compiles the AllowedImagePatterns, anchored since an image must fully match one of them.
+func compileImagePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %s in AllowedImagePatterns: %w", pattern, err)
+		}
+		regexes = append(regexes, regex)
+	}
+	return regexes, nil
+}
+
+// checkImageAllowed returns an error if the image does not fully match any of the AllowedImagePatterns regular expressions.
+// An empty list of patterns allows every image. The patterns are compiled by NewSlurmConfig, or here for a config that does not come from it.
+func checkImageAllowed(config SlurmConfig, image string) error {
+	if len(config.AllowedImagePatterns) == 0 {
+		return nil
+	}
+	regexes := config.allowedImageRegexes
+	if len(regexes) != len(config.AllowedImagePatterns) {
+		var err error
+		regexes, err = compileImagePatterns(config.AllowedImagePatterns)
+		if err != nil {
+			return err
+		}
+	}
+	for _, regex := range regexes {
+		if regex.MatchString(image) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s is not allowed by the site policy (AllowedImagePatterns)", image)
+}
+
+// containerResource returns the quantity of a resource of the container used to size the job, per ResourceScope.
+func containerResource(config SlurmConfig, container v1.Container, name v1.ResourceName) resource.Quantity {
+	limit := container.Resources.Limits[name]
+	request := container.Resources.Requests[name]
+	switch config.ResourceScope {
+	case ResourceScopeRequests:
+		return request
+	case ResourceScopeMax:
+		if request.Cmp(limit) > 0 {
+			return request
+		}
+		return limit
+	default:
+		return limit
+	}
+}
+
+// podResources returns the CPUs and memory (in bytes) needed by the pod, per ResourceAggregation. With the pod aggregation, as Kubernetes computes them:
+// containers run together, so their resources are summed, while init containers run one at a time before them, so only the largest one counts.
+// With the max aggregation, the largest CPUs and memory of any container, app or init. A container without a resource does not lower it, 0 means not set.
+func podResources(config SlurmConfig, pod v1.Pod) (float64, int64) {
+	var cpu, initCPU float64
+	var memory, initMemory int64
+	for _, container := range pod.Spec.Containers {
+		cpuQuantity, memoryQuantity := containerResource(config, container, v1.ResourceCPU), containerResource(config, container, v1.ResourceMemory)
+		if config.ResourceAggregation == ResourceAggregationMax {
+			cpu = math.Max(cpu, cpuQuantity.AsApproximateFloat64())
+			memory = max(memory, memoryQuantity.Value())
+			continue
+		}
+		cpu += cpuQuantity.AsApproximateFloat64()
+		memory += memoryQuantity.Value()
+	}
+	for _, container := range pod.Spec.InitContainers {
+		cpuQuantity, memoryQuantity := containerResource(config, container, v1.ResourceCPU), containerResource(config, container, v1.ResourceMemory)
+		initCPU = math.Max(initCPU, cpuQuantity.AsApproximateFloat64())
+		if memoryQuantity.Value() > initMemory {
+			initMemory = memoryQuantity.Value()
+		}
+	}
+	if initMemory > memory {
+		memory = initMemory
+	}
+	return math.Max(cpu, initCPU), memory
+}
+
+// memoryFloorMB returns the minimum memory of a job in MB: MemoryFloorMB, at least 1 since --mem=0 means the whole memory of the node.
+func memoryFloorMB(config SlurmConfig) int64 {
+	if config.MemoryFloorMB < 1 {
+		return 1
+	}
+	return int64(config.MemoryFloorMB)
+}
+
+// applyResourceFloor checks that the limits aggregated from the pod are at least 1 CPU and MemoryFloorMB of memory.
+// Limits below the floor are raised to it, or rejected if ResourceFloorMode is "error". Default limits are not checked, they already use the floor.
+func applyResourceFloor(Ctx context.Context, config SlurmConfig, resourceLimits *ResourceLimits, isDefaultCPU bool, isDefaultRam bool) error {
+	if !isDefaultCPU && resourceLimits.CPU < 1 {
+		if config.ResourceFloorMode == ResourceFloorError {
+			return fmt.Errorf("CPU limit %d is below the minimum of 1 CPU", resourceLimits.CPU)
+		}
+		log.G(Ctx).Warning("CPU limit ", resourceLimits.CPU, " is below the minimum, using 1 CPU")
+		resourceLimits.CPU = 1
+	}
+
+	floor := memoryFloorMB(config) * 1024 * 1024
+	if !isDefaultRam && resourceLimits.Memory < floor {
+		if config.ResourceFloorMode == ResourceFloorError {
+			return fmt.Errorf("memory limit of %d bytes is below the minimum of %dMB (MemoryFloorMB)", resourceLimits.Memory, memoryFloorMB(config))
+		}
+		log.G(Ctx).Warning("Memory limit of ", resourceLimits.Memory, " bytes is below the minimum, using ", memoryFloorMB(config), "MB")
+		resourceLimits.Memory = floor
+	}
+	return nil
+}
+
+// checkHostNamespaces returns an error if the pod requests the host network, PID or IPC namespaces and AllowHostNamespaces is not set.
+func checkHostNamespaces(config SlurmConfig, pod v1.Pod) error {
+	if config.AllowHostNamespaces {
+		return nil
+	}
+	var requested []string
+	if pod.Spec.HostNetwork {
+		requested = append(requested, "hostNetwork")
+	}
+	if pod.Spec.HostPID {
+		requested = append(requested, "hostPID")
+	}
+	if pod.Spec.HostIPC {
+		requested = append(requested, "hostIPC")
+	}
+	if len(requested) > 0 {
+		return fmt.Errorf("pod %s requests %s, which is not allowed by the site policy (AllowHostNamespaces)", pod.Name, strings.Join(requested, ", "))
+	}
+	return nil
+}
+
+// sysctlAllowed returns true if the sysctl matches a name of AllowSysctls, or a prefix ending with "*" (eg: net.ipv4.*).
+func sysctlAllowed(config SlurmConfig, name string) bool {
+	for _, allowed := range config.AllowSysctls {
+		if allowed == name || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSysctls returns an error if the pod sets sysctls that are not in AllowSysctls.
+// Singularity cannot set sysctls for a container, so the allowed ones are not applied: they are expected to be set on the nodes.
+func checkSysctls(Ctx context.Context, config SlurmConfig, pod v1.Pod) error {
+	if pod.Spec.SecurityContext == nil || len(pod.Spec.SecurityContext.Sysctls) == 0 {
+		return nil
+	}
+	var rejected, ignored []string
+	for _, sysctl := range pod.Spec.SecurityContext.Sysctls {
+		if sysctlAllowed(config, sysctl.Name) {
+			ignored = append(ignored, sysctl.Name+"="+sysctl.Value)
+		} else {
+			rejected = append(rejected, sysctl.Name)
+		}
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("pod %s sets sysctls %s, which are not allowed by the site policy (AllowSysctls)", pod.Name, strings.Join(rejected, ", "))
+	}
+	log.G(Ctx).Warning("Sysctls " + strings.Join(ignored, ", ") + " of pod " + pod.Name + " are allowed but cannot be set by singularity, using the values of the node")
+	return nil
+}
+
+// isSkippableMissingSource tells if a ConfigMap or Secret missing from the retrieved pod data can be skipped with a warning.
+// Only sources marked as optional are skipped, unless StrictMounts is enabled, in which case any missing source fails the submission.
+func isSkippableMissingSource(config SlurmConfig, optional *bool) bool {
+	return !config.StrictMounts && optional != nil && *optional
+}
+
 func prepareMountsSimpleVolume(
 	Ctx context.Context,
 	config SlurmConfig,
@@ -320,8 +649,9 @@ func prepareMountsSimpleVolume(
 	volumeMount v1.VolumeMount,
 	volume v1.Volume,
 	mountedDataSB *strings.Builder,
+	scriptPrefix *strings.Builder,
 ) error {
-	volumesHostToContainerPaths, envVarNames, err := mountData(Ctx, config, container, volumeObject, volumeMount, volume, workingPath)
+	volumesHostToContainerPaths, envVarNames, fileModes, err := mountData(Ctx, config, container, volumeObject, volumeMount, volume, workingPath, scriptPrefix)
 	if err != nil {
 		log.G(Ctx).Error(err)
 		return err
@@ -333,17 +663,19 @@ func prepareMountsSimpleVolume(
 		if os.Getenv("SHARED_FS") != "true" {
 			filePathSplitted := strings.Split(volumesHostToContainerPath, ":")
 			hostFilePath := filePathSplitted[0]
-			hostFilePathSplitted := strings.Split(hostFilePath, "/")
-			hostParentDir := filepath.Join(hostFilePathSplitted[:len(hostFilePathSplitted)-1]...)
+			hostParentDir := filepath.Dir(hostFilePath)
 
 			// Creates parent dir of the file, then create empty file.
-			prefix += "\nmkdir -p \"" + hostParentDir + "\" && touch " + hostFilePath
+			scriptPrefix.WriteString("\nmkdir -p \"" + hostParentDir + "\" && touch \"" + hostFilePath + "\"")
 
 			// Puts content of the file thanks to env var. Note: the envVarNames has the same number and order that volumesHostToContainerPaths.
 			envVarName := envVarNames[filePathIndex]
 			splittedEnvName := strings.Split(envVarName, "_")
 			log.G(Ctx).Info(splittedEnvName[len(splittedEnvName)-1])
-			prefix += "\necho \"${" + envVarName + "}\" > \"" + hostFilePath + "\""
+			scriptPrefix.WriteString("\necho \"${" + envVarName + "}\" > \"" + hostFilePath + "\"")
+
+			// The mode of the volume is applied last, since a read-only mode, eg: 0400 of secrets, would prevent writing the content.
+			scriptPrefix.WriteString("\nchmod " + strconv.FormatUint(uint64(fileModes[filePathIndex].Perm()), 8) + " \"" + hostFilePath + "\"")
 		}
 		mountedDataSB.WriteString(" --bind ")
 		mountedDataSB.WriteString(volumesHostToContainerPath)
@@ -351,11 +683,117 @@ func prepareMountsSimpleVolume(
 	return nil
 }
 
+// mountEnvVarRegex matches the lines of the script prefix written by prepareMountsSimpleVolume, that fill a mounted file from an env var.
+var mountEnvVarRegex = regexp.MustCompile(`(?m)^echo "\$\{([^}]+)\}" > `)
+
+// mountEnvVarNames returns the names of the env vars filling the configMap, secret and projected files in the script prefix, without SHARED_FS.
+// They are set in the environment of the sidecar, so they only reach the job if sbatch gets and exports them.
+func mountEnvVarNames(scriptPrefix string) []string {
+	names := []string{}
+	for _, match := range mountEnvVarRegex.FindAllStringSubmatch(scriptPrefix, -1) {
+		if !containsString(names, match[1]) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// prepareStdin writes the ConfigMap key referenced by the slurm-job.vk.io/stdin-configmap annotation ("<configmap>/<key>")
+// in the working directory and returns the path of the file, to be redirected into the container stdin.
+// The ConfigMap must be referenced by the container (e.g. as a volume), otherwise it is not retrieved by interLink.
+func prepareStdin(Ctx context.Context, podData *commonIL.RetrievedPodData, container *v1.Container, workingPath string) (string, error) {
+	stdinRef, ok := podData.Pod.Annotations["slurm-job.vk.io/stdin-configmap"]
+	if !ok {
+		return "", nil
+	}
+	configMapName, key, found := strings.Cut(stdinRef, "/")
+	if !found || configMapName == "" || key == "" {
+		return "", fmt.Errorf("invalid slurm-job.vk.io/stdin-configmap annotation %q, expected <configmap>/<key>", stdinRef)
+	}
+
+	retrievedContainer, err := getRetrievedContainer(podData, container.Name)
+	if err != nil {
+		return "", err
+	}
+	configMap, err := getRetrievedConfigMap(retrievedContainer, configMapName, container.Name, podData.Pod.Name)
+	if err != nil {
+		return "", err
+	}
+	content, ok := configMap.Data[key]
+	if !ok {
+		return "", fmt.Errorf("could not find key %s in configMap %s for the stdin of container %s", key, configMapName, container.Name)
+	}
+
+	stdinPath := filepath.Join(workingPath, "stdin-"+container.Name)
+	err = os.WriteFile(stdinPath, []byte(content), 0644)
+	if err != nil {
+		return "", err
+	}
+	log.G(Ctx).Info("-- Stdin of container ", container.Name, " read from configMap ", configMapName, " key ", key)
+	return stdinPath, nil
+}
+
+// initContainerStepCommand returns the srun command running an init container in a job step sized with its own limits.
+// Limits not set are not passed, the step then uses the srun defaults. The step cannot exceed the job allocation,
+// which is already sized on the biggest container.
+func initContainerStepCommand(config SlurmConfig, container v1.Container) []string {
+	stepCommand := []string{config.Srunpath, "--ntasks=1", "--nodes=1", "--exact"}
+	cpuQuantity, memoryQuantity := containerResource(config, container, v1.ResourceCPU), containerResource(config, container, v1.ResourceMemory)
+	if cpu := cpuQuantity.AsApproximateFloat64(); cpu > 0 {
+		stepCommand = append(stepCommand, "--cpus-per-task="+strconv.FormatInt(int64(math.Ceil(cpu)), 10))
+	}
+	if memory := memoryQuantity.Value(); memory > 0 {
+		stepCommand = append(stepCommand, "--mem="+strconv.FormatInt(int64(math.Ceil(float64(memory)/1024/1024)), 10))
+	}
+	return stepCommand
+}
+
+// resolveMountConflicts checks the destinations of the container volume mounts for duplicates. Conflicts are rejected, or only the last mount
+// is kept with a warning, per MountConflictPolicy. Nested mounts are kept, as in Kubernetes, and ordered parent first, since singularity
+// applies the --bind flags in order and a later mount of a parent path would shadow them.
+func resolveMountConflicts(Ctx context.Context, config SlurmConfig, container *v1.Container) ([]v1.VolumeMount, error) {
+	volumeMounts := []v1.VolumeMount{}
+	for i, volumeMount := range container.VolumeMounts {
+		destination := filepath.Clean(volumeMount.MountPath)
+		var shadowedBy *v1.VolumeMount
+		for j := i + 1; j < len(container.VolumeMounts); j++ {
+			if destination == filepath.Clean(container.VolumeMounts[j].MountPath) {
+				shadowedBy = &container.VolumeMounts[j]
+				break
+			}
+		}
+		if shadowedBy == nil {
+			volumeMounts = append(volumeMounts, volumeMount)
+			continue
+		}
+
+		if config.MountConflictPolicy == MountConflictError {
+			return nil, fmt.Errorf("mount of volume %s at %s in container %s conflicts with mount of volume %s at %s",
+				volumeMount.Name, volumeMount.MountPath, container.Name, shadowedBy.Name, shadowedBy.MountPath)
+		}
+		log.G(Ctx).Warningf("mount of volume %s at %s in container %s is shadowed by mount of volume %s at %s, skipping it",
+			volumeMount.Name, volumeMount.MountPath, container.Name, shadowedBy.Name, shadowedBy.MountPath)
+	}
+	sort.SliceStable(volumeMounts, func(i, j int) bool {
+		return mountDepth(volumeMounts[i].MountPath) < mountDepth(volumeMounts[j].MountPath)
+	})
+	return volumeMounts, nil
+}
+
+// mountDepth returns the number of components of the mount path, 0 for /.
+func mountDepth(mountPath string) int {
+	destination := filepath.Clean(mountPath)
+	if destination == "/" {
+		return 0
+	}
+	return strings.Count(destination, "/")
+}
+
 // prepareMounts iterates along the struct provided in the data parameter and checks for ConfigMaps, Secrets and EmptyDirs to be mounted.
 // For each element found, the mountData function is called.
 // In this context, the general case is given by host and container not sharing the file system, so data are stored within ENVS with matching names.
 // The content of these ENVS will be written to a text file by the generated SLURM script later, so the container will be able to mount these files.
-// The command to write files is appended in the global "prefix" variable.
+// The commands to write files are appended to scriptPrefix, the prefix of the job script of the pod.
 // It returns a string composed as the singularity --bind command to bind mount directories and files and the first encountered error.
 func prepareMounts(
 	Ctx context.Context,
@@ -363,6 +801,7 @@ func prepareMounts(
 	podData *commonIL.RetrievedPodData,
 	container *v1.Container,
 	workingPath string,
+	scriptPrefix *strings.Builder,
 ) (string, error) {
 	span := trace.SpanFromContext(Ctx)
 	start := time.Now().UnixMicro()
@@ -380,12 +819,18 @@ func prepareMounts(
 	log.G(Ctx).Info("-- Created directory ", workingPath)
 	podName := podData.Pod.Name
 
-	for _, volumeMount := range container.VolumeMounts {
+	volumeMounts, err := resolveMountConflicts(Ctx, config, container)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+
+	for _, volumeMount := range volumeMounts {
 		volumePtr, err := getPodVolume(&podData.Pod, volumeMount.Name)
-		volume := *volumePtr
 		if err != nil {
 			return "", err
 		}
+		volume := *volumePtr
 
 		retrievedContainer, err := getRetrievedContainer(podData, container.Name)
 		if err != nil {
@@ -396,10 +841,14 @@ func prepareMounts(
 		case volume.ConfigMap != nil:
 			retrievedConfigMap, err := getRetrievedConfigMap(retrievedContainer, volume.ConfigMap.Name, container.Name, podName)
 			if err != nil {
+				if isSkippableMissingSource(config, volume.ConfigMap.Optional) {
+					log.G(Ctx).Warningf("optional configMap %s of volume %s not found, skipping mount: %s", volume.ConfigMap.Name, volume.Name, err)
+					continue
+				}
 				return "", err
 			}
 
-			err = prepareMountsSimpleVolume(Ctx, config, container, workingPath, *retrievedConfigMap, volumeMount, volume, &mountedDataSB)
+			err = prepareMountsSimpleVolume(Ctx, config, container, workingPath, *retrievedConfigMap, volumeMount, volume, &mountedDataSB, scriptPrefix)
 			if err != nil {
 				return "", err
 			}
@@ -419,7 +868,7 @@ func prepareMounts(
 					"either this is an error or this is because InterLink VK has DisableProjectedVolumes set to true.",
 					volume.Name, container.Name, podName, strings.Join(retrievedProjectedVolumeMapKeys, ","))
 			} else {
-				err = prepareMountsSimpleVolume(Ctx, config, container, workingPath, *retrievedProjectedVolumeMap, volumeMount, volume, &mountedDataSB)
+				err = prepareMountsSimpleVolume(Ctx, config, container, workingPath, *retrievedProjectedVolumeMap, volumeMount, volume, &mountedDataSB, scriptPrefix)
 				if err != nil {
 					return "", err
 				}
@@ -428,17 +877,21 @@ func prepareMounts(
 		case volume.Secret != nil:
 			retrievedSecret, err := getRetrievedSecret(retrievedContainer, volume.Secret.SecretName, container.Name, podName)
 			if err != nil {
+				if isSkippableMissingSource(config, volume.Secret.Optional) {
+					log.G(Ctx).Warningf("optional secret %s of volume %s not found, skipping mount: %s", volume.Secret.SecretName, volume.Name, err)
+					continue
+				}
 				return "", err
 			}
 
-			err = prepareMountsSimpleVolume(Ctx, config, container, workingPath, *retrievedSecret, volumeMount, volume, &mountedDataSB)
+			err = prepareMountsSimpleVolume(Ctx, config, container, workingPath, *retrievedSecret, volumeMount, volume, &mountedDataSB, scriptPrefix)
 			if err != nil {
 				return "", err
 			}
 
 		case volume.EmptyDir != nil:
 			// retrievedContainer.EmptyDirs is deprecated in favor of each plugin giving its own emptyDir path, that will be built in mountData().
-			edPath, _, err := mountData(Ctx, config, container, "emptyDir", volumeMount, volume, workingPath)
+			edPath, _, _, err := mountData(Ctx, config, container, "emptyDir", volumeMount, volume, workingPath, scriptPrefix)
 			if err != nil {
 				log.G(Ctx).Error(err)
 				return "", err
@@ -523,7 +976,7 @@ func prepareMounts(
 
 // produceSLURMScript generates a SLURM script according to data collected.
 // It must be called after ENVS and mounts are already set up since
-// it relies on "prefix" variable being populated with needed data and ENVS passed in the commands parameter.
+// it relies on scriptPrefix being populated by prepareMounts with needed data and ENVS passed in the commands parameter.
 // It returns the path to the generated script and the first encountered error.
 func produceSLURMScript(
 	Ctx context.Context,
@@ -535,15 +988,18 @@ func produceSLURMScript(
 	resourceLimits ResourceLimits,
 	isDefaultCPU bool,
 	isDefaultRam bool,
+	placementFlags []string,
+	hetComponents [][]string,
+	scriptPrefix *strings.Builder,
 ) (string, error) {
 	start := time.Now().UnixMicro()
 	span := trace.SpanFromContext(Ctx)
 	span.AddEvent("Producing SLURM script")
 
 	podUID := string(pod.UID)
+	prefix := scriptPrefix.String()
 
 	log.G(Ctx).Info("-- Creating file for the Slurm script")
-	prefix = ""
 	err := os.MkdirAll(path, os.ModePerm)
 	if err != nil {
 		log.G(Ctx).Error(err)
@@ -630,6 +1086,20 @@ func produceSLURMScript(
 		}
 	}
 
+	if config.SbatchExport != "" {
+		export := config.SbatchExport
+		// Without SHARED_FS, the mounted files are filled from env vars of sbatch, so they are always exported.
+		if mountEnvs := mountEnvVarNames(scriptPrefix.String()); export != "ALL" && len(mountEnvs) > 0 {
+			if export == "NONE" {
+				export = strings.Join(mountEnvs, ",")
+			} else {
+				export += "," + strings.Join(mountEnvs, ",")
+			}
+		}
+		// Prepended so that an --export in the slurm-job.vk.io/flags annotation still takes precedence.
+		sbatchFlagsFromArgo = append([]string{"--export=" + export}, sbatchFlagsFromArgo...)
+	}
+
 	if mpiFlags, ok := metadata.Annotations["slurm-job.vk.io/mpi-flags"]; ok {
 		if mpiFlags != "true" {
 			mpi := append([]string{"mpiexec", "-np", "$SLURM_NTASKS"}, strings.Split(mpiFlags, " ")...)
@@ -639,6 +1109,85 @@ func produceSLURMScript(
 		}
 	}
 
+	sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, placementFlags...)
+	sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, clusterFlags(podClusterName(config, pod))...)
+
+	partition, err := parsePartition(config, pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if partition != "" {
+		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--partition="+partition)
+	}
+
+	qos, err := parseQos(config, pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if qos != "" {
+		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--qos="+qos)
+	}
+
+	account, err := parseAccount(config, pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if account != "" {
+		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--account="+account)
+	}
+
+	timeLimit, err := parseTimeLimit(config, pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if timeLimit != "" {
+		if regexp.MustCompile(`(--time[ =]|-t ?[0-9])`).MatchString(metadata.Annotations["slurm-job.vk.io/flags"]) {
+			log.G(Ctx).Info("Time limit of pod " + pod.Name + " is already set in slurm-job.vk.io/flags, ignoring " + timeLimit)
+		} else {
+			sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--time="+timeLimit)
+		}
+	}
+
+	coreSpecFlags, err := parseCoreSpec(pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, coreSpecFlags...)
+
+	gpuFlags, err := gpuCountFlags(Ctx, pod, resourceLimits, metadata.Annotations["slurm-job.vk.io/flags"])
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, gpuFlags...)
+	sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, gpuGresFlags(Ctx, pod, resourceLimits, metadata.Annotations["slurm-job.vk.io/flags"])...)
+
+	spreadFlags, err := spreadJobFlags(Ctx, pod, metadata.Annotations["slurm-job.vk.io/flags"])
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, spreadFlags...)
+	sbatchFlagsFromArgo = hugepagesGresFlags(Ctx, config, pod, sbatchFlagsFromArgo)
+
+	gpuBind, err := parseGPUBind(pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if gpuBind != "" {
+		if podRequestsGPU(config, pod) {
+			sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--gpu-bind="+gpuBind)
+		} else {
+			log.G(Ctx).Warning("slurm-job.vk.io/gpu-bind annotation found on pod " + pod.Name + " but no GPU is requested, ignoring it")
+		}
+	}
+
 	if !isDefaultCPU {
 		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--cpus-per-task="+strconv.FormatInt(resourceLimits.CPU, 10))
 		log.G(Ctx).Info("Using CPU limit of " + strconv.FormatInt(resourceLimits.CPU, 10))
@@ -652,15 +1201,51 @@ func produceSLURMScript(
 	if !isDefaultRam {
 		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--mem="+strconv.FormatInt(resourceLimits.Memory/1024/1024, 10))
 	} else {
-		log.G(Ctx).Info("Using default Memory limit of 1MB")
+		log.G(Ctx).Info("Using default Memory limit of " + strconv.FormatInt(memoryFloorMB(config), 10) + "MB")
 		if !memoryLimitSetFromFlags {
-			sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--mem=1")
+			sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--mem="+strconv.FormatInt(memoryFloorMB(config), 10))
+		}
+	}
+
+	if config.MaxRequeue > 0 {
+		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--requeue")
+	}
+
+	comments := []string{}
+	if structuredComment := formatStructuredComment(config, pod); structuredComment != "" {
+		comments = append(comments, structuredComment)
+	}
+	if config.PortsInJobComment {
+		if portsComment := formatPortsComment(pod); portsComment != "" {
+			comments = append(comments, portsComment)
 		}
 	}
+	if len(comments) > 0 {
+		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--comment="+strings.Join(comments, ";"))
+	}
+
+	if resourceLimits.CPUFraction > 0 {
+		log.G(Ctx).Info("CPU request of " + strconv.FormatFloat(resourceLimits.CPUFraction, 'f', 3, 64) + " is below 1, allowing the job to share cores")
+		sbatchFlagsFromArgo = append(sbatchFlagsFromArgo, "--oversubscribe")
+		// SLURM can only allocate whole CPUs, so the actual fraction is exported as a hint for the workload.
+		prefix += "\nexport INTERLINK_CPU_FRACTION=" + strconv.FormatFloat(resourceLimits.CPUFraction, 'f', 3, 64) + "\n"
+	}
+
+	if config.ExportGPUUUIDs && podRequestsGPU(config, pod) {
+		// CUDA_VISIBLE_DEVICES is set by SLURM to the allocated GPUs, and the SINGULARITYENV_ copy survives --cleanenv/--containall.
+		prefix += "\nexport ALLOCATED_GPU_UUIDS=$(nvidia-smi --query-gpu=uuid --format=csv,noheader ${CUDA_VISIBLE_DEVICES:+-i \"${CUDA_VISIBLE_DEVICES}\"} | paste -sd, -)"
+		prefix += "\nexport SINGULARITYENV_ALLOCATED_GPU_UUIDS=\"${ALLOCATED_GPU_UUIDS}\"\n"
+	}
 
 	for _, slurmFlag := range sbatchFlagsFromArgo {
 		sbatchFlagsAsString += "\n#SBATCH " + slurmFlag
 	}
+	for _, componentFlags := range hetComponents {
+		sbatchFlagsAsString += "\n#SBATCH hetjob"
+		for _, slurmFlag := range append(hetInheritedFlags(sbatchFlagsFromArgo), componentFlags...) {
+			sbatchFlagsAsString += "\n#SBATCH " + slurmFlag
+		}
+	}
 
 	if config.Tsocks {
 		log.G(Ctx).Debug("--- Adding SSH connection and setting ENVs to use TSOCKS")
@@ -699,9 +1284,16 @@ func produceSLURMScript(
 		prefix += "\n" + preExecAnnotations
 	}
 
+	jobErrorFlag := ""
+	if config.SplitOutputStreams {
+		// Without --error, SLURM writes the stderr of the job script to the --output file.
+		jobErrorFlag = "\n#SBATCH --error=" + path + "/job.err"
+	}
+
 	sbatch_macros := "#!" + config.BashPath +
-		"\n#SBATCH --job-name=" + podUID +
+		"\n#SBATCH --job-name=" + slurmJobName(config, pod) +
 		"\n#SBATCH --output=" + path + "/job.out" +
+		jobErrorFlag +
 		sbatchFlagsAsString +
 		"\n" +
 		prefix + " " + f.Name() +
@@ -744,16 +1336,44 @@ waitFileExist() {
   done
 }
 
+# Print the GPUs of CUDA_VISIBLE_DEVICES from index $1 to $1 + $2 (excluded), to give each container its own GPUs.
+# All GPUs are printed if the job got less, eg: when they are requested in the sbatch flags.
+gpusOfCtn() {
+  IFS=, read -r -a jobGpus <<< "${CUDA_VISIBLE_DEVICES}"
+  if test "${#jobGpus[@]}" -lt "$(($1 + $2))" ; then
+    printf "%s" "${CUDA_VISIBLE_DEVICES}"
+  else
+    (IFS=, ; printf "%s" "${jobGpus[*]:$1:$2}")
+  fi
+}
+# Exported for the srun steps of the heterogeneous job components, see hetStepGPUEnv.
+export -f gpusOfCtn
+
+# Run the command with a copy of its stdout and stderr in $1.stdout and $1.stderr, the combined output still goes to the .out file.
+# See SlurmConfig.SplitOutputStreams.
+splitOutput() {
+  streamsPrefix="$1"
+  shift
+  "$@" > >(tee -a "${streamsPrefix}.stdout") 2> >(tee -a "${streamsPrefix}.stderr" >&2)
+}
+
 runInitCtn() {
   ctn="$1"
   shift
   printf "%s\n" "$(date -Is --utc) Running init container ${ctn}..."
-  time ( "$@" ) &> ${workingPath}/init-${ctn}.out
+  if test -n "${logPipe}" ; then
+    time ( "$@" ) &> >(tee ${workingPath}/init-${ctn}.out | bash -c "${logPipe}")
+  else
+    time ( "$@" ) &> ${workingPath}/init-${ctn}.out
+  fi
   exitCode="$?"
   printf "%s\n" "${exitCode}" > ${workingPath}/init-${ctn}.status
   waitFileExist "${workingPath}/init-${ctn}.status"
   if test "${exitCode}" != 0 ; then
     printf "%s\n" "$(date -Is --utc) InitContainer ${ctn} failed with status ${exitCode}" >&2
+    highestExitCode="${exitCode}"
+    requeueOnFailure
+    removeTmpScratch
     # InitContainers are fail-fast.
     exit "${exitCode}"
   fi
@@ -763,12 +1383,77 @@ runCtn() {
   ctn="$1"
   shift
   # This subshell below is NOT POSIX shell compatible, it needs for example bash.
-  time ( "$@" ) &> ${workingPath}/run-${ctn}.out &
+  # stdin is explicitly forwarded, otherwise background commands read from /dev/null.
+  # logPipe, if set, is a command receiving a copy of the output (see SlurmConfig.LogPipeCommand).
+  # The status file is written as soon as the container exits, so that the status path reports it while the other containers run.
+  (
+    if test -n "${logPipe}" ; then
+      time ( "$@" ) <&0 &> >(tee ${workingPath}/run-${ctn}.out | bash -c "${logPipe}")
+    else
+      time ( "$@" ) <&0 &> ${workingPath}/run-${ctn}.out
+    fi
+    exitCode="$?"
+    printf "%s\n" "${exitCode}" > "${workingPath}/run-${ctn}.status"
+    exit "${exitCode}"
+  ) <&0 &
   pid="$!"
   printf "%s\n" "$(date -Is --utc) Running in background ${ctn} pid ${pid}..."
   pidCtns="${pidCtns} ${pid}:${ctn}"
 }
 
+# Same as runCtn, but the container is restarted when requestCtnRestart is called by its liveness probe, up to maxLivenessRestarts times.
+runRestartableCtn() {
+  ctn="$1"
+  shift
+  printf "%s\n" "0" > ${workingPath}/restarts-${ctn}.count
+  : > ${workingPath}/run-${ctn}.out
+  (
+    restarts=0
+    while true ; do
+      rm -f "${workingPath}/restart-${ctn}.request"
+      startedAt="$(date -Is --utc)"
+      if test -n "${logPipe}" ; then
+        time ( "$@" ) <&0 &> >(tee -a ${workingPath}/run-${ctn}.out | bash -c "${logPipe}") &
+      else
+        time ( "$@" ) <&0 &>> ${workingPath}/run-${ctn}.out &
+      fi
+      ctnPid="$!"
+      printf "%s\n" "${ctnPid}" > ${workingPath}/run-${ctn}.pid
+      wait "${ctnPid}"
+      exitCode="$?"
+      if ! test -f "${workingPath}/restart-${ctn}.request" ; then
+        printf "%s\n" "${exitCode}" > "${workingPath}/run-${ctn}.status"
+        exit "${exitCode}"
+      fi
+      printf "%s %s %s\n" "${exitCode}" "${startedAt}" "$(date -Is --utc)" > ${workingPath}/run-${ctn}.last
+      restarts=$((restarts + 1))
+      printf "%s\n" "${restarts}" > ${workingPath}/restarts-${ctn}.count
+      printf "%s\n" "$(date -Is --utc) Restarting container ${ctn} after liveness failure (${restarts}/${maxLivenessRestarts})..."
+    done
+  ) &
+  pid="$!"
+  printf "%s\n" "$(date -Is --utc) Running in background ${ctn} pid ${pid} with liveness restarts..."
+  pidCtns="${pidCtns} ${pid}:${ctn}"
+}
+
+killTree() {
+  for child in $(pgrep -P "$1") ; do
+    killTree "${child}"
+  done
+  kill "$1" 2>/dev/null
+}
+
+# Called by liveness probes: returns 1 if the container is not restartable or its restart budget is exhausted.
+requestCtnRestart() {
+  ctn="$1"
+  test -f "${workingPath}/restarts-${ctn}.count" || return 1
+  restarts=$(cat "${workingPath}/restarts-${ctn}.count")
+  test "${restarts}" -lt "${maxLivenessRestarts:-0}" || return 1
+  touch "${workingPath}/restart-${ctn}.request"
+  killTree "$(cat "${workingPath}/run-${ctn}.pid")"
+  return 0
+}
+
 waitCtns() {
   # POSIX shell substring test below. Also, container name follows DNS pattern (hyphen alphanumeric, so no ":" inside)
   # pidCtn=12345:container-name-rfc-dns
@@ -791,17 +1476,102 @@ waitCtns() {
   done
 }
 
-endScript() {
-  printf "%s\n" "$(date -Is --utc) End of script, highest exit code ${highestExitCode}..."
-  # Deprecated the sleep in favor of checking the status file with waitFileExist (see above).
-  #printf "%s\n" "$(date -Is --utc) Sleeping 30s in case of..."
-  # For some reason, the status files does not have the time for being written in some HPC, because slurm kills the job too soon.
-  #sleep 30
-
-  exit "${highestExitCode}"
+# Requeue the job if it failed and the requeue budget is not exhausted. maxRequeue is 0 unless SlurmConfig.MaxRequeue is set.
+requeueOnFailure() {
+  if test "${highestExitCode}" != 0 && test "${maxRequeue:-0}" -gt 0 ; then
+    if test "${restartCount:-0}" -lt "${maxRequeue}" ; then
+      printf "%s\n" "$(date -Is --utc) Job failed with exit code ${highestExitCode}, requeueing (attempt $((restartCount + 1))/${maxRequeue})..."
+      "${scontrolPath}" requeue "${SLURM_JOBID}"
+    else
+      printf "%s\n" "$(date -Is --utc) Job failed with exit code ${highestExitCode} after ${restartCount} requeues, giving up." >&2
+    fi
+  fi
 }
 
-####
+# Removes the node-local scratch bound to /tmp of the containers, if any (see SlurmConfig.BindTmpToScratch).
+removeTmpScratch() {
+  if test -n "${podTmpDir}" ; then
+    rm -rf "${podTmpDir}"
+  fi
+  # Memory emptyDir volumes on disk are removed with the working directory.
+  if test -n "${memEmptyDirs}" && test "${memEmptyDirs}" != "${workingPath}/emptyDirs" ; then
+    rm -rf "${memEmptyDirs}"
+  fi
+}
+
+# Writes the resolv.conf of the pod to $1 (see SlurmConfig.HonorDNSConfig): the resolv.conf of the node, unless $2 is "none",
+# with the nameservers $3 and the searches $4 of the pod dnsConfig appended, and its options $5 overriding the ones with the same name.
+writeResolvConf() {
+  local nameservers=() searches=() options=() kept=() key values value existing
+  if test "$2" != "none" && test -r /etc/resolv.conf ; then
+    while read -r key values ; do
+      case "${key}" in
+        nameserver)
+          value="${values%% *}"
+          [[ " ${nameservers[*]} " == *" ${value} "* ]] || nameservers+=("${value}")
+          ;;
+        domain|search)
+          # The last search or domain line wins, as for the resolver.
+          read -r -a searches <<< "${values}"
+          ;;
+        options)
+          read -r -a kept <<< "${values}"
+          options+=("${kept[@]}")
+          ;;
+      esac
+    done < /etc/resolv.conf
+  fi
+  for value in $3 ; do
+    [[ " ${nameservers[*]} " == *" ${value} "* ]] || nameservers+=("${value}")
+  done
+  for value in $4 ; do
+    [[ " ${searches[*]} " == *" ${value} "* ]] || searches+=("${value}")
+  done
+  for value in $5 ; do
+    kept=()
+    for existing in "${options[@]}" ; do
+      test "${existing%%:*}" = "${value%%:*}" || kept+=("${existing}")
+    done
+    options=("${kept[@]}" "${value}")
+  done
+  if test "${#nameservers[@]}" -gt 3 ; then
+    # The resolver of the libc only uses the first three.
+    printf "%s\n" "$(date -Is --utc) The pod has more than 3 nameservers, only keeping ${nameservers[*]:0:3}" >&2
+  fi
+  {
+    for value in "${nameservers[@]:0:3}" ; do
+      printf "nameserver %s\n" "${value}"
+    done
+    if test "${#searches[@]}" -gt 0 ; then
+      printf "search %s\n" "${searches[*]}"
+    fi
+    if test "${#options[@]}" -gt 0 ; then
+      printf "options %s\n" "${options[*]}"
+    fi
+  } > "$1"
+}
+
+# Adds a command run when the job script exits, also when it is cancelled, times out or is preempted, since SLURM then sends TERM first.
+# The EXIT trap runs the commands in the order they were added.
+addExitCleanup() {
+  exitCleanups="${exitCleanups:+${exitCleanups} ; }$1"
+  trap "${exitCleanups}" EXIT
+  trap 'exit 143' TERM
+}
+
+endScript() {
+  requeueOnFailure
+  removeTmpScratch
+  printf "%s\n" "$(date -Is --utc) End of script, highest exit code ${highestExitCode}..."
+  # Deprecated the sleep in favor of checking the status file with waitFileExist (see above).
+  #printf "%s\n" "$(date -Is --utc) Sleeping 30s in case of..."
+  # For some reason, the status files does not have the time for being written in some HPC, because slurm kills the job too soon.
+  #sleep 30
+
+  exit "${highestExitCode}"
+}
+
+####
 # Main
 ####
 
@@ -826,18 +1596,82 @@ highestExitCode=0
 	stringToBeWritten.WriteString(path)
 	stringToBeWritten.WriteString("\n")
 
+	if config.MaxRequeue > 0 {
+		stringToBeWritten.WriteString(generateRequeueGuard(config.MaxRequeue, config.Scontrolpath))
+	}
+
+	envDir := config.EnvDir
+	if envDirAnnotation, ok := metadata.Annotations["slurm-job.vk.io/env-dir"]; ok {
+		envDir = envDirAnnotation
+	}
+	if envDir != "" {
+		stringToBeWritten.WriteString(generateEnvDirSourcing(envDir))
+	}
+
+	umask, err := parseUmask(config, pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if umask != "" {
+		// Inherited by the containers started below.
+		stringToBeWritten.WriteString("\numask " + umask + "\n")
+	}
+
+	envProfileCommands, err := parseEnvProfile(config, pod)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if len(envProfileCommands) > 0 {
+		// Written as is, the profiles are set by the site administrators.
+		stringToBeWritten.WriteString("\nprintf \"%s\\n\" \"$(date -Is --utc) Loading environment profile " + metadata.Annotations["slurm-job.vk.io/env-profile"] + "...\"\n")
+		stringToBeWritten.WriteString(strings.Join(envProfileCommands, "\n") + "\n")
+	}
+
+	if groups := podSupplementalGroups(pod); len(groups) > 0 {
+		if config.AllowSupplementalGroups {
+			stringToBeWritten.WriteString(generateSupplementalGroupsCheck(groups))
+		} else {
+			log.G(Ctx).Warning("Pod " + pod.Name + " sets supplementalGroups, which are ignored since AllowSupplementalGroups is not set")
+		}
+	}
+
+	stringToBeWritten.WriteString(generateRunAsCheck(pod))
+
+	restartOnLiveness := config.EnableProbes && config.MaxLivenessRestarts > 0 && pod.Spec.RestartPolicy != v1.RestartPolicyNever
+	if restartOnLiveness {
+		stringToBeWritten.WriteString("\nmaxLivenessRestarts=" + strconv.Itoa(config.MaxLivenessRestarts) + "\n")
+	}
+
+	useMPS := isMPSEnabled(Ctx, config, pod)
+	if useMPS {
+		stringToBeWritten.WriteString(generateMPSPrologue())
+	}
+
+	memoryEmptyDirsPrologue := generateMemoryEmptyDirsPrologue(pod)
+	if config.BindTmpToScratch || memoryEmptyDirsPrologue != "" {
+		// Installed first, so that the directories do not stay on the node if the job is cancelled while creating them.
+		stringToBeWritten.WriteString("\naddExitCleanup removeTmpScratch\n")
+	}
+	if config.BindTmpToScratch {
+		stringToBeWritten.WriteString(generateTmpScratchPrologue())
+	}
+	stringToBeWritten.WriteString(memoryEmptyDirsPrologue)
+	stringToBeWritten.WriteString(generateResolvConfPrologue(config, pod))
+
 	// Generate probe cleanup script first if any probes exist
 	var hasProbes bool
 	for _, singularityCommand := range commands {
-		if len(singularityCommand.readinessProbes) > 0 || len(singularityCommand.livenessProbes) > 0 {
+		if len(singularityCommand.readinessProbes) > 0 || len(singularityCommand.livenessProbes) > 0 || len(singularityCommand.startupProbes) > 0 {
 			hasProbes = true
 			break
 		}
 	}
 	if hasProbes && config.EnableProbes {
 		for _, singularityCommand := range commands {
-			if len(singularityCommand.readinessProbes) > 0 || len(singularityCommand.livenessProbes) > 0 {
-				cleanupScript := generateProbeCleanupScript(singularityCommand.containerName, singularityCommand.readinessProbes, singularityCommand.livenessProbes)
+			if len(singularityCommand.readinessProbes) > 0 || len(singularityCommand.livenessProbes) > 0 || len(singularityCommand.startupProbes) > 0 {
+				cleanupScript := generateProbeCleanupScript(singularityCommand.containerName, singularityCommand.readinessProbes, singularityCommand.livenessProbes, singularityCommand.startupProbes)
 				stringToBeWritten.WriteString(cleanupScript)
 				break // Only need one cleanup script
 			}
@@ -848,13 +1682,31 @@ highestExitCode=0
 
 		stringToBeWritten.WriteString("\n")
 
+		if singularityCommand.registryAuthFile != "" {
+			stringToBeWritten.WriteString(". " + shellescape.Quote(singularityCommand.registryAuthFile) + "\n")
+		}
+
+		if config.LogPipeCommand != "" {
+			// Set only for the duration of the run function call.
+			stringToBeWritten.WriteString("logPipe=" + shellescape.Quote(logPipeCommand(config, pod, singularityCommand.containerName)) + " ")
+		}
+
 		if singularityCommand.isInitContainer {
 			stringToBeWritten.WriteString("runInitCtn ")
+		} else if restartOnLiveness && len(singularityCommand.livenessProbes) > 0 {
+			stringToBeWritten.WriteString("runRestartableCtn ")
 		} else {
 			stringToBeWritten.WriteString("runCtn ")
 		}
 		stringToBeWritten.WriteString(singularityCommand.containerName)
 		stringToBeWritten.WriteString(" ")
+		if config.SplitOutputStreams {
+			streamsPrefix := "run-"
+			if singularityCommand.isInitContainer {
+				streamsPrefix = "init-"
+			}
+			stringToBeWritten.WriteString("splitOutput ${workingPath}/" + streamsPrefix + singularityCommand.containerName + " ")
+		}
 		stringToBeWritten.WriteString(strings.Join(singularityCommand.singularityCommand[:], " "))
 
 		if singularityCommand.containerCommand != nil {
@@ -873,9 +1725,17 @@ highestExitCode=0
 				stringToBeWritten.WriteString(shellescape.Quote(argsEntry))
 			}
 		}
+		if singularityCommand.stdinFile != "" {
+			stringToBeWritten.WriteString(" < ")
+			stringToBeWritten.WriteString(shellescape.Quote(singularityCommand.stdinFile))
+		}
+		if singularityCommand.registryAuthFile != "" {
+			// Only this container is pulled with these credentials.
+			stringToBeWritten.WriteString("\nunset SINGULARITY_DOCKER_USERNAME SINGULARITY_DOCKER_PASSWORD")
+		}
 
 		// Generate probe scripts if enabled and not an init container
-		if config.EnableProbes && !singularityCommand.isInitContainer && (len(singularityCommand.readinessProbes) > 0 || len(singularityCommand.livenessProbes) > 0) {
+		if config.EnableProbes && !singularityCommand.isInitContainer && (len(singularityCommand.readinessProbes) > 0 || len(singularityCommand.livenessProbes) > 0 || len(singularityCommand.startupProbes) > 0) {
 			// Extract the image name from the singularity command
 			var imageName string
 			for i, arg := range singularityCommand.singularityCommand {
@@ -899,12 +1759,12 @@ highestExitCode=0
 
 			if imageName != "" {
 				// Store probe metadata for status checking
-				err := storeProbeMetadata(path, singularityCommand.containerName, len(singularityCommand.readinessProbes), len(singularityCommand.livenessProbes))
+				err := storeProbeMetadata(path, singularityCommand.containerName, len(singularityCommand.readinessProbes), len(singularityCommand.livenessProbes), len(singularityCommand.startupProbes))
 				if err != nil {
 					log.G(Ctx).Error("Failed to store probe metadata: ", err)
 				}
 
-				probeScript := generateProbeScript(Ctx, config, singularityCommand.containerName, imageName, singularityCommand.readinessProbes, singularityCommand.livenessProbes)
+				probeScript := generateProbeScript(Ctx, config, singularityCommand.containerName, imageName, singularityCommand.readinessProbes, singularityCommand.livenessProbes, singularityCommand.startupProbes)
 				stringToBeWritten.WriteString("\n")
 				stringToBeWritten.WriteString(probeScript)
 			}
@@ -915,7 +1775,11 @@ highestExitCode=0
 	stringToBeWritten.WriteString(postfix)
 
 	// Waits for all containers to end, then exit with the highest exit code.
-	stringToBeWritten.WriteString("\nwaitCtns\nendScript\n\n")
+	stringToBeWritten.WriteString("\nwaitCtns\n")
+	if useMPS {
+		stringToBeWritten.WriteString(generateMPSEpilogue())
+	}
+	stringToBeWritten.WriteString("endScript\n\n")
 
 	_, err = f.WriteString(stringToBeWritten.String())
 
@@ -935,117 +1799,689 @@ highestExitCode=0
 	return fJob.Name(), nil
 }
 
+// generateTmpScratchPrologue returns the script lines creating the node-local scratch directory of the job, bound to /tmp of the containers
+// with BindTmpToScratch, under $SLURM_TMPDIR, or $TMPDIR as set by SLURM. It is removed by removeTmpScratch when the job script exits.
+func generateTmpScratchPrologue() string {
+	return "\n# Node-local scratch bound to /tmp of the containers" +
+		"\nexport podTmpDir=\"${SLURM_TMPDIR:-${TMPDIR:-/tmp}}/interlink-${SLURM_JOB_ID}\"" +
+		"\nmkdir -p \"${podTmpDir}\" && chmod 1777 \"${podTmpDir}\"\n"
+}
+
+// generateMemoryEmptyDirsPrologue returns the script lines creating the directories of the emptyDir volumes of the pod with the Memory medium
+// on the /dev/shm tmpfs of the node, or in the working directory if it is not writable. They are removed by removeTmpScratch when the job script exits.
+func generateMemoryEmptyDirsPrologue(pod v1.Pod) string {
+	memoryVolumes := map[string]bool{}
+	volumeDirs := []string{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil && volume.EmptyDir.Medium == v1.StorageMediumMemory {
+			memoryVolumes[volume.Name] = true
+			volumeDirs = append(volumeDirs, "\"${memEmptyDirs}\"/"+volume.Name)
+		}
+	}
+	// The subPaths must exist too, to be bound.
+	for _, container := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		for _, volumeMount := range container.VolumeMounts {
+			if memoryVolumes[volumeMount.Name] && volumeMount.SubPath != "" {
+				volumeDirs = appendUnique(volumeDirs, "\"${memEmptyDirs}\"/"+filepath.Join(volumeMount.Name, volumeMount.SubPath))
+			}
+		}
+	}
+	if len(volumeDirs) == 0 {
+		return ""
+	}
+	return "\n# emptyDir volumes with the Memory medium" +
+		"\nmemEmptyDirs=\"/dev/shm/interlink-${SLURM_JOB_ID}\"" +
+		"\nif ! mkdir -p \"${memEmptyDirs}\" 2>/dev/null ; then" +
+		"\n  printf \"%s\\n\" \"$(date -Is --utc) /dev/shm is not writable, memory emptyDir volumes are on disk\" >&2" +
+		"\n  memEmptyDirs=\"${workingPath}/emptyDirs\"" +
+		"\nfi" +
+		"\nmkdir -p " + strings.Join(volumeDirs, " ") + "\n"
+}
+
+// generateEnvDirSourcing returns the script lines sourcing the *.sh files of envDir, for site-wide environment setup (module paths, licenses...).
+// The directory is checked on the node running the job, since a per-pod one is not known to the plugin.
+func generateEnvDirSourcing(envDir string) string {
+	return "\nenvDir=" + shellescape.Quote(envDir) +
+		"\nif test -d \"${envDir}\" ; then" +
+		"\n  for envFile in \"${envDir}\"/*.sh ; do" +
+		"\n    if test -r \"${envFile}\" ; then" +
+		"\n      printf \"%s\\n\" \"$(date -Is --utc) Sourcing ${envFile}...\"" +
+		"\n      . \"${envFile}\"" +
+		"\n    fi" +
+		"\n  done" +
+		"\nelse" +
+		"\n  printf \"%s\\n\" \"$(date -Is --utc) Env directory ${envDir} not found, skipping it\" >&2" +
+		"\nfi\n"
+}
+
+// generateRequeueGuard returns the script lines setting up the requeue counter and the scontrol binary used by requeueOnFailure.
+// SLURM_RESTART_COUNT is incremented by SLURM every time the job is requeued, so after maxRequeue requeues the job fails for good.
+// Status files of the previous attempt are removed, otherwise the status path would report the old exit codes.
+func generateRequeueGuard(maxRequeue int, scontrolPath string) string {
+	return "\nmaxRequeue=" + strconv.Itoa(maxRequeue) +
+		"\nscontrolPath=" + shellescape.Quote(scontrolPath) +
+		"\nrestartCount=\"${SLURM_RESTART_COUNT:-0}\"" +
+		"\nif test \"${restartCount}\" -gt 0 ; then" +
+		"\n  printf \"%s\\n\" \"$(date -Is --utc) Job requeued ${restartCount}/${maxRequeue} times, removing status files of the previous attempt...\"" +
+		"\n  rm -f \"${workingPath}\"/*.status" +
+		"\nfi\n"
+}
+
+// submitUserRegex matches the user names that can be given to SubmitAsUserCommand.
+var submitUserRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// parseSubmitUser returns the user the job is submitted as with SubmitAsUserCommand: the NamespaceUserMap entry of the namespace,
+// or the slurm-job.vk.io/submit-user annotation if AllowSubmitUserAnnotation is set. It is empty if SubmitAsUserCommand is not set
+// or no user is mapped, then the job is submitted by the user running the sidecar.
+func parseSubmitUser(config SlurmConfig, pod v1.Pod) (string, error) {
+	if config.SubmitAsUserCommand == "" {
+		return "", nil
+	}
+	user := config.NamespaceUserMap[pod.Namespace]
+	if annotationUser, ok := pod.Annotations["slurm-job.vk.io/submit-user"]; ok {
+		if !config.AllowSubmitUserAnnotation {
+			return "", fmt.Errorf("pod %s sets slurm-job.vk.io/submit-user, which is not allowed by the site policy (AllowSubmitUserAnnotation)", pod.Name)
+		}
+		user = annotationUser
+	}
+	if user != "" && !submitUserRegex.MatchString(user) {
+		return "", fmt.Errorf("invalid submission user %q", user)
+	}
+	return user, nil
+}
+
+// sbatchCommand returns the sbatch command, wrapped with SubmitAsUserCommand to submit as the provided user, eg: sudo -n -u alice /usr/bin/sbatch.
+// envNames are the env vars sbatch needs from the sidecar, see mountEnvVarNames.
+func sbatchCommand(config SlurmConfig, user string, envNames []string) string {
+	return submitUserPrefix(config, user, envNames) + config.Sbatchpath
+}
+
+// submitUserPrefix returns SubmitAsUserCommand for the provided user followed by a space, or an empty string if the user is empty.
+// The {env} placeholder is replaced by the comma separated envNames, eg: for sudo --preserve-env={env}, which otherwise resets the environment.
+func submitUserPrefix(config SlurmConfig, user string, envNames []string) string {
+	if user == "" {
+		return ""
+	}
+	return strings.NewReplacer("{user}", user, "{env}", strings.Join(envNames, ",")).Replace(config.SubmitAsUserCommand) + " "
+}
+
+// scancelCommand returns the scancel command run as the user the job was submitted as, since only the job owner can cancel it.
+func scancelCommand(config SlurmConfig, user string, args ...string) *exec.Cmd {
+	if user == "" {
+		return exec.Command(config.Scancelpath, args...)
+	}
+	return exec.Command(config.BashPath, append([]string{"-c", submitUserPrefix(config, user, nil) + `"$@"`, "scancel", config.Scancelpath}, args...)...)
+}
+
 // SLURMBatchSubmit submits the job provided in the path argument to the SLURM queue.
 // At this point, it's up to the SLURM scheduler to manage the job.
+// sbatch is run again up to SubmitRetries times while it fails with a transient error, waiting SubmitRetryBaseDelay milliseconds
+// before the first retry and twice as long before each next one, unless Ctx is done. Since a timed out sbatch may have been accepted anyway,
+// a job named jobName in the queue is taken as the submitted one instead of submitting it again.
 // Returns the output of the sbatch command and the first encoundered error.
-func SLURMBatchSubmit(Ctx context.Context, config SlurmConfig, path string) (string, error) {
+func SLURMBatchSubmit(Ctx context.Context, config SlurmConfig, path string, user string, envNames []string, jobName string, cluster string) (string, error) {
 	log.G(Ctx).Info("- Submitting Slurm job")
 	shell := exec2.ExecTask{
 		Command: "sh",
-		Args:    []string{"-c", "\"" + config.Sbatchpath + " " + path + "\""},
+		Args:    []string{"-c", "\"" + sbatchCommand(config, user, envNames) + " " + path + "\""},
+		Shell:   true,
+	}
+
+	delay := time.Duration(config.SubmitRetryBaseDelay) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := ensureKerberosTicket(Ctx, config)
+		if err != nil {
+			log.G(Ctx).Error(err)
+			return "", err
+		}
+		sbatchStart := time.Now()
+		execReturn, err := shell.Execute()
+		observeSlurmCommand(config.Sbatchpath, sbatchStart, err != nil || execReturn.Stderr != "")
+		if err != nil {
+			log.G(Ctx).Error("Unable to create file " + path)
+			return "", err
+		}
+		execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
+
+		if execReturn.Stderr == "" {
+			log.G(Ctx).Debug("Job submitted")
+			return string(execReturn.Stdout), nil
+		}
+		if attempt > config.SubmitRetries || !isTransientSlurmError(execReturn.Stderr) {
+			log.G(Ctx).Error("Could not run sbatch: " + execReturn.Stderr)
+			return "", errors.New(execReturn.Stderr)
+		}
+
+		log.G(Ctx).Warning("sbatch failed with a transient error, retrying in ", delay, " (", attempt, "/", config.SubmitRetries, "): ", strings.TrimSpace(execReturn.Stderr))
+		select {
+		case <-Ctx.Done():
+			return "", fmt.Errorf("submission cancelled after a transient sbatch error: %w: %s", Ctx.Err(), strings.TrimSpace(execReturn.Stderr))
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if submitted := queuedJobNamed(Ctx, config, jobName, cluster); submitted != "" {
+			log.G(Ctx).Warning("sbatch failed but job " + submitted + " named " + jobName + " is queued, not submitting it again")
+			return submitted, nil
+		}
+	}
+}
+
+// lintSLURMScript checks the syntax of the job.slurm and job.sh files of the working directory with bash -n,
+// to catch quoting issues in the generated script before submitting it. It returns the shell error if a file is malformed.
+func lintSLURMScript(Ctx context.Context, config SlurmConfig, path string) error {
+	for _, script := range []string{path + "/job.slurm", path + "/job.sh"} {
+		shell := exec2.ExecTask{
+			Command: config.BashPath,
+			Args:    []string{"-n", script},
+		}
+		execReturn, err := shell.Execute()
+		if err != nil {
+			return err
+		}
+		if execReturn.ExitCode != 0 {
+			log.G(Ctx).Error("Syntax error in generated script " + script + ": " + execReturn.Stderr)
+			return errors.New(strings.TrimSpace(execReturn.Stderr))
+		}
+	}
+	log.G(Ctx).Debug("--- Generated scripts syntax checked")
+	return nil
+}
+
+// SLURMBatchTestOnly runs sbatch --test-only on the provided job script, to check that it would be accepted by the scheduling policies
+// (partition, qos, account, ...) without submitting it. It returns the sbatch error if the job would be rejected.
+func SLURMBatchTestOnly(Ctx context.Context, config SlurmConfig, path string, user string, envNames []string) error {
+	log.G(Ctx).Info("- Validating Slurm job with --test-only")
+	shell := exec2.ExecTask{
+		Command: "sh",
+		Args:    []string{"-c", "\"" + sbatchCommand(config, user, envNames) + " --test-only " + path + "\""},
 		Shell:   true,
 	}
 
 	execReturn, err := shell.Execute()
 	if err != nil {
-		log.G(Ctx).Error("Unable to create file " + path)
-		return "", err
+		return err
 	}
-	execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
 
-	if execReturn.Stderr != "" {
-		log.G(Ctx).Error("Could not run sbatch: " + execReturn.Stderr)
-		return "", errors.New(execReturn.Stderr)
-	} else {
-		log.G(Ctx).Debug("Job submitted")
+	// On success, sbatch --test-only reports the expected start time on stderr too, so only errors are rejections.
+	if execReturn.ExitCode != 0 || strings.Contains(execReturn.Stderr, "error:") {
+		log.G(Ctx).Error("Job rejected by sbatch --test-only: " + execReturn.Stderr)
+		return errors.New(strings.TrimSpace(execReturn.Stderr))
 	}
-	return string(execReturn.Stdout), nil
+	log.G(Ctx).Debug("Job validated: " + execReturn.Stderr)
+	return nil
+}
+
+// sbatchJobIDRegex matches the job ID in the sbatch output, eg: "Submitted batch job 12345", with the cluster the job was submitted to
+// for federated or multi-cluster submissions ("Submitted batch job 12345 on cluster c1", or "12345.c1").
+var sbatchJobIDRegex = regexp.MustCompile(`Submitted batch job (\d+)(?:\.([A-Za-z0-9_-]+)| on cluster ([A-Za-z0-9_.-]+))?`)
+
+// sbatchParsableJobIDRegex matches the --parsable output of sbatch, eg: "12345" or "12345;c1".
+var sbatchParsableJobIDRegex = regexp.MustCompile(`^(\d+)(?:[.;]([A-Za-z0-9_.-]+))?$`)
+
+// parseSbatchJobID returns the numeric job ID used by squeue and scancel, and the cluster if the sbatch output names one.
+func parseSbatchJobID(output string) (string, string, error) {
+	if match := sbatchJobIDRegex.FindStringSubmatch(output); match != nil {
+		return match[1], match[2] + match[3], nil
+	}
+	if match := sbatchParsableJobIDRegex.FindStringSubmatch(strings.TrimSpace(output)); match != nil {
+		return match[1], match[2], nil
+	}
+	return "", "", fmt.Errorf("unable to find the job ID in the sbatch output %q", output)
 }
 
 // handleJidAndPodUid creates a JID file to store the Job ID of the submitted job.
 // The output parameter must be the output of SLURMBatchSubmit function and the path
 // is the path where to store the JID file.
 // It also adds the JID to the JIDs main structure.
-// Finally, it stores the namespace and podUID info in the same location, to restore
+// Finally, it stores the namespace, podUID, cluster and submission user info in the same location, to restore
 // status at startup.
 // Return the first encountered error.
-func handleJidAndPodUid(Ctx context.Context, pod v1.Pod, JIDs *map[string]*JidStruct, output string, path string) (string, error) {
-	r := regexp.MustCompile(`Submitted batch job (?P<jid>\d+)`)
-	jid := r.FindStringSubmatch(output)
-	fJID, err := os.Create(path + "/JobID.jid")
+func handleJidAndPodUid(Ctx context.Context, pod v1.Pod, JIDs *map[string]*JidStruct, output string, path string, cluster string, submitUser string) (string, error) {
+	jid, jobCluster, err := parseSbatchJobID(output)
 	if err != nil {
-		log.G(Ctx).Error("Can't create jid_file")
+		log.G(Ctx).Error(err)
 		return "", err
 	}
-	defer fJID.Close()
+	if jobCluster != "" && jobCluster != cluster {
+		// With a list of clusters, sbatch submits to one of them, which then serves the squeue and scancel calls.
+		log.G(Ctx).Info("Job " + jid + " was submitted to cluster " + jobCluster)
+		cluster = jobCluster
+	}
+
+	// Serialized with a deletion of the same pod, so that the pod is not deleted between the files and the map update.
+	unlock := lockPod(string(pod.UID))
+	defer unlock()
 
-	fNS, err := os.Create(path + "/PodNamespace.ns")
+	// JobID.jid is written last: LoadJIDs only recovers the jobs whose files are all written.
+	err = writeFileAtomic(path+"/PodNamespace.ns", []byte(pod.Namespace), 0644)
 	if err != nil {
 		log.G(Ctx).Error("Can't create namespace_file")
 		return "", err
 	}
-	defer fNS.Close()
 
-	fUID, err := os.Create(path + "/PodUID.uid")
+	err = writeFileAtomic(path+"/PodUID.uid", []byte(pod.UID), 0644)
 	if err != nil {
 		log.G(Ctx).Error("Can't create PodUID_file")
 		return "", err
 	}
-	defer fUID.Close()
 
-	_, err = fJID.WriteString(jid[1])
+	if cluster != "" {
+		err = writeFileAtomic(path+"/Cluster.name", []byte(cluster), 0644)
+		if err != nil {
+			log.G(Ctx).Error("Can't create cluster_file")
+			return "", err
+		}
+	}
+
+	if submitUser != "" {
+		err = writeFileAtomic(path+"/SubmitUser.name", []byte(submitUser), 0644)
+		if err != nil {
+			log.G(Ctx).Error("Can't create submit_user_file")
+			return "", err
+		}
+	}
+
+	err = writeFileAtomic(path+"/JobID.jid", []byte(jid), 0644)
 	if err != nil {
-		log.G(Ctx).Error(err)
+		log.G(Ctx).Error("Can't create jid_file")
 		return "", err
 	}
 
-	(*JIDs)[string(pod.UID)] = &JidStruct{PodUID: string(pod.UID), PodNamespace: pod.Namespace, JID: jid[1]}
-	log.G(Ctx).Info("Job ID is: " + (*JIDs)[string(pod.UID)].JID)
+	jidsMutex.Lock()
+	(*JIDs)[string(pod.UID)] = &JidStruct{PodUID: string(pod.UID), PodNamespace: pod.Namespace, JID: jid, Cluster: cluster, SubmitUser: submitUser}
+	jidsMutex.Unlock()
+	log.G(Ctx).Info("Job ID is: " + jid)
 
-	_, err = fNS.WriteString(pod.Namespace)
+	return jid, nil
+}
+
+// writeFileAtomic writes the file through a temporary file renamed over it, so that a crash never leaves a partial file, eg: an empty JobID.jid.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
-		log.G(Ctx).Error(err)
-		return "", err
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// jidsMutex guards JIDs, which the submit, status and delete handlers access concurrently, and the fields of the tracked jobs.
+// Readers take it with RLock, see lookupJID and trackedJobs, and the updates of the jobs with updateJID.
+var jidsMutex sync.RWMutex
+
+// podLock is a mutex shared by all the callers currently working on the same pod.
+type podLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	podLocksMutex sync.Mutex
+	podLocks      = make(map[string]*podLock)
+)
+
+// lockPod acquires the lock of the provided pod UID and returns the function to release it.
+// Locks are reference counted, so they are removed once no caller uses them anymore.
+func lockPod(podUID string) func() {
+	podLocksMutex.Lock()
+	lock, ok := podLocks[podUID]
+	if !ok {
+		lock = &podLock{}
+		podLocks[podUID] = lock
+	}
+	lock.refs++
+	podLocksMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		podLocksMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(podLocks, podUID)
+		}
+		podLocksMutex.Unlock()
+	}
+}
+
+// slurmNameRegex matches the SLURM names that can be written in a #SBATCH line, eg: partitions, QoS and accounts, or a comma separated list of them.
+var slurmNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+(,[A-Za-z0-9_.-]+)*$`)
+
+// parsePartition returns the partition of the job: the slurm-job.vk.io/partition annotation, or DefaultPartition.
+// It is empty if neither is set, then SLURM uses the default partition.
+func parsePartition(config SlurmConfig, pod v1.Pod) (string, error) {
+	partition, ok := pod.Annotations["slurm-job.vk.io/partition"]
+	if !ok {
+		partition = config.DefaultPartition
+	}
+	if partition != "" && !slurmNameRegex.MatchString(partition) {
+		return "", fmt.Errorf("invalid SLURM partition %q", partition)
+	}
+	return partition, nil
+}
+
+// parseQos returns the QoS of the job: the slurm-job.vk.io/qos annotation, or DefaultQos. It is empty if neither is set.
+func parseQos(config SlurmConfig, pod v1.Pod) (string, error) {
+	qos, ok := pod.Annotations["slurm-job.vk.io/qos"]
+	if !ok {
+		qos = config.DefaultQos
+	}
+	if qos != "" && !slurmNameRegex.MatchString(qos) {
+		return "", fmt.Errorf("invalid SLURM QoS %q", qos)
+	}
+	return qos, nil
+}
+
+// parseAccount returns the SLURM account billed for the job: the slurm-job.vk.io/account annotation, the NamespaceAccountMap entry
+// of the namespace, or DefaultAccount. It is empty if none is set, then SLURM uses the default account of the user.
+func parseAccount(config SlurmConfig, pod v1.Pod) (string, error) {
+	account, ok := pod.Annotations["slurm-job.vk.io/account"]
+	if !ok {
+		account, ok = config.NamespaceAccountMap[pod.Namespace]
+	}
+	if !ok {
+		account = config.DefaultAccount
+	}
+	if account != "" && !slurmNameRegex.MatchString(account) {
+		return "", fmt.Errorf("invalid SLURM account %q", account)
+	}
+	return account, nil
+}
+
+// timeLimitRegex matches the SLURM time formats: minutes, MM:SS, HH:MM:SS, D-HH, D-HH:MM, D-HH:MM:SS and UNLIMITED.
+var timeLimitRegex = regexp.MustCompile(`^(?i:[0-9]+(:[0-9]{1,2}){0,2}|[0-9]+-[0-9]{1,2}(:[0-9]{1,2}){0,2}|UNLIMITED|INFINITE)$`)
+
+// formatTimeLimit converts seconds to the SLURM D-HH:MM:SS format. SLURM time limits are in minutes, so seconds are rounded up to the next minute.
+func formatTimeLimit(seconds int64) string {
+	minutes := (seconds + 59) / 60
+	if minutes < 1 {
+		minutes = 1
 	}
+	days, hours, minutes := minutes/(24*60), minutes/60%24, minutes%60
+	if days > 0 {
+		return fmt.Sprintf("%d-%02d:%02d:00", days, hours, minutes)
+	}
+	return fmt.Sprintf("%02d:%02d:00", hours, minutes)
+}
+
+// parseTimeLimit returns the wall-clock limit of the job: the slurm-job.vk.io/time-limit annotation, the activeDeadlineSeconds of the pod,
+// or DefaultTimeLimit. It is empty if none is set, then the job gets the default time limit of the partition.
+func parseTimeLimit(config SlurmConfig, pod v1.Pod) (string, error) {
+	if timeLimit, ok := pod.Annotations["slurm-job.vk.io/time-limit"]; ok {
+		if !timeLimitRegex.MatchString(timeLimit) {
+			return "", fmt.Errorf("invalid slurm-job.vk.io/time-limit annotation %q, expected a SLURM time such as 2-00:00:00", timeLimit)
+		}
+		return timeLimit, nil
+	}
+	if pod.Spec.ActiveDeadlineSeconds != nil && *pod.Spec.ActiveDeadlineSeconds > 0 {
+		return formatTimeLimit(*pod.Spec.ActiveDeadlineSeconds), nil
+	}
+	return config.DefaultTimeLimit, nil
+}
 
-	_, err = fUID.WriteString(string(pod.UID))
+// parseSpread returns the value of the slurm-job.vk.io/spread annotation, false if not set.
+func parseSpread(pod v1.Pod) (bool, error) {
+	value, ok := pod.Annotations["slurm-job.vk.io/spread"]
+	if !ok {
+		return false, nil
+	}
+	spread, err := strconv.ParseBool(value)
 	if err != nil {
-		log.G(Ctx).Error(err)
-		return "", err
+		return false, fmt.Errorf("invalid slurm-job.vk.io/spread annotation %q, expected true or false", value)
+	}
+	return spread, nil
+}
+
+// spreadJobFlags returns --spread-job if the slurm-job.vk.io/spread annotation is "true", to spread a multi-node job over as many nodes as possible.
+// Without it SLURM packs the job on the fewest nodes. Nothing is emitted for single node jobs.
+func spreadJobFlags(ctx context.Context, pod v1.Pod, slurmFlags string) ([]string, error) {
+	spread, err := parseSpread(pod)
+	if err != nil || !spread {
+		return nil, err
+	}
+	if nodesFromFlags(slurmFlags) <= 1 {
+		log.G(ctx).Warning("slurm-job.vk.io/spread annotation found on pod " + pod.Name + " but it runs on a single node, ignoring it")
+		return nil, nil
+	}
+	return []string{"--spread-job"}, nil
+}
+
+// parseCoreSpec returns the --core-spec or --thread-spec sbatch flag from the slurm-job.vk.io/core-spec and slurm-job.vk.io/thread-spec annotations,
+// used to reserve cores/threads of the nodes for the OS. The values must be non-negative integers, and only one of the two can be set.
+func parseCoreSpec(pod v1.Pod) ([]string, error) {
+	var flags []string
+	for _, spec := range []string{"core-spec", "thread-spec"} {
+		value, ok := pod.Annotations["slurm-job.vk.io/"+spec]
+		if !ok {
+			continue
+		}
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid slurm-job.vk.io/%s annotation %q, expected a non-negative integer", spec, value)
+		}
+		flags = append(flags, "--"+spec+"="+strconv.Itoa(count))
+	}
+	if len(flags) > 1 {
+		return nil, errors.New("slurm-job.vk.io/core-spec and slurm-job.vk.io/thread-spec annotations cannot be used together")
+	}
+	return flags, nil
+}
+
+// umaskRegex matches an octal file mode creation mask, eg: "027" or "0077".
+var umaskRegex = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// parseUmask returns the umask of the containers of the pod: the slurm-job.vk.io/umask annotation, or DefaultContainerUmask.
+// It is empty if neither is set, then the containers inherit the umask of the job.
+func parseUmask(config SlurmConfig, pod v1.Pod) (string, error) {
+	umask, ok := pod.Annotations["slurm-job.vk.io/umask"]
+	if !ok {
+		return config.DefaultContainerUmask, nil
+	}
+	if !umaskRegex.MatchString(umask) {
+		return "", fmt.Errorf("invalid slurm-job.vk.io/umask annotation %q, expected an octal value such as 027", umask)
+	}
+	return umask, nil
+}
+
+// parseEnvProfile returns the commands of the EnvProfiles entry selected with the slurm-job.vk.io/env-profile annotation, eg: module load lines.
+// It returns an error if the profile is not configured, and no command if the annotation is not set.
+func parseEnvProfile(config SlurmConfig, pod v1.Pod) ([]string, error) {
+	profile, ok := pod.Annotations["slurm-job.vk.io/env-profile"]
+	if !ok {
+		return nil, nil
+	}
+	commands, ok := config.EnvProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown slurm-job.vk.io/env-profile annotation %q, it is not one of the EnvProfiles", profile)
+	}
+	return commands, nil
+}
+
+// podSupplementalGroups returns the supplementalGroups of the pod security context.
+func podSupplementalGroups(pod v1.Pod) []int64 {
+	if pod.Spec.SecurityContext == nil {
+		return nil
+	}
+	return pod.Spec.SecurityContext.SupplementalGroups
+}
+
+// generateSupplementalGroupsCheck returns the script lines checking that the job user belongs to the supplemental groups of the pod.
+// Singularity runs the containers with the groups of the job user and has no flag to add more, so missing groups can only be reported.
+func generateSupplementalGroupsCheck(groups []int64) string {
+	gids := make([]string, 0, len(groups))
+	for _, gid := range groups {
+		gids = append(gids, strconv.FormatInt(gid, 10))
+	}
+	return "\nfor gid in " + strings.Join(gids, " ") + " ; do" +
+		"\n  if ! id -G | tr ' ' '\\n' | grep -qx \"${gid}\" ; then" +
+		"\n    printf \"%s\\n\" \"$(date -Is --utc) Job user $(id -un) is not a member of supplemental group ${gid}, the containers will not get its permissions\" >&2" +
+		"\n  fi" +
+		"\ndone\n"
+}
+
+// logPipeCommand returns the LogPipeCommand for a container, with the {namespace}, {pod}, {uid} and {container} placeholders replaced.
+func logPipeCommand(config SlurmConfig, pod v1.Pod, containerName string) string {
+	return strings.NewReplacer(
+		"{namespace}", pod.Namespace,
+		"{pod}", pod.Name,
+		"{uid}", string(pod.UID),
+		"{container}", containerName,
+	).Replace(config.LogPipeCommand)
+}
+
+// podHostname returns the hostname of the containers of the pod: spec.hostname if set, otherwise the pod name truncated to 63 characters, as Kubernetes does.
+func podHostname(pod v1.Pod) string {
+	if pod.Spec.Hostname != "" {
+		return pod.Spec.Hostname
+	}
+	hostname := pod.Name
+	if len(hostname) > 63 {
+		hostname = strings.TrimRight(hostname[:63], "-.")
+	}
+	return hostname
+}
+
+// slurmJobName returns the --job-name of the job of the pod. It is the pod UID, unless JobNamePrefix is set: in this case it is
+// <JobNamePrefix><pod name>-<first 8 characters of the UID>, so that the name is readable and pods recreated with the same name get distinct job names.
+func slurmJobName(config SlurmConfig, pod v1.Pod) string {
+	uid := string(pod.UID)
+	if config.JobNamePrefix == "" {
+		return uid
+	}
+	if len(uid) > 8 {
+		uid = uid[:8]
 	}
+	return config.JobNamePrefix + pod.Name + "-" + uid
+}
 
-	return (*JIDs)[string(pod.UID)].JID, nil
+// trackedJobs returns a copy of the jobs of JIDs, to iterate over them while the handlers add and remove jobs.
+func trackedJobs(JIDs *map[string]*JidStruct) map[string]JidStruct {
+	jidsMutex.RLock()
+	defer jidsMutex.RUnlock()
+	jobs := make(map[string]JidStruct, len(*JIDs))
+	for uid, jid := range *JIDs {
+		jobs[uid] = *jid
+	}
+	return jobs
+}
+
+// lookupJID returns the tracked job of the pod.
+func lookupJID(JIDs *map[string]*JidStruct, podUID string) (*JidStruct, bool) {
+	jidsMutex.RLock()
+	defer jidsMutex.RUnlock()
+	jid, ok := (*JIDs)[podUID]
+	return jid, ok
+}
+
+// updateJID applies an update to the fields of a tracked job under jidsMutex, since trackedJobs copies them concurrently.
+func updateJID(update func()) {
+	jidsMutex.Lock()
+	defer jidsMutex.Unlock()
+	update()
 }
 
 // removeJID delete a JID from the structure
 func removeJID(podUID string, JIDs *map[string]*JidStruct) {
+	jidsMutex.Lock()
+	defer jidsMutex.Unlock()
 	delete(*JIDs, podUID)
 }
 
+// scancelJobErrors are the errors of scancel for a job that does not exist anymore, eg: finished and purged from the controller.
+var scancelJobErrors = []string{
+	"Invalid job id specified",
+	"Job/step already completing or completed",
+	"Job not found",
+}
+
+// scancelJobGone tells if the output of a failed scancel is one of the scancelJobErrors, so that the job needs no cancellation.
+func scancelJobGone(output string) bool {
+	for _, jobError := range scancelJobErrors {
+		if strings.Contains(output, jobError) {
+			return true
+		}
+	}
+	return false
+}
+
 // deleteContainer checks if a Job has not yet been deleted and, in case, calls the scancel command to abort the job execution.
-// It then removes the JID from the main JIDs structure and all the related files on the disk.
+// If the Job ID is not known (eg: the sidecar stopped between the submission and the JID storage), the job is cancelled by jobName on the provided cluster,
+// as the provided submitUser. A known job is cancelled as the user it was submitted as.
+// It then removes the JID from the main JIDs structure and, if removeFiles is true, all the related files on the disk.
 // Returns the first encountered error.
-func deleteContainer(Ctx context.Context, config SlurmConfig, podUID string, JIDs *map[string]*JidStruct, path string) error {
+func deleteContainer(Ctx context.Context, config SlurmConfig, podUID string, jobName string, cluster string, submitUser string, JIDs *map[string]*JidStruct, path string, removeFiles bool) error {
+	// Concurrent deletions of the same pod (eg: retries from InterLink) are serialized, so that the second one finds the job already gone.
+	unlock := lockPod(podUID)
+	defer unlock()
+
 	log.G(Ctx).Info("- Deleting Job for pod " + podUID)
 	span := trace.SpanFromContext(Ctx)
-	if checkIfJidExists(Ctx, JIDs, podUID) {
-		_, err := exec.Command(config.Scancelpath, (*JIDs)[podUID].JID).Output()
-		if err != nil {
+	jid := ""
+	if err := ensureKerberosTicket(Ctx, config); err != nil {
+		log.G(Ctx).Error(err)
+	}
+	if trackedJID, ok := lookupJID(JIDs, podUID); ok {
+		jid = trackedJID.JID
+		scancelStart := time.Now()
+		output, err := scancelCommand(config, trackedJID.SubmitUser, append(clusterFlags(trackedJID.Cluster), jid)...).CombinedOutput()
+		observeSlurmCommand(config.Scancelpath, scancelStart, err != nil && !scancelJobGone(string(output)))
+		if err != nil && scancelJobGone(string(output)) {
+			// Already finished and purged, or cancelled by a previous delete: there is nothing left to cancel.
+			log.G(Ctx).Info("- Job ", jid, " already ended: ", strings.TrimSpace(string(output)))
+		} else if err != nil {
+			err = fmt.Errorf("unable to cancel job %s: %w: %s", jid, err, strings.TrimSpace(string(output)))
 			log.G(Ctx).Error(err)
 			return err
 		} else {
-			log.G(Ctx).Info("- Deleted Job ", (*JIDs)[podUID].JID)
+			log.G(Ctx).Info("- Deleted Job ", jid)
+		}
+	} else {
+		log.G(Ctx).Info("- No Job found for pod " + podUID + ", cancelling any job named " + jobName)
+		// The job name contains the pod UID, so it cannot match a job of another generation of the pod.
+		_, err := scancelCommand(config, submitUser, append(clusterFlags(cluster), "--name="+jobName)...).Output()
+		if err != nil {
+			log.G(Ctx).Warning("Unable to cancel jobs named ", jobName, ": ", err)
 		}
 	}
-	jid := (*JIDs)[podUID].JID
 	removeJID(podUID, JIDs)
 
-	errFirstAttempt := os.RemoveAll(path)
 	span.SetAttributes(
 		attribute.String("delete.pod.uid", podUID),
 		attribute.String("delete.jid", jid),
+		attribute.Bool("delete.removefiles", removeFiles),
 	)
 
+	if !removeFiles {
+		// Kept working directories are for debugging, they do not need the registry credentials nor the secrets.
+		removeRegistryCredentials(Ctx, path)
+		if err := os.RemoveAll(path + "/secrets"); err != nil {
+			log.G(Ctx).Warning("Unable to remove the secrets of pod ", podUID, ": ", err)
+		}
+		// Renamed, so that LoadJIDs does not track the deleted pod again at the next start, while the job ID stays available for debugging.
+		if err := os.Rename(path+"/JobID.jid", path+"/JobID.jid.deleted"); err != nil && !os.IsNotExist(err) {
+			log.G(Ctx).Warning("Unable to rename the job ID file of pod ", podUID, ": ", err)
+		}
+		log.G(Ctx).Info("- Keeping working directory " + path + " of pod " + podUID)
+		span.AddEvent("SLURM Job " + jid + " for Pod " + podUID + " successfully deleted, working directory kept")
+		return nil
+	}
+
+	errFirstAttempt := os.RemoveAll(path)
+
 	if errFirstAttempt != nil {
 		log.G(Ctx).Debug("Attempt 1 of deletion failed, not really an error! Probably log file still opened, waiting for close... Error: ", errFirstAttempt)
 		// We expect first rm of directory to possibly fail, in case for eg logs are in follow mode, so opened. The removeJID will end the follow loop,
@@ -1068,6 +2504,41 @@ func deleteContainer(Ctx context.Context, config SlurmConfig, podUID string, JID
 	return nil
 }
 
+// shouldRemoveWorkingDir reads the slurm-job.vk.io/cleanup-policy annotation and tells if the working directory of the pod
+// must be removed when the pod is deleted. Supported policies are "always" (default), "on-success" and "never".
+// With "on-success", the directory is kept if any container did not terminate or terminated with a non-zero exit code.
+func shouldRemoveWorkingDir(Ctx context.Context, pod *v1.Pod, path string) bool {
+	policy, ok := pod.Annotations["slurm-job.vk.io/cleanup-policy"]
+	if !ok {
+		return true
+	}
+
+	switch policy {
+	case "always":
+		return true
+	case "never":
+		return false
+	case "on-success":
+		containers := append([]v1.Container{}, pod.Spec.InitContainers...)
+		containers = append(containers, pod.Spec.Containers...)
+		for i, container := range containers {
+			statusFilePath := path + "/run-" + container.Name + ".status"
+			if i < len(pod.Spec.InitContainers) {
+				statusFilePath = path + "/init-" + container.Name + ".status"
+			}
+			exitCode, err := os.ReadFile(statusFilePath)
+			if err != nil || strings.TrimSpace(string(exitCode)) != "0" {
+				log.G(Ctx).Info("Container " + container.Name + " did not succeed, keeping working directory " + path)
+				return false
+			}
+		}
+		return true
+	default:
+		log.G(Ctx).Warning("Unknown cleanup policy " + policy + " for pod " + pod.Name + ", falling back to always")
+		return true
+	}
+}
+
 // For simple volume type like configMap, secret, projectedVolumeMap.
 func mountDataSimpleVolume(
 	Ctx context.Context,
@@ -1078,24 +2549,30 @@ func mountDataSimpleVolume(
 	mountDataFiles map[string][]byte,
 	start int64,
 	volumeType string,
-	fileMode os.FileMode,
-) ([]string, []string, error) {
+	fileModes map[string]os.FileMode,
+) ([]string, []string, []os.FileMode, error) {
 	span.AddEvent("Preparing " + volumeType + " mount")
 
 	// Slice of elements of "[host path]:[container volume mount path]"
 	var volumesHostToContainerPaths []string
 	var envVarNames []string
+	var volumeFileModes []os.FileMode
 
 	err := os.RemoveAll(path + "/" + volumeType + "/" + volumeMount.Name)
 	if err != nil {
 		log.G(Ctx).Error("Unable to delete root folder")
-		return []string{}, nil, err
+		return []string{}, nil, nil, err
 	}
 
 	log.G(Ctx).Info("--- Mounting ", volumeType, ": "+volumeMount.Name)
 	podVolumeDir := filepath.Join(path, volumeType, volumeMount.Name)
 
 	for key := range mountDataFiles {
+		if volumeMount.SubPath != "" && key != volumeMount.SubPath && !strings.HasPrefix(key, volumeMount.SubPath+"/") {
+			// Only the file, or the files of the directory, at subPath in the volume are mounted. The others are still written,
+			// since other mounts of the volume share its directory.
+			continue
+		}
 		fullPath := filepath.Join(podVolumeDir, key)
 		hexString := stringToHex(fullPath)
 		mode := ""
@@ -1109,13 +2586,14 @@ func mountDataSimpleVolume(
 
 		var containerPath string
 		if volumeMount.SubPath != "" {
-			containerPath = volumeMount.MountPath
+			containerPath = filepath.Join(volumeMount.MountPath, strings.TrimPrefix(key, volumeMount.SubPath))
 		} else {
 			containerPath = filepath.Join(volumeMount.MountPath, key)
 		}
 
 		bind := fullPath + ":" + containerPath + mode + " "
 		volumesHostToContainerPaths = append(volumesHostToContainerPaths, bind)
+		volumeFileModes = append(volumeFileModes, fileModes[key])
 
 		if os.Getenv("SHARED_FS") != "true" {
 			currentEnvVarName := string(container.Name) + "_" + volumeType + "_" + hexString
@@ -1123,17 +2601,21 @@ func mountDataSimpleVolume(
 			err = os.Setenv(currentEnvVarName, string(mountDataFiles[key]))
 			if err != nil {
 				log.G(Ctx).Error("--- Shared FS disabled, unable to set ENV for ", volumeType, "key: ", key, " env name: ", currentEnvVarName)
-				return []string{}, nil, err
+				return []string{}, nil, nil, err
 			}
 			envVarNames = append(envVarNames, currentEnvVarName)
 		}
 	}
 
+	if volumeMount.SubPath != "" && len(volumesHostToContainerPaths) == 0 {
+		return []string{}, nil, nil, fmt.Errorf("subPath %s of the mount of volume %s in container %s is not in the volume", volumeMount.SubPath, volumeMount.Name, container.Name)
+	}
+
 	if os.Getenv("SHARED_FS") == "true" {
 		log.G(Ctx).Info("--- Shared FS enabled, files will be directly created before the job submission")
 		err := os.MkdirAll(podVolumeDir, os.FileMode(0755)|os.ModeDir)
 		if err != nil {
-			return []string{}, nil, fmt.Errorf("could not create whole directory of %s root cause %w", podVolumeDir, err)
+			return []string{}, nil, nil, fmt.Errorf("could not create whole directory of %s root cause %w", podVolumeDir, err)
 		}
 		log.G(Ctx).Debug("--- Created folder ", podVolumeDir)
 		/*
@@ -1162,16 +2644,23 @@ func mountDataSimpleVolume(
 			// TODO: Ensure that these files are deleted in failure cases
 			fullPath := filepath.Join(podVolumeDir, k)
 
-			// mode := os.FileMode(0644)
-			err := os.WriteFile(fullPath, v, fileMode)
+			// The paths of items may contain directories.
+			err := os.MkdirAll(filepath.Dir(fullPath), os.FileMode(0755)|os.ModeDir)
+			if err == nil {
+				err = os.WriteFile(fullPath, v, fileModes[k])
+			}
+			if err == nil {
+				// WriteFile applies the umask, and keeps the mode of an existing file.
+				err = os.Chmod(fullPath, fileModes[k])
+			}
 			if err != nil {
 				log.G(Ctx).Errorf("Could not write %s file %s", volumeType, fullPath)
-				err = os.RemoveAll(fullPath)
-				if err != nil {
+				errRemove := os.RemoveAll(fullPath)
+				if errRemove != nil {
 					log.G(Ctx).Error("Unable to remove file ", fullPath)
-					return []string{}, nil, err
+					return []string{}, nil, nil, errRemove
 				}
-				return []string{}, nil, err
+				return []string{}, nil, nil, err
 			} else {
 				log.G(Ctx).Debugf("--- Written %s file %s", volumeType, fullPath)
 			}
@@ -1182,12 +2671,46 @@ func mountDataSimpleVolume(
 		attribute.String("mountdata.container.name", container.Name),
 		attribute.Int64("mountdata.duration", duration),
 		attribute.StringSlice("mountdata.container."+volumeType, volumesHostToContainerPaths)))
-	return volumesHostToContainerPaths, envVarNames, nil
+	return volumesHostToContainerPaths, envVarNames, volumeFileModes, nil
+}
+
+// selectVolumeItems returns the files of a configMap or secret volume with their mode: all the keys with defaultMode, or only the keys listed
+// in items, at their path and with their mode if set. A key of items missing from the data is an error, unless the volume is optional.
+func selectVolumeItems(data map[string][]byte, items []v1.KeyToPath, defaultMode *int32, fallbackMode os.FileMode, optional *bool) (map[string][]byte, map[string]os.FileMode, error) {
+	mode := fallbackMode
+	if defaultMode != nil {
+		mode = os.FileMode(*defaultMode)
+	}
+	files := map[string][]byte{}
+	fileModes := map[string]os.FileMode{}
+	if len(items) == 0 {
+		for key, content := range data {
+			files[key] = content
+			fileModes[key] = mode
+		}
+		return files, fileModes, nil
+	}
+	for _, item := range items {
+		content, ok := data[item.Key]
+		if !ok {
+			if optional != nil && *optional {
+				continue
+			}
+			return nil, nil, fmt.Errorf("key %s of the items of the volume is not in its data", item.Key)
+		}
+		files[item.Path] = content
+		fileModes[item.Path] = mode
+		if item.Mode != nil {
+			fileModes[item.Path] = os.FileMode(*item.Mode)
+		}
+	}
+	return files, fileModes, nil
 }
 
 /*
 mountData is called by prepareMounts and creates files and directory according to their definition in the pod structure.
 The data parameter is an interface and it can be of type v1.ConfigMap, v1.Secret and string (for the empty dir).
+Without a shared filesystem, the commands creating the emptyDir directories on the node are appended to scriptPrefix.
 
 Returns:
 volumesHostToContainerPaths:
@@ -1204,19 +2727,25 @@ error:
 
 	The first encountered error, or nil
 */
-func mountData(Ctx context.Context, config SlurmConfig, container *v1.Container, retrievedDataObject interface{}, volumeMount v1.VolumeMount, volume v1.Volume, path string) ([]string, []string, error) {
+func mountData(Ctx context.Context, config SlurmConfig, container *v1.Container, retrievedDataObject interface{}, volumeMount v1.VolumeMount, volume v1.Volume, path string, scriptPrefix *strings.Builder) ([]string, []string, []os.FileMode, error) {
 	span := trace.SpanFromContext(Ctx)
 	start := time.Now().UnixMicro()
-	if config.ExportPodData {
+	// EmptyDirs are not pod data, they are created even without ExportPodData.
+	if _, isEmptyDir := retrievedDataObject.(string); config.ExportPodData || isEmptyDir {
 		// for _, mountSpec := range container.VolumeMounts {
 		switch retrievedDataObjectCasted := retrievedDataObject.(type) {
 		case v1.ConfigMap:
 			var volumeType string
 			var defaultMode *int32
+			var items []v1.KeyToPath
+			var optional *bool
 			if volume.ConfigMap != nil {
 				volumeType = "configMaps"
 				defaultMode = volume.ConfigMap.DefaultMode
+				items = volume.ConfigMap.Items
+				optional = volume.ConfigMap.Optional
 			} else if volume.Projected != nil {
+				// The items of the sources of projected volumes are already applied by interLink.
 				volumeType = "projectedVolumeMaps"
 				defaultMode = volume.Projected.DefaultMode
 			}
@@ -1228,15 +2757,24 @@ func mountData(Ctx context.Context, config SlurmConfig, container *v1.Container,
 			for key := range retrievedDataObjectCasted.Data {
 				mountDataConfigMapsAsBytes[key] = []byte(retrievedDataObjectCasted.Data[key])
 			}
-			fileMode := os.FileMode(*defaultMode)
-			return mountDataSimpleVolume(Ctx, container, path, span, volumeMount, mountDataConfigMapsAsBytes, start, volumeType, fileMode)
+			for key := range retrievedDataObjectCasted.BinaryData {
+				mountDataConfigMapsAsBytes[key] = retrievedDataObjectCasted.BinaryData[key]
+			}
+			files, fileModes, err := selectVolumeItems(mountDataConfigMapsAsBytes, items, defaultMode, 0644, optional)
+			if err != nil {
+				return []string{}, nil, nil, fmt.Errorf("configMap volume %s of container %s: %w", volume.Name, container.Name, err)
+			}
+			return mountDataSimpleVolume(Ctx, container, path, span, volumeMount, files, start, volumeType, fileModes)
 
 		case v1.Secret:
 			volumeType := "secrets"
 			log.G(Ctx).Debugf("in mountData() volume found: %s type: %s", volumeMount.Name, volumeType)
 
-			fileMode := os.FileMode(*volume.Secret.DefaultMode)
-			return mountDataSimpleVolume(Ctx, container, path, span, volumeMount, retrievedDataObjectCasted.Data, start, volumeType, fileMode)
+			files, fileModes, err := selectVolumeItems(retrievedDataObjectCasted.Data, volume.Secret.Items, volume.Secret.DefaultMode, 0600, volume.Secret.Optional)
+			if err != nil {
+				return []string{}, nil, nil, fmt.Errorf("secret volume %s of container %s: %w", volume.Name, container.Name, err)
+			}
+			return mountDataSimpleVolume(Ctx, container, path, span, volumeMount, files, start, volumeType, fileModes)
 
 		case string:
 			span.AddEvent("Preparing EmptyDirs mount")
@@ -1244,30 +2782,21 @@ func mountData(Ctx context.Context, config SlurmConfig, container *v1.Container,
 			if volume.EmptyDir != nil {
 				log.G(Ctx).Debugf("in mountData() volume found: %s type: emptyDir", volumeMount.Name)
 
-				var edPath string
-				edPath = filepath.Join(path, "emptyDirs", volume.Name)
+				// The directory of the volume is shared by all the containers of the pod mounting it, eg: for init containers handing data to the others.
+				edPath := filepath.Join(path, "emptyDirs", volume.Name, volumeMount.SubPath)
 				log.G(Ctx).Info("-- Creating EmptyDir in ", edPath)
 				err := os.MkdirAll(edPath, os.FileMode(0755)|os.ModeDir)
 				if err != nil {
-					return []string{}, nil, fmt.Errorf("could not create whole directory of %s root cause %w", edPath, err)
+					return []string{}, nil, nil, fmt.Errorf("could not create whole directory of %s root cause %w", edPath, err)
 				}
 				log.G(Ctx).Debug("-- Created EmptyDir in ", edPath)
-				/*
-					cmd := []string{"-p " + edPath}
-					shell := exec2.ExecTask{
-						Command: "mkdir",
-						Args:    cmd,
-						Shell:   true,
-					}
-
-					_, err := shell.Execute()
-					if err != nil {
-						log.G(Ctx).Error(err)
-						return []string{}, nil, err
-					} else {
-						log.G(Ctx).Debug("-- Created EmptyDir in ", edPath)
-					}
-				*/
+				if os.Getenv("SHARED_FS") != "true" {
+					scriptPrefix.WriteString("\nmkdir -p \"" + edPath + "\"")
+				}
+				if volume.EmptyDir.Medium == v1.StorageMediumMemory {
+					// memEmptyDirs is created by the job script on a tmpfs of the node, see generateMemoryEmptyDirsPrologue.
+					edPath = "\"${memEmptyDirs}\"/" + filepath.Join(volume.Name, volumeMount.SubPath)
+				}
 
 				mode := ""
 				if volumeMount.ReadOnly {
@@ -1283,19 +2812,19 @@ func mountData(Ctx context.Context, config SlurmConfig, container *v1.Container,
 				attribute.String("mountdata.container.name", container.Name),
 				attribute.Int64("mountdata.duration", duration),
 				attribute.StringSlice("mountdata.container.emptydirs", edPaths)))
-			return edPaths, nil, nil
+			return edPaths, nil, nil, nil
 
 		default:
 			log.G(Ctx).Warningf("in mountData() volume %s with unknown retrievedDataObject", volumeMount.Name)
 		}
 	}
-	return nil, nil, nil
+	return nil, nil, nil, nil
 }
 
 // checkIfJidExists checks if a JID is in the main JIDs struct
 func checkIfJidExists(ctx context.Context, JIDs *map[string]*JidStruct, uid string) bool {
 	span := trace.SpanFromContext(ctx)
-	_, ok := (*JIDs)[uid]
+	_, ok := lookupJID(JIDs, uid)
 
 	if ok {
 		return true
@@ -0,0 +1,1007 @@
+package slurm
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testContainer returns a container with the provided CPU and memory limits, not set when empty.
+func testContainer(name string, cpu string, memory string) v1.Container {
+	limits := v1.ResourceList{}
+	if cpu != "" {
+		limits[v1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		limits[v1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return v1.Container{Name: name, Resources: v1.ResourceRequirements{Limits: limits}}
+}
+
+// testSLURMConfig returns a configuration with the defaults of NewSlurmConfig that the script generation relies on.
+func testSLURMConfig() SlurmConfig {
+	return SlurmConfig{
+		BashPath:            "/bin/bash",
+		SingularityPath:     "singularity",
+		ImagePrefix:         "docker://",
+		Scontrolpath:        "/usr/bin/scontrol",
+		ResourceScope:       ResourceScopeLimits,
+		ResourceAggregation: ResourceAggregationPod,
+		GPUGresNames:        map[string]string{"nvidia.com/gpu": "gpu", "amd.com/gpu": "gpu"},
+	}
+}
+
+// testSLURMScript produces the job of the pod in a temporary directory, and returns the directory and the content of job.slurm followed by job.sh.
+// The CPU and memory are the defaults if not set in resourceLimits.
+func testSLURMScript(t *testing.T, config SlurmConfig, pod v1.Pod, commands []SingularityCommand, resourceLimits ResourceLimits) (string, string) {
+	t.Helper()
+	path := t.TempDir()
+	_, err := produceSLURMScript(context.Background(), config, pod, path, pod.ObjectMeta, commands, resourceLimits, resourceLimits.CPU == 0, resourceLimits.Memory == 0, nil, nil, &strings.Builder{})
+	if err != nil {
+		t.Fatalf("produceSLURMScript() error = %v", err)
+	}
+	return path, readJobScript(t, path)
+}
+
+// writeTestExecutable writes a shell script to dir, eg: a stub of a SLURM command, and returns its path.
+func writeTestExecutable(t testing.TB, dir string, name string, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPodResources(t *testing.T) {
+	tests := []struct {
+		name           string
+		aggregation    string
+		initContainers []v1.Container
+		containers     []v1.Container
+		wantCPU        float64
+		wantMemory     int64
+	}{
+		{
+			name:        "one container with limits",
+			aggregation: ResourceAggregationPod,
+			containers:  []v1.Container{testContainer("app", "2", "1Gi")},
+			wantCPU:     2,
+			wantMemory:  1 << 30,
+		},
+		{
+			name:        "second container without limits",
+			aggregation: ResourceAggregationPod,
+			containers:  []v1.Container{testContainer("app", "2", "1Gi"), testContainer("sidecar", "", "")},
+			wantCPU:     2,
+			wantMemory:  1 << 30,
+		},
+		{
+			name:        "containers summed",
+			aggregation: ResourceAggregationPod,
+			containers:  []v1.Container{testContainer("app", "1500m", "1Gi"), testContainer("sidecar", "500m", "512Mi")},
+			wantCPU:     2,
+			wantMemory:  1<<30 + 512<<20,
+		},
+		{
+			name:           "init container only limits",
+			aggregation:    ResourceAggregationPod,
+			initContainers: []v1.Container{testContainer("init", "4", "2Gi")},
+			containers:     []v1.Container{testContainer("app", "", "")},
+			wantCPU:        4,
+			wantMemory:     2 << 30,
+		},
+		{
+			name:           "largest init container over the summed containers",
+			aggregation:    ResourceAggregationPod,
+			initContainers: []v1.Container{testContainer("init", "3", "1Gi"), testContainer("init2", "1", "4Gi")},
+			containers:     []v1.Container{testContainer("app", "1", "1Gi"), testContainer("sidecar", "1", "1Gi")},
+			wantCPU:        3,
+			wantMemory:     4 << 30,
+		},
+		{
+			name:        "all default",
+			aggregation: ResourceAggregationPod,
+			containers:  []v1.Container{testContainer("app", "", ""), testContainer("sidecar", "", "")},
+			wantCPU:     0,
+			wantMemory:  0,
+		},
+		{
+			name:        "max of one container with limits",
+			aggregation: ResourceAggregationMax,
+			containers:  []v1.Container{testContainer("app", "2", "1Gi")},
+			wantCPU:     2,
+			wantMemory:  1 << 30,
+		},
+		{
+			name:        "max with second container without limits",
+			aggregation: ResourceAggregationMax,
+			containers:  []v1.Container{testContainer("app", "2", "1Gi"), testContainer("sidecar", "", "")},
+			wantCPU:     2,
+			wantMemory:  1 << 30,
+		},
+		{
+			name:        "max of the containers",
+			aggregation: ResourceAggregationMax,
+			containers:  []v1.Container{testContainer("app", "1500m", "512Mi"), testContainer("sidecar", "500m", "1Gi")},
+			wantCPU:     1.5,
+			wantMemory:  1 << 30,
+		},
+		{
+			name:           "max with init container only limits",
+			aggregation:    ResourceAggregationMax,
+			initContainers: []v1.Container{testContainer("init", "4", "2Gi")},
+			containers:     []v1.Container{testContainer("app", "", "")},
+			wantCPU:        4,
+			wantMemory:     2 << 30,
+		},
+		{
+			name:        "max all default",
+			aggregation: ResourceAggregationMax,
+			containers:  []v1.Container{testContainer("app", "", "")},
+			wantCPU:     0,
+			wantMemory:  0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := SlurmConfig{ResourceScope: ResourceScopeLimits, ResourceAggregation: test.aggregation}
+			pod := v1.Pod{Spec: v1.PodSpec{InitContainers: test.initContainers, Containers: test.containers}}
+			cpu, memory := podResources(config, pod)
+			if cpu != test.wantCPU || memory != test.wantMemory {
+				t.Errorf("podResources() = %v, %v, want %v, %v", cpu, memory, test.wantCPU, test.wantMemory)
+			}
+		})
+	}
+}
+
+func TestRequeueGuard(t *testing.T) {
+	tests := []struct {
+		name         string
+		restartCount string
+		wantRequeue  bool
+	}{
+		{name: "first attempt", restartCount: "0", wantRequeue: true},
+		{name: "last requeue", restartCount: "1", wantRequeue: true},
+		{name: "limit reached", restartCount: "2", wantRequeue: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			requeued := filepath.Join(stubs, "requeued")
+			config := testSLURMConfig()
+			config.MaxRequeue = 2
+			config.Scontrolpath = writeTestExecutable(t, stubs, "scontrol", `echo "$@" > `+requeued)
+			pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "failing", Namespace: "default", UID: "uid"}}
+			commands := []SingularityCommand{{containerName: "app", singularityCommand: []string{"false"}}}
+			path, script := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+			if !strings.Contains(script, "#SBATCH --requeue") {
+				t.Errorf("job.slurm does not request --requeue:\n%s", script)
+			}
+
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID=42", "SLURM_RESTART_COUNT="+test.restartCount)
+			output, err := cmd.CombinedOutput()
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok || exitErr.ExitCode() != 1 {
+				t.Fatalf("job.sh error = %v, want exit code 1, output:\n%s", err, output)
+			}
+			args, err := os.ReadFile(requeued)
+			if test.wantRequeue && (err != nil || strings.TrimSpace(string(args)) != "requeue 42") {
+				t.Errorf("scontrol called with %q, %v, want requeue 42", args, err)
+			}
+			if !test.wantRequeue && err == nil {
+				t.Errorf("scontrol called with %q after the requeue limit", args)
+			}
+		})
+	}
+}
+
+func TestPrepareMountsMissingSecret(t *testing.T) {
+	tests := []struct {
+		name         string
+		optional     bool
+		strictMounts bool
+		wantErr      bool
+	}{
+		{name: "missing optional secret", optional: true},
+		{name: "missing required secret", wantErr: true},
+		{name: "missing optional secret with StrictMounts", optional: true, strictMounts: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.ExportPodData = true
+			config.StrictMounts = test.strictMounts
+			container := v1.Container{
+				Name: "app",
+				VolumeMounts: []v1.VolumeMount{
+					{Name: "present", MountPath: "/etc/present"},
+					{Name: "missing", MountPath: "/etc/missing"},
+				},
+			}
+			pod := testPod(container)
+			pod.Spec.Volumes = []v1.Volume{
+				{Name: "present", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "present"}}},
+				{Name: "missing", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "missing", Optional: &test.optional}}},
+			}
+			podData := commonIL.RetrievedPodData{
+				Pod: pod,
+				Containers: []commonIL.RetrievedContainer{{
+					Name:    "app",
+					Secrets: []v1.Secret{{ObjectMeta: metav1.ObjectMeta{Name: "present"}, Data: map[string][]byte{"key": []byte("value")}}},
+				}},
+			}
+
+			mounts, err := prepareMounts(context.Background(), config, &podData, &container, t.TempDir(), &strings.Builder{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("prepareMounts() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !strings.Contains(mounts, ":/etc/present/key") {
+				t.Errorf("prepareMounts() = %q, want the present secret mounted", mounts)
+			}
+			if strings.Contains(mounts, "/etc/missing") {
+				t.Errorf("prepareMounts() = %q, want the missing secret skipped", mounts)
+			}
+		})
+	}
+}
+
+func TestSbatchExport(t *testing.T) {
+	t.Setenv("SHARED_FS", "false")
+	tests := []struct {
+		name         string
+		sbatchExport string
+		flags        string
+		secret       bool
+		wantExports  []string
+	}{
+		{name: "default"},
+		{name: "none", sbatchExport: "NONE", wantExports: []string{"--export=NONE"}},
+		{name: "variable list", sbatchExport: "PATH,HOME", wantExports: []string{"--export=PATH,HOME"}},
+		{name: "annotation after the configured one", sbatchExport: "NONE", flags: "--export=ALL", wantExports: []string{"--export=NONE", "--export=ALL"}},
+		{name: "all with a secret", sbatchExport: "ALL", secret: true, wantExports: []string{"--export=ALL"}},
+		{name: "none with a secret", sbatchExport: "NONE", secret: true, wantExports: []string{"--export=<secret>"}},
+		{name: "variable list with a secret", sbatchExport: "PATH,HOME", secret: true, wantExports: []string{"--export=PATH,HOME,<secret>"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.ExportPodData = true
+			config.SbatchExport = test.sbatchExport
+			container := v1.Container{Name: "app"}
+			pod := testPod(container)
+			if test.flags != "" {
+				pod.Annotations["slurm-job.vk.io/flags"] = test.flags
+			}
+			path := t.TempDir()
+			scriptPrefix := &strings.Builder{}
+			if test.secret {
+				container.VolumeMounts = []v1.VolumeMount{{Name: "token", MountPath: "/etc/token"}}
+				pod.Spec.Volumes = []v1.Volume{{Name: "token", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "token"}}}}
+				podData := commonIL.RetrievedPodData{Pod: pod, Containers: []commonIL.RetrievedContainer{{
+					Name:    "app",
+					Secrets: []v1.Secret{{ObjectMeta: metav1.ObjectMeta{Name: "token"}, Data: map[string][]byte{"token": []byte("s3cr3t")}}},
+				}}}
+				if _, err := prepareMounts(context.Background(), config, &podData, &container, path, scriptPrefix); err != nil {
+					t.Fatalf("prepareMounts() error = %v", err)
+				}
+			}
+			secretEnv := "app_secrets_" + stringToHex(filepath.Join(path, "secrets", "token", "token"))
+			if _, err := produceSLURMScript(context.Background(), config, pod, path, pod.ObjectMeta, nil, ResourceLimits{}, true, true, nil, nil, scriptPrefix); err != nil {
+				t.Fatalf("produceSLURMScript() error = %v", err)
+			}
+			script := readJobScript(t, path)
+			exports := []string{}
+			for _, line := range strings.Split(script, "\n") {
+				if export, found := strings.CutPrefix(line, "#SBATCH "); found && strings.HasPrefix(export, "--export=") {
+					exports = append(exports, export)
+				}
+			}
+			wantExports := strings.ReplaceAll(strings.Join(test.wantExports, " "), "<secret>", secretEnv)
+			if strings.Join(exports, " ") != wantExports {
+				t.Errorf("#SBATCH --export lines = %v, want %v", exports, wantExports)
+			}
+			if !test.secret || test.sbatchExport == "ALL" {
+				return
+			}
+
+			// sbatch only passes the exported env vars to the job.
+			env := []string{}
+			for _, name := range strings.Split(strings.TrimPrefix(exports[0], "--export="), ",") {
+				env = append(env, name+"="+os.Getenv(name))
+			}
+			cmd := exec.Command("/bin/bash", "-c", scriptPrefix.String())
+			cmd.Env = env
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("script prefix error = %v, output:\n%s", err, output)
+			}
+			if content, err := os.ReadFile(filepath.Join(path, "secrets", "token", "token")); err != nil || string(content) != "s3cr3t\n" {
+				t.Errorf("mounted secret = %q, %v, want %q", content, err, "s3cr3t\n")
+			}
+		})
+	}
+}
+
+func TestDeleteContainerConcurrent(t *testing.T) {
+	stubs := t.TempDir()
+	calls := filepath.Join(stubs, "calls")
+	config := testSLURMConfig()
+	config.Scancelpath = writeTestExecutable(t, stubs, "scancel", `echo "$@" >> `+calls+`
+sleep 0.2`)
+	path := filepath.Join(t.TempDir(), "default-test-uid")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	JIDs := map[string]*JidStruct{"test-uid": {PodUID: "test-uid", PodNamespace: "default", JID: "123"}}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- deleteContainer(context.Background(), config, "test-uid", "test-uid", "", "", &JIDs, path, true)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("deleteContainer() error = %v", err)
+		}
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("working directory still exists: %v", err)
+	}
+	if _, tracked := lookupJID(&JIDs, "test-uid"); tracked {
+		t.Errorf("job still tracked after deleteContainer()")
+	}
+	// The second deletion does not know the job anymore, it only cancels the jobs named after the pod.
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Split(strings.TrimSpace(string(content)), "\n"), []string{"123", "--name=test-uid"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("scancel calls = %q, want %q", got, want)
+	}
+}
+
+func TestLogPipeCommand(t *testing.T) {
+	logs := t.TempDir()
+	config := testSLURMConfig()
+	config.LogPipeCommand = "cat >> " + logs + "/{namespace}-{pod}-{container}.log"
+	pod := testPod(v1.Container{Name: "app"})
+	commands := []SingularityCommand{{containerName: "app", singularityCommand: []string{"/bin/echo"}, containerArgs: []string{"hello"}}}
+	path, script := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+	if want := "logPipe='cat >> " + logs + "/default-test-app.log' runCtn app /bin/echo hello\n"; !strings.Contains(script, want) {
+		t.Fatalf("job.sh does not run app with its log pipe %q:\n%s", want, script)
+	}
+
+	cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+	}
+	// The output is still written to the file read by the status and logs handlers.
+	if content, err := os.ReadFile(filepath.Join(path, "run-app.out")); err != nil || !strings.Contains(string(content), "hello") {
+		t.Errorf("run-app.out = %q, %v, want the container output", content, err)
+	}
+	// The pipe may end shortly after the job, since it runs in a process substitution.
+	var content []byte
+	for i := 0; i < 50 && !strings.Contains(string(content), "hello"); i++ {
+		time.Sleep(20 * time.Millisecond)
+		content, _ = os.ReadFile(filepath.Join(logs, "default-test-app.log"))
+	}
+	if !strings.Contains(string(content), "hello") {
+		t.Errorf("log pipe received %q, want the container output", content)
+	}
+}
+
+func TestApplyResourceFloor(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		limits       ResourceLimits
+		isDefaultRam bool
+		want         ResourceLimits
+		wantErr      bool
+	}{
+		{name: "above the floor", mode: ResourceFloorError, limits: ResourceLimits{CPU: 2, Memory: 1 << 30}, want: ResourceLimits{CPU: 2, Memory: 1 << 30}},
+		{name: "zero memory clamped", mode: ResourceFloorClamp, limits: ResourceLimits{CPU: 1}, want: ResourceLimits{CPU: 1, Memory: 256 << 20}},
+		{name: "zero CPU clamped", mode: ResourceFloorClamp, limits: ResourceLimits{Memory: 1 << 30}, want: ResourceLimits{CPU: 1, Memory: 1 << 30}},
+		{name: "zero memory rejected", mode: ResourceFloorError, limits: ResourceLimits{CPU: 1}, wantErr: true},
+		{name: "zero CPU rejected", mode: ResourceFloorError, limits: ResourceLimits{Memory: 1 << 30}, wantErr: true},
+		{name: "default memory", mode: ResourceFloorError, limits: ResourceLimits{CPU: 1}, isDefaultRam: true, want: ResourceLimits{CPU: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.MemoryFloorMB = 256
+			config.ResourceFloorMode = test.mode
+			limits := test.limits
+			err := applyResourceFloor(context.Background(), config, &limits, false, test.isDefaultRam)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("applyResourceFloor() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && (limits.CPU != test.want.CPU || limits.Memory != test.want.Memory) {
+				t.Errorf("applyResourceFloor() limits = %+v, want %+v", limits, test.want)
+			}
+		})
+	}
+}
+
+func TestLintSLURMScript(t *testing.T) {
+	config := testSLURMConfig()
+	commands := []SingularityCommand{{containerName: "app", singularityCommand: []string{"/bin/true"}}}
+	path, _ := testSLURMScript(t, config, testPod(v1.Container{Name: "app"}), commands, ResourceLimits{})
+	if err := lintSLURMScript(context.Background(), config, path); err != nil {
+		t.Fatalf("lintSLURMScript() error = %v, want the generated script accepted", err)
+	}
+
+	// An env value with an unbalanced quote, as a quoting bug of the env assembly would write it.
+	jobScript, err := os.OpenFile(filepath.Join(path, "job.sh"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jobScript.WriteString(`export SINGULARITYENV_GREETING="it's \"quoted` + "\n")
+	jobScript.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lintSLURMScript(context.Background(), config, path)
+	if err == nil || !strings.Contains(err.Error(), "job.sh") {
+		t.Errorf("lintSLURMScript() error = %v, want the bash syntax error of job.sh", err)
+	}
+}
+
+func TestResolveMountConflicts(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		volumeMounts []v1.VolumeMount
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:         "distinct paths",
+			policy:       MountConflictError,
+			volumeMounts: []v1.VolumeMount{{Name: "config", MountPath: "/etc/app"}, {Name: "data", MountPath: "/data"}},
+			want:         []string{"data", "config"},
+		},
+		{
+			name:         "same path rejected",
+			policy:       MountConflictError,
+			volumeMounts: []v1.VolumeMount{{Name: "config", MountPath: "/etc/app"}, {Name: "override", MountPath: "/etc/app/"}},
+			wantErr:      true,
+		},
+		{
+			name:         "same path last wins",
+			policy:       MountConflictLastWins,
+			volumeMounts: []v1.VolumeMount{{Name: "config", MountPath: "/etc/app"}, {Name: "data", MountPath: "/data"}, {Name: "override", MountPath: "/etc/app/"}},
+			want:         []string{"data", "override"},
+		},
+		{
+			name:         "nested paths ordered parent first",
+			policy:       MountConflictError,
+			volumeMounts: []v1.VolumeMount{{Name: "secret", MountPath: "/etc/app/secret"}, {Name: "config", MountPath: "/etc/app"}},
+			want:         []string{"config", "secret"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.MountConflictPolicy = test.policy
+			container := v1.Container{Name: "app", VolumeMounts: test.volumeMounts}
+			volumeMounts, err := resolveMountConflicts(context.Background(), config, &container)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("resolveMountConflicts() error = %v, wantErr %v", err, test.wantErr)
+			}
+			names := []string{}
+			for _, volumeMount := range volumeMounts {
+				names = append(names, volumeMount.Name)
+			}
+			if !test.wantErr && strings.Join(names, " ") != strings.Join(test.want, " ") {
+				t.Errorf("resolveMountConflicts() = %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestEnvDirSourcing(t *testing.T) {
+	siteEnvDir, podEnvDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, siteEnvDir, "license.sh", "export SITE_LICENSE=site")
+	writeTestFile(t, siteEnvDir, "notes.txt", "export SITE_LICENSE=ignored")
+	writeTestFile(t, podEnvDir, "license.sh", "export SITE_LICENSE=pod")
+	tests := []struct {
+		name        string
+		annotation  string
+		wantLicense string
+	}{
+		{name: "EnvDir", wantLicense: "site"},
+		{name: "annotation over EnvDir", annotation: podEnvDir, wantLicense: "pod"},
+		{name: "missing directory", annotation: filepath.Join(podEnvDir, "missing"), wantLicense: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.EnvDir = siteEnvDir
+			pod := testPod(v1.Container{Name: "app"})
+			if test.annotation != "" {
+				pod.Annotations["slurm-job.vk.io/env-dir"] = test.annotation
+			}
+			commands := []SingularityCommand{{containerName: "app", singularityCommand: []string{"/bin/sh"}, containerArgs: []string{"-c", "echo license=$SITE_LICENSE"}}}
+			path, script := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+			if !strings.Contains(script, "for envFile in \"${envDir}\"/*.sh ; do") {
+				t.Fatalf("job.sh does not source the env directory:\n%s", script)
+			}
+
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+			}
+			content, err := os.ReadFile(filepath.Join(path, "run-app.out"))
+			if err != nil || !strings.Contains(string(content), "license="+test.wantLicense+"\n") {
+				t.Errorf("run-app.out = %q, %v, want license=%s", content, err, test.wantLicense)
+			}
+		})
+	}
+}
+
+func TestUmask(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotation   string
+		defaultUmask string
+		wantUmask    string
+		wantOutput   string
+		wantErr      bool
+	}{
+		{name: "no umask"},
+		{name: "annotation", annotation: "027", wantUmask: "027", wantOutput: "umask=0027\n"},
+		{name: "DefaultContainerUmask", defaultUmask: "0077", wantUmask: "0077", wantOutput: "umask=0077\n"},
+		{name: "annotation over DefaultContainerUmask", annotation: "022", defaultUmask: "0077", wantUmask: "022", wantOutput: "umask=0022\n"},
+		{name: "not octal", annotation: "089", wantErr: true},
+		{name: "symbolic", annotation: "u=rwx,g=rx,o=", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.DefaultContainerUmask = test.defaultUmask
+			pod := testPod(v1.Container{Name: "app"})
+			if test.annotation != "" {
+				pod.Annotations["slurm-job.vk.io/umask"] = test.annotation
+			}
+			commands := []SingularityCommand{{containerName: "app", singularityCommand: []string{"/bin/sh"}, containerArgs: []string{"-c", "echo umask=$(umask)"}}}
+			if test.wantErr {
+				_, err := produceSLURMScript(context.Background(), config, pod, t.TempDir(), pod.ObjectMeta, commands, ResourceLimits{}, true, true, nil, nil, &strings.Builder{})
+				if err == nil {
+					t.Errorf("produceSLURMScript() error = nil, want an invalid umask error")
+				}
+				return
+			}
+			path, script := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+			if got := strings.Contains(script, "\numask "+test.wantUmask+"\n"); got != (test.wantUmask != "") {
+				t.Fatalf("job.sh has the umask %s line = %v, want %v:\n%s", test.wantUmask, got, test.wantUmask != "", script)
+			}
+			if test.wantUmask == "" {
+				return
+			}
+
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+			}
+			content, err := os.ReadFile(filepath.Join(path, "run-app.out"))
+			if err != nil || !strings.Contains(string(content), test.wantOutput) {
+				t.Errorf("run-app.out = %q, %v, want %q", content, err, test.wantOutput)
+			}
+		})
+	}
+}
+
+func TestPrepareEnvsTruncatesAttributes(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test").Start(context.Background(), "prepareEnvs")
+	config := testSLURMConfig()
+	config.DataRootFolder = t.TempDir() + "/"
+	config.MaxAttrValueLen = 64
+	value := strings.Repeat("a", 10*1024)
+	pod := testPod(v1.Container{Name: "app", Env: []v1.EnvVar{{Name: "CERT", Value: value}}})
+	if err := os.MkdirAll(config.DataRootFolder+pod.Namespace+"-"+string(pod.UID), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	envs := prepareEnvs(ctx, config, commonIL.RetrievedPodData{Pod: pod}, pod.Spec.Containers[0])
+	span.End()
+	if len(envs) != 2 || envs[0] != "--env-file" {
+		t.Fatalf("prepareEnvs() = %v, want the --env-file flags", envs)
+	}
+	content, err := os.ReadFile(envs[1])
+	if err != nil || string(content) != "CERT="+value+"\n" {
+		t.Errorf("env file has %d bytes, %v, want the full value of %d bytes", len(content), err, len(value))
+	}
+
+	var envsData []string
+	for _, event := range recorder.Ended()[0].Events() {
+		for _, attr := range event.Attributes {
+			if attr.Key == "prepareenvs.container.envs_data" {
+				envsData = attr.Value.AsStringSlice()
+			}
+		}
+	}
+	if len(envsData) != 1 || envsData[0] != "CERT="+strings.Repeat("a", 59)+"..." {
+		t.Errorf("prepareenvs.container.envs_data = %v, want the value truncated to 64 bytes", envsData)
+	}
+}
+
+func TestSupplementalGroups(t *testing.T) {
+	memberGID := int64(os.Getgid())
+	const otherGID = 4242421
+	tests := []struct {
+		name                    string
+		allowSupplementalGroups bool
+		wantCheck               bool
+	}{
+		{name: "AllowSupplementalGroups", allowSupplementalGroups: true, wantCheck: true},
+		{name: "supplementalGroups ignored", allowSupplementalGroups: false, wantCheck: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.AllowSupplementalGroups = test.allowSupplementalGroups
+			pod := testPod(v1.Container{Name: "app"})
+			pod.Spec.SecurityContext = &v1.PodSecurityContext{SupplementalGroups: []int64{memberGID, otherGID}}
+			commands := []SingularityCommand{{containerName: "app", singularityCommand: []string{"/bin/true"}}}
+			path, script := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+			wantLoop := "for gid in " + strconv.FormatInt(memberGID, 10) + " 4242421 ; do"
+			if got := strings.Contains(script, wantLoop); got != test.wantCheck {
+				t.Fatalf("job.sh checks the supplemental groups = %v, want %v:\n%s", got, test.wantCheck, script)
+			}
+			if !test.wantCheck {
+				return
+			}
+
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+			}
+			if !strings.Contains(string(output), "not a member of supplemental group 4242421") {
+				t.Errorf("job.sh output does not report the missing group 4242421:\n%s", output)
+			}
+			if strings.Contains(string(output), "supplemental group "+strconv.FormatInt(memberGID, 10)+",") {
+				t.Errorf("job.sh output reports the group %d of the job user:\n%s", memberGID, output)
+			}
+		})
+	}
+}
+
+func TestEnvProfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		profile      string
+		wantCompiler string
+		wantErr      bool
+	}{
+		{name: "no profile"},
+		{name: "profile", profile: "gcc", wantCompiler: "gcc-12"},
+		{name: "unknown profile", profile: "icc", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.EnvProfiles = map[string][]string{"gcc": {"COMPILER=gcc-12", "export COMPILER"}}
+			pod := testPod(v1.Container{Name: "app"})
+			if test.profile != "" {
+				pod.Annotations["slurm-job.vk.io/env-profile"] = test.profile
+			}
+			commands := []SingularityCommand{{containerName: "app", singularityCommand: []string{"/bin/sh"}, containerArgs: []string{"-c", "echo compiler=$COMPILER"}}}
+			if test.wantErr {
+				_, err := produceSLURMScript(context.Background(), config, pod, t.TempDir(), pod.ObjectMeta, commands, ResourceLimits{}, true, true, nil, nil, &strings.Builder{})
+				if err == nil {
+					t.Errorf("produceSLURMScript() error = nil, want an unknown profile error")
+				}
+				return
+			}
+			path, script := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+			if got := strings.Contains(script, "\nCOMPILER=gcc-12\nexport COMPILER\n"); got != (test.profile != "") {
+				t.Fatalf("job.sh has the commands of the profile = %v, want %v:\n%s", got, test.profile != "", script)
+			}
+
+			cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+			cmd.Dir = path
+			cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("job.sh error = %v, output:\n%s", err, output)
+			}
+			content, err := os.ReadFile(filepath.Join(path, "run-app.out"))
+			if err != nil || !strings.Contains(string(content), "compiler="+test.wantCompiler+"\n") {
+				t.Errorf("run-app.out = %q, %v, want compiler=%s", content, err, test.wantCompiler)
+			}
+		})
+	}
+}
+
+func TestParseSbatchJobID(t *testing.T) {
+	tests := []struct {
+		output      string
+		wantJID     string
+		wantCluster string
+		wantErr     bool
+	}{
+		{output: "Submitted batch job 12345\n", wantJID: "12345"},
+		{output: "Submitted batch job 12345.cluster\n", wantJID: "12345", wantCluster: "cluster"},
+		{output: "Submitted batch job 12345 on cluster c1\n", wantJID: "12345", wantCluster: "c1"},
+		{output: "sbatch: warning: no QoS set\nSubmitted batch job 12345\n", wantJID: "12345"},
+		{output: "12345\n", wantJID: "12345"},
+		{output: "12345.cluster\n", wantJID: "12345", wantCluster: "cluster"},
+		{output: "12345;c1\n", wantJID: "12345", wantCluster: "c1"},
+		{output: "sbatch: error: Batch job submission failed", wantErr: true},
+		{output: "Submitted batch job abc", wantErr: true},
+		{output: "", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.output, func(t *testing.T) {
+			jid, cluster, err := parseSbatchJobID(test.output)
+			if (err != nil) != test.wantErr || jid != test.wantJID || cluster != test.wantCluster {
+				t.Errorf("parseSbatchJobID(%q) = %q, %q, %v, want %q, %q, wantErr %v", test.output, jid, cluster, err, test.wantJID, test.wantCluster, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubmitRedactsSensitiveEnvs(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	config := testSubmitConfig(t)
+	config.SensitiveEnvPatterns = defaultSensitiveEnvPatterns
+	const secret = "s3cr3t-value"
+	container := testContainer("app", "1", "1Gi")
+	container.Env = []v1.EnvVar{{Name: "API_TOKEN", Value: secret}, {Name: "db_password", Value: secret}, {Name: "LOG_LEVEL", Value: "debug"}}
+	pod := testPod(container)
+	w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+	if w.Code != http.StatusOK {
+		t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	content, err := os.ReadFile(filepath.Join(path, "app_envfile.properties"))
+	want := "API_TOKEN=" + secret + "\ndb_password=" + secret + "\nLOG_LEVEL=debug\n"
+	if err != nil || string(content) != want {
+		t.Errorf("env file = %q, %v, want %q", content, err, want)
+	}
+
+	var envsData []string
+	for _, span := range recorder.Ended() {
+		attributes := span.Attributes()
+		for _, event := range span.Events() {
+			attributes = append(attributes, event.Attributes...)
+		}
+		for _, attr := range attributes {
+			if strings.Contains(attr.Value.Emit(), secret) {
+				t.Errorf("attribute %s of span %s = %s, want the secret redacted", attr.Key, span.Name(), attr.Value.Emit())
+			}
+			if attr.Key == "prepareenvs.container.envs_data" {
+				envsData = attr.Value.AsStringSlice()
+			}
+		}
+	}
+	if wantData := []string{"API_TOKEN=***", "db_password=***", "LOG_LEVEL=debug"}; strings.Join(envsData, " ") != strings.Join(wantData, " ") {
+		t.Errorf("prepareenvs.container.envs_data = %v, want %v", envsData, wantData)
+	}
+}
+
+func TestDeleteContainerJobGone(t *testing.T) {
+	for _, output := range scancelJobErrors {
+		t.Run(output, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.Scancelpath = writeTestExecutable(t, t.TempDir(), "scancel", `echo "scancel: error: Kill job error on job id $1: `+output+`" >&2
+exit 1`)
+			JIDs := map[string]*JidStruct{"test-uid": {PodUID: "test-uid", JID: "123"}}
+			path := t.TempDir()
+			err := deleteContainer(context.Background(), config, "test-uid", "test-uid", "", "", &JIDs, path, true)
+			if err != nil {
+				t.Errorf("deleteContainer() error = %v, want the ended job deleted", err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("job files still present after deleteContainer(): %v", err)
+			}
+			if _, tracked := lookupJID(&JIDs, "test-uid"); tracked {
+				t.Errorf("job still tracked after deleteContainer()")
+			}
+		})
+	}
+
+	config := testSLURMConfig()
+	config.Scancelpath = writeTestExecutable(t, t.TempDir(), "scancel", `echo "scancel: error: Access/permission denied" >&2
+exit 1`)
+	JIDs := map[string]*JidStruct{"test-uid": {PodUID: "test-uid", JID: "123"}}
+	if err := deleteContainer(context.Background(), config, "test-uid", "test-uid", "", "", &JIDs, t.TempDir(), true); err == nil {
+		t.Errorf("deleteContainer() error = nil, want the scancel error")
+	}
+	if _, tracked := lookupJID(&JIDs, "test-uid"); !tracked {
+		t.Errorf("job not tracked anymore after a failed scancel")
+	}
+}
+
+func TestPrepareMountsFileModes(t *testing.T) {
+	t.Setenv("SHARED_FS", "false")
+	config := testSLURMConfig()
+	config.ExportPodData = true
+	container := v1.Container{Name: "app", VolumeMounts: []v1.VolumeMount{{Name: "credentials", MountPath: "/etc/credentials"}}}
+	pod := testPod(container)
+	defaultMode, certMode := int32(0400), int32(0444)
+	pod.Spec.Volumes = []v1.Volume{{Name: "credentials", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+		SecretName:  "credentials",
+		DefaultMode: &defaultMode,
+		Items:       []v1.KeyToPath{{Key: "token", Path: "token"}, {Key: "ca", Path: "certs/ca.crt", Mode: &certMode}},
+	}}}}
+	podData := commonIL.RetrievedPodData{
+		Pod: pod,
+		Containers: []commonIL.RetrievedContainer{{
+			Name:    "app",
+			Secrets: []v1.Secret{{ObjectMeta: metav1.ObjectMeta{Name: "credentials"}, Data: map[string][]byte{"token": []byte("s3cr3t"), "ca": []byte("CERT")}}},
+		}},
+	}
+	path := t.TempDir()
+	scriptPrefix := &strings.Builder{}
+	if _, err := prepareMounts(context.Background(), config, &podData, &container, path, scriptPrefix); err != nil {
+		t.Fatalf("prepareMounts() error = %v", err)
+	}
+
+	files := map[string]struct {
+		content string
+		mode    os.FileMode
+	}{"token": {"s3cr3t\n", 0400}, "certs/ca.crt": {"CERT\n", 0444}}
+	prefix := scriptPrefix.String()
+	for key, want := range files {
+		hostPath := filepath.Join(path, "secrets", "credentials", key)
+		touch := strings.Index(prefix, `touch "`+hostPath+`"`)
+		write := strings.Index(prefix, `> "`+hostPath+`"`)
+		chmod := strings.Index(prefix, "chmod "+strconv.FormatUint(uint64(want.mode), 8)+` "`+hostPath+`"`)
+		if touch < 0 || write < touch || chmod < write {
+			t.Errorf("%s created at %d, written at %d, chmod %o at %d, want them in this order, script prefix:\n%s", key, touch, write, want.mode, chmod, prefix)
+		}
+	}
+
+	// The prefix runs in the job, with the contents in the environment of sbatch.
+	cmd := exec.Command("/bin/bash", "-c", prefix)
+	cmd.Dir = path
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("script prefix error = %v, output:\n%s", err, output)
+	}
+	for key, want := range files {
+		hostPath := filepath.Join(path, "secrets", "credentials", key)
+		content, err := os.ReadFile(hostPath)
+		if err != nil || string(content) != want.content {
+			t.Errorf("%s = %q, %v, want %q", key, content, err, want.content)
+		}
+		info, err := os.Stat(hostPath)
+		if err != nil || info.Mode().Perm() != want.mode {
+			t.Errorf("mode of %s = %v, want %o", key, info, want.mode)
+		}
+	}
+}
+
+func TestLoadJIDs(t *testing.T) {
+	stubs := t.TempDir()
+	config := testSLURMConfig()
+	config.DataRootFolder = t.TempDir() + "/"
+	// Job 1 is lost, job 2 left squeue but is in the accounting, job 3 is running and squeue times out for job 4.
+	config.Squeuepath = writeTestExecutable(t, stubs, "squeue", `case "$*" in
+  *"-j 3"*) echo "R" ;;
+  *"-j 4"*) echo "slurm_load_jobs error: Socket timed out on send/recv operation" >&2 ;;
+  *) echo "slurm_load_jobs error: Invalid job id specified" >&2 ;;
+esac`)
+	config.Sacctpath = writeTestExecutable(t, stubs, "sacct", `case "$*" in
+  *"-j 2 "*) echo "COMPLETED|0:0" ;;
+esac`)
+	for jid, files := range map[string]map[string]string{
+		"1": {},
+		"2": {},
+		"3": {},
+		"4": {},
+		// Finished jobs are kept without asking SLURM.
+		"5": {"FinishedAt.time": time.Now().Format("2006-01-02 15:04:05.999999999 -0700 MST")},
+		// Not recovered before JobID.jid is written.
+		"6": {"JobID.jid": ""},
+	} {
+		path := filepath.Join(config.DataRootFolder, "default-pod-"+jid)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, path, "PodUID.uid", "pod-"+jid)
+		writeTestFile(t, path, "PodNamespace.ns", "default")
+		if _, found := files["JobID.jid"]; !found {
+			writeTestFile(t, path, "JobID.jid", jid)
+		}
+		for name, content := range files {
+			if name != "JobID.jid" {
+				writeTestFile(t, path, name, content)
+			}
+		}
+	}
+
+	JIDs := map[string]*JidStruct{}
+	h := SidecarHandler{Config: config, JIDs: &JIDs, Ctx: context.Background()}
+	if err := h.LoadJIDs(); err != nil {
+		t.Fatalf("LoadJIDs() error = %v", err)
+	}
+	loaded := []string{}
+	for podUID, jid := range JIDs {
+		if podUID != "pod-"+jid.JID || jid.PodNamespace != "default" {
+			t.Errorf("JIDs[%s] = %+v, want job %s of namespace default", podUID, jid, strings.TrimPrefix(podUID, "pod-"))
+		}
+		loaded = append(loaded, jid.JID)
+	}
+	sort.Strings(loaded)
+	if strings.Join(loaded, " ") != "2 3 4 5" {
+		t.Errorf("LoadJIDs() loaded jobs %v, want 2 3 4 5", loaded)
+	}
+}
+
+func TestHandleJidAndPodUidWritesJobIDLast(t *testing.T) {
+	pod := testPod(testContainer("app", "1", "1Gi"))
+	path := t.TempDir()
+	// A PodUID.uid that cannot be written stops before JobID.jid.
+	if err := os.Mkdir(filepath.Join(path, "PodUID.uid"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, "PodUID.uid/keep", "")
+	JIDs := map[string]*JidStruct{}
+	if _, err := handleJidAndPodUid(context.Background(), pod, &JIDs, "Submitted batch job 123", path, "", ""); err == nil {
+		t.Fatalf("handleJidAndPodUid() error = nil, want the PodUID.uid error")
+	}
+	if _, err := os.Stat(filepath.Join(path, "JobID.jid")); !os.IsNotExist(err) {
+		t.Errorf("JobID.jid written before PodUID.uid: %v", err)
+	}
+
+	path = t.TempDir()
+	if _, err := handleJidAndPodUid(context.Background(), pod, &JIDs, "Submitted batch job 123", path, "c1", "alice"); err != nil {
+		t.Fatalf("handleJidAndPodUid() error = %v", err)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	// No temporary file is left by writeFileAtomic.
+	if want := "Cluster.name JobID.jid PodNamespace.ns PodUID.uid SubmitUser.name"; strings.Join(names, " ") != want {
+		t.Errorf("written files = %v, want %s", names, want)
+	}
+	jobInfo, _ := os.Stat(filepath.Join(path, "JobID.jid"))
+	for _, name := range names {
+		if info, _ := os.Stat(filepath.Join(path, name)); info.ModTime().After(jobInfo.ModTime()) {
+			t.Errorf("%s written after JobID.jid", name)
+		}
+	}
+}
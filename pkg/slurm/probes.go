@@ -4,19 +4,21 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/containerd/containerd/log"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
 // translateKubernetesProbes converts Kubernetes probe specifications to internal ProbeCommand format
-func translateKubernetesProbes(ctx context.Context, container v1.Container) ([]ProbeCommand, []ProbeCommand) {
-	var readinessProbes, livenessProbes []ProbeCommand
+func translateKubernetesProbes(ctx context.Context, container v1.Container) ([]ProbeCommand, []ProbeCommand, []ProbeCommand) {
+	var readinessProbes, livenessProbes, startupProbes []ProbeCommand
 	span := trace.SpanFromContext(ctx)
 
 	// Handle readiness probe
@@ -37,7 +39,16 @@ func translateKubernetesProbes(ctx context.Context, container v1.Container) ([]P
 		}
 	}
 
-	return readinessProbes, livenessProbes
+	// Handle startup probe
+	if container.StartupProbe != nil {
+		probe := translateSingleProbe(ctx, container.StartupProbe)
+		if probe != nil {
+			startupProbes = append(startupProbes, *probe)
+			span.AddEvent("Translated startup probe for container " + container.Name)
+		}
+	}
+
+	return readinessProbes, livenessProbes, startupProbes
 }
 
 // translateSingleProbe converts a single Kubernetes probe to internal format
@@ -102,12 +113,13 @@ func translateSingleProbe(ctx context.Context, k8sProbe *v1.Probe) *ProbeCommand
 	return nil
 }
 
-// generateProbeScript generates the shell script commands for executing probes
-func generateProbeScript(ctx context.Context, config SlurmConfig, containerName string, imageName string, readinessProbes []ProbeCommand, livenessProbes []ProbeCommand) string {
+// generateProbeScript generates the shell script commands for executing probes.
+// Readiness and liveness probes only start once the startup probes succeeded.
+func generateProbeScript(ctx context.Context, config SlurmConfig, containerName string, imageName string, readinessProbes []ProbeCommand, livenessProbes []ProbeCommand, startupProbes []ProbeCommand) string {
 	span := trace.SpanFromContext(ctx)
 	span.AddEvent("Generating probe script for container " + containerName)
 
-	if len(readinessProbes) == 0 && len(livenessProbes) == 0 {
+	if len(readinessProbes) == 0 && len(livenessProbes) == 0 && len(startupProbes) == 0 {
 		return ""
 	}
 
@@ -152,6 +164,23 @@ executeExecProbe() {
 }`, imageName))
 
 	scriptBuilder.WriteString(`
+# Waits for the startup probes of the container, returns 1 if one of them failed.
+waitStartupProbes() {
+    local container_name="$1"
+    local startup_status_file
+    for startup_status_file in "${workingPath}/startup-probe-${container_name}-"*.status ; do
+        test -e "$startup_status_file" || continue
+        while true; do
+            case "$(cat "$startup_status_file")" in
+                SUCCESS) break ;;
+                FAILED_THRESHOLD) return 1 ;;
+            esac
+            sleep 1
+        done
+    done
+    return 0
+}
+
 runProbe() {
     local probe_type="$1"
     local container_name="$2"
@@ -164,19 +193,26 @@ runProbe() {
     local probe_index="$9"
     shift 9
     local probe_args=("$@")
+    # Probes are started right after the container, so pid is the one of the container (see runCtn and runRestartableCtn).
+    local ctn_pid="${pid}"
     
     local probe_status_file="${workingPath}/${probe_name}-probe-${container_name}-${probe_index}.status"
     local probe_timestamp_file="${workingPath}/${probe_name}-probe-${container_name}-${probe_index}.timestamp"
     
-    printf "%%s\n" "$(date -Is --utc) Starting ${probe_name} probe for container ${container_name}..."
+    printf "%s\n" "$(date -Is --utc) Starting ${probe_name} probe for container ${container_name}..."
     
     # Initialize probe status as unknown
     echo "UNKNOWN" > "$probe_status_file"
     date -Is --utc > "$probe_timestamp_file"
     
+    if [ "$probe_name" != "startup" ] && ! waitStartupProbes "$container_name"; then
+        printf "%s\n" "$(date -Is --utc) Startup probe failed for ${container_name}, not starting ${probe_name} probe" >&2
+        return 1
+    fi
+    
     # Initial delay
     if [ "$initial_delay" -gt 0 ]; then
-        printf "%%s\n" "$(date -Is --utc) Waiting ${initial_delay}s before starting ${probe_name} probe..."
+        printf "%s\n" "$(date -Is --utc) Waiting ${initial_delay}s before starting ${probe_name} probe..."
         sleep "$initial_delay"
     fi
     
@@ -199,10 +235,17 @@ runProbe() {
         if [ $exit_code -eq 0 ]; then
             consecutive_successes=$((consecutive_successes + 1))
             consecutive_failures=0
-            printf "%%s\n" "$(date -Is --utc) ${probe_name} probe succeeded for ${container_name} (${consecutive_successes}/${success_threshold})"
+            printf "%s\n" "$(date -Is --utc) ${probe_name} probe succeeded for ${container_name} (${consecutive_successes}/${success_threshold})"
+            
+            if [ "$probe_name" = "startup" ] && [ $consecutive_successes -ge $success_threshold ]; then
+                # The startup probe is done once it succeeded, then readiness and liveness probes take over.
+                printf "%s\n" "$(date -Is --utc) startup probe successful for ${container_name}"
+                echo "SUCCESS" > "$probe_status_file"
+                return 0
+            fi
             
             if [ $consecutive_successes -ge $success_threshold ] && [ "$probe_ready" = false ]; then
-                printf "%%s\n" "$(date -Is --utc) ${probe_name} probe successful for ${container_name}"
+                printf "%s\n" "$(date -Is --utc) ${probe_name} probe successful for ${container_name}"
                 echo "SUCCESS" > "$probe_status_file"
                 probe_ready=true
             elif [ "$probe_ready" = true ]; then
@@ -212,15 +255,26 @@ runProbe() {
         else
             consecutive_failures=$((consecutive_failures + 1))
             consecutive_successes=0
-            printf "%%s\n" "$(date -Is --utc) ${probe_name} probe failed for ${container_name} (${consecutive_failures}/${failure_threshold})"
+            printf "%s\n" "$(date -Is --utc) ${probe_name} probe failed for ${container_name} (${consecutive_failures}/${failure_threshold})"
             
             # Always write failure status immediately
             echo "FAILURE" > "$probe_status_file"
             probe_ready=false
             
             if [ $consecutive_failures -ge $failure_threshold ]; then
-                printf "%%s\n" "$(date -Is --utc) ${probe_name} probe failed for ${container_name} after ${failure_threshold} attempts" >&2
+                printf "%s\n" "$(date -Is --utc) ${probe_name} probe failed for ${container_name} after ${failure_threshold} attempts" >&2
+                if { [ "$probe_name" = "liveness" ] || [ "$probe_name" = "startup" ]; } && requestCtnRestart "$container_name"; then
+                    # The container is being restarted, probe it again as a new container.
+                    consecutive_failures=0
+                    echo "UNKNOWN" > "$probe_status_file"
+                    sleep "$initial_delay"
+                    continue
+                fi
                 echo "FAILED_THRESHOLD" > "$probe_status_file"
+                if [ "$probe_name" = "startup" ]; then
+                    # A container that never started is failed, as the kubelet does.
+                    killTree "$ctn_pid"
+                fi
                 return 1
             fi
         fi
@@ -233,6 +287,19 @@ runProbe() {
 
 `)
 
+	// Generate startup probe calls first, their status is initialized before any probe starts so that the other probes wait for them
+	for i, probe := range startupProbes {
+		probeArgs := buildProbeArgs(probe)
+		containerVarName := strings.ReplaceAll(containerName, "-", "_")
+		scriptBuilder.WriteString(fmt.Sprintf(`
+# Startup probe %d for %s
+echo "UNKNOWN" > "${workingPath}/startup-probe-%s-%d.status"
+runProbe "%s" "%s" %d %d %d %d %d "startup" %d %s &
+STARTUP_PROBE_%s_%d_PID=$!
+`, i, containerName, containerName, i, probe.Type, containerName, probe.InitialDelaySeconds, probe.PeriodSeconds,
+			probe.TimeoutSeconds, probe.SuccessThreshold, probe.FailureThreshold, i, probeArgs, containerVarName, i))
+	}
+
 	// Generate readiness probe calls
 	for i, probe := range readinessProbes {
 		probeArgs := buildProbeArgs(probe)
@@ -261,6 +328,7 @@ LIVENESS_PROBE_%s_%d_PID=$!
 		attribute.String("probes.container.name", containerName),
 		attribute.Int("probes.readiness.count", len(readinessProbes)),
 		attribute.Int("probes.liveness.count", len(livenessProbes)),
+		attribute.Int("probes.startup.count", len(startupProbes)),
 	)
 
 	return scriptBuilder.String()
@@ -287,8 +355,8 @@ func buildProbeArgs(probe ProbeCommand) string {
 }
 
 // generateProbeCleanupScript generates cleanup commands for probe processes
-func generateProbeCleanupScript(containerName string, readinessProbes []ProbeCommand, livenessProbes []ProbeCommand) string {
-	if len(readinessProbes) == 0 && len(livenessProbes) == 0 {
+func generateProbeCleanupScript(containerName string, readinessProbes []ProbeCommand, livenessProbes []ProbeCommand, startupProbes []ProbeCommand) string {
+	if len(readinessProbes) == 0 && len(livenessProbes) == 0 && len(startupProbes) == 0 {
 		return ""
 	}
 
@@ -317,10 +385,18 @@ cleanup_probes() {
 `, containerVarName, i, containerVarName, i))
 	}
 
+	// Kill startup probes
+	for i := range startupProbes {
+		scriptBuilder.WriteString(fmt.Sprintf(`    if [ ! -z "$STARTUP_PROBE_%s_%d_PID" ]; then
+        kill $STARTUP_PROBE_%s_%d_PID 2>/dev/null || true
+    fi
+`, containerVarName, i, containerVarName, i))
+	}
+
 	scriptBuilder.WriteString(`}
 
-# Set up trap to cleanup probes on exit
-trap cleanup_probes EXIT
+# Set up trap to cleanup probes on exit, along with the other cleanups of the job
+addExitCleanup cleanup_probes
 `)
 
 	return scriptBuilder.String()
@@ -374,9 +450,9 @@ func getProbeStatus(ctx context.Context, workingPath, probeType, containerName s
 	}, nil
 }
 
-// checkContainerReadiness evaluates if a container is ready based on its readiness probes
-func checkContainerReadiness(ctx context.Context, config SlurmConfig, workingPath, containerName string, readinessProbeCount int) bool {
-	if !config.EnableProbes || readinessProbeCount == 0 {
+// checkContainerReadiness evaluates if a container is ready based on its startup and readiness probes
+func checkContainerReadiness(ctx context.Context, config SlurmConfig, workingPath, containerName string, readinessProbeCount int, startupProbeCount int) bool {
+	if !config.EnableProbes || (readinessProbeCount == 0 && startupProbeCount == 0) {
 		// No readiness probes configured, container is ready if running
 		return true
 	}
@@ -384,6 +460,23 @@ func checkContainerReadiness(ctx context.Context, config SlurmConfig, workingPat
 	span := trace.SpanFromContext(ctx)
 	allProbesSuccessful := true
 
+	// The container is not ready until its startup probes succeeded.
+	for i := 0; i < startupProbeCount; i++ {
+		probeStatus, err := getProbeStatus(ctx, workingPath, "startup", containerName, i)
+		if err != nil {
+			log.G(ctx).Error("Failed to check startup probe status: ", err)
+			allProbesSuccessful = false
+			continue
+		}
+
+		span.SetAttributes(attribute.String(fmt.Sprintf("startup.probe.%d.status", i), probeStatus.Status))
+
+		if probeStatus.Status != "SUCCESS" {
+			allProbesSuccessful = false
+			log.G(ctx).Debugf("Startup probe %d for container %s is not successful: %s", i, containerName, probeStatus.Status)
+		}
+	}
+
 	for i := 0; i < readinessProbeCount; i++ {
 		probeStatus, err := getProbeStatus(ctx, workingPath, "readiness", containerName, i)
 		if err != nil {
@@ -436,22 +529,22 @@ func checkContainerLiveness(ctx context.Context, config SlurmConfig, workingPath
 }
 
 // storeProbeMetadata saves probe count information for later status checking
-func storeProbeMetadata(workingPath, containerName string, readinessProbeCount, livenessProbeCount int) error {
+func storeProbeMetadata(workingPath, containerName string, readinessProbeCount, livenessProbeCount, startupProbeCount int) error {
 	metadataFile := fmt.Sprintf("%s/probe-metadata-%s.txt", workingPath, containerName)
-	content := fmt.Sprintf("readiness:%d\nliveness:%d", readinessProbeCount, livenessProbeCount)
+	content := fmt.Sprintf("readiness:%d\nliveness:%d\nstartup:%d", readinessProbeCount, livenessProbeCount, startupProbeCount)
 	return os.WriteFile(metadataFile, []byte(content), 0644)
 }
 
 // loadProbeMetadata loads probe count information for status checking
-func loadProbeMetadata(workingPath, containerName string) (readinessCount, livenessCount int, err error) {
+func loadProbeMetadata(workingPath, containerName string) (readinessCount, livenessCount, startupCount int, err error) {
 	metadataFile := fmt.Sprintf("%s/probe-metadata-%s.txt", workingPath, containerName)
 	content, err := os.ReadFile(metadataFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// No probe metadata file means no probes configured
-			return 0, 0, nil
+			return 0, 0, 0, nil
 		}
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 
 	lines := strings.Split(string(content), "\n")
@@ -471,8 +564,70 @@ func loadProbeMetadata(workingPath, containerName string) (readinessCount, liven
 			readinessCount = count
 		case "liveness":
 			livenessCount = count
+		case "startup":
+			startupCount = count
 		}
 	}
 
-	return readinessCount, livenessCount, nil
+	return readinessCount, livenessCount, startupCount, nil
+}
+
+// loadContainerRestartCount returns how many times a container has been restarted in the job after a liveness failure.
+func loadContainerRestartCount(workingPath, containerName string) int32 {
+	content, err := os.ReadFile(workingPath + "/restarts-" + containerName + ".count")
+	if err != nil {
+		return 0
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0
+	}
+	return int32(count)
+}
+
+// loadContainerLastState returns the state of the previous run of a container restarted in the job, from the run-<container>.last file
+// written by runRestartableCtn as "<exit code> <started at> <finished at>". It is empty if the container has not been restarted.
+func loadContainerLastState(workingPath, containerName string) v1.ContainerState {
+	content, err := os.ReadFile(workingPath + "/run-" + containerName + ".last")
+	if err != nil {
+		return v1.ContainerState{}
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) != 3 {
+		return v1.ContainerState{}
+	}
+	exitCode, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return v1.ContainerState{}
+	}
+
+	terminated := &v1.ContainerStateTerminated{
+		ExitCode: int32(exitCode),
+		Reason:   terminatedReason(int32(exitCode)),
+		Message:  "Container restarted by the job after a probe failure",
+	}
+	// Shells report the processes killed by a signal with 128 + the signal number.
+	if exitCode > 128 {
+		terminated.Signal = int32(exitCode - 128)
+	}
+	if startedAt, err := time.Parse(time.RFC3339, fields[1]); err == nil {
+		terminated.StartedAt = metav1.Time{Time: startedAt}
+	}
+	if finishedAt, err := time.Parse(time.RFC3339, fields[2]); err == nil {
+		terminated.FinishedAt = metav1.Time{Time: finishedAt}
+	}
+	return v1.ContainerState{Terminated: terminated}
+}
+
+// terminatedReason returns the Kubernetes reason of a container that exited with the provided code.
+// 137 (SIGKILL) is reported as OOMKilled, since in a job it is most often the memory cgroup of SLURM killing the container.
+func terminatedReason(exitCode int32) string {
+	switch exitCode {
+	case 0:
+		return "Completed"
+	case 137:
+		return "OOMKilled"
+	default:
+		return "Error"
+	}
 }
@@ -0,0 +1,157 @@
+package slurm
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLivenessRestart(t *testing.T) {
+	config := testSLURMConfig()
+	config.EnableProbes = true
+	config.MaxLivenessRestarts = 1
+	// The probes run with singularity exec, which always fails.
+	config.SingularityPath = writeTestExecutable(t, t.TempDir(), "singularity", "exit 1")
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "unhealthy", Namespace: "default", UID: "uid"}}
+	commands := []SingularityCommand{{
+		containerName:      "app",
+		singularityCommand: []string{"/bin/sleep"},
+		containerArgs:      []string{"2"},
+		livenessProbes: []ProbeCommand{{
+			Type:             ProbeTypeExec,
+			ExecAction:       &ExecAction{Command: []string{"true"}},
+			PeriodSeconds:    1,
+			TimeoutSeconds:   1,
+			SuccessThreshold: 1,
+			FailureThreshold: 2,
+		}},
+	}}
+	path, script := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+	if !strings.Contains(script, "runRestartableCtn app ") {
+		t.Fatalf("container with a liveness probe is not restartable:\n%s", script)
+	}
+
+	cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("job.sh error = %v, want the restarted container to succeed, output:\n%s", err, output)
+	}
+
+	// The second failed threshold exhausts the budget, so the restarted container runs to completion.
+	if got := loadContainerRestartCount(path, "app"); got != 1 {
+		t.Errorf("loadContainerRestartCount() = %d, want 1, output:\n%s", got, output)
+	}
+	lastState := loadContainerLastState(path, "app")
+	if lastState.Terminated == nil || lastState.Terminated.ExitCode == 0 {
+		t.Errorf("loadContainerLastState() = %+v, want the killed container", lastState)
+	}
+	status, err := os.ReadFile(filepath.Join(path, "liveness-probe-app-0.status"))
+	if err != nil || strings.TrimSpace(string(status)) != "FAILED_THRESHOLD" {
+		t.Errorf("liveness probe status = %q, %v, want FAILED_THRESHOLD", status, err)
+	}
+}
+
+func TestStartupProbeReadiness(t *testing.T) {
+	stubs := t.TempDir()
+	started := filepath.Join(stubs, "started")
+	config := testSLURMConfig()
+	config.EnableProbes = true
+	// The probes succeed once the container started, which the test decides.
+	config.SingularityPath = writeTestExecutable(t, stubs, "singularity", "test -e "+started)
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "slow", Namespace: "default", UID: "uid"}}
+	commands := []SingularityCommand{{
+		containerName:      "app",
+		singularityCommand: []string{"/bin/sleep"},
+		containerArgs:      []string{"3"},
+		startupProbes: []ProbeCommand{{
+			Type:             ProbeTypeExec,
+			ExecAction:       &ExecAction{Command: []string{"true"}},
+			PeriodSeconds:    1,
+			TimeoutSeconds:   1,
+			SuccessThreshold: 1,
+			FailureThreshold: 10,
+		}},
+	}}
+	path, _ := testSLURMScript(t, config, pod, commands, ResourceLimits{})
+
+	cmd := exec.Command("/bin/bash", filepath.Join(path, "job.sh"))
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(), "SLURM_JOBID=42")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if checkContainerReadiness(ctx, config, path, "app", 0, 1) {
+			t.Fatalf("checkContainerReadiness() = true before the startup probe passed")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err := os.WriteFile(started, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ready := false
+	for i := 0; i < 20 && !ready; i++ {
+		time.Sleep(100 * time.Millisecond)
+		ready = checkContainerReadiness(ctx, config, path, "app", 0, 1)
+	}
+	if !ready {
+		t.Errorf("checkContainerReadiness() = false after the startup probe passed")
+	}
+}
+
+func TestLoadContainerLastState(t *testing.T) {
+	startedAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	finishedAt := startedAt.Add(time.Minute)
+	times := " " + startedAt.Format(time.RFC3339) + " " + finishedAt.Format(time.RFC3339)
+	tests := []struct {
+		name       string
+		last       string
+		wantReason string
+		wantCode   int32
+		wantSignal int32
+	}{
+		{name: "not restarted"},
+		{name: "killed", last: "137" + times, wantReason: "OOMKilled", wantCode: 137, wantSignal: 9},
+		{name: "terminated", last: "143" + times, wantReason: "Error", wantCode: 143, wantSignal: 15},
+		{name: "failed", last: "1" + times, wantReason: "Error", wantCode: 1},
+		{name: "completed", last: "0" + times, wantReason: "Completed"},
+		{name: "malformed", last: "137"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir()
+			if test.last != "" {
+				writeTestFile(t, path, "run-app.last", test.last)
+			}
+			terminated := loadContainerLastState(path, "app").Terminated
+			if test.wantReason == "" {
+				if terminated != nil {
+					t.Errorf("loadContainerLastState() = %+v, want no last state", terminated)
+				}
+				return
+			}
+			if terminated == nil {
+				t.Fatalf("loadContainerLastState() has no terminated state, want %s", test.wantReason)
+			}
+			if terminated.Reason != test.wantReason || terminated.ExitCode != test.wantCode || terminated.Signal != test.wantSignal {
+				t.Errorf("loadContainerLastState() = %s, exit code %d, signal %d, want %s, %d, %d",
+					terminated.Reason, terminated.ExitCode, terminated.Signal, test.wantReason, test.wantCode, test.wantSignal)
+			}
+			if !terminated.StartedAt.Time.Equal(startedAt) || !terminated.FinishedAt.Time.Equal(finishedAt) {
+				t.Errorf("loadContainerLastState() ran from %v to %v, want %v to %v", terminated.StartedAt, terminated.FinishedAt, startedAt, finishedAt)
+			}
+		})
+	}
+}
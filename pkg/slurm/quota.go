@@ -0,0 +1,73 @@
+package slurm
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// namespaceReservation is the CPUs and the memory (in bytes) of a pod that passed checkNamespaceResourceCaps and is being submitted.
+type namespaceReservation struct {
+	namespace string
+	cpu       int64
+	memory    int64
+}
+
+// namespaceReservations are the pods being submitted, counted in the allocations of their namespace until their job is tracked.
+// They are guarded by jidsMutex, as JIDs, so that two pods submitted at once cannot both pass the cap.
+var namespaceReservations = map[string]namespaceReservation{}
+
+// namespaceAllocations returns the CPUs and the memory (in bytes) of the jobs of the namespace that have not terminated yet,
+// as stored in the pod metadata at submission time, and of the pods of the namespace being submitted. jidsMutex must be held.
+func namespaceAllocations(config SlurmConfig, pod v1.Pod, JIDs *map[string]*JidStruct) (int64, int64) {
+	var cpu, memory int64
+	for uid, jid := range *JIDs {
+		if uid == string(pod.UID) || jid.PodNamespace != pod.Namespace || !jid.EndTime.IsZero() {
+			continue
+		}
+		podMetadata, err := readPodMetadata(config.DataRootFolder + jid.PodNamespace + "-" + uid)
+		if err != nil {
+			continue
+		}
+		cpu += podMetadata.CPU
+		memory += podMetadata.Memory
+	}
+	for uid, reservation := range namespaceReservations {
+		if _, tracked := (*JIDs)[uid]; tracked || uid == string(pod.UID) || reservation.namespace != pod.Namespace {
+			continue
+		}
+		cpu += reservation.cpu
+		memory += reservation.memory
+	}
+	return cpu, memory
+}
+
+// releaseNamespaceReservation removes the reservation of checkNamespaceResourceCaps once the submission of the pod is over,
+// its job being counted from then on if it was submitted.
+func releaseNamespaceReservation(podUID string) {
+	jidsMutex.Lock()
+	defer jidsMutex.Unlock()
+	delete(namespaceReservations, podUID)
+}
+
+// checkNamespaceResourceCaps returns an error if the pod would push its namespace over the cap set in NamespaceResourceCaps.
+// Only the jobs tracked by this sidecar are counted, so this keeps a namespace within its share of the cluster, not within a SLURM account limit.
+// A pod within the cap is reserved until releaseNamespaceReservation.
+func checkNamespaceResourceCaps(config SlurmConfig, pod v1.Pod, resourceLimits ResourceLimits, JIDs *map[string]*JidStruct) error {
+	resourceCap, ok := config.NamespaceResourceCaps[pod.Namespace]
+	if !ok {
+		return nil
+	}
+
+	jidsMutex.Lock()
+	defer jidsMutex.Unlock()
+	cpu, memory := namespaceAllocations(config, pod, JIDs)
+	if resourceCap.CPU > 0 && cpu+resourceLimits.CPU > resourceCap.CPU {
+		return fmt.Errorf("pod %s requests %d CPUs, but namespace %s already uses %d of its %d CPUs", pod.Name, resourceLimits.CPU, pod.Namespace, cpu, resourceCap.CPU)
+	}
+	if resourceCap.MemoryMB > 0 && (memory+resourceLimits.Memory)/(1024*1024) > resourceCap.MemoryMB {
+		return fmt.Errorf("pod %s requests %dMB of memory, but namespace %s already uses %dMB of its %dMB", pod.Name, resourceLimits.Memory/(1024*1024), pod.Namespace, memory/(1024*1024), resourceCap.MemoryMB)
+	}
+	namespaceReservations[string(pod.UID)] = namespaceReservation{namespace: pod.Namespace, cpu: resourceLimits.CPU, memory: resourceLimits.Memory}
+	return nil
+}
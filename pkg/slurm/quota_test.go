@@ -0,0 +1,62 @@
+package slurm
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSubmitNamespaceResourceCaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		cpu      string
+		wantCode int
+	}{
+		{name: "within the cap", cpu: "1", wantCode: http.StatusOK},
+		{name: "over the cap", cpu: "2", wantCode: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.NamespaceResourceCaps = map[string]NamespaceResourceCap{"default": {CPU: 4}}
+			// The running job of the namespace uses 3 CPUs, the terminated one and the one of another namespace are not counted.
+			JIDs := map[string]*JidStruct{}
+			for _, job := range []struct {
+				uid       string
+				namespace string
+				cpu       int64
+				ended     bool
+			}{
+				{uid: "running", namespace: "default", cpu: 3},
+				{uid: "terminated", namespace: "default", cpu: 8, ended: true},
+				{uid: "other", namespace: "other", cpu: 8},
+			} {
+				path := config.DataRootFolder + job.namespace + "-" + job.uid
+				if err := os.MkdirAll(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := writePodMetadata(path, PodMetadata{CPU: job.cpu}); err != nil {
+					t.Fatal(err)
+				}
+				JIDs[job.uid] = &JidStruct{JID: "1", PodUID: job.uid, PodNamespace: job.namespace}
+				if job.ended {
+					JIDs[job.uid].EndTime = time.Now()
+				}
+			}
+
+			pod := testPod(testContainer("app", test.cpu, "1Gi"))
+			pod.UID = types.UID("new")
+			w, _ := testSubmitWithHandler(t, SidecarHandler{Config: config, JIDs: &JIDs}, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Errorf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if _, reserved := namespaceReservations[string(pod.UID)]; reserved {
+				t.Errorf("pod %s is still reserved after its submission", pod.UID)
+			}
+		})
+	}
+}
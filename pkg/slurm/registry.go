@@ -0,0 +1,135 @@
+package slurm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"al.essio.dev/pkg/shellescape"
+	"github.com/containerd/containerd/log"
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+// registryAuth is an entry of the auths of a docker config, with either the username and password or their base64 "user:password" form.
+type registryAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// registryHost returns the registry of a docker:// image, eg: "registry.example.com:5000", or docker.io for images without registry.
+// It is empty for other images, which singularity does not pull with the docker credentials.
+func registryHost(image string) string {
+	if !strings.HasPrefix(image, "docker://") {
+		return ""
+	}
+	name := strings.TrimPrefix(image, "docker://")
+	host, _, found := strings.Cut(name, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "docker.io"
+	}
+	return host
+}
+
+// normalizeRegistry returns the host of a docker config auths key, which can be a URL, eg: https://index.docker.io/v1/.
+func normalizeRegistry(key string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// retrievedSecret returns the secret of the pod data with this name, from any of its containers.
+func retrievedSecret(podData commonIL.RetrievedPodData, secretName string) *v1.Secret {
+	for _, container := range podData.Containers {
+		for i := range container.Secrets {
+			if container.Secrets[i].Name == secretName {
+				return &container.Secrets[i]
+			}
+		}
+	}
+	return nil
+}
+
+// imagePullCredentials returns the username and password of the first imagePullSecret of the pod with an entry for the registry of the image.
+// Secrets not retrieved by interLink are skipped with a warning, then the image is pulled anonymously.
+func imagePullCredentials(Ctx context.Context, podData commonIL.RetrievedPodData, image string) (string, string, error) {
+	registry := registryHost(image)
+	if registry == "" {
+		return "", "", nil
+	}
+	for _, reference := range podData.Pod.Spec.ImagePullSecrets {
+		secret := retrievedSecret(podData, reference.Name)
+		if secret == nil {
+			log.G(Ctx).Warning("imagePullSecret " + reference.Name + " of pod " + podData.Pod.Name + " was not retrieved, skipping it")
+			continue
+		}
+
+		auths := map[string]registryAuth{}
+		if content, ok := secret.Data[v1.DockerConfigJsonKey]; ok {
+			dockerConfig := struct {
+				Auths map[string]registryAuth `json:"auths"`
+			}{}
+			if err := json.Unmarshal(content, &dockerConfig); err != nil {
+				return "", "", fmt.Errorf("invalid %s in imagePullSecret %s: %w", v1.DockerConfigJsonKey, reference.Name, err)
+			}
+			auths = dockerConfig.Auths
+		} else if content, ok := secret.Data[v1.DockerConfigKey]; ok {
+			if err := json.Unmarshal(content, &auths); err != nil {
+				return "", "", fmt.Errorf("invalid %s in imagePullSecret %s: %w", v1.DockerConfigKey, reference.Name, err)
+			}
+		}
+
+		for key, auth := range auths {
+			if normalizeRegistry(key) != registry {
+				continue
+			}
+			if auth.Username == "" && auth.Auth != "" {
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				if err != nil {
+					return "", "", fmt.Errorf("invalid auth of registry %s in imagePullSecret %s: %w", key, reference.Name, err)
+				}
+				auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+			}
+			log.G(Ctx).Info("Using imagePullSecret " + reference.Name + " for registry " + registry)
+			return auth.Username, auth.Password, nil
+		}
+	}
+	return "", "", nil
+}
+
+// prepareRegistryCredentials writes the credentials of the registry of the container image to registry-auth-<container>.sh in the working directory,
+// readable only by the job user, and returns its path. The job script sources it just before starting the container, as singularity reads them from
+// SINGULARITY_DOCKER_USERNAME and SINGULARITY_DOCKER_PASSWORD, so that they are neither in the script nor in the command line.
+// The path is empty if there are no credentials for the image.
+func prepareRegistryCredentials(Ctx context.Context, podData commonIL.RetrievedPodData, containerName string, image string, workingPath string) (string, error) {
+	username, password, err := imagePullCredentials(Ctx, podData, image)
+	if err != nil || username == "" {
+		return "", err
+	}
+	credentialsPath := filepath.Join(workingPath, "registry-auth-"+containerName+".sh")
+	content := "export SINGULARITY_DOCKER_USERNAME=" + shellescape.Quote(username) + "\nexport SINGULARITY_DOCKER_PASSWORD=" + shellescape.Quote(password) + "\n"
+	err = os.WriteFile(credentialsPath, []byte(content), 0600)
+	if err != nil {
+		return "", err
+	}
+	return credentialsPath, nil
+}
+
+// removeRegistryCredentials deletes the registry credentials files of the working directory, see prepareRegistryCredentials.
+func removeRegistryCredentials(Ctx context.Context, workingPath string) {
+	files, _ := filepath.Glob(filepath.Join(workingPath, "registry-auth-*.sh"))
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			log.G(Ctx).Warning("Unable to remove registry credentials ", file, ": ", err)
+		}
+	}
+}
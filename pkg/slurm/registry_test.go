@@ -0,0 +1,179 @@
+package slurm
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testPullSecretPodData returns the pod data with its imagePullSecrets, retrieved by the app container.
+func testPullSecretPodData(pullSecrets []string, secrets ...v1.Secret) commonIL.RetrievedPodData {
+	pod := testPod(v1.Container{Name: "app"})
+	for _, name := range pullSecrets {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, v1.LocalObjectReference{Name: name})
+	}
+	return commonIL.RetrievedPodData{
+		Pod:        pod,
+		Containers: []commonIL.RetrievedContainer{{Name: "app", Secrets: secrets}},
+	}
+}
+
+// testPullSecret returns a secret with this docker config under key, eg: .dockerconfigjson.
+func testPullSecret(name string, key string, config string) v1.Secret {
+	return v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Data:       map[string][]byte{key: []byte(config)},
+	}
+}
+
+func TestImagePullCredentials(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("robot:s3cr:t"))
+	tests := []struct {
+		name         string
+		image        string
+		pullSecrets  []string
+		secrets      []v1.Secret
+		wantUsername string
+		wantPassword string
+	}{
+		{
+			name:         ".dockerconfigjson",
+			image:        "docker://registry.example.org/app:1.0",
+			pullSecrets:  []string{"pull"},
+			secrets:      []v1.Secret{testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"registry.example.org": {"username": "user", "password": "pass"}}}`)},
+			wantUsername: "user",
+			wantPassword: "pass",
+		},
+		{
+			name:         ".dockercfg",
+			image:        "docker://registry.example.org/app:1.0",
+			pullSecrets:  []string{"pull"},
+			secrets:      []v1.Secret{testPullSecret("pull", v1.DockerConfigKey, `{"registry.example.org": {"username": "user", "password": "pass"}}`)},
+			wantUsername: "user",
+			wantPassword: "pass",
+		},
+		{
+			name:         "auth only",
+			image:        "docker://registry.example.org/app:1.0",
+			pullSecrets:  []string{"pull"},
+			secrets:      []v1.Secret{testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"registry.example.org": {"auth": "`+auth+`"}}}`)},
+			wantUsername: "robot",
+			wantPassword: "s3cr:t",
+		},
+		{
+			name:         "docker hub URL for an image without registry",
+			image:        "docker://library/busybox",
+			pullSecrets:  []string{"pull"},
+			secrets:      []v1.Secret{testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"https://index.docker.io/v1/": {"username": "user", "password": "pass"}}}`)},
+			wantUsername: "user",
+			wantPassword: "pass",
+		},
+		{
+			name:        "docker hub for another registry",
+			image:       "docker://registry.example.org/app:1.0",
+			pullSecrets: []string{"pull"},
+			secrets:     []v1.Secret{testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"https://index.docker.io/v1/": {"username": "user", "password": "pass"}}}`)},
+		},
+		{
+			name:         "localhost with a port",
+			image:        "docker://localhost:5000/app:1.0",
+			pullSecrets:  []string{"pull"},
+			secrets:      []v1.Secret{testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"localhost:5000": {"username": "user", "password": "pass"}}}`)},
+			wantUsername: "user",
+			wantPassword: "pass",
+		},
+		{
+			name:         "pull secret not retrieved",
+			image:        "docker://registry.example.org/app:1.0",
+			pullSecrets:  []string{"missing", "pull"},
+			secrets:      []v1.Secret{testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"registry.example.org": {"username": "user", "password": "pass"}}}`)},
+			wantUsername: "user",
+			wantPassword: "pass",
+		},
+		{
+			name:        "only pull secret not retrieved",
+			image:       "docker://registry.example.org/app:1.0",
+			pullSecrets: []string{"missing"},
+		},
+		{
+			name:        "not a docker image",
+			image:       "/cvmfs/unpacked.cern.ch/app.sif",
+			pullSecrets: []string{"pull"},
+			secrets:     []v1.Secret{testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"registry.example.org": {"username": "user", "password": "pass"}}}`)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podData := testPullSecretPodData(test.pullSecrets, test.secrets...)
+			username, password, err := imagePullCredentials(context.Background(), podData, test.image)
+			if err != nil {
+				t.Fatalf("imagePullCredentials() error = %v", err)
+			}
+			if username != test.wantUsername || password != test.wantPassword {
+				t.Errorf("imagePullCredentials() = %q, %q, want %q, %q", username, password, test.wantUsername, test.wantPassword)
+			}
+		})
+	}
+}
+
+func TestImagePullCredentialsInvalid(t *testing.T) {
+	for name, secret := range map[string]v1.Secret{
+		"invalid .dockerconfigjson": testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": `),
+		"invalid .dockercfg":        testPullSecret("pull", v1.DockerConfigKey, `[]`),
+		"invalid auth":              testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"registry.example.org": {"auth": "not base64"}}}`),
+	} {
+		podData := testPullSecretPodData([]string{"pull"}, secret)
+		if _, _, err := imagePullCredentials(context.Background(), podData, "docker://registry.example.org/app:1.0"); err == nil {
+			t.Errorf("%s: imagePullCredentials() error = nil", name)
+		}
+	}
+}
+
+func TestRegistryCredentialsFile(t *testing.T) {
+	workingPath := t.TempDir()
+	podData := testPullSecretPodData([]string{"pull"}, testPullSecret("pull", v1.DockerConfigJsonKey, `{"auths": {"registry.example.org": {"username": "user", "password": "it's"}}}`))
+
+	credentialsPath, err := prepareRegistryCredentials(context.Background(), podData, "app", "docker://registry.example.org/app:1.0", workingPath)
+	if err != nil {
+		t.Fatalf("prepareRegistryCredentials() error = %v", err)
+	}
+	if credentialsPath != filepath.Join(workingPath, "registry-auth-app.sh") {
+		t.Errorf("prepareRegistryCredentials() = %q, want registry-auth-app.sh", credentialsPath)
+	}
+	info, err := os.Stat(credentialsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("registry-auth-app.sh mode = %v, want 0600", info.Mode().Perm())
+	}
+	content, err := os.ReadFile(credentialsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "export SINGULARITY_DOCKER_USERNAME=user\nexport SINGULARITY_DOCKER_PASSWORD='it'\"'\"'s'\n"
+	if string(content) != want {
+		t.Errorf("registry-auth-app.sh = %q, want %q", content, want)
+	}
+
+	// Images without credentials do not get a file.
+	noCredentialsPath, err := prepareRegistryCredentials(context.Background(), podData, "sidecar", "docker://ghcr.io/org/sidecar:1.0", workingPath)
+	if err != nil || noCredentialsPath != "" {
+		t.Errorf("prepareRegistryCredentials() = %q, %v, want no file", noCredentialsPath, err)
+	}
+
+	writeTestFile(t, workingPath, "job.sh", "")
+	removeRegistryCredentials(context.Background(), workingPath)
+	if _, err := os.Stat(credentialsPath); !os.IsNotExist(err) {
+		t.Errorf("registry-auth-app.sh not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(workingPath, "job.sh")); err != nil {
+		t.Errorf("removeRegistryCredentials() removed other files: %v", err)
+	}
+}
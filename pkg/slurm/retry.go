@@ -0,0 +1,119 @@
+package slurm
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	exec "github.com/alexellis/go-execute/pkg/v1"
+	"github.com/containerd/containerd/log"
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+// transientSlurmErrors are the errors of the SLURM commands caused by an overloaded or restarting controller, after which the same query can succeed.
+// Other errors, eg: "Invalid job id specified", are returned at once.
+var transientSlurmErrors = []string{
+	"Socket timed out",
+	"Unable to contact slurm controller",
+	"Connection refused",
+	"Connection timed out",
+	"Resource temporarily unavailable",
+	"Zero Bytes were transmitted or received",
+	"backup controller in standby mode",
+}
+
+// isTransientSlurmError tells if the stderr of a SLURM command is one of the transientSlurmErrors.
+func isTransientSlurmError(stderr string) bool {
+	for _, transientError := range transientSlurmErrors {
+		if strings.Contains(stderr, transientError) {
+			return true
+		}
+	}
+	return false
+}
+
+// executeSlurmQuery runs a squeue or sacct command, and runs it again up to SlurmQueryRetries times while it fails with a transient error,
+// waiting SlurmQueryRetryDelay milliseconds before the first retry and twice as long before each next one, unless ctx is done.
+func executeSlurmQuery(ctx context.Context, config SlurmConfig, shell exec.ExecTask) (exec.ExecResult, error) {
+	if err := ensureKerberosTicket(ctx, config); err != nil {
+		log.G(ctx).Error(err)
+	}
+	delay := time.Duration(config.SlurmQueryRetryDelay) * time.Millisecond
+	execReturn, err := executeObserved(shell)
+	for retry := 1; retry <= config.SlurmQueryRetries && err == nil && isTransientSlurmError(execReturn.Stderr); retry++ {
+		log.G(ctx).Warning(shell.Command, " failed with a transient error, retrying in ", delay, " (", retry, "/", config.SlurmQueryRetries, "): ", strings.TrimSpace(execReturn.Stderr))
+		select {
+		case <-ctx.Done():
+			log.G(ctx).Warning("Not retrying ", shell.Command, ": ", ctx.Err())
+			return execReturn, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		execReturn, err = executeObserved(shell)
+	}
+	return execReturn, err
+}
+
+// executeObserved runs a SLURM command and records its duration in the metrics.
+func executeObserved(shell exec.ExecTask) (exec.ExecResult, error) {
+	start := time.Now()
+	execReturn, err := shell.Execute()
+	observeSlurmCommand(shell.Command, start, err != nil || execReturn.Stderr != "")
+	return execReturn, err
+}
+
+// lastKnownStatus returns the status of the pod in the last status computed from squeue, to report while the controller does not answer.
+func lastKnownStatus(podUID string) (commonIL.PodStatus, bool) {
+	for _, status := range cachedStatus {
+		if status.PodUID == podUID {
+			return status, true
+		}
+	}
+	return commonIL.PodStatus{}, false
+}
+
+// lastKnownStatuses returns the status of each requested pod in the last status computed from squeue, to report while the controller does not answer.
+// The pods missing from it, eg: created since, have their containers waiting with the Unknown reason.
+func lastKnownStatuses(req []*v1.Pod) []commonIL.PodStatus {
+	statuses := make([]commonIL.PodStatus, 0, len(req))
+	for _, pod := range req {
+		if status, ok := lastKnownStatus(string(pod.UID)); ok {
+			statuses = append(statuses, status)
+			continue
+		}
+		containerStatuses := []v1.ContainerStatus{}
+		for _, ct := range pod.Spec.Containers {
+			containerStatuses = append(containerStatuses, v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "Unknown", Message: "the SLURM controller does not answer"}}})
+		}
+		statuses = append(statuses, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
+	}
+	return statuses
+}
+
+// queuedJobNamed returns the job named jobName as the parsable output of sbatch, "<jid>[;<cluster>]", or an empty string if squeue does not list one.
+// It tells if a submission that failed with a transient error was accepted anyway.
+func queuedJobNamed(ctx context.Context, config SlurmConfig, jobName string, cluster string) string {
+	shell := exec.ExecTask{
+		Command: config.Squeuepath,
+		Args:    append([]string{"--noheader", "-a", "--name=" + jobName, "-O", "JobID,Cluster"}, clusterFlags(cluster)...),
+		Shell:   true,
+	}
+	execReturn, err := executeSlurmQuery(ctx, config, shell)
+	if err != nil || execReturn.Stderr != "" {
+		log.G(ctx).Warning("Unable to check if job ", jobName, " was submitted: ", err, execReturn.Stderr)
+		return ""
+	}
+	for _, line := range strings.Split(stripClusterHeader(execReturn.Stdout), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			// The components of a heterogeneous job are listed as <jid>+<component>.
+			jid, _, _ := strings.Cut(fields[0], "+")
+			if cluster == "" {
+				// Without --clusters, the cluster is the local one, which the job must keep.
+				return jid
+			}
+			return jid + ";" + fields[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,212 @@
+package slurm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	exec "github.com/alexellis/go-execute/pkg/v1"
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+// testFlakySqueue returns a stub of squeue failing with a transient error as many times as written to the failures file,
+// then printing job 123 as pending. Each call appends a line to the calls file.
+func testFlakySqueue(t *testing.T, stubs string) string {
+	failures, calls := filepath.Join(stubs, "failures"), filepath.Join(stubs, "calls")
+	writeTestFile(t, stubs, "failures", "0")
+	return writeTestExecutable(t, stubs, "squeue", `echo "$@" >> `+calls+`
+remaining=$(cat `+failures+`)
+if test "${remaining}" -gt 0 ; then
+  echo $((remaining - 1)) > `+failures+`
+  echo "slurm_load_jobs error: Socket timed out on send/recv operation" >&2
+  exit 1
+fi
+case "$*" in
+  *--jobs=*|*-j*) echo "123 0 PD" ;;
+esac`)
+}
+
+// testSqueueCalls returns how many times the stub of testFlakySqueue was called, and resets the count.
+func testSqueueCalls(t *testing.T, stubs string) int {
+	t.Helper()
+	content, _ := os.ReadFile(filepath.Join(stubs, "calls"))
+	os.Remove(filepath.Join(stubs, "calls"))
+	return bytes.Count(content, []byte("\n"))
+}
+
+func TestExecuteSlurmQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		retries   int
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "no failure", retries: 3, wantCalls: 1},
+		{name: "fails twice then succeeds", failures: 2, retries: 3, wantCalls: 3},
+		{name: "retries exhausted", failures: 5, retries: 2, wantCalls: 3, wantErr: true},
+		{name: "no retries", failures: 1, wantCalls: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			config := testSLURMConfig()
+			config.Squeuepath = testFlakySqueue(t, stubs)
+			config.SlurmQueryRetries = test.retries
+			config.SlurmQueryRetryDelay = 1
+			writeTestFile(t, stubs, "failures", strconv.Itoa(test.failures))
+
+			execReturn, err := executeSlurmQuery(context.Background(), config, exec.ExecTask{Command: config.Squeuepath, Args: []string{"-j", "123"}})
+			if err != nil {
+				t.Fatalf("executeSlurmQuery() error = %v", err)
+			}
+			if (execReturn.Stderr != "") != test.wantErr {
+				t.Errorf("executeSlurmQuery() stderr = %q, wantErr %v", execReturn.Stderr, test.wantErr)
+			}
+			if calls := testSqueueCalls(t, stubs); calls != test.wantCalls {
+				t.Errorf("squeue called %d times, want %d", calls, test.wantCalls)
+			}
+		})
+	}
+
+	// An unknown job is not a transient error, it is reported at once.
+	stubs := t.TempDir()
+	config := testSLURMConfig()
+	config.Squeuepath = writeTestExecutable(t, stubs, "squeue", `echo "$@" >> `+filepath.Join(stubs, "calls")+`
+echo "slurm_load_jobs error: Invalid job id specified" >&2`)
+	config.SlurmQueryRetries = 3
+	config.SlurmQueryRetryDelay = 1
+	execReturn, _ := executeSlurmQuery(context.Background(), config, exec.ExecTask{Command: config.Squeuepath, Args: []string{"-j", "123"}})
+	if calls := testSqueueCalls(t, stubs); execReturn.Stderr == "" || calls != 1 {
+		t.Errorf("executeSlurmQuery() stderr = %q after %d calls, want the invalid job id error without retries", execReturn.Stderr, calls)
+	}
+}
+
+func TestStatusWithTransientSqueueErrors(t *testing.T) {
+	stubs := t.TempDir()
+	config := testSLURMConfig()
+	config.DataRootFolder = t.TempDir() + "/"
+	config.Squeuepath = testFlakySqueue(t, stubs)
+	config.SlurmQueryRetries = 3
+	config.SlurmQueryRetryDelay = 1
+	pod := testPod(v1.Container{Name: "app"})
+	if err := os.MkdirAll(config.DataRootFolder+pod.Namespace+"-"+string(pod.UID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	JIDs := map[string]*JidStruct{string(pod.UID): {JID: "123", PodUID: string(pod.UID), PodNamespace: pod.Namespace}}
+	h := SidecarHandler{Config: config, JIDs: &JIDs, Ctx: context.Background()}
+	status := func() []commonIL.PodStatus {
+		t.Helper()
+		body, err := json.Marshal([]*v1.Pod{&pod})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.StatusHandler(w, httptest.NewRequest(http.MethodGet, "/status", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("StatusHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		var statuses []commonIL.PodStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 1 || len(statuses[0].Containers) != 1 || statuses[0].Containers[0].State.Waiting == nil {
+			t.Fatalf("StatusHandler() = %+v, want the container of the pending job waiting", statuses)
+		}
+		return statuses
+	}
+
+	status()
+	testSqueueCalls(t, stubs)
+
+	// The first squeue call fails twice, then the retries get the same status.
+	writeTestFile(t, stubs, "failures", "2")
+	status()
+	if calls := testSqueueCalls(t, stubs); calls != 4 {
+		t.Errorf("squeue called %d times, want 2 failed and 2 successful calls", calls)
+	}
+
+	// The controller stays down, the last known status is served instead of flapping.
+	writeTestFile(t, stubs, "failures", "100")
+	status()
+}
+
+func TestSLURMBatchSubmitRetries(t *testing.T) {
+	tests := []struct {
+		name            string
+		failures        int
+		stderr          string
+		retries         int
+		queued          string
+		cluster         string
+		want            string
+		wantErr         bool
+		wantSbatchCalls int
+		wantSqueueCalls int
+		// Set for a base delay of 40ms, that doubles before each retry.
+		wantMinElapsed time.Duration
+	}{
+		{name: "no failure", retries: 3, want: "Submitted batch job 123", wantSbatchCalls: 1},
+		{name: "transient error then success", failures: 1, stderr: "Socket timed out on send/recv operation", retries: 3, want: "Submitted batch job 123", wantSbatchCalls: 2, wantSqueueCalls: 1},
+		{name: "retries exhausted", failures: 5, stderr: "Unable to contact slurm controller", retries: 2, wantErr: true, wantSbatchCalls: 3, wantSqueueCalls: 2, wantMinElapsed: 120 * time.Millisecond},
+		{name: "non-transient error", failures: 1, stderr: "Invalid account or account/partition combination specified", retries: 3, wantErr: true, wantSbatchCalls: 1},
+		{name: "job already queued", failures: 1, stderr: "Socket timed out on send/recv operation", retries: 3, queued: "456 c1", want: "456", wantSbatchCalls: 1, wantSqueueCalls: 1},
+		{name: "job already queued on a cluster", failures: 1, stderr: "Socket timed out on send/recv operation", retries: 3, queued: "456 c1", cluster: "c1,c2", want: "456;c1", wantSbatchCalls: 1, wantSqueueCalls: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			sbatchCalls, squeueCalls := filepath.Join(stubs, "sbatch-calls"), filepath.Join(stubs, "squeue-calls")
+			writeTestFile(t, stubs, "failures", strconv.Itoa(test.failures))
+			config := testSLURMConfig()
+			config.SubmitRetries = test.retries
+			config.SubmitRetryBaseDelay = 1
+			if test.wantMinElapsed > 0 {
+				config.SubmitRetryBaseDelay = 40
+			}
+			config.Sbatchpath = writeTestExecutable(t, stubs, "sbatch", `echo "$@" >> `+sbatchCalls+`
+remaining=$(cat `+filepath.Join(stubs, "failures")+`)
+if test "${remaining}" -gt 0 ; then
+  echo $((remaining - 1)) > `+filepath.Join(stubs, "failures")+`
+  echo "sbatch: error: `+test.stderr+`" >&2
+  exit 1
+fi
+echo "Submitted batch job 123"`)
+			config.Squeuepath = writeTestExecutable(t, stubs, "squeue", `echo "$@" >> `+squeueCalls+`
+echo "`+test.queued+`"`)
+
+			start := time.Now()
+			got, err := SLURMBatchSubmit(context.Background(), config, filepath.Join(stubs, "job.slurm"), "", nil, "default-test-uid", test.cluster)
+			if elapsed := time.Since(start); elapsed < test.wantMinElapsed {
+				t.Errorf("SLURMBatchSubmit() returned after %v, want a backoff of at least %v", elapsed, test.wantMinElapsed)
+			}
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Errorf("SLURMBatchSubmit() = %q, %v, want %q, wantErr %v", got, err, test.want, test.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), test.stderr) {
+				t.Errorf("SLURMBatchSubmit() error = %v, want the sbatch error", err)
+			}
+			for name, want := range map[string]int{sbatchCalls: test.wantSbatchCalls, squeueCalls: test.wantSqueueCalls} {
+				content, _ := os.ReadFile(name)
+				if calls := bytes.Count(content, []byte("\n")); calls != want {
+					t.Errorf("%s called %d times, want %d", filepath.Base(name), calls, want)
+				}
+			}
+			if test.wantSqueueCalls > 0 {
+				content, _ := os.ReadFile(squeueCalls)
+				if !strings.Contains(string(content), "--name=default-test-uid") {
+					t.Errorf("squeue called with %q, want the job name", content)
+				}
+			}
+		})
+	}
+}
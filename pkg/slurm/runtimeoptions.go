@@ -0,0 +1,91 @@
+package slurm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// RuntimeOptionConflictError rejects pods whose containers do not agree on a job-wide runtime option.
+	RuntimeOptionConflictError = "error"
+	// RuntimeOptionConflictUnion applies a job-wide runtime option requested by any container to every container.
+	RuntimeOptionConflictUnion = "union"
+)
+
+// jobWideSingularityOptions are the singularity options (with their short form) that must be the same for every container of a job,
+// since they change the environment in which containers see each other.
+var jobWideSingularityOptions = map[string]string{
+	"--cleanenv":   "-e",
+	"--contain":    "-c",
+	"--containall": "-C",
+	"--fakeroot":   "-f",
+	"--userns":     "-u",
+}
+
+// containerSingularityOptions returns the singularity options set for a single container with the slurm-job.vk.io/singularity-options.<container name> annotation.
+func containerSingularityOptions(pod v1.Pod, containerName string) string {
+	return pod.Annotations["slurm-job.vk.io/singularity-options."+containerName]
+}
+
+// normalizeSingularityOption returns the long form of a job-wide singularity option, or an empty string if the option is not job-wide.
+func normalizeSingularityOption(option string) string {
+	for long, short := range jobWideSingularityOptions {
+		if option == long || option == short {
+			return long
+		}
+	}
+	return ""
+}
+
+// resolveJobWideSingularityOptions checks that the job-wide options set by per-container annotations are requested by every container.
+// With RuntimeOptionConflictUnion, it returns the options to add to each container so that all of them get the same job-wide options,
+// otherwise it returns an error describing the conflict.
+func resolveJobWideSingularityOptions(config SlurmConfig, pod v1.Pod) (map[string][]string, error) {
+	containers := append([]v1.Container{}, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+
+	requestedBy := map[string]map[string]bool{}
+	for _, container := range containers {
+		for _, option := range strings.Fields(containerSingularityOptions(pod, container.Name)) {
+			if long := normalizeSingularityOption(option); long != "" {
+				if requestedBy[long] == nil {
+					requestedBy[long] = map[string]bool{}
+				}
+				requestedBy[long][container.Name] = true
+			}
+		}
+	}
+
+	options := make([]string, 0, len(requestedBy))
+	for option := range requestedBy {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+
+	missingOptions := map[string][]string{}
+	for _, option := range options {
+		var requesting, missing []string
+		for _, container := range containers {
+			if requestedBy[option][container.Name] {
+				requesting = append(requesting, container.Name)
+			} else {
+				missing = append(missing, container.Name)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if config.RuntimeOptionConflictPolicy != RuntimeOptionConflictUnion {
+			return nil, fmt.Errorf("singularity option %s applies to the whole job but is requested only by containers %s and not by %s: set it in slurm-job.vk.io/singularity-options or for every container",
+				option, strings.Join(requesting, ","), strings.Join(missing, ","))
+		}
+		for _, containerName := range missing {
+			missingOptions[containerName] = append(missingOptions[containerName], option)
+		}
+	}
+
+	return missingOptions, nil
+}
@@ -0,0 +1,58 @@
+package slurm
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestResolveJobWideSingularityOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		annotations map[string]string
+		want        map[string][]string
+		wantErr     bool
+	}{
+		{name: "no option", want: map[string][]string{}},
+		{
+			name:        "same option for every container",
+			annotations: map[string]string{"slurm-job.vk.io/singularity-options.app": "--cleanenv", "slurm-job.vk.io/singularity-options.sidecar": "-e"},
+			want:        map[string][]string{},
+		},
+		{
+			name:        "container option",
+			annotations: map[string]string{"slurm-job.vk.io/singularity-options.app": "--writable-tmpfs"},
+			want:        map[string][]string{},
+		},
+		{
+			name:        "conflict",
+			annotations: map[string]string{"slurm-job.vk.io/singularity-options.app": "--cleanenv"},
+			wantErr:     true,
+		},
+		{
+			name:        "conflict resolved by union",
+			policy:      RuntimeOptionConflictUnion,
+			annotations: map[string]string{"slurm-job.vk.io/singularity-options.app": "--cleanenv --writable-tmpfs", "slurm-job.vk.io/singularity-options.sidecar": "-C"},
+			want:        map[string][]string{"app": {"--containall"}, "sidecar": {"--cleanenv"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSLURMConfig()
+			config.RuntimeOptionConflictPolicy = test.policy
+			pod := testPod(v1.Container{Name: "app"}, v1.Container{Name: "sidecar"})
+			for key, value := range test.annotations {
+				pod.Annotations[key] = value
+			}
+			got, err := resolveJobWideSingularityOptions(config, pod)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("resolveJobWideSingularityOptions() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("resolveJobWideSingularityOptions() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
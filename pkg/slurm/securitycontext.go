@@ -0,0 +1,134 @@
+package slurm
+
+import (
+	"fmt"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// containerRunAs returns the runAsUser and runAsGroup of the container, from its security context or else from the one of the pod. They are nil when not set.
+func containerRunAs(pod v1.Pod, container v1.Container) (*int64, *int64) {
+	var uid, gid *int64
+	if pod.Spec.SecurityContext != nil {
+		uid, gid = pod.Spec.SecurityContext.RunAsUser, pod.Spec.SecurityContext.RunAsGroup
+	}
+	if container.SecurityContext != nil {
+		if container.SecurityContext.RunAsUser != nil {
+			uid = container.SecurityContext.RunAsUser
+		}
+		if container.SecurityContext.RunAsGroup != nil {
+			gid = container.SecurityContext.RunAsGroup
+		}
+	}
+	return uid, gid
+}
+
+// runAsSingularityFlags returns the singularity flags running the container as its runAsUser that are not already in the command:
+// --fakeroot for UID 0. Singularity cannot run the containers as another UID than the one of the job user, which is checked by generateRunAsCheck.
+func runAsSingularityFlags(pod v1.Pod, container v1.Container, command []string) []string {
+	uid, _ := containerRunAs(pod, container)
+	if uid == nil || *uid != 0 || containsArg(command, "--fakeroot") || containsArg(command, "-f") {
+		return nil
+	}
+	return []string{"--fakeroot"}
+}
+
+// runAsPrerequisite describes what the cluster must provide for the container to run as its runAsUser and runAsGroup, or is empty when they are not set.
+func runAsPrerequisite(pod v1.Pod, container v1.Container) string {
+	uid, gid := containerRunAs(pod, container)
+	prerequisites := []string{}
+	if uid != nil && *uid == 0 {
+		prerequisites = append(prerequisites, "runAsUser 0 runs the container with --fakeroot, the job user needs an entry in /etc/subuid and /etc/subgid of the nodes (or unprivileged user namespaces)")
+	} else if uid != nil {
+		prerequisites = append(prerequisites, "runAsUser "+strconv.FormatInt(*uid, 10)+" must be the UID of the job user, see SubmitAsUserCommand and NamespaceUserMap")
+	}
+	if gid != nil && (uid == nil || *uid != 0) {
+		prerequisites = append(prerequisites, "runAsGroup "+strconv.FormatInt(*gid, 10)+" must be the primary GID of the job user")
+	}
+	return strings.Join(prerequisites, "; ")
+}
+
+// runAsIDs returns the runAsUser and runAsGroup set for the containers of the pod not running with --fakeroot.
+func runAsIDs(pod v1.Pod) (map[int64]bool, map[int64]bool) {
+	uids := map[int64]bool{}
+	gids := map[int64]bool{}
+	containers := append([]v1.Container{}, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	for _, container := range containers {
+		uid, gid := containerRunAs(pod, container)
+		if uid != nil && *uid == 0 {
+			continue
+		}
+		if uid != nil {
+			uids[*uid] = true
+		}
+		if gid != nil {
+			gids[*gid] = true
+		}
+	}
+	return uids, gids
+}
+
+// checkRunAsUser rejects the pods with a runAsUser or runAsGroup other than the UID or the primary GID of the user their job is submitted as.
+// It is skipped if the job is submitted by the sidecar user or the submit user is not known on the sidecar host, the job script then reports the mismatch.
+func checkRunAsUser(pod v1.Pod, submitUser string) error {
+	if submitUser == "" {
+		return nil
+	}
+	jobUser, err := user.Lookup(submitUser)
+	if err != nil {
+		return nil
+	}
+	uids, gids := runAsIDs(pod)
+	for _, id := range sortedIDs(uids) {
+		if id != jobUser.Uid {
+			return fmt.Errorf("pod %s has runAsUser %s, but its job is submitted as %s with UID %s", pod.Name, id, submitUser, jobUser.Uid)
+		}
+	}
+	for _, id := range sortedIDs(gids) {
+		if id != jobUser.Gid {
+			return fmt.Errorf("pod %s has runAsGroup %s, but its job is submitted as %s with primary GID %s", pod.Name, id, submitUser, jobUser.Gid)
+		}
+	}
+	return nil
+}
+
+// generateRunAsCheck returns the script lines checking that the job user has the runAsUser and runAsGroup of the containers not running with --fakeroot.
+// It reports the mismatches checkRunAsUser cannot detect, the containers then run as the job user.
+func generateRunAsCheck(pod v1.Pod) string {
+	uids, gids := runAsIDs(pod)
+
+	check := ""
+	for _, id := range sortedIDs(uids) {
+		check += "\nif test \"$(id -u)\" != \"" + id + "\" ; then" +
+			"\n  printf \"%s\\n\" \"$(date -Is --utc) Job user $(id -un) does not have runAsUser " + id + ", the containers run as UID $(id -u)\" >&2" +
+			"\nfi"
+	}
+	for _, id := range sortedIDs(gids) {
+		check += "\nif test \"$(id -g)\" != \"" + id + "\" ; then" +
+			"\n  printf \"%s\\n\" \"$(date -Is --utc) Job user $(id -un) does not have runAsGroup " + id + " as primary group, the containers run as GID $(id -g)\" >&2" +
+			"\nfi"
+	}
+	if check == "" {
+		return ""
+	}
+	return check + "\n"
+}
+
+// sortedIDs returns the UIDs or GIDs of the set as sorted strings.
+func sortedIDs(set map[int64]bool) []string {
+	ids := make([]int64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strs = append(strs, strconv.FormatInt(id, 10))
+	}
+	return strs
+}
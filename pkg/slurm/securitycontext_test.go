@@ -0,0 +1,133 @@
+package slurm
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+// testID returns a pointer to the UID or GID, eg: for a runAsUser.
+func testID(id int64) *int64 {
+	return &id
+}
+
+// formatTestID returns the UID or GID, or <nil> if not set.
+func formatTestID(id *int64) string {
+	if id == nil {
+		return "<nil>"
+	}
+	return strconv.FormatInt(*id, 10)
+}
+
+func TestContainerRunAs(t *testing.T) {
+	tests := []struct {
+		name      string
+		pod       *v1.PodSecurityContext
+		container *v1.SecurityContext
+		wantUID   string
+		wantGID   string
+	}{
+		{name: "not set", wantUID: "<nil>", wantGID: "<nil>"},
+		{name: "pod context", pod: &v1.PodSecurityContext{RunAsUser: testID(1000), RunAsGroup: testID(100)}, wantUID: "1000", wantGID: "100"},
+		{name: "container context", container: &v1.SecurityContext{RunAsUser: testID(2000)}, wantUID: "2000", wantGID: "<nil>"},
+		{
+			name:      "container overriding the pod context",
+			pod:       &v1.PodSecurityContext{RunAsUser: testID(1000), RunAsGroup: testID(100)},
+			container: &v1.SecurityContext{RunAsUser: testID(2000)},
+			wantUID:   "2000",
+			wantGID:   "100",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container := v1.Container{Name: "app", SecurityContext: test.container}
+			pod := testPod(container)
+			pod.Spec.SecurityContext = test.pod
+			uid, gid := containerRunAs(pod, container)
+			if formatTestID(uid) != test.wantUID || formatTestID(gid) != test.wantGID {
+				t.Errorf("containerRunAs() = %s, %s, want %s, %s", formatTestID(uid), formatTestID(gid), test.wantUID, test.wantGID)
+			}
+		})
+	}
+}
+
+func TestSubmitRunAsUser(t *testing.T) {
+	tests := []struct {
+		name         string
+		submitUser   string
+		pod          *v1.PodSecurityContext
+		container    *v1.SecurityContext
+		options      string
+		wantCode     int
+		wantFakeroot bool
+		wantCheck    string
+	}{
+		{name: "not set", wantCode: http.StatusOK},
+		{name: "uid 0", pod: &v1.PodSecurityContext{RunAsUser: testID(0)}, wantCode: http.StatusOK, wantFakeroot: true},
+		{name: "uid 0 with --fakeroot in the options", pod: &v1.PodSecurityContext{RunAsUser: testID(0)}, options: "--writable-tmpfs --fakeroot", wantCode: http.StatusOK, wantFakeroot: true},
+		{name: "container overriding uid 0", pod: &v1.PodSecurityContext{RunAsUser: testID(0)}, container: &v1.SecurityContext{RunAsUser: testID(65534)}, submitUser: "nobody", wantCode: http.StatusOK},
+		{name: "uid of the submit user", pod: &v1.PodSecurityContext{RunAsUser: testID(65534), RunAsGroup: testID(65534)}, submitUser: "nobody", wantCode: http.StatusOK},
+		{name: "uid of another user", pod: &v1.PodSecurityContext{RunAsUser: testID(1000)}, submitUser: "nobody", wantCode: http.StatusBadRequest},
+		{name: "gid of another group", pod: &v1.PodSecurityContext{RunAsUser: testID(65534), RunAsGroup: testID(1000)}, submitUser: "nobody", wantCode: http.StatusBadRequest},
+		{name: "unknown submit user", pod: &v1.PodSecurityContext{RunAsUser: testID(1000)}, submitUser: "interlink-unknown-user", wantCode: http.StatusOK, wantCheck: "does not have runAsUser 1000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			if test.submitUser != "" {
+				config.SubmitAsUserCommand = writeTestExecutable(t, t.TempDir(), "impersonate", `shift; exec "$@"`) + " {user}"
+				config.NamespaceUserMap = map[string]string{"default": test.submitUser}
+			}
+			pod := testPod(v1.Container{Name: "app", SecurityContext: test.container})
+			pod.Spec.SecurityContext = test.pod
+			if test.options != "" {
+				pod.Annotations["slurm-job.vk.io/singularity-options"] = test.options
+			}
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != test.wantCode {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				if _, err := os.Stat(filepath.Join(path, "job.slurm")); err == nil {
+					t.Errorf("job.slurm written for a rejected pod")
+				}
+				return
+			}
+
+			script := readJobScript(t, path)
+			runCtn := ""
+			for _, line := range strings.Split(script, "\n") {
+				if strings.HasPrefix(line, "runCtn app ") {
+					runCtn = line
+				}
+			}
+			wantFakeroots := 0
+			if test.wantFakeroot {
+				wantFakeroots = 1
+			}
+			if got := strings.Count(runCtn, "--fakeroot"); got != wantFakeroots {
+				t.Errorf("--fakeroot %d times in %q, want %d", got, runCtn, wantFakeroots)
+			}
+
+			check := generateRunAsCheck(pod)
+			if test.wantCheck == "" {
+				return
+			}
+			if !strings.Contains(script, check) {
+				t.Errorf("runAsUser check missing from the script:\n%s", script)
+			}
+			// The test runs as another UID than 1000, as the job user would.
+			output, err := exec.Command("/bin/bash", "-c", check).CombinedOutput()
+			if err != nil || !strings.Contains(string(output), test.wantCheck) {
+				t.Errorf("runAsUser check = %q, %v, want %q", output, err, test.wantCheck)
+			}
+		})
+	}
+}
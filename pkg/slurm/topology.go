@@ -0,0 +1,41 @@
+package slurm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// topologySpreadSbatchFlags approximates the topologySpreadConstraints of a multi-node pod with the sbatch flags of TopologySpreadFlags
+// for their topology key, eg: --distribution=cyclic to spread the tasks over the nodes. SLURM places a single job, so maxSkew and
+// the label selector are not evaluated, and constraints whose topology key is not mapped are ignored with a warning.
+func topologySpreadSbatchFlags(ctx context.Context, config SlurmConfig, pod v1.Pod, slurmFlags string) []string {
+	constraints := pod.Spec.TopologySpreadConstraints
+	if len(constraints) == 0 {
+		return nil
+	}
+	if nodesFromFlags(slurmFlags) <= 1 {
+		log.G(ctx).Debug("Topology spread constraints of pod ", pod.Name, " ignored, it runs on a single node")
+		return nil
+	}
+
+	var flags []string
+	for _, constraint := range constraints {
+		constraintFlags, ok := config.TopologySpreadFlags[constraint.TopologyKey]
+		if !ok {
+			log.G(ctx).Warning("Topology spread constraint on ", constraint.TopologyKey, " of pod ", pod.Name, " cannot be translated, it is not in TopologySpreadFlags")
+			continue
+		}
+		for _, flag := range constraintFlags {
+			if !containsString(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+
+	if len(flags) > 0 {
+		log.G(ctx).Info("Topology spread constraints of ", pod.Name, " translated to ", flags)
+	}
+	return flags
+}
@@ -0,0 +1,67 @@
+package slurm
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/interlink"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSubmitTopologySpread(t *testing.T) {
+	constraint := func(topologyKey string) v1.TopologySpreadConstraint {
+		return v1.TopologySpreadConstraint{
+			MaxSkew:           1,
+			TopologyKey:       topologyKey,
+			WhenUnsatisfiable: v1.DoNotSchedule,
+			LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"job-name": "solver"}},
+		}
+	}
+	tests := []struct {
+		name           string
+		constraints    []v1.TopologySpreadConstraint
+		flags          string
+		wantDirectives []string
+	}{
+		{name: "no constraint", flags: "--nodes=4"},
+		{name: "hostname", constraints: []v1.TopologySpreadConstraint{constraint(v1.LabelHostname)}, flags: "--nodes=4", wantDirectives: []string{"--distribution=cyclic"}},
+		{
+			name:           "hostname and rack",
+			constraints:    []v1.TopologySpreadConstraint{constraint(v1.LabelHostname), constraint("topology.example.org/rack")},
+			flags:          "--nodes=4",
+			wantDirectives: []string{"--distribution=cyclic", "--switches=1"},
+		},
+		{name: "unmapped topology key", constraints: []v1.TopologySpreadConstraint{constraint(v1.LabelTopologyZone)}, flags: "--nodes=4"},
+		{name: "single node", constraints: []v1.TopologySpreadConstraint{constraint(v1.LabelHostname)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testSubmitConfig(t)
+			config.TranslateTopologySpread = true
+			config.TopologySpreadFlags = map[string][]string{
+				v1.LabelHostname:            {"--distribution=cyclic"},
+				"topology.example.org/rack": {"--distribution=cyclic", "--switches=1"},
+			}
+			pod := testPod(testContainer("app", "1", "1Gi"))
+			pod.Spec.TopologySpreadConstraints = test.constraints
+			if test.flags != "" {
+				pod.Annotations["slurm-job.vk.io/flags"] = test.flags
+			}
+			w, path := testSubmit(t, config, commonIL.RetrievedPodData{Pod: pod})
+			if w.Code != http.StatusOK {
+				t.Fatalf("SubmitHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			directives := []string{}
+			for _, line := range strings.Split(readJobScript(t, path), "\n") {
+				if flag, found := strings.CutPrefix(line, "#SBATCH "); found && (strings.HasPrefix(flag, "--distribution") || strings.HasPrefix(flag, "--switches")) {
+					directives = append(directives, flag)
+				}
+			}
+			if strings.Join(directives, " ") != strings.Join(test.wantDirectives, " ") {
+				t.Errorf("#SBATCH lines = %v, want %v", directives, test.wantDirectives)
+			}
+		})
+	}
+}
@@ -1,35 +1,134 @@
 package slurm
 
+import "regexp"
+
 // InterLinkConfig holds the whole configuration
 type SlurmConfig struct {
-	VKConfigPath              string   `yaml:"VKConfigPath"`
-	Sbatchpath                string   `yaml:"SbatchPath"`
-	Scancelpath               string   `yaml:"ScancelPath"`
-	Squeuepath                string   `yaml:"SqueuePath"`
-	Sinfopath                 string   `yaml:"SinfoPath"`
-	Sidecarport               string   `yaml:"SidecarPort"`
-	Socket                    string   `yaml:"Socket"`
-	ExportPodData             bool     `yaml:"ExportPodData"`
-	Commandprefix             string   `yaml:"CommandPrefix"`
-	ImagePrefix               string   `yaml:"ImagePrefix"`
-	DataRootFolder            string   `yaml:"DataRootFolder"`
-	Namespace                 string   `yaml:"Namespace"`
-	Tsocks                    bool     `yaml:"Tsocks"`
-	Tsockspath                string   `yaml:"TsocksPath"`
-	Tsockslogin               string   `yaml:"TsocksLoginNode"`
-	BashPath                  string   `yaml:"BashPath"`
-	VerboseLogging            bool     `yaml:"VerboseLogging"`
-	ErrorsOnlyLogging         bool     `yaml:"ErrorsOnlyLogging"`
-	SingularityDefaultOptions []string `yaml:"SingularityDefaultOptions"`
-	SingularityPrefix         string   `yaml:"SingularityPrefix"`
-	SingularityPath           string   `yaml:"SingularityPath"`
-	EnableProbes              bool     `yaml:"EnableProbes"`
-	set                       bool
+	VKConfigPath                string                          `yaml:"VKConfigPath"`
+	Sbatchpath                  string                          `yaml:"SbatchPath"`
+	Scancelpath                 string                          `yaml:"ScancelPath"`
+	Squeuepath                  string                          `yaml:"SqueuePath"`
+	Sacctpath                   string                          `yaml:"SacctPath"`
+	Srunpath                    string                          `yaml:"SrunPath"`
+	Sinfopath                   string                          `yaml:"SinfoPath"`
+	Scontrolpath                string                          `yaml:"ScontrolPath"`
+	Sidecarport                 string                          `yaml:"SidecarPort"`
+	Socket                      string                          `yaml:"Socket"`
+	ExportPodData               bool                            `yaml:"ExportPodData"`
+	Commandprefix               string                          `yaml:"CommandPrefix"`
+	ImagePrefix                 string                          `yaml:"ImagePrefix"`
+	DataRootFolder              string                          `yaml:"DataRootFolder"`
+	Namespace                   string                          `yaml:"Namespace"`
+	Tsocks                      bool                            `yaml:"Tsocks"`
+	Tsockspath                  string                          `yaml:"TsocksPath"`
+	Tsockslogin                 string                          `yaml:"TsocksLoginNode"`
+	BashPath                    string                          `yaml:"BashPath"`
+	VerboseLogging              bool                            `yaml:"VerboseLogging"`
+	ErrorsOnlyLogging           bool                            `yaml:"ErrorsOnlyLogging"`
+	SingularityDefaultOptions   []string                        `yaml:"SingularityDefaultOptions"`
+	SingularityPrefix           string                          `yaml:"SingularityPrefix"`
+	SingularityPath             string                          `yaml:"SingularityPath"`
+	EnableProbes                bool                            `yaml:"EnableProbes"`
+	MaxRequeue                  int                             `yaml:"MaxRequeue"`
+	MaxLivenessRestarts         int                             `yaml:"MaxLivenessRestarts"`
+	AllowOversubscribe          bool                            `yaml:"AllowOversubscribe"`
+	StrictMounts                bool                            `yaml:"StrictMounts"`
+	StrictAnnotations           bool                            `yaml:"StrictAnnotations"`
+	AllowedImagePatterns        []string                        `yaml:"AllowedImagePatterns"`
+	CPUScaleFactor              float64                         `yaml:"CPUScaleFactor"`
+	MemoryScaleFactor           float64                         `yaml:"MemoryScaleFactor"`
+	FailureLogTailLines         int                             `yaml:"FailureLogTailLines"`
+	TLSCertFile                 string                          `yaml:"TLSCertFile"`
+	TLSKeyFile                  string                          `yaml:"TLSKeyFile"`
+	TLSClientCAFile             string                          `yaml:"TLSClientCAFile"`
+	PortsInJobComment           bool                            `yaml:"PortsInJobComment"`
+	SbatchExport                string                          `yaml:"SbatchExport"`
+	AllowMPS                    bool                            `yaml:"AllowMPS"`
+	CollectAccounting           bool                            `yaml:"CollectAccounting"`
+	CollectNodeFeatures         bool                            `yaml:"CollectNodeFeatures"`
+	PodTransformCommand         string                          `yaml:"PodTransformCommand"`
+	TestOnlyPreflight           bool                            `yaml:"TestOnlyPreflight"`
+	JobNamePrefix               string                          `yaml:"JobNamePrefix"`
+	RuntimeOptionConflictPolicy string                          `yaml:"RuntimeOptionConflictPolicy"`
+	SetHostname                 bool                            `yaml:"SetHostname"`
+	TranslatePodAffinity        bool                            `yaml:"TranslatePodAffinity"`
+	AccountingLagGrace          int                             `yaml:"AccountingLagGrace"`
+	AllowHostNamespaces         bool                            `yaml:"AllowHostNamespaces"`
+	LogPipeCommand              string                          `yaml:"LogPipeCommand"`
+	MemoryFloorMB               int                             `yaml:"MemoryFloorMB"`
+	ResourceFloorMode           string                          `yaml:"ResourceFloorMode"`
+	LintScript                  bool                            `yaml:"LintScript"`
+	MountConflictPolicy         string                          `yaml:"MountConflictPolicy"`
+	ExportGPUUUIDs              bool                            `yaml:"ExportGPUUUIDs"`
+	InitContainerResourceMode   string                          `yaml:"InitContainerResourceMode"`
+	ClusterName                 string                          `yaml:"ClusterName"`
+	EnvDir                      string                          `yaml:"EnvDir"`
+	HugepagesGresName           string                          `yaml:"HugepagesGresName"`
+	Drain                       bool                            `yaml:"Drain"`
+	DefaultContainerUmask       string                          `yaml:"DefaultContainerUmask"`
+	MaxAttrValueLen             int                             `yaml:"MaxAttrValueLen"`
+	AllowSupplementalGroups     bool                            `yaml:"AllowSupplementalGroups"`
+	TranslateNodeName           bool                            `yaml:"TranslateNodeName"`
+	ValidateNodeName            bool                            `yaml:"ValidateNodeName"`
+	NodeNameExclusive           bool                            `yaml:"NodeNameExclusive"`
+	NamespaceResourceCaps       map[string]NamespaceResourceCap `yaml:"NamespaceResourceCaps"`
+	ImageResolveCommand         string                          `yaml:"ImageResolveCommand"`
+	GPUGresNames                map[string]string               `yaml:"GPUGresNames"`
+	TypedGpuMap                 map[string]string               `yaml:"TypedGpuMap"`
+	EnvProfiles                 map[string][]string             `yaml:"EnvProfiles"`
+	DefaultPartition            string                          `yaml:"DefaultPartition"`
+	DefaultQos                  string                          `yaml:"DefaultQos"`
+	AuditLogPath                string                          `yaml:"AuditLogPath"`
+	TranslateTopologySpread     bool                            `yaml:"TranslateTopologySpread"`
+	TopologySpreadFlags         map[string][]string             `yaml:"TopologySpreadFlags"`
+	DefaultTimeLimit            string                          `yaml:"DefaultTimeLimit"`
+	NamespaceAccountMap         map[string]string               `yaml:"NamespaceAccountMap"`
+	DefaultAccount              string                          `yaml:"DefaultAccount"`
+	SubmitAsUserCommand         string                          `yaml:"SubmitAsUserCommand"`
+	NamespaceUserMap            map[string]string               `yaml:"NamespaceUserMap"`
+	AllowSubmitUserAnnotation   bool                            `yaml:"AllowSubmitUserAnnotation"`
+	ResourceScope               string                          `yaml:"ResourceScope"`
+	ResourceAggregation         string                          `yaml:"ResourceAggregation"`
+	EnableEphemeralContainers   bool                            `yaml:"EnableEphemeralContainers"`
+	AllowSysctls                []string                        `yaml:"AllowSysctls"`
+	StatusPollInterval          int                             `yaml:"StatusPollInterval"`
+	StatusPollJitter            float64                         `yaml:"StatusPollJitter"`
+	WorkdirMaxBytes             int64                           `yaml:"WorkdirMaxBytes"`
+	WorkdirFullAction           string                          `yaml:"WorkdirFullAction"`
+	SensitiveEnvPatterns        []string                        `yaml:"SensitiveEnvPatterns"`
+	HonorDNSConfig              bool                            `yaml:"HonorDNSConfig"`
+	SlurmQueryRetries           int                             `yaml:"SlurmQueryRetries"`
+	SlurmQueryRetryDelay        int                             `yaml:"SlurmQueryRetryDelay"`
+	BindTmpToScratch            bool                            `yaml:"BindTmpToScratch"`
+	SplitOutputStreams          bool                            `yaml:"SplitOutputStreams"`
+	EnforcePullPolicyNever      bool                            `yaml:"EnforcePullPolicyNever"`
+	CommentFields               []string                        `yaml:"CommentFields"`
+	SubmitRetries               int                             `yaml:"SubmitRetries"`
+	SubmitRetryBaseDelay        int                             `yaml:"SubmitRetryBaseDelay"`
+	MetricsPort                 string                          `yaml:"MetricsPort"`
+	KerberosKeytab              string                          `yaml:"KerberosKeytab"`
+	KerberosPrincipal           string                          `yaml:"KerberosPrincipal"`
+	KinitPath                   string                          `yaml:"KinitPath"`
+	KlistPath                   string                          `yaml:"KlistPath"`
+	SynchronousSubmit           bool                            `yaml:"SynchronousSubmit"`
+	SynchronousSubmitTimeout    int                             `yaml:"SynchronousSubmitTimeout"`
+	// allowedImageRegexes are the AllowedImagePatterns compiled by NewSlurmConfig.
+	allowedImageRegexes []*regexp.Regexp
+	set                 bool
+}
+
+// NamespaceResourceCap is the maximum of CPUs and memory that the running jobs of a namespace can use. A 0 value means no cap.
+type NamespaceResourceCap struct {
+	CPU      int64 `yaml:"CPU"`
+	MemoryMB int64 `yaml:"MemoryMB"`
 }
 
 type CreateStruct struct {
 	PodUID string `json:"PodUID"`
 	PodJID string `json:"PodJID"`
+	// JobState and NodeList are only set with SynchronousSubmit.
+	JobState string `json:"JobState,omitempty"`
+	NodeList string `json:"NodeList,omitempty"`
 }
 
 type ProbeType string
@@ -0,0 +1,155 @@
+package slurm
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	// WorkdirFullTruncate empties the logs of the containers that already exited, oldest first, and fails the job if that is not enough.
+	WorkdirFullTruncate = "truncate"
+	// WorkdirFullFail cancels the job as soon as its working directory is too big.
+	WorkdirFullFail = "fail"
+)
+
+// workdirFullReason is the reason reported in the terminated state of the containers of a job cancelled by checkWorkdirSize.
+const workdirFullReason = "ScratchFull"
+
+// chownWorkingDir gives the working directory of a job submitted as another user to that user, so that the job can read the files
+// only readable by their owner (the registry credentials and the secrets) and write its own files. It needs the sidecar to run as root.
+func chownWorkingDir(path string, submitUser string) error {
+	jobUser, err := user.Lookup(submitUser)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(jobUser.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(jobUser.Gid)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(path, func(filePath string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(filePath, uid, gid)
+	})
+}
+
+// workdirSize returns the total size of the regular files of the working directory.
+func workdirSize(path string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// exitedContainerLogs returns the output files of the containers that wrote their status file, so that no process writes them anymore, oldest first.
+// The stdout and stderr copies of SplitOutputStreams are included.
+func exitedContainerLogs(path string) []string {
+	logs := []string{}
+	for _, extension := range []string{".out", ".stdout", ".stderr"} {
+		extensionLogs, _ := filepath.Glob(filepath.Join(path, "*"+extension))
+		logs = append(logs, extensionLogs...)
+	}
+	exited := []string{}
+	modTimes := map[string]int64{}
+	for _, logPath := range logs {
+		if !strings.HasPrefix(filepath.Base(logPath), "run-") && !strings.HasPrefix(filepath.Base(logPath), "init-") {
+			continue
+		}
+		if _, err := os.Stat(strings.TrimSuffix(logPath, filepath.Ext(logPath)) + ".status"); err != nil {
+			continue
+		}
+		info, err := os.Stat(logPath)
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+		exited = append(exited, logPath)
+		modTimes[logPath] = info.ModTime().UnixNano()
+	}
+	sort.Slice(exited, func(i, j int) bool { return modTimes[exited[i]] < modTimes[exited[j]] })
+	return exited
+}
+
+// checkWorkdirSize enforces WorkdirMaxBytes on the working directory of a running job, per WorkdirFullAction.
+// When the job is cancelled, the reason is written to workdir-full.reason and reported in the state of its containers.
+func checkWorkdirSize(Ctx context.Context, config SlurmConfig, path string, jid *JidStruct) {
+	if config.WorkdirMaxBytes <= 0 {
+		return
+	}
+	size, err := workdirSize(path)
+	if err != nil {
+		log.G(Ctx).Warning("Unable to compute the size of the working directory ", path, ": ", err)
+		return
+	}
+	if size <= config.WorkdirMaxBytes {
+		return
+	}
+
+	if config.WorkdirFullAction == WorkdirFullTruncate {
+		for _, logPath := range exitedContainerLogs(path) {
+			info, err := os.Stat(logPath)
+			if err != nil {
+				continue
+			}
+			if err := os.Truncate(logPath, 0); err != nil {
+				log.G(Ctx).Warning("Unable to truncate ", logPath, ": ", err)
+				continue
+			}
+			log.G(Ctx).Warning("Working directory of job ", jid.JID, " exceeds WorkdirMaxBytes, truncated ", logPath)
+			size -= info.Size()
+			if size <= config.WorkdirMaxBytes {
+				return
+			}
+		}
+	}
+
+	if _, err := os.Stat(path + "/workdir-full.reason"); err == nil {
+		// Already cancelled, waiting for the job to end.
+		return
+	}
+	reason := "working directory uses " + strconv.FormatInt(size, 10) + " bytes, more than the " + strconv.FormatInt(config.WorkdirMaxBytes, 10) + " bytes allowed (scratch full)"
+	log.G(Ctx).Error("Cancelling job ", jid.JID, ": ", reason)
+	err = os.WriteFile(path+"/workdir-full.reason", []byte(reason), 0644)
+	if err != nil {
+		log.G(Ctx).Error("Unable to write the reason of the cancellation of job ", jid.JID, ": ", err)
+	}
+	if err := ensureKerberosTicket(Ctx, config); err != nil {
+		log.G(Ctx).Error(err)
+	}
+	_, err = scancelCommand(config, jid.SubmitUser, append(clusterFlags(jid.Cluster), jid.JID)...).Output()
+	if err != nil {
+		log.G(Ctx).Error("Unable to cancel job ", jid.JID, ": ", err)
+	}
+}
+
+// loadWorkdirFullReason returns the reason written by checkWorkdirSize if it cancelled the job, or an empty string.
+func loadWorkdirFullReason(path string) string {
+	content, err := os.ReadFile(path + "/workdir-full.reason")
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
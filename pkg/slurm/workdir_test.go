@@ -0,0 +1,61 @@
+package slurm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckWorkdirSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		action        string
+		exitedLog     int
+		runningLog    int
+		wantTruncated bool
+		wantCancelled bool
+	}{
+		{name: "within the limit", action: WorkdirFullTruncate, exitedLog: 200, runningLog: 200},
+		{name: "truncated", action: WorkdirFullTruncate, exitedLog: 600, runningLog: 300, wantTruncated: true},
+		{name: "truncated but still too big", action: WorkdirFullTruncate, exitedLog: 300, runningLog: 800, wantTruncated: true, wantCancelled: true},
+		{name: "fail", action: WorkdirFullFail, exitedLog: 600, runningLog: 300, wantCancelled: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := t.TempDir()
+			cancelled := filepath.Join(stubs, "cancelled")
+			config := testSLURMConfig()
+			config.WorkdirMaxBytes = 500
+			config.WorkdirFullAction = test.action
+			config.Scancelpath = writeTestExecutable(t, stubs, "scancel", `echo "$@" > `+cancelled)
+			path := t.TempDir()
+			writeTestFile(t, path, "run-done.out", strings.Repeat("a", test.exitedLog))
+			writeTestFile(t, path, "run-done.status", "0")
+			writeTestFile(t, path, "run-app.out", strings.Repeat("b", test.runningLog))
+			// The log of the exited container is the oldest one.
+			old := time.Now().Add(-time.Hour)
+			if err := os.Chtimes(filepath.Join(path, "run-done.out"), old, old); err != nil {
+				t.Fatal(err)
+			}
+			jid := &JidStruct{JID: "123"}
+
+			checkWorkdirSize(context.Background(), config, path, jid)
+			if info, err := os.Stat(filepath.Join(path, "run-done.out")); err != nil || (info.Size() == 0) != test.wantTruncated {
+				t.Errorf("log of the exited container truncated = %v, want %v", err == nil && info.Size() == 0, test.wantTruncated)
+			}
+			if info, err := os.Stat(filepath.Join(path, "run-app.out")); err != nil || info.Size() != int64(test.runningLog) {
+				t.Errorf("log of the running container has been changed")
+			}
+			args, _ := os.ReadFile(cancelled)
+			if (string(args) == "123\n") != test.wantCancelled {
+				t.Errorf("scancel arguments = %q, want the job cancelled %v", args, test.wantCancelled)
+			}
+			if reason := loadWorkdirFullReason(path); strings.Contains(reason, "scratch full") != test.wantCancelled {
+				t.Errorf("loadWorkdirFullReason() = %q, want the scratch full reason %v", reason, test.wantCancelled)
+			}
+		})
+	}
+}